@@ -0,0 +1,200 @@
+// Package acl authorizes clients of a shared cache by token, so that for
+// example builds of pull requests from forks can read the organization
+// cache but not write to it.
+//
+// A Policy maps tokens to identities, and each identity has an access level
+// per namespace. Servers authenticate the token presented by a client with
+// Policy.Authenticate and check each request with Identity.Allowed;
+// HTTPMiddleware and Middleware do both for HTTP servers and GOCACHEPROG
+// sessions.
+package acl
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// ErrUnauthenticated is returned by Authenticate for unknown tokens.
+var ErrUnauthenticated = errors.New("unknown token")
+
+// Access is the level of access to a namespace.
+type Access string
+
+const (
+	None      = Access("none")
+	Read      = Access("read")
+	ReadWrite = Access("read-write")
+)
+
+// allows reports whether a grants reads, or writes if write is set.
+func (a Access) allows(write bool) bool {
+	switch a {
+	case ReadWrite:
+		return true
+	case Read:
+		return !write
+	}
+	return false
+}
+
+// Rule grants access to the namespaces matching a path.Match pattern.
+type Rule struct {
+	Namespace string `json:"namespace"`
+	Access    Access `json:"access"`
+}
+
+// Identity is an authenticated client.
+type Identity struct {
+	Name string `json:"name"`
+
+	// TokenSHA256 is the hex SHA-256 of the token, so that policy files do
+	// not contain the tokens themselves.
+	TokenSHA256 string `json:"token_sha256"`
+
+	// Namespace is the namespace the HTTP requests of the identity belong
+	// to, whatever namespace they name, so that a client cannot write to
+	// the namespace of another; the name of the identity if empty.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Rules are checked in order; the first rule whose pattern matches the
+	// namespace decides. Without a matching rule, access is denied.
+	Rules []Rule `json:"rules"`
+}
+
+// Allowed reports whether the identity may read namespace, or write to it
+// if write is set.
+func (id *Identity) Allowed(namespace string, write bool) bool {
+	for _, rule := range id.Rules {
+		if ok, _ := path.Match(rule.Namespace, namespace); ok {
+			return rule.Access.allows(write)
+		}
+	}
+	return false
+}
+
+// Policy is the set of known identities.
+type Policy struct {
+	Identities []*Identity `json:"identities"`
+}
+
+// ParsePolicy reads a policy in JSON form.
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	var p Policy
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	for _, id := range p.Identities {
+		if id.Namespace == "" {
+			id.Namespace = id.Name
+		}
+		if _, err := hex.DecodeString(id.TokenSHA256); err != nil || len(id.TokenSHA256) != 2*sha256.Size {
+			return nil, fmt.Errorf("identity %q has an invalid token_sha256", id.Name)
+		}
+		for _, rule := range id.Rules {
+			if _, err := path.Match(rule.Namespace, ""); err != nil {
+				return nil, fmt.Errorf("identity %q has an invalid namespace pattern %q", id.Name, rule.Namespace)
+			}
+			if !rule.Access.allows(false) && rule.Access != None {
+				return nil, fmt.Errorf("identity %q has an invalid access %q", id.Name, rule.Access)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// LoadPolicy reads the policy file at name.
+func LoadPolicy(name string) (*Policy, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy: %w", err)
+	}
+	defer f.Close()
+	return ParsePolicy(f)
+}
+
+// HashToken returns the value of Identity.TokenSHA256 for token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the identity holding token.
+func (p *Policy) Authenticate(token string) (*Identity, error) {
+	sum := sha256.Sum256([]byte(token))
+	for _, id := range p.Identities {
+		want, _ := hex.DecodeString(id.TokenSHA256)
+		if subtle.ConstantTimeCompare(sum[:], want) == 1 {
+			return id, nil
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+// HTTPMiddleware authenticates the bearer token of every HTTP request and
+// checks access to the namespace of the identity holding it. GET and HEAD
+// requests need read access; any other method needs write access.
+// Unauthenticated requests get 401 and denied ones 403. The handler it
+// wraps finds the identity with IdentityFromContext, and must account the
+// request to its Namespace rather than to one the client named.
+func HTTPMiddleware(p *Policy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				http.Error(w, "missing bearer token", http.StatusUnauthorized)
+				return
+			}
+			id, err := p.Authenticate(token)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			write := r.Method != http.MethodGet && r.Method != http.MethodHead
+			if !id.Allowed(id.Namespace, write) {
+				http.Error(w, "permission denied", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ContextWithIdentity(r.Context(), id)))
+		})
+	}
+}
+
+// Middleware checks every request of a GOCACHEPROG session against id,
+// which the program authenticated when it started. Puts need write access
+// and other commands read access, except close, which is always allowed.
+func Middleware(id *Identity, namespace func(ctx context.Context, r *cache.Request) string) cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+			if r.Command != cache.CmdClose && !id.Allowed(namespace(ctx, r), r.Command == cache.CmdPut) {
+				cache.WriteError(w, r, cache.Errorf(cache.CodePermissionDenied, "%s is not allowed to %s", id.Name, r.Command))
+				return
+			}
+			next.Handle(ContextWithIdentity(ctx, id), w, r)
+		})
+	}
+}
+
+type identityKey struct{}
+
+// ContextWithIdentity returns a copy of ctx carrying id.
+func ContextWithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns the identity of the authenticated client.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
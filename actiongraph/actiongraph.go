@@ -0,0 +1,139 @@
+// Package actiongraph resolves the ActionIDs of cache requests to the
+// actions of the go command that issued them, from the action graph that
+// go build writes with -debug-actiongraph:
+//
+//	go build -debug-actiongraph=graph.json ./...
+//	g, err := actiongraph.Load("graph.json")
+//	a, ok := g.Lookup(r.ActionID) // a.Package is "fmt", a.Mode is "build"
+//
+// The graph only holds a prefix of every ActionID, the action part of the
+// build ID, which Lookup matches. The go command stores side outputs, such
+// as the compiler output of a build action, under subkeys of the ActionID
+// of the action; they resolve too, once the ActionID they derive from was
+// looked up. Requests the go command issues outside of actions, such as
+// those of the module index, resolve to no action.
+package actiongraph
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// subkeys are the descriptions of the subkeys the go command derives from
+// ActionIDs to store side outputs, see cmd/go/internal/cache.Subkey.
+var subkeys = []string{"stdout", "srcfiles"}
+
+// Action is an action of the graph. Only the fields useful to identify an
+// action are kept.
+type Action struct {
+	ID       int
+	Mode     string // "build", "link", "vet", ...
+	Package  string // import path, "" for actions of no package
+	Target   string `json:",omitempty"`
+	ActionID string `json:",omitempty"` // prefix in base64, "" if the action was not cached
+	Deps     []int  `json:",omitempty"`
+}
+
+// Graph indexes the actions of an action graph by ActionID. It is safe for
+// concurrent use.
+type Graph struct {
+	Actions []Action
+
+	prefixLen int
+	byPrefix  map[string]int // ActionID prefix -> index in Actions
+
+	mu       sync.RWMutex
+	learned  map[string]struct{} // ActionIDs whose subkeys are indexed
+	bySubkey map[string]int      // subkey of a learned ActionID -> index in Actions
+}
+
+// Parse reads an action graph in the JSON form written by go build
+// -debug-actiongraph.
+func Parse(r io.Reader) (*Graph, error) {
+	var actions []Action
+	if err := json.NewDecoder(r).Decode(&actions); err != nil {
+		return nil, fmt.Errorf("failed to parse action graph: %w", err)
+	}
+	g := &Graph{
+		Actions:  actions,
+		byPrefix: make(map[string]int),
+		learned:  make(map[string]struct{}),
+		bySubkey: make(map[string]int),
+	}
+	for i, a := range actions {
+		if a.ActionID == "" {
+			continue
+		}
+		prefix, err := base64.RawURLEncoding.DecodeString(a.ActionID)
+		if err != nil || len(prefix) == 0 {
+			return nil, fmt.Errorf("action %d has an invalid ActionID %q", a.ID, a.ActionID)
+		}
+		if g.prefixLen == 0 {
+			g.prefixLen = len(prefix)
+		} else if len(prefix) != g.prefixLen {
+			return nil, fmt.Errorf("action %d has an ActionID of %d bytes, want %d", a.ID, len(prefix), g.prefixLen)
+		}
+		g.byPrefix[string(prefix)] = i
+	}
+	return g, nil
+}
+
+// Load reads the action graph file at name.
+func Load(name string) (*Graph, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open action graph: %w", err)
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Subkey returns the ActionID the go command derives from parent to store
+// the side output described by desc.
+func Subkey(parent []byte, desc string) []byte {
+	h := sha256.New()
+	h.Write([]byte("subkey:"))
+	h.Write(parent)
+	h.Write([]byte(desc))
+	return h.Sum(nil)
+}
+
+// Lookup returns the action whose output, or side output, is stored under
+// actionID.
+func (g *Graph) Lookup(actionID []byte) (*Action, bool) {
+	if g.prefixLen > 0 && len(actionID) >= g.prefixLen {
+		if i, ok := g.byPrefix[string(actionID[:g.prefixLen])]; ok {
+			g.learn(actionID, i)
+			return &g.Actions[i], true
+		}
+	}
+	g.mu.RLock()
+	i, ok := g.bySubkey[string(actionID)]
+	g.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return &g.Actions[i], true
+}
+
+// learn indexes the subkeys of actionID, the full ActionID of the action
+// at index i.
+func (g *Graph) learn(actionID []byte, i int) {
+	g.mu.RLock()
+	_, known := g.learned[string(actionID)]
+	g.mu.RUnlock()
+	if known {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.learned[string(actionID)] = struct{}{}
+	for _, desc := range subkeys {
+		g.bySubkey[string(Subkey(actionID, desc))] = i
+	}
+}
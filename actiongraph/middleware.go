@@ -0,0 +1,147 @@
+package actiongraph
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// reloadInterval bounds how often an Annotator checks its graph file for
+// changes.
+const reloadInterval = time.Second
+
+type actionKey struct{}
+
+// ContextWithAction returns a copy of ctx carrying a.
+func ContextWithAction(ctx context.Context, a *Action) context.Context {
+	return context.WithValue(ctx, actionKey{}, a)
+}
+
+// ActionFromContext returns the action of the request being handled, as
+// resolved by an Annotator.
+func ActionFromContext(ctx context.Context) (*Action, bool) {
+	a, ok := ctx.Value(actionKey{}).(*Action)
+	return a, ok
+}
+
+// Counts are the requests of the actions of a package and mode.
+type Counts struct {
+	Gets   int64
+	Hits   int64
+	Misses int64
+	Puts   int64
+	Bytes  int64 // put
+}
+
+// Annotator resolves the ActionIDs of requests with the action graph file
+// at a path, which is reloaded when it changes: the go command writes the
+// graph at the end of a build, so a cache program serving several builds
+// resolves the requests of a build with the graph of the previous one,
+// which shares the ActionIDs of every package that did not change.
+type Annotator struct {
+	path string
+
+	mu      sync.Mutex
+	graph   *Graph
+	modTime time.Time
+	checked time.Time
+	counts  map[string]*Counts // keyed by mode and package
+}
+
+// NewAnnotator returns an Annotator of the graph file at path, which need
+// not exist yet.
+func NewAnnotator(path string) *Annotator {
+	return &Annotator{path: path, counts: make(map[string]*Counts)}
+}
+
+// Graph returns the current graph, reloading it if the file changed, or
+// nil if there is none.
+func (a *Annotator) Graph() *Graph {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if now.Sub(a.checked) < reloadInterval {
+		return a.graph
+	}
+	a.checked = now
+	fi, err := os.Stat(a.path)
+	if err != nil || fi.ModTime().Equal(a.modTime) {
+		return a.graph
+	}
+	g, err := Load(a.path)
+	if err != nil {
+		// The go command may be writing it; try again later.
+		slog.Warn("failed to load action graph", "path", a.path, "err", err)
+		return a.graph
+	}
+	a.graph, a.modTime = g, fi.ModTime()
+	return g
+}
+
+// Middleware returns a middleware that resolves the ActionID of every
+// request to its action, which the handlers it wraps find with
+// ActionFromContext and in the "package" and "mode" attributes of the
+// request logger, and counts the requests of every package.
+func (a *Annotator) Middleware() cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+			g := a.Graph()
+			if g == nil || len(r.ActionID) == 0 {
+				next.Handle(ctx, w, r)
+				return
+			}
+			action, ok := g.Lookup(r.ActionID)
+			if !ok {
+				next.Handle(ctx, w, r)
+				return
+			}
+			ctx = ContextWithAction(ctx, action)
+			ctx = cache.ContextWithLogger(ctx, cache.LoggerFromContext(ctx).With(
+				slog.String("package", action.Package),
+				slog.String("mode", action.Mode),
+			))
+
+			ww := cache.WrapResponseWriter(w)
+			next.Handle(ctx, ww, r)
+			res, ok := ww.Response()
+			if !ok || res.Err != "" {
+				return
+			}
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			c, ok := a.counts[action.Mode+" "+action.Package]
+			if !ok {
+				c = new(Counts)
+				a.counts[action.Mode+" "+action.Package] = c
+			}
+			switch r.Command {
+			case cache.CmdGet:
+				c.Gets++
+				if res.Miss {
+					c.Misses++
+				} else {
+					c.Hits++
+				}
+			case cache.CmdPut:
+				c.Puts++
+				c.Bytes += r.BodySize
+			}
+		})
+	}
+}
+
+// Stats returns the counts of the requests resolved so far, keyed by the
+// mode and package of their action, such as "build fmt".
+func (a *Annotator) Stats() map[string]Counts {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := make(map[string]Counts, len(a.counts))
+	for k, c := range a.counts {
+		stats[k] = *c
+	}
+	return stats
+}
@@ -0,0 +1,117 @@
+// Package audit records every cache write with its provenance, for
+// supply-chain traceability of cached build artifacts.
+package audit
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// Record describes one successful put.
+type Record struct {
+	Time     time.Time         `json:"time"`
+	Session  string            `json:"session,omitempty"` // see cache.SessionIDFromContext
+	ActionID string            `json:"action_id"`
+	OutputID string            `json:"output_id"`
+	Size     int64             `json:"size"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Sink stores audit records. Implementations must be safe for concurrent
+// use.
+type Sink interface {
+	Write(ctx context.Context, rec Record) error
+}
+
+// SinkFunc is a function type that implements the Sink interface.
+type SinkFunc func(ctx context.Context, rec Record) error
+
+// Write calls the sink function.
+func (f SinkFunc) Write(ctx context.Context, rec Record) error {
+	return f(ctx, rec)
+}
+
+// FileSink appends records to a file, one JSON object per line.
+type FileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenFile returns a FileSink appending to the file at path, which is
+// created if needed. Existing records are never rewritten.
+func OpenFile(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &FileSink{f: f}, nil
+}
+
+// Write appends rec as one line. The line is written with a single write
+// call, so records of several processes sharing the file do not interleave.
+func (s *FileSink) Write(ctx context.Context, rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(line); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// MetadataFromEnv returns the fingerprint of the builder: GOOS, GOARCH,
+// GOVERSION, HOSTNAME and the CI job and commit identifiers found in the
+// environment, keyed by variable name. See cache.CurrentEnvironment.
+func MetadataFromEnv() map[string]string {
+	return cache.CurrentEnvironment().Metadata()
+}
+
+// Middleware returns a middleware that writes a record to sink for every
+// put the handler stores successfully, with metadata attached. A failure to
+// write the record is logged and does not fail the put.
+func Middleware(sink Sink, metadata map[string]string) cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+			if r.Command != cache.CmdPut {
+				next.Handle(ctx, w, r)
+				return
+			}
+
+			ww := cache.WrapResponseWriter(w)
+			next.Handle(ctx, ww, r)
+			if res, ok := ww.Response(); !ok || res.Err != "" {
+				return
+			}
+
+			session, _ := cache.SessionIDFromContext(ctx)
+			rec := Record{
+				Time:     time.Now().UTC(),
+				Session:  session,
+				ActionID: hex.EncodeToString(r.ActionID),
+				OutputID: hex.EncodeToString(r.OutputID),
+				Size:     r.BodySize,
+				Metadata: metadata,
+			}
+			if err := sink.Write(ctx, rec); err != nil {
+				cache.LoggerFromContext(ctx).Warn("failed to audit put", "error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Package batch coalesces concurrent lookups into bulk calls.
+//
+// During a build the go command issues many get requests at once. Remote
+// backends whose stores offer bulk reads (DynamoDB BatchGetItem, Redis MGET,
+// a multi-key HTTP endpoint) can route their lookups through a Batcher,
+// which gathers the keys requested within a short window into a single call
+// and hands every caller its own result.
+package batch
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LookupFunc looks up keys in bulk. Keys missing from the returned map are
+// reported to their callers as not found.
+type LookupFunc[V any] func(ctx context.Context, keys [][]byte) (map[string]V, error)
+
+// Batcher coalesces Lookup calls into calls to a LookupFunc.
+type Batcher[V any] struct {
+	fn      LookupFunc[V]
+	window  time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	pending *call[V]
+}
+
+// call is one bulk lookup and the callers waiting for it.
+type call[V any] struct {
+	ctx     context.Context
+	keys    [][]byte
+	index   map[string]struct{}
+	timer   *time.Timer
+	done    chan struct{}
+	results map[string]V
+	err     error
+}
+
+// New returns a Batcher that calls fn with the keys gathered during window,
+// or as soon as maxSize distinct keys are pending.
+func New[V any](fn LookupFunc[V], window time.Duration, maxSize int) *Batcher[V] {
+	return &Batcher[V]{
+		fn:      fn,
+		window:  window,
+		maxSize: max(maxSize, 1),
+	}
+}
+
+// Lookup returns the value for key and reports whether it was found. The
+// key is looked up together with the other keys requested within the same
+// window. Canceling ctx abandons the wait but not the bulk call, which other
+// callers may depend on.
+func (b *Batcher[V]) Lookup(ctx context.Context, key []byte) (V, bool, error) {
+	c := b.enqueue(ctx, key)
+
+	var zero V
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return zero, false, ctx.Err()
+	}
+	if c.err != nil {
+		return zero, false, c.err
+	}
+	v, ok := c.results[string(key)]
+	return v, ok, nil
+}
+
+// enqueue adds key to the pending call, starting a new one if needed, and
+// flushes the call when it is full.
+func (b *Batcher[V]) enqueue(ctx context.Context, key []byte) *call[V] {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.pending
+	if c == nil {
+		c = &call[V]{
+			// The bulk call serves several callers, so it must not be
+			// canceled along with the one that happened to start it.
+			ctx:   context.WithoutCancel(ctx),
+			index: make(map[string]struct{}),
+			done:  make(chan struct{}),
+		}
+		c.timer = time.AfterFunc(b.window, func() { b.flush(c) })
+		b.pending = c
+	}
+	if _, ok := c.index[string(key)]; !ok {
+		c.index[string(key)] = struct{}{}
+		c.keys = append(c.keys, key)
+	}
+	if len(c.keys) >= b.maxSize {
+		c.timer.Stop()
+		b.pending = nil
+		go b.run(c)
+	}
+	return c
+}
+
+// flush runs c if it is still the pending call.
+func (b *Batcher[V]) flush(c *call[V]) {
+	b.mu.Lock()
+	if b.pending != c {
+		b.mu.Unlock()
+		return
+	}
+	b.pending = nil
+	b.mu.Unlock()
+
+	b.run(c)
+}
+
+func (b *Batcher[V]) run(c *call[V]) {
+	c.results, c.err = b.fn(c.ctx, c.keys)
+	close(c.done)
+}
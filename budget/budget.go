@@ -0,0 +1,195 @@
+// Package budget splits one disk budget between caches sharing a volume,
+// typically the build cache and the module proxy cache of a server, so
+// that neither can starve the other of space.
+//
+// Every cache is given a share of the budget. A cache may grow past its
+// share while the others leave theirs unused; once the caches together
+// exceed the budget, the space to free is taken from the caches over their
+// share, in proportion to how far over they are. Directories that must not
+// be pruned by this program, such as the GOMODCACHE of the go command,
+// can be accounted too: their usage reduces the budget of the others.
+//
+//	m := budget.New(100<<30)
+//	m.Add("build", buildCache, 3)
+//	m.Add("modules", proxyCache, 1)
+//	m.Add("gomodcache", budget.Dir(os.Getenv("GOMODCACHE")), 0)
+//	go m.Run(ctx, time.Minute)
+package budget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Cache is a cache whose disk usage is managed.
+type Cache interface {
+	// Usage returns the bytes used by the cache.
+	Usage() (int64, error)
+
+	// Evict deletes the least recently used objects until at least need
+	// bytes are freed, and returns the number of objects and bytes freed.
+	// Caches that cannot be pruned return errors.ErrUnsupported.
+	Evict(need int64) (int, int64, error)
+}
+
+// Dir returns a Cache accounting the files under dir, which it never
+// prunes.
+func Dir(dir string) Cache {
+	return dirCache(dir)
+}
+
+type dirCache string
+
+func (d dirCache) Usage() (int64, error) {
+	var n int64
+	err := filepath.WalkDir(string(d), func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if e.Type().IsRegular() {
+			if info, err := e.Info(); err == nil {
+				n += info.Size()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure %s: %w", string(d), err)
+	}
+	return n, nil
+}
+
+func (d dirCache) Evict(int64) (int, int64, error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+// Manager enforces a disk budget over several caches.
+type Manager struct {
+	budget int64
+
+	mu     sync.Mutex
+	caches []member
+}
+
+type member struct {
+	name  string
+	cache Cache
+	share float64
+}
+
+// New returns a Manager keeping the caches added to it under budget bytes.
+func New(budget int64) *Manager {
+	return &Manager{budget: budget}
+}
+
+// Add manages c under name, with share as its weight in the split of the
+// budget. Caches that cannot be pruned should be added with a zero share.
+func (m *Manager) Add(name string, c Cache, share float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.caches = append(m.caches, member{name: name, cache: c, share: share})
+}
+
+// Usage is the state of a managed cache after a check.
+type Usage struct {
+	Name  string
+	Bytes int64 // used before the check evicted anything
+	Quota int64 // the share of the budget
+	Freed int64
+}
+
+// Check measures the caches and, if they exceed the budget, evicts from
+// the caches over their quota until they fit again, plus 10% headroom of
+// the excess. It returns the usage of every cache.
+func (m *Manager) Check() ([]Usage, error) {
+	m.mu.Lock()
+	caches := append([]member(nil), m.caches...)
+	m.mu.Unlock()
+
+	usage := make([]Usage, len(caches))
+	var total, fixed int64
+	var shares float64
+	var errs []error
+	for i, c := range caches {
+		usage[i].Name = c.name
+		n, err := c.cache.Usage()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+			continue
+		}
+		usage[i].Bytes = n
+		total += n
+		if c.share > 0 {
+			shares += c.share
+		} else {
+			fixed += n
+		}
+	}
+
+	// The caches that cannot be pruned use up their part of the budget
+	// first; the rest is split by share.
+	rest := max(m.budget-fixed, 0)
+	var over int64
+	for i, c := range caches {
+		if c.share > 0 {
+			usage[i].Quota = int64(float64(rest) * c.share / shares)
+			over += max(usage[i].Bytes-usage[i].Quota, 0)
+		} else {
+			usage[i].Quota = usage[i].Bytes
+		}
+	}
+	if total <= m.budget || over == 0 {
+		return usage, errors.Join(errs...)
+	}
+
+	excess := total - m.budget
+	excess += excess / 10
+	for i, c := range caches {
+		o := usage[i].Bytes - usage[i].Quota
+		if c.share <= 0 || o <= 0 {
+			continue
+		}
+		need := min(o, int64(float64(excess)*float64(o)/float64(over)))
+		if need <= 0 {
+			continue
+		}
+		_, freed, err := c.cache.Evict(need)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+		usage[i].Freed = freed
+	}
+	return usage, errors.Join(errs...)
+}
+
+// Run checks the caches every interval until ctx is done, logging the
+// evictions.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		usage, err := m.Check()
+		if err != nil {
+			log.Printf("disk budget check failed: %v", err)
+		}
+		for _, u := range usage {
+			if u.Freed > 0 {
+				log.Printf("disk budget exceeded: %s used %d bytes of a %d byte quota, evicted %d bytes", u.Name, u.Bytes, u.Quota, u.Freed)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// WithAdaptiveConcurrency adjusts the concurrency limit while serving,
+// instead of keeping the fixed size set by WithConcurrency, which becomes
+// the starting point. The limit grows by one after every limit requests that
+// complete within target, and shrinks by a quarter when a request takes
+// longer than target or fails with a retryable error, staying between min
+// and max. min is at least 1. This finds the parallelism a remote backend
+// sustains without the user having to guess it.
+func WithAdaptiveConcurrency(min, max uint, target time.Duration) ServerOption {
+	lo := math.Max(float64(min), 1)
+	hi := math.Max(float64(max), lo)
+	return func(s *server) {
+		s.adaptive = &aimd{min: lo, max: hi, target: target}
+	}
+}
+
+// aimd is an additive-increase, multiplicative-decrease controller of the
+// concurrency limit.
+type aimd struct {
+	min, max float64
+	target   time.Duration
+
+	mu           sync.Mutex
+	limit        float64
+	lastDecrease time.Time
+}
+
+// start sets the initial limit, clamped to the bounds, and returns it.
+func (c *aimd) start(limit int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = math.Min(math.Max(float64(limit), c.min), c.max)
+	return int(c.limit)
+}
+
+// observe records a request that completed at now and returns the new
+// limit.
+func (c *aimd) observe(now time.Time, latency time.Duration, failed bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if failed || latency > c.target {
+		// Requests that were started under the previous limit finish slow
+		// too; decrease at most once per target interval so that one burst
+		// does not collapse the limit to the minimum.
+		if now.Sub(c.lastDecrease) >= c.target {
+			c.limit = math.Max(c.limit*0.75, c.min)
+			c.lastDecrease = now
+		}
+	} else {
+		c.limit = math.Min(c.limit+1/c.limit, c.max)
+	}
+	return int(c.limit)
+}
+
+// overloaded reports whether res describes a failure that indicates an
+// overloaded backend.
+func overloaded(res Response) bool {
+	return res.Error != nil && res.Error.Retryable
+}
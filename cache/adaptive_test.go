@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAIMD(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	type obs struct {
+		at      time.Duration // since start
+		latency time.Duration
+		failed  bool
+	}
+	tests := []struct {
+		name string
+		obs  []obs
+		want int
+	}{
+		{"fast requests grow the limit", []obs{{0, time.Millisecond, false}, {0, time.Millisecond, false}, {0, time.Millisecond, false}, {0, time.Millisecond, false}, {0, time.Millisecond, false}}, 5},
+		{"slow request shrinks the limit", []obs{{time.Second, time.Second, false}}, 3},
+		{"failure shrinks the limit", []obs{{time.Second, time.Millisecond, true}}, 3},
+		{"one decrease per target", []obs{{time.Second, time.Second, false}, {time.Second + 50*time.Millisecond, time.Second, false}}, 3},
+		{"decreases a target apart", []obs{{time.Second, time.Second, false}, {time.Second + 100*time.Millisecond, time.Second, false}}, 2},
+		{"stays above min", []obs{{time.Second, 0, true}, {2 * time.Second, 0, true}, {3 * time.Second, 0, true}, {4 * time.Second, 0, true}}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &aimd{min: 2, max: 8, target: 100 * time.Millisecond}
+			c.start(4)
+			got := 0
+			for _, o := range tt.obs {
+				got = c.observe(start.Add(o.at), o.latency, o.failed)
+			}
+			if got != tt.want {
+				t.Fatalf("limit = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Codec frames the requests and responses of a session on the wire. The
+// go command speaks JSONCodec; other codecs let programs talking to each
+// other, such as a shim and a daemon, or tests, use another framing
+// without changes to the serve loop.
+type Codec interface {
+	NewDecoder(r io.Reader) RequestDecoder
+	NewEncoder(w io.Writer) ResponseEncoder
+}
+
+// RequestDecoder reads requests from a stream.
+//
+// If the request itself cannot be read, Decode returns a nil Request and
+// the stream must not be used any further. If the request was read but is
+// invalid, Decode returns the Request together with an *Error so that the
+// server can reply to it. At the end of the stream, it returns a nil
+// Request and an error wrapping io.EOF.
+type RequestDecoder interface {
+	Decode() (*Request, error)
+}
+
+// ResponseEncoder writes responses to a stream. The server serializes the
+// calls to Encode.
+type ResponseEncoder interface {
+	Encode(res *Response) error
+}
+
+// JSONCodec is the codec of the GOCACHEPROG protocol: JSON objects, with
+// the body of a put request sent as a base64-encoded JSON string after it.
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) NewDecoder(r io.Reader) RequestDecoder { return NewDecoder(r) }
+
+func (jsonCodec) NewEncoder(w io.Writer) ResponseEncoder {
+	return &jsonEncoder{w: w, fallback: json.NewEncoder(w)}
+}
+
+// jsonEncoder encodes responses with appendResponse into a buffer reused
+// across responses, which saves the allocations of json.Encoder on builds
+// issuing tens of thousands of them.
+type jsonEncoder struct {
+	w        io.Writer
+	buf      []byte
+	fallback *json.Encoder // for the responses appendResponse cannot encode
+}
+
+// maxReusedBuffer bounds the buffer a jsonEncoder keeps between responses,
+// so that one large error message does not pin its memory.
+const maxReusedBuffer = 64 << 10
+
+func (e *jsonEncoder) Encode(res *Response) error {
+	buf, ok := appendResponse(e.buf[:0], res)
+	if cap(buf) <= maxReusedBuffer {
+		e.buf = buf
+	}
+	if !ok {
+		return e.fallback.Encode(res)
+	}
+	if _, err := e.w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+// WithCodec sets the framing of requests and responses. The default is
+// JSONCodec, which the go command requires.
+func WithCodec(c Codec) ServerOption {
+	return func(s *server) {
+		s.codec = c
+	}
+}
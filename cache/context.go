@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// contextKey is the type of the keys this package stores in contexts.
+type contextKey int
+
+const (
+	requestInfoKey contextKey = iota
+	loggerKey
+	localOnlyKey // set for requests that must stay in the local tier
+)
+
+// requestInfo is the request metadata attached to every handler context.
+type requestInfo struct {
+	session string
+	id      int64
+	command Cmd
+	start   time.Time
+}
+
+// newRequestContext returns a copy of ctx carrying the metadata of r and a
+// logger derived from base that is annotated with the request ID and command.
+func newRequestContext(ctx context.Context, session string, r *Request, base *slog.Logger) context.Context {
+	ctx = context.WithValue(ctx, requestInfoKey, requestInfo{
+		session: session,
+		id:      r.ID,
+		command: r.Command,
+		start:   time.Now(),
+	})
+	return ContextWithLogger(ctx, base.With(
+		slog.Int64("id", r.ID),
+		slog.String("command", string(r.Command)),
+	))
+}
+
+// newSessionID returns a random ID for a session, unique across processes
+// and hosts with overwhelming probability.
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// SessionIDFromContext returns the ID of the session of the request being
+// handled: one go command, or one connection of ServeListener. It is
+// generated at handshake and attached to every log of the session as the
+// "session" attribute, so that the logs of concurrent builds sharing a
+// logging backend can be told apart.
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	info, ok := ctx.Value(requestInfoKey).(requestInfo)
+	return info.session, ok
+}
+
+// RequestIDFromContext returns the ID of the request being handled. IDs
+// are only unique within a session.
+func RequestIDFromContext(ctx context.Context) (int64, bool) {
+	info, ok := ctx.Value(requestInfoKey).(requestInfo)
+	return info.id, ok
+}
+
+// CommandFromContext returns the command of the request being handled.
+func CommandFromContext(ctx context.Context) (Cmd, bool) {
+	info, ok := ctx.Value(requestInfoKey).(requestInfo)
+	return info.command, ok
+}
+
+// StartTimeFromContext returns the time the request was received.
+func StartTimeFromContext(ctx context.Context) (time.Time, bool) {
+	info, ok := ctx.Value(requestInfoKey).(requestInfo)
+	return info.start, ok
+}
+
+// LoggerFromContext returns the logger of the request being handled. It is
+// annotated with the request ID and command. If ctx carries no logger, the
+// default logger is returned.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// ContextWithLogger returns a copy of ctx carrying l. Middlewares can use it
+// to add attributes to the logger seen by the handlers they wrap.
+func ContextWithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// ContextReader returns a reader of r that fails with the error of ctx once
+// ctx is done, so that copying a large body to a slow disk or network stops
+// when the request times out or is abandoned. The server hands handlers put
+// bodies wrapped this way, except spooled ones, see Request.BodyFile.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,382 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/hirasawayuki/go-cache-prog/spool"
+)
+
+// Decoder reads GOCACHEPROG requests, including the base64-encoded bodies
+// that follow put requests, from an input stream.
+// It is the RequestDecoder of JSONCodec.
+//
+// Bodies are decoded as they are read rather than from a copy of their
+// base64 string, so that a put never holds more than its decoded body in
+// memory, and none at all when it is spooled or rejected, see bodyLimits.
+type Decoder struct {
+	r      *bufio.Reader
+	buf    []byte // the JSON object of the last request
+	limits bodyLimits
+	err    error // set once the stream is unusable
+}
+
+// bodyLimits tells a Decoder what to do with large put bodies while it
+// reads them. The server sets them from WithMaxBodySize and
+// WithBodySpillThreshold.
+type bodyLimits struct {
+	max      int64  // bodies over max are discarded and the put rejected, if > 0
+	spill    int64  // bodies over spill are written to a spool file, if > 0
+	spillDir string // where spool files are created, os.TempDir if empty
+}
+
+// maxRequestSize bounds the JSON object of a request, which holds IDs and
+// a command but never a body.
+const maxRequestSize = 1 << 20
+
+// maxBodyPrealloc bounds the memory allocated for a body before it is
+// read, whatever size the request declares.
+const maxBodyPrealloc = 1 << 20
+
+// NewDecoder returns a Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next request from the stream.
+//
+// If the request itself cannot be read, Decode returns a nil Request and the
+// stream must not be used any further. If the request was read but is
+// invalid, for example because its body is malformed, Decode returns the
+// Request together with an *Error so that the caller can reply to it.
+func (d *Decoder) Decode() (*Request, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	var req Request
+	if err := d.decodeObject(&req); err != nil {
+		d.err = fmt.Errorf("error: invalid request: %w", err)
+		return nil, d.err
+	}
+	if req.BodySize < 0 {
+		return &req, Errorf(CodeInvalidRequest, "invalid body size: %d", req.BodySize)
+	}
+	if err := d.decodeBody(&req); err != nil {
+		var e *Error
+		if errors.As(err, &e) {
+			return &req, e
+		}
+		e = Errorf(CodeInvalidRequest, "failed to decode request body: %w", err)
+		e.Category = CategoryDecode
+		return &req, e
+	}
+	return &req, nil
+}
+
+// decodeObject reads the JSON object of the next request into req. It
+// reads exactly up to the end of the object, so that the body after it can
+// be streamed from d.r.
+func (d *Decoder) decodeObject(req *Request) error {
+	c, err := d.skipSpace()
+	if err != nil {
+		return err
+	}
+	if c != '{' {
+		return fmt.Errorf("invalid character %q looking for beginning of object", c)
+	}
+	d.buf = d.buf[:0]
+	depth := 0
+	inString, escaped := false, false
+	for {
+		d.buf = append(d.buf, c)
+		switch {
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		}
+		if depth == 0 {
+			break
+		}
+		if len(d.buf) > maxRequestSize {
+			return fmt.Errorf("request exceeds %d bytes", maxRequestSize)
+		}
+		if c, err = d.r.ReadByte(); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	return json.Unmarshal(d.buf, req)
+}
+
+// skipSpace skips JSON white space and returns the byte after it.
+func (d *Decoder) skipSpace() (byte, error) {
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, nil
+		}
+	}
+}
+
+// decodeBody decodes the base64-encoded body that follows a request with a
+// non-zero BodySize. Unless the string of the body itself is malformed, it
+// reads the stream up to the end of the string whatever the error, so that
+// the next request can be decoded.
+func (d *Decoder) decodeBody(req *Request) error {
+	if req.BodySize == 0 {
+		req.Body = bytes.NewReader(nil)
+		return nil
+	}
+	c, err := d.skipSpace()
+	if err != nil {
+		d.err = fmt.Errorf("error: invalid request: %w", unexpectedEOF(err))
+		return fmt.Errorf("failed to decode body: %w", unexpectedEOF(err))
+	}
+	if c != '"' {
+		d.err = fmt.Errorf("error: invalid request: invalid character %q looking for beginning of body", c)
+		return fmt.Errorf("failed to decode body: invalid character %q looking for beginning of string", c)
+	}
+	str := &stringReader{r: d.r}
+	err = d.readBody(req, base64.NewDecoder(base64.StdEncoding, str))
+	if _, derr := io.Copy(io.Discard, str); derr != nil {
+		d.err = fmt.Errorf("error: invalid request: %w", derr)
+		return fmt.Errorf("failed to decode body: %w", derr)
+	}
+	var e *Error
+	var corrupt base64.CorruptInputError
+	switch {
+	case err == nil || errors.As(err, &e):
+		return err
+	case errors.As(err, &corrupt):
+		return fmt.Errorf("body is not valid base64: %w", err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// The string ended in the middle of a base64 quantum.
+		return errors.New("body is not valid base64: truncated input")
+	}
+	return err
+}
+
+// readBody reads the body of req from src, which decodes it, according to
+// the limits of d.
+func (d *Decoder) readBody(req *Request, src io.Reader) error {
+	put := req.Command == CmdPut
+	switch {
+	case put && d.limits.max > 0 && req.BodySize > d.limits.max:
+		if _, err := io.Copy(io.Discard, src); err != nil {
+			return err
+		}
+		return Errorf(CodeInvalidRequest, "body of %d bytes exceeds the limit of %d bytes", req.BodySize, d.limits.max)
+
+	case put && d.limits.spill > 0 && req.BodySize > d.limits.spill:
+		f, err := spool.Create(d.limits.spillDir)
+		if err != nil {
+			return Errorf(CodeInternal, "failed to spill body: %w", err)
+		}
+		n, err := f.ReadFrom(io.LimitReader(src, req.BodySize+1))
+		if err == nil {
+			err = checkBodySize(n, req.BodySize, src)
+		}
+		if err == nil {
+			if _, serr := f.OSFile().Seek(0, io.SeekStart); serr != nil {
+				f.Close()
+				return Errorf(CodeInternal, "failed to rewind spilled body: %w", serr)
+			}
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		req.Body = f.OSFile()
+		req.bodyFile = f.OSFile()
+		req.spooled = f
+		return nil
+
+	default:
+		var buf bytes.Buffer
+		buf.Grow(int(min(req.BodySize, maxBodyPrealloc)))
+		n, err := buf.ReadFrom(io.LimitReader(src, req.BodySize+1))
+		if err == nil {
+			err = checkBodySize(n, req.BodySize, src)
+		}
+		if err != nil {
+			return err
+		}
+		req.Body = bytes.NewReader(buf.Bytes())
+		return nil
+	}
+}
+
+// checkBodySize returns an error if the n bytes read from src so far,
+// limited to want+1, are not the want bytes of the body.
+func checkBodySize(n, want int64, src io.Reader) error {
+	if n == want {
+		return nil
+	}
+	if n > want {
+		rest, err := io.Copy(io.Discard, src)
+		if err != nil {
+			return err
+		}
+		n += rest
+	}
+	return fmt.Errorf("body has %d bytes, want %d", n, want)
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// stringReader reads the content of a JSON string, unescaped, from r. The
+// opening quote must have been read; reading stops after the closing one.
+type stringReader struct {
+	r       *bufio.Reader
+	pending []byte // unescaped bytes not returned yet
+	done    bool
+	err     error // the string is malformed or cut short
+}
+
+func (s *stringReader) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+func (s *stringReader) read(p []byte) (int, error) {
+	if len(s.pending) > 0 {
+		n := copy(p, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+	if s.done {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if s.r.Buffered() == 0 {
+		if _, err := s.r.Peek(1); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+	}
+	b, _ := s.r.Peek(min(s.r.Buffered(), len(p)))
+	n := 0
+	for n < len(b) && b[n] != '"' && b[n] != '\\' && b[n] >= 0x20 {
+		n++
+	}
+	if n > 0 {
+		copy(p, b[:n])
+		s.r.Discard(n)
+		return n, nil
+	}
+	c, _ := s.r.ReadByte()
+	switch {
+	case c == '"':
+		s.done = true
+		return 0, io.EOF
+	case c == '\\':
+		if err := s.unescape(); err != nil {
+			return 0, err
+		}
+		return s.read(p)
+	default:
+		return 0, fmt.Errorf("invalid character %q in string literal", c)
+	}
+}
+
+// unescape decodes the escape sequence after a backslash into s.pending.
+func (s *stringReader) unescape() error {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	switch c {
+	case '"', '\\', '/':
+	case 'b':
+		c = '\b'
+	case 'f':
+		c = '\f'
+	case 'n':
+		c = '\n'
+	case 'r':
+		c = '\r'
+	case 't':
+		c = '\t'
+	case 'u':
+		var hex [4]byte
+		if _, err := io.ReadFull(s.r, hex[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		r, err := strconv.ParseUint(string(hex[:]), 16, 16)
+		if err != nil {
+			return fmt.Errorf("invalid escape \\u%s in string literal", hex[:])
+		}
+		s.pending = utf8.AppendRune(s.pending[:0], rune(r))
+		return nil
+	default:
+		return fmt.Errorf("invalid escape \\%c in string literal", c)
+	}
+	s.pending = append(s.pending[:0], c)
+	return nil
+}
+
+// ErrBodySize is reported by DecodeAll when a decoded body does not match
+// its declared size. It indicates a bug in the decoder.
+var ErrBodySize = errors.New("error: decoded body size mismatch")
+
+// DecodeAll decodes every request in data, reading each body in full, until
+// the stream ends or becomes unreadable. It returns the number of requests
+// that were decoded successfully. DecodeAll is meant as a fuzzing entry
+// point: it must never panic, whatever data contains.
+func DecodeAll(data []byte) (int, error) {
+	d := NewDecoder(bytes.NewReader(data))
+	n := 0
+	for {
+		req, err := d.Decode()
+		if req == nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, err
+		}
+		if err != nil {
+			continue
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return n, err
+		}
+		if int64(len(body)) != req.BodySize {
+			return n, ErrBodySize
+		}
+		n++
+	}
+}
@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+)
+
+// FuzzDecode fuzzes the request decoder with the inputs a go command, or a
+// corrupted stdin, could produce, seeded with well-formed and malformed
+// streams.
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{
+		``,
+		`null`,
+		`{"ID":1,"Command":"get","ActionID":"AAEC"}` + "\n",
+		`{"ID":2,"Command":"put","ActionID":"AAEC","OutputID":"AwQF","BodySize":5}` + "\n" + `"aGVsbG8="` + "\n",
+		`{"ID":3,"Command":"put","BodySize":5}` + "\n" + `"not base64"` + "\n",
+		`{"ID":4,"Command":"put","BodySize":-1}`,
+		`{"ID":5,"Command":"put","BodySize":100}` + "\n" + `"aGVsbG8="`,
+		`{"ID":6,"Command":"put","BodySize":5}` + "\n" + `12345`,
+		`{"ID":7,"Command":"close"}` + "\n",
+		`{"ID":"x"}`,
+		`{"ID":8,`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, err := DecodeAll(data); errors.Is(err, ErrBodySize) {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"encoding/base64"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// appendResponse appends res to b as a line of JSON, byte for byte as
+// json.Encoder writes it, without allocating. It reports false if res
+// cannot be encoded this way, which only happens for times outside the
+// years 0 to 9999 that json.Encoder rejects as well.
+func appendResponse(b []byte, res *Response) ([]byte, bool) {
+	b = append(b, `{"ID":`...)
+	b = strconv.AppendInt(b, res.ID, 10)
+	if res.Err != "" {
+		b = append(b, `,"Err":`...)
+		b = appendString(b, res.Err)
+	}
+	if len(res.KnownCommands) > 0 {
+		b = append(b, `,"KnownCommands":[`...)
+		for i, cmd := range res.KnownCommands {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendString(b, string(cmd))
+		}
+		b = append(b, ']')
+	}
+	if res.Miss {
+		b = append(b, `,"Miss":true`...)
+	}
+	if len(res.OutputID) > 0 {
+		b = append(b, `,"OutputID":"`...)
+		b = base64.StdEncoding.AppendEncode(b, res.OutputID)
+		b = append(b, '"')
+	}
+	if res.Size != 0 {
+		b = append(b, `,"Size":`...)
+		b = strconv.AppendInt(b, res.Size, 10)
+	}
+	if res.Time != nil {
+		if y := res.Time.Year(); y < 0 || y > 9999 {
+			return b, false
+		}
+		b = append(b, `,"Time":"`...)
+		b = res.Time.AppendFormat(b, time.RFC3339Nano)
+		b = append(b, '"')
+	}
+	if res.DiskPath != "" {
+		b = append(b, `,"DiskPath":`...)
+		b = appendString(b, res.DiskPath)
+	}
+	return append(b, "}\n"...), true
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendString appends s as a JSON string, escaped like encoding/json with
+// HTML escaping: invalid UTF-8 becomes U+FFFD, and <, >, &, U+2028 and
+// U+2029 are escaped.
+func appendString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, "\uFFFD"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
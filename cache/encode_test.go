@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAppendResponse(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	tests := []Response{
+		{ID: 0, KnownCommands: []Cmd{CmdGet, CmdPut, CmdClose}},
+		{ID: 1, Miss: true},
+		{ID: 2, OutputID: []byte{1, 2, 3}, Size: 42, Time: &now, DiskPath: "/tmp/cache/o-d"},
+		{ID: 3, Err: "bad \"path\" < >\n\xff"},
+	}
+	for _, res := range tests {
+		var want bytes.Buffer
+		if err := json.NewEncoder(&want).Encode(res); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := appendResponse(nil, &res)
+		if !ok {
+			t.Fatalf("appendResponse(%+v) failed", res)
+		}
+		if string(got) != want.String() {
+			t.Errorf("appendResponse(%+v) = %s, want %s", res, got, want.String())
+		}
+	}
+}
+
+func BenchmarkAppendResponse(b *testing.B) {
+	now := time.Now()
+	res := &Response{
+		ID:       1234,
+		OutputID: bytes.Repeat([]byte{0xab}, 32),
+		Size:     4096,
+		Time:     &now,
+		DiskPath: "/home/user/.cache/cacheprog/ab/abababababababababababababababababababababababababababababababab-d",
+	}
+	buf := make([]byte, 0, 512)
+	b.ReportAllocs()
+	for b.Loop() {
+		buf, _ = appendResponse(buf[:0], res)
+	}
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Environment fingerprints the builder a cache program runs on, so that
+// hit rates can be segmented by builder type.
+type Environment struct {
+	GOOS      string
+	GOARCH    string
+	GoVersion string // of the go command, "" if unknown
+	Hostname  string
+
+	// CI holds the job and commit identifiers set by common CI systems,
+	// keyed by environment variable.
+	CI map[string]string `json:",omitempty"`
+}
+
+// ciVariables lists the environment variables, set by common CI systems,
+// that identify the job and the commit being built.
+var ciVariables = []string{
+	// GitHub Actions
+	"GITHUB_REPOSITORY", "GITHUB_RUN_ID", "GITHUB_RUN_ATTEMPT", "GITHUB_SHA", "GITHUB_REF",
+	// GitLab CI
+	"CI_PROJECT_PATH", "CI_PIPELINE_ID", "CI_JOB_ID", "CI_COMMIT_SHA",
+	// Buildkite
+	"BUILDKITE_PIPELINE_SLUG", "BUILDKITE_BUILD_ID", "BUILDKITE_JOB_ID", "BUILDKITE_COMMIT",
+	// Jenkins
+	"JOB_NAME", "BUILD_ID", "GIT_COMMIT",
+}
+
+// CurrentEnvironment returns the environment of the process, captured on
+// first use.
+//
+// GOOS and GOARCH are those of the environment, which the go command
+// exports when cross-compiling, and otherwise those of the program. The
+// Go version is read from GOVERSION or the VERSION file of GOROOT, since
+// the program may have been built with another release than the go
+// command it serves.
+var CurrentEnvironment = sync.OnceValue(func() Environment {
+	env := Environment{
+		GOOS:      envOr("GOOS", runtime.GOOS),
+		GOARCH:    envOr("GOARCH", runtime.GOARCH),
+		GoVersion: goVersion(),
+		CI:        make(map[string]string),
+	}
+	env.Hostname, _ = os.Hostname()
+	for _, key := range ciVariables {
+		if v := os.Getenv(key); v != "" {
+			env.CI[key] = v
+		}
+	}
+	return env
+})
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// goVersion returns the version of the go command found in the
+// environment.
+func goVersion() string {
+	if v := os.Getenv("GOVERSION"); v != "" {
+		return v
+	}
+	if root := os.Getenv("GOROOT"); root != "" {
+		if b, err := os.ReadFile(filepath.Join(root, "VERSION")); err == nil {
+			v, _, _ := strings.Cut(string(b), "\n")
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// LogValue implements slog.LogValuer.
+func (e Environment) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("goos", e.GOOS),
+		slog.String("goarch", e.GOARCH),
+		slog.String("go_version", e.GoVersion),
+		slog.String("hostname", e.Hostname),
+	}
+	for _, k := range slices.Sorted(maps.Keys(e.CI)) {
+		attrs = append(attrs, slog.String(k, e.CI[k]))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Metadata returns the environment as flat key/value pairs: GOOS, GOARCH,
+// GOVERSION and HOSTNAME, plus the CI variables.
+func (e Environment) Metadata() map[string]string {
+	m := maps.Clone(e.CI)
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m["GOOS"] = e.GOOS
+	m["GOARCH"] = e.GOARCH
+	if e.GoVersion != "" {
+		m["GOVERSION"] = e.GoVersion
+	}
+	if e.Hostname != "" {
+		m["HOSTNAME"] = e.Hostname
+	}
+	return m
+}
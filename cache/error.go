@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrorCode classifies an Error.
+type ErrorCode string
+
+const (
+	// CodeInternal is an unexpected failure of the cache program or its
+	// backend. It is the code of errors that are not an *Error.
+	CodeInternal = ErrorCode("internal")
+
+	// CodeInvalidRequest means the request was malformed and retrying it
+	// unchanged will fail the same way.
+	CodeInvalidRequest = ErrorCode("invalid_request")
+
+	// CodeUnsupported means the command is not handled by this program.
+	CodeUnsupported = ErrorCode("unsupported")
+
+	// CodeUnavailable means the backend is temporarily unreachable.
+	CodeUnavailable = ErrorCode("unavailable")
+
+	// CodeTimeout means the request did not complete in time.
+	CodeTimeout = ErrorCode("timeout")
+
+	// CodePermissionDenied means the client is not allowed to perform the
+	// request, for example a put by a read-only client.
+	CodePermissionDenied = ErrorCode("permission_denied")
+)
+
+// retryable reports whether errors with this code are transient by default.
+func (c ErrorCode) retryable() bool {
+	return c == CodeUnavailable || c == CodeTimeout
+}
+
+// ErrorCategory is the coarse origin of an Error, which middlewares use to
+// decide whether to retry or fail open and which prefixes Response.Err so
+// that failures can be told apart in build logs.
+type ErrorCategory string
+
+const (
+	// CategoryTimeout is a request that did not complete in time or whose
+	// context was canceled.
+	CategoryTimeout = ErrorCategory("timeout")
+
+	// CategoryDecode is a request whose body could not be decoded.
+	CategoryDecode = ErrorCategory("decode")
+
+	// CategoryValidation is a request that was decoded but rejected: it is
+	// invalid, unsupported or not permitted.
+	CategoryValidation = ErrorCategory("validation")
+
+	// CategoryBackend is a failure of the handler or its backend.
+	CategoryBackend = ErrorCategory("backend")
+)
+
+// category returns the category of errors with this code.
+func (c ErrorCode) category() ErrorCategory {
+	switch c {
+	case CodeTimeout:
+		return CategoryTimeout
+	case CodeInvalidRequest, CodeUnsupported, CodePermissionDenied:
+		return CategoryValidation
+	}
+	return CategoryBackend
+}
+
+// ErrMiss reports a cache miss. WriteError turns it into a response with
+// Miss set instead of an error response.
+var ErrMiss = errors.New("cache miss")
+
+// Error is a structured error that handlers can return through WriteError.
+// Unlike a plain Response.Err string, it lets middlewares distinguish
+// transient failures from permanent ones.
+type Error struct {
+	Code      ErrorCode
+	Category  ErrorCategory
+	Msg       string
+	Retryable bool
+
+	// Err is the underlying cause, if any.
+	Err error
+
+	wrapped error // cause captured by Errorf or AsError
+}
+
+// Errorf returns an Error with the given code and a message formatted like
+// fmt.Errorf, including support for %w. Retryable is set for codes that
+// describe transient failures, and Category is derived from the code.
+func Errorf(code ErrorCode, format string, args ...any) *Error {
+	err := fmt.Errorf(format, args...)
+	return &Error{
+		Code:      code,
+		Category:  code.category(),
+		Msg:       err.Error(),
+		Retryable: code.retryable(),
+		wrapped:   errors.Unwrap(err),
+	}
+}
+
+// Error returns the message and, if set, the underlying cause.
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return e.Msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error {
+	if e.Err != nil {
+		return e.Err
+	}
+	return e.wrapped
+}
+
+// AsError returns err as an *Error. Errors that wrap an *Error keep its
+// code, category and retryability with the full message of err; context
+// errors become CodeTimeout errors and any other error becomes a
+// CodeInternal error.
+func AsError(err error) *Error {
+	var e *Error
+	if !errors.As(err, &e) {
+		code := CodeInternal
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			code = CodeTimeout
+		}
+		return &Error{Code: code, Category: code.category(), Msg: err.Error(), Retryable: code.retryable(), wrapped: err}
+	}
+	category := e.Category
+	if category == "" {
+		category = e.Code.category()
+	}
+	if e == err && category == e.Category {
+		return e
+	}
+	return &Error{Code: e.Code, Category: category, Msg: err.Error(), Retryable: e.Retryable, wrapped: err}
+}
+
+// CategoryOf returns the category of err: that of the *Error it wraps, or
+// as classified by AsError.
+func CategoryOf(err error) ErrorCategory {
+	return AsError(err).Category
+}
+
+// WriteError writes the response for a failed request. ErrMiss, wrapped or
+// not, produces a cache miss; any other error produces a response whose Err
+// is the error message prefixed with "error: " and its category in brackets,
+// as in "error: [timeout] context canceled: context deadline exceeded", and
+// whose Error carries the structured form.
+func WriteError(w ResponseWriter, r *Request, err error) {
+	w.WriteResponse(errorResponse(r.ID, err))
+}
+
+func errorResponse(id int64, err error) Response {
+	if errors.Is(err, ErrMiss) {
+		return Response{ID: id, Miss: true}
+	}
+	e := AsError(err)
+	return Response{
+		ID:    id,
+		Err:   "error: [" + string(e.Category) + "] " + e.Error(),
+		Error: e,
+	}
+}
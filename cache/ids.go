@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"hash"
+	"slices"
+)
+
+const (
+	// MinIDSize and MaxIDSize bound the size in bytes of the ActionIDs and
+	// OutputIDs accepted by default: hashes of 128 to 512 bits. The go
+	// command uses SHA-256, but backends should not depend on it, so that
+	// a future change of hash does not corrupt their key layouts.
+	MinIDSize = 16
+	MaxIDSize = 64
+)
+
+// WithIDSizes only accepts ActionIDs and OutputIDs of the given sizes in
+// bytes, for example WithIDSizes(sha256.Size) for backends that depend on
+// the current hash. Requests with other IDs are rejected as invalid.
+func WithIDSizes(sizes ...int) ServerOption {
+	return func(s *server) {
+		s.idSizes = sizes
+	}
+}
+
+// WithOutputIDHash makes WithOutputIDCheck verify OutputIDs of size bytes
+// with the hash returned by newHash. SHA-256 is registered for 32-byte
+// OutputIDs.
+func WithOutputIDHash(size int, newHash func() hash.Hash) ServerOption {
+	return func(s *server) {
+		if s.outputIDHashes == nil {
+			s.outputIDHashes = make(map[int]func() hash.Hash)
+		}
+		s.outputIDHashes[size] = newHash
+	}
+}
+
+// defaultOutputIDHashes returns the hashes of OutputIDs by size.
+func defaultOutputIDHashes() map[int]func() hash.Hash {
+	return map[int]func() hash.Hash{sha256.Size: sha256.New}
+}
+
+// validIDSize reports whether IDs of n bytes are accepted.
+func (s *server) validIDSize(n int) bool {
+	if s.idSizes != nil {
+		return slices.Contains(s.idSizes, n)
+	}
+	return n >= MinIDSize && n <= MaxIDSize
+}
+
+// checkIDs rejects the gets and puts whose ActionID or OutputID has a size
+// that is not accepted, before they reach backends that derive file names
+// or keys from them.
+func (s *server) checkIDs(req *Request) error {
+	if req.Command != CmdGet && req.Command != CmdPut {
+		return nil
+	}
+	if !s.validIDSize(len(req.ActionID)) {
+		return Errorf(CodeInvalidRequest, "ActionID has an unsupported size of %d bytes", len(req.ActionID))
+	}
+	if req.Command == CmdPut && !s.validIDSize(len(req.OutputID)) {
+		return Errorf(CodeInvalidRequest, "OutputID has an unsupported size of %d bytes", len(req.OutputID))
+	}
+	return nil
+}
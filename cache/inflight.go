@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"context"
+	"encoding/hex"
+	"expvar"
+	"slices"
+	"sync"
+	"time"
+)
+
+// InflightRequest describes a request being handled or waiting for a
+// worker slot.
+type InflightRequest struct {
+	Session  string // see SessionIDFromContext
+	ID       int64
+	Command  Cmd
+	ActionID string // hex
+	Start    time.Time
+}
+
+// registry tracks the in-flight requests of every session, so that hung
+// backends can be diagnosed and requests canceled on shutdown.
+var registry struct {
+	mu       sync.Mutex
+	requests map[*inflightEntry]struct{}
+}
+
+type inflightEntry struct {
+	req    InflightRequest
+	cancel context.CancelFunc
+}
+
+func init() {
+	expvar.Publish("gocacheprog_inflight", expvar.Func(func() any { return Inflight() }))
+}
+
+// register adds req, handled by session with a context canceled by cancel,
+// to the registry, and returns the function removing it.
+func register(session string, req *Request, cancel context.CancelFunc) func() {
+	e := &inflightEntry{
+		req: InflightRequest{
+			Session:  session,
+			ID:       req.ID,
+			Command:  req.Command,
+			ActionID: hex.EncodeToString(req.ActionID),
+			Start:    time.Now(),
+		},
+		cancel: cancel,
+	}
+	registry.mu.Lock()
+	if registry.requests == nil {
+		registry.requests = make(map[*inflightEntry]struct{})
+	}
+	registry.requests[e] = struct{}{}
+	registry.mu.Unlock()
+	return func() {
+		registry.mu.Lock()
+		delete(registry.requests, e)
+		registry.mu.Unlock()
+	}
+}
+
+// Inflight returns the requests in flight in every session, oldest first.
+// They are also published through expvar under the name
+// "gocacheprog_inflight", next to the counters of Stats.
+func Inflight() []InflightRequest {
+	registry.mu.Lock()
+	reqs := make([]InflightRequest, 0, len(registry.requests))
+	for e := range registry.requests {
+		reqs = append(reqs, e.req)
+	}
+	registry.mu.Unlock()
+	slices.SortFunc(reqs, func(a, b InflightRequest) int { return a.Start.Compare(b.Start) })
+	return reqs
+}
+
+// CancelInflight cancels the contexts of every request in flight, which
+// are answered with an error if their handler honors the cancellation,
+// and returns their number. Programs call it on shutdown signals so that
+// requests stuck on a dead backend do not hold the process.
+func CancelInflight() int {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for e := range registry.requests {
+		e.cancel()
+	}
+	return len(registry.requests)
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/hirasawayuki/go-cache-prog/spool"
+)
+
+// OversizePolicy is what the server does with a put whose body exceeds the
+// limit set by WithMaxBodySize.
+type OversizePolicy int
+
+const (
+	// OversizeReject answers the put with a non-retryable error without
+	// calling the handler. The go command keeps building; the object is
+	// just not cached.
+	OversizeReject OversizePolicy = iota
+
+	// OversizeLocalOnly handles the put, but marks its context so that
+	// LocalOnlyFromContext reports true. Handlers and middlewares for
+	// remote tiers should skip such puts, keeping large objects off slow
+	// links while the local tier still caches them.
+	OversizeLocalOnly
+
+	// OversizeSpool copies the body to a temporary file and hands the
+	// handler a reader of the file, so that the in-memory copy can be
+	// released while the put waits for a worker and is handled.
+	OversizeSpool
+)
+
+// WithMaxBodySize applies policy to puts whose body is larger than n bytes,
+// protecting memory-constrained runners from pathological objects. With
+// JSONCodec, the policy applies while the body is read: rejected bodies are
+// discarded and spooled ones written to their file as they are decoded,
+// so neither is held in memory. With OversizeSpool, temporary files are
+// created in os.TempDir, or in the directory of WithBodySpillDir.
+func WithMaxBodySize(n int64, policy OversizePolicy) ServerOption {
+	return func(s *server) {
+		s.maxBodySize = n
+		s.oversizePolicy = policy
+	}
+}
+
+// LocalOnlyFromContext reports whether the request being handled must not
+// be sent to remote tiers, see OversizeLocalOnly.
+func LocalOnlyFromContext(ctx context.Context) bool {
+	v, _ := ctx.Value(localOnlyKey).(bool)
+	return v
+}
+
+// limitBody applies the oversize policy to req. It returns the context to
+// handle req with and a function to call once it is handled, or false if
+// req was answered already.
+func (s *server) limitBody(ctx context.Context, req *Request) (context.Context, func(), bool) {
+	if s.maxBodySize <= 0 || req.Command != CmdPut || req.BodySize <= s.maxBodySize {
+		return ctx, func() {}, true
+	}
+
+	switch s.oversizePolicy {
+	case OversizeLocalOnly:
+		return context.WithValue(ctx, localOnlyKey, true), func() {}, true
+	case OversizeSpool:
+		if req.spooled != nil {
+			// The decoder spooled the body already.
+			return ctx, func() {}, true
+		}
+		f, err := spool.Create(s.spillDir)
+		if err == nil {
+			_, err = f.ReadFrom(req.Body)
+			if err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			WriteError(s.writer, req, err)
+			return ctx, nil, false
+		}
+		req.Body = f.Reader()
+		req.bodyFile = f.OSFile()
+		return ctx, func() { f.Close() }, true
+	default:
+		WriteError(s.writer, req, Errorf(CodeInvalidRequest, "body of %d bytes exceeds the limit of %d bytes", req.BodySize, s.maxBodySize))
+		return ctx, nil, false
+	}
+}
+
+// bodyLimits returns the limits a Decoder applies to bodies as it reads
+// them, so that oversized and spilled bodies never sit in memory.
+func (s *server) bodyLimits() bodyLimits {
+	l := bodyLimits{spill: s.spillThreshold, spillDir: s.spillDir}
+	if s.maxBodySize <= 0 {
+		return l
+	}
+	switch s.oversizePolicy {
+	case OversizeReject:
+		l.max = s.maxBodySize
+	case OversizeSpool:
+		if l.spill <= 0 || s.maxBodySize < l.spill {
+			l.spill = s.maxBodySize
+		}
+	}
+	return l
+}
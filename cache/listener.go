@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// splitAddr splits an address of the form "unix:/path/to/socket" or
+// "tcp:host:port" into a network and an address. An address without a
+// scheme is a Unix socket path.
+func splitAddr(addr string) (network, address string) {
+	if network, address, ok := strings.Cut(addr, ":"); ok && (network == "unix" || network == "tcp") {
+		return network, address
+	}
+	return "unix", addr
+}
+
+// Listen announces on addr, which is "unix:/path/to/socket" or
+// "tcp:host:port". A stale Unix socket left behind by a crashed server is
+// removed first.
+func Listen(addr string) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to listen on %s: %w", addr, err)
+	}
+	return l, nil
+}
+
+// Dial connects to a server listening on addr, in the format accepted by
+// Listen.
+func Dial(addr string) (net.Conn, error) {
+	network, address := splitAddr(addr)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to connect to %s: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// removeStaleSocket removes the socket file at path if no server accepts
+// connections on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error: failed to stat socket: %w", err)
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("error: %s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("error: a server is already listening on %s", path)
+	}
+	return os.Remove(path)
+}
+
+// ServeListener serves the GOCACHEPROG protocol on every connection accepted
+// from l, as an alternative to the stdio transport of Serve. Each connection
+// is an independent session, normally one go command connected through
+// cmd/cacheshim, which starts with the handshake and ends with a close
+// request. This lets a single long-lived process serve many concurrent go
+// invocations while keeping its state warm.
+//
+// ServeListener returns when l is closed, after the sessions in progress
+// have ended. The options apply to every session.
+func ServeListener(l net.Listener, opts ...ServerOption) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error: failed to accept connection: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			srv := newServer(append(opts, WithInput(conn), WithOutput(conn))...)
+			if err := srv.serve(); err != nil {
+				srv.logger.Warn("session ended with error", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+// WrappedResponseWriter is a ResponseWriter that records the response
+// written through it, so that middlewares can inspect it after the handler
+// returns.
+type WrappedResponseWriter struct {
+	ResponseWriter
+
+	mu      sync.Mutex
+	res     Response
+	written bool
+}
+
+// WrapResponseWriter returns a WrappedResponseWriter that forwards responses
+// to w.
+func WrapResponseWriter(w ResponseWriter) *WrappedResponseWriter {
+	return &WrappedResponseWriter{ResponseWriter: w}
+}
+
+// WriteResponse records res and writes it to the underlying ResponseWriter.
+func (w *WrappedResponseWriter) WriteResponse(res Response) {
+	w.mu.Lock()
+	w.res = res
+	w.written = true
+	w.mu.Unlock()
+
+	w.ResponseWriter.WriteResponse(res)
+}
+
+// Response returns the last response written and reports whether any
+// response was written at all.
+func (w *WrappedResponseWriter) Response() (Response, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.res, w.written
+}
+
+// Observer is notified of the final response of each request.
+type Observer interface {
+	// Observe is called after the handler returns with the response it
+	// wrote. It is not called if the handler wrote no response.
+	Observe(ctx context.Context, r *Request, res Response)
+}
+
+// ObserverFunc is a function type that implements the Observer interface.
+type ObserverFunc func(ctx context.Context, r *Request, res Response)
+
+// Observe calls the observer function.
+func (f ObserverFunc) Observe(ctx context.Context, r *Request, res Response) {
+	f(ctx, r, res)
+}
+
+// ObserveMiddleware returns a middleware that reports the response of every
+// request to o, which is how metrics and logging middlewares learn about
+// hits, misses, sizes and errors.
+func ObserveMiddleware(o Observer) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+			ww := WrapResponseWriter(w)
+			next.Handle(ctx, ww, r)
+			if res, ok := ww.Response(); ok {
+				o.Observe(ctx, r, res)
+			}
+		})
+	}
+}
+
+// Call passes r to h and returns the response it wrote, which lets programs
+// use handlers as clients of their backend, for example to compare or copy
+// entries between two backends. If h writes no response, Call returns an
+// error response.
+func Call(ctx context.Context, h Handler, r *Request) Response {
+	ww := WrapResponseWriter(discardWriter{})
+	h.Handle(ctx, ww, r)
+	if res, ok := ww.Response(); ok {
+		return res
+	}
+	return errorResponse(r.ID, Errorf(CodeInternal, "handler wrote no response to %s", r.Command))
+}
+
+// discardWriter is a ResponseWriter that drops responses.
+type discardWriter struct{}
+
+func (discardWriter) WriteResponse(Response) {}
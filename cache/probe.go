@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hirasawayuki/go-cache-prog/clock"
+)
+
+// Pinger is implemented by backends that can check that they are usable,
+// for example that their credentials are valid and their storage reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// PingerFunc is a function type that implements the Pinger interface.
+type PingerFunc func(ctx context.Context) error
+
+// Ping calls the pinger function.
+func (f PingerFunc) Ping(ctx context.Context) error {
+	return f(ctx)
+}
+
+// ProbePolicy decides what happens when the startup probe fails.
+type ProbePolicy int
+
+const (
+	// ProbeAbort makes Serve return the probe error before the handshake.
+	// The go command then reports that the cache program failed to start.
+	ProbeAbort ProbePolicy = iota
+
+	// ProbeFailOpen serves the build without the backend: gets are misses
+	// and puts are kept in a temporary directory for the duration of the
+	// session, so the build proceeds uncached instead of failing on every
+	// request.
+	ProbeFailOpen
+)
+
+// WithStartupProbe sets a probe that is run once before the handshake,
+// bounded by the response timeout, so that a misconfigured backend is
+// detected immediately instead of producing an error for every request.
+func WithStartupProbe(p Pinger, policy ProbePolicy) ServerOption {
+	return func(s *server) {
+		s.probe = p
+		s.probePolicy = policy
+	}
+}
+
+// runProbe runs the startup probe and applies the probe policy. It returns
+// an error only if the server must not start.
+func (s *server) runProbe() error {
+	if s.probe == nil {
+		return nil
+	}
+	ctx, cancel := clock.WithTimeout(context.Background(), s.clock, s.timeout)
+	defer cancel()
+
+	err := s.probe.Ping(ctx)
+	if err == nil {
+		return nil
+	}
+	if s.probePolicy == ProbeAbort {
+		return fmt.Errorf("error: startup probe failed: %w", err)
+	}
+
+	dir, derr := os.MkdirTemp("", "cacheprog-failopen")
+	if derr != nil {
+		return fmt.Errorf("error: startup probe failed: %w (and failed to enter fail-open mode: %v)", err, derr)
+	}
+	s.logger.Warn("startup probe failed, serving without cache", "error", err)
+	s.fallback = &failOpenHandler{dir: dir}
+	return nil
+}
+
+// failOpenHandler serves requests when the backend is unusable. It never
+// hits, and stores put bodies only as long as the go command needs them.
+type failOpenHandler struct {
+	dir string
+}
+
+func (h *failOpenHandler) Handle(ctx context.Context, w ResponseWriter, r *Request) {
+	switch r.Command {
+	case CmdGet:
+		WriteError(w, r, ErrMiss)
+	case CmdPut:
+		// Write to a temporary file and rename it, so that the go command
+		// never reads a partial object at path, for example one being
+		// put again by a concurrent request with the same OutputID.
+		path := filepath.Join(h.dir, hex.EncodeToString(r.OutputID))
+		f, err := os.CreateTemp(h.dir, "put-*")
+		if err != nil {
+			WriteError(w, r, fmt.Errorf("failed to create object file: %w", err))
+			return
+		}
+		_, err = io.Copy(f, r.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			WriteError(w, r, fmt.Errorf("failed to write object file: %w", err))
+			return
+		}
+		w.WriteResponse(Response{ID: r.ID, DiskPath: path})
+	case CmdClose:
+		w.WriteResponse(Response{ID: r.ID})
+		os.RemoveAll(h.dir)
+	default:
+		WriteError(w, r, Errorf(CodeUnavailable, "backend unavailable: %s", r.Command))
+	}
+}
@@ -10,7 +10,10 @@ package cache
 
 import (
 	"io"
+	"os"
 	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/spool"
 )
 
 type Cmd string
@@ -80,6 +83,29 @@ type Request struct {
 	// backwards compatibility with Go 1.23 and earlier when
 	// GOEXPERIMENT=gocacheprog is set. It will be removed in Go 1.25.
 	ObjectID []byte `json:",omitempty"`
+
+	bodyFile *os.File    // set when the body was spooled, see BodyFile
+	spooled  *spool.File // set when the decoder spooled the body, see closeBody
+}
+
+// BodyFile returns the temporary file holding the body of a put that the
+// server spooled, with WithBodySpillThreshold or OversizeSpool, and
+// reports whether there is one. The file implements io.ReaderAt, so
+// backends can hash the body first, for verification or deduplication,
+// and then upload it, without the body being read again from the go
+// command; s3 signs its uploads this way. Body may be the file itself, so
+// read the file through an io.SectionReader, which leaves the offset Body
+// reads from alone.
+func (r *Request) BodyFile() (*os.File, bool) {
+	return r.bodyFile, r.bodyFile != nil
+}
+
+// closeBody removes the spool file the decoder wrote the body to, if any,
+// once the request is handled.
+func (r *Request) closeBody() {
+	if r.spooled != nil {
+		r.spooled.Close()
+	}
 }
 
 type Response struct {
@@ -103,4 +129,9 @@ type Response struct {
 	// DiskPath is the absolute path on disk of the body corresponding to a
 	// "get" (on cache hit) or "put" request's ActionID.
 	DiskPath string `json:",omitempty"`
+
+	// Error is the structured form of Err, set by WriteError. It is never
+	// sent to the go command; it lets middlewares tell transient failures
+	// from permanent ones.
+	Error *Error `json:"-"`
 }
@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// priority orders requests waiting for a worker slot. Lower values are
+// served first.
+type priority int
+
+const (
+	// priorityHigh is for gets, which block compilation, and for other
+	// commands whose cost is unknown.
+	priorityHigh priority = iota
+
+	// priorityLow is for puts, whose results the build can wait for.
+	priorityLow
+
+	numPriorities
+)
+
+// commandPriority returns the priority of requests for cmd.
+func commandPriority(cmd Cmd) priority {
+	if cmd == CmdPut {
+		return priorityLow
+	}
+	return priorityHigh
+}
+
+// scheduler limits the number of requests handled at once, in total and
+// per command. When a slot frees up, it goes to the oldest waiting request
+// of the highest priority whose command is below its own limit, so gets
+// overtake queued puts while the backend is slow, and puts cannot take all
+// the slots.
+type scheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	classes [numPriorities]schedClass
+
+	cmdLimits  map[Cmd]int // no entry means only the total limit applies
+	cmdRunning map[Cmd]int
+}
+
+// schedClass is the state of one priority class.
+type schedClass struct {
+	waiting *list.List // of *schedWaiter, oldest first
+}
+
+// schedWaiter is a request waiting for a slot. ready is closed once the slot
+// is granted.
+type schedWaiter struct {
+	cmd   Cmd
+	ready chan struct{}
+}
+
+// newScheduler returns a scheduler running at most limit requests at once,
+// and at most cmdLimits[cmd] requests for each command in cmdLimits.
+func newScheduler(limit int, cmdLimits map[Cmd]int) *scheduler {
+	s := &scheduler{
+		limit:      limit,
+		cmdLimits:  cmdLimits,
+		cmdRunning: make(map[Cmd]int),
+	}
+	for i := range s.classes {
+		s.classes[i].waiting = list.New()
+	}
+	return s
+}
+
+// acquire waits for a slot for a request for cmd. It returns the context
+// error if ctx is done first.
+func (s *scheduler) acquire(ctx context.Context, cmd Cmd) error {
+	p := commandPriority(cmd)
+	s.mu.Lock()
+	if s.running < s.limit && s.below(cmd) && !s.blocked(p) {
+		s.start(cmd)
+		s.mu.Unlock()
+		return nil
+	}
+	w := &schedWaiter{cmd: cmd, ready: make(chan struct{})}
+	el := s.classes[p].waiting.PushBack(w)
+	s.mu.Unlock()
+	stats.queued.Add(1)
+	stats.waits.Add(1)
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Granted concurrently with the cancellation; pass it on.
+			s.finish(cmd)
+			s.grant()
+		default:
+			s.classes[p].waiting.Remove(el)
+			stats.queued.Add(-1)
+		}
+		return ctx.Err()
+	}
+}
+
+// blocked reports whether a waiting request of priority p or higher could
+// take a free slot, and so must be served before a new request of priority
+// p, as grant would. Waiting requests held back by their command limit do
+// not block requests for other commands.
+func (s *scheduler) blocked(p priority) bool {
+	for i := range p + 1 {
+		for el := s.classes[i].waiting.Front(); el != nil; el = el.Next() {
+			if s.below(el.Value.(*schedWaiter).cmd) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// below reports whether cmd is below its own concurrency limit.
+func (s *scheduler) below(cmd Cmd) bool {
+	limit, ok := s.cmdLimits[cmd]
+	return !ok || s.cmdRunning[cmd] < limit
+}
+
+// start and finish account for a request entering and leaving its slot.
+// They must be called with s.mu held.
+func (s *scheduler) start(cmd Cmd) {
+	s.running++
+	s.cmdRunning[cmd]++
+	stats.inflight.Add(1)
+}
+
+func (s *scheduler) finish(cmd Cmd) {
+	s.running--
+	s.cmdRunning[cmd]--
+	stats.inflight.Add(-1)
+}
+
+// setLimit changes the total limit. Raising it starts waiting requests
+// right away; lowering it lets running requests finish.
+func (s *scheduler) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.grant()
+}
+
+// pending returns the number of running and waiting requests per command.
+func (s *scheduler) pending() map[Cmd]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := make(map[Cmd]int)
+	for cmd, running := range s.cmdRunning {
+		if running > 0 {
+			n[cmd] = running
+		}
+	}
+	for i := range s.classes {
+		for el := s.classes[i].waiting.Front(); el != nil; el = el.Next() {
+			n[el.Value.(*schedWaiter).cmd]++
+		}
+	}
+	return n
+}
+
+// release frees the slot of a request for cmd.
+func (s *scheduler) release(cmd Cmd) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finish(cmd)
+	s.grant()
+}
+
+// grant hands free slots to waiting requests in priority order. It must be
+// called with s.mu held.
+func (s *scheduler) grant() {
+	for s.running < s.limit {
+		w := s.next()
+		if w == nil {
+			return
+		}
+		s.start(w.cmd)
+		stats.queued.Add(-1)
+		close(w.ready)
+	}
+}
+
+// next dequeues the next request that may run, or returns nil if every
+// waiting request is held back by its command limit.
+func (s *scheduler) next() *schedWaiter {
+	for i := range s.classes {
+		q := s.classes[i].waiting
+		for el := q.Front(); el != nil; el = el.Next() {
+			if w := el.Value.(*schedWaiter); s.below(w.cmd) {
+				q.Remove(el)
+				return w
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSchedulerOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		cmdLimits map[Cmd]int
+		queued    []Cmd
+		want      []Cmd
+	}{
+		{"gets first", nil, []Cmd{CmdPut, CmdGet}, []Cmd{CmdGet, CmdPut}},
+		{"fifo within priority", nil, []Cmd{CmdGet, CmdPut, CmdGet, CmdPut}, []Cmd{CmdGet, CmdGet, CmdPut, CmdPut}},
+		{"other commands are high priority", nil, []Cmd{CmdPut, "get2", CmdGet}, []Cmd{"get2", CmdGet, CmdPut}},
+		{"get limit", map[Cmd]int{CmdGet: 0}, []Cmd{CmdGet, CmdPut}, []Cmd{CmdPut}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(1, tt.cmdLimits)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Hold the only slot while the requests queue up.
+			if err := s.acquire(ctx, CmdClose); err != nil {
+				t.Fatal(err)
+			}
+			granted := make(chan Cmd)
+			for i, cmd := range tt.queued {
+				go func() {
+					if s.acquire(ctx, cmd) == nil {
+						granted <- cmd
+					}
+				}()
+				waitQueued(t, s, i+1)
+			}
+
+			var got []Cmd
+			running := CmdClose
+			for range tt.want {
+				s.release(running)
+				running = <-granted
+				got = append(got, running)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("granted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// waitQueued waits until n requests are waiting in s.
+func waitQueued(t *testing.T, s *scheduler, n int) {
+	t.Helper()
+	for range 1000 {
+		s.mu.Lock()
+		queued := 0
+		for i := range s.classes {
+			queued += s.classes[i].waiting.Len()
+		}
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d requests did not queue", n)
+}
+
+func TestSchedulerAdmitsPastHeldBackWaiters(t *testing.T) {
+	s := newScheduler(2, map[Cmd]int{CmdGet: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.acquire(ctx, CmdGet); err != nil {
+		t.Fatal(err)
+	}
+	go s.acquire(ctx, CmdGet)
+	waitQueued(t, s, 1)
+
+	// The queued get is held back by the get limit, so it must not keep a
+	// request of the same priority from the free slot.
+	if err := s.acquire(ctx, "get2"); err != nil {
+		t.Fatal(err)
+	}
+	waitQueued(t, s, 1)
+}
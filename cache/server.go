@@ -1,18 +1,21 @@
 package cache
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"log"
+	"log/slog"
 	"maps"
 	"os"
 	"slices"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/clock"
 )
 
 const (
@@ -21,115 +24,401 @@ const (
 )
 
 // Serve starts the GOCACHEPROG server with the provided options.
-func Serve(opts ...serverOption) error {
+func Serve(opts ...ServerOption) error {
 	var err error
 	sync.OnceFunc(func() {
-		srv := &server{
-			decoder: json.NewDecoder(os.Stdin),
-			writer: &defaultWriter{
-				encoder: json.NewEncoder(os.Stdout),
-			},
-			timeout: defaultTimeout,
-			sem:     make(chan struct{}, defaultConcurrency),
-		}
-
-		for _, opt := range opts {
-			opt(srv)
-		}
-
-		err = srv.serve()
+		err = newServer(opts...).serve()
 	})()
 	return err
 }
 
-// serverOption is a function that configures a Server.
-type serverOption func(*server)
+// newServer returns a server reading from stdin and writing to stdout,
+// configured by opts.
+func newServer(opts ...ServerOption) *server {
+	srv := &server{
+		input:          os.Stdin,
+		output:         os.Stdout,
+		codec:          JSONCodec,
+		outputIDHashes: defaultOutputIDHashes(),
+		timeout:        defaultTimeout,
+		clock:          clock.Real,
+		concurrency:    defaultConcurrency,
+		logger:         slog.Default(),
+	}
+
+	for _, opt := range opts {
+		opt(srv)
+	}
+	if srv.serial {
+		srv.concurrency, srv.adaptive = 1, nil
+	}
+	if srv.adaptive != nil {
+		srv.concurrency = srv.adaptive.start(srv.concurrency)
+	}
+	srv.sched = newScheduler(srv.concurrency, srv.cmdConcurrency)
+	srv.decoder = srv.codec.NewDecoder(srv.input)
+	if d, ok := srv.decoder.(*Decoder); ok {
+		d.limits = srv.bodyLimits()
+	}
+	srv.writer = &defaultWriter{encoder: srv.codec.NewEncoder(srv.output)}
+	return srv
+}
+
+// ServerOption is a function that configures the server.
+type ServerOption func(*server)
+
+// WithConcurrency sets the maximum number of requests handled at once.
+// When all workers are busy, waiting gets are started before waiting puts,
+// because gets block compilation while puts can lag behind.
+func WithConcurrency(concurrency uint) ServerOption {
+	return func(s *server) {
+		s.concurrency = int(concurrency)
+	}
+}
+
+// WithGetConcurrency limits the number of gets handled at once, within the
+// total set by WithConcurrency.
+func WithGetConcurrency(concurrency uint) ServerOption {
+	return withCommandConcurrency(CmdGet, concurrency)
+}
 
-// WithResponseTimeout sets the timeout for request handling.
-func WithConcurrency(concurrency uint) serverOption {
+// WithPutConcurrency limits the number of puts handled at once, within the
+// total set by WithConcurrency. Keeping it below the total reserves slots for
+// gets, so that uploads to a slow remote cannot stall the build.
+func WithPutConcurrency(concurrency uint) ServerOption {
+	return withCommandConcurrency(CmdPut, concurrency)
+}
+
+func withCommandConcurrency(cmd Cmd, concurrency uint) ServerOption {
 	return func(s *server) {
-		s.sem = make(chan struct{}, concurrency)
+		if s.cmdConcurrency == nil {
+			s.cmdConcurrency = make(map[Cmd]int)
+		}
+		s.cmdConcurrency[cmd] = int(concurrency)
 	}
 }
 
-// WithResponseTimeout sets the timeout for request handling.
-func WithResponseTimeout(timeout time.Duration) serverOption {
+// WithResponseTimeout sets the timeout for request handling, from the time
+// a request is read.
+func WithResponseTimeout(timeout time.Duration) ServerOption {
 	return func(s *server) {
 		s.timeout = timeout
 	}
 }
 
+// WithClock measures the response timeout on c instead of the real clock,
+// for tests of timeout behavior.
+func WithClock(c clock.Clock) ServerOption {
+	return func(s *server) {
+		s.clock = c
+	}
+}
+
+// WithCloseTimeout bounds how long a close request waits for in-flight
+// requests, such as uploads to a slow remote, before it is answered. While
+// waiting, the number of remaining requests is logged every second; when
+// the timeout expires, their contexts are canceled and the close request is
+// answered without them, so builds never hang at exit on a dead backend.
+// By default the close request waits for every in-flight request.
+func WithCloseTimeout(timeout time.Duration) ServerOption {
+	return func(s *server) {
+		s.closeTimeout = timeout
+	}
+}
+
+// WithSerialHandling makes the server handle requests one at a time, in the
+// order they are received, on the serve loop itself. Responses are then
+// written in request order, which makes protocol-level assertions and golden
+// files deterministic and handler logs easy to follow when debugging. It
+// overrides WithConcurrency and WithAdaptiveConcurrency, and should not be
+// used in production: a slow put blocks every get behind it.
+func WithSerialHandling() ServerOption {
+	return func(s *server) {
+		s.serial = true
+	}
+}
+
+// WithLogger sets the logger handlers obtain through LoggerFromContext.
+// Each request gets a child logger annotated with its ID and command.
+// The default is slog.Default().
+func WithLogger(l *slog.Logger) ServerOption {
+	return func(s *server) {
+		s.logger = l
+	}
+}
+
+// WithInput sets the reader requests are decoded from. The default is os.Stdin.
+func WithInput(r io.Reader) ServerOption {
+	return func(s *server) {
+		s.input = r
+	}
+}
+
+// WithOutput sets the writer responses are encoded to. The default is os.Stdout.
+func WithOutput(w io.Writer) ServerOption {
+	return func(s *server) {
+		s.output = w
+	}
+}
+
+// WithObjectIDCompat enables compatibility with the go command of Go 1.21
+// through 1.23, where GOCACHEPROG was still behind GOEXPERIMENT=gocacheprog
+// and put requests carried the OutputID in the ObjectID field. When enabled,
+// whichever of Request.OutputID and Request.ObjectID is empty is filled from
+// the other, so handlers can rely on OutputID regardless of the go version.
+// Responses need no translation: every version reads Response.OutputID.
+func WithObjectIDCompat() ServerOption {
+	return func(s *server) {
+		s.objectIDCompat = true
+	}
+}
+
+// HandshakeFunc customizes the initial response the server writes on startup.
+// It receives the default response, whose KnownCommands lists the commands
+// with registered handlers, and returns the response to send instead. The ID
+// of the returned response is always forced to 0.
+//
+// As the protocol evolves, new capability fields added to Response can be
+// advertised from a HandshakeFunc without changes to the serve loop.
+type HandshakeFunc func(res Response) Response
+
+// WithHandshake sets a function that customizes the initial response.
+func WithHandshake(fn HandshakeFunc) ServerOption {
+	return func(s *server) {
+		s.handshake = fn
+	}
+}
+
+// WithRequestInspector sets a function that is called with every request
+// the go command sends, in the order they are received and before they are
+// dispatched to handlers. It lets the program learn what the peer actually
+// speaks, for example whether it still fills the deprecated ObjectID field.
+// The function runs on the serve loop and must not block or modify the
+// request.
+func WithRequestInspector(fn func(r *Request)) ServerOption {
+	return func(s *server) {
+		s.inspect = fn
+	}
+}
+
 // server handles the GOCACHEPROG protocol and dispatches requests to registered handlers.
 type server struct {
-	decoder *json.Decoder
+	input   io.Reader
+	output  io.Writer
+	codec   Codec
+	decoder RequestDecoder
 	writer  ResponseWriter
+	session string // generated at handshake, see SessionIDFromContext
 	timeout time.Duration
+	clock   clock.Clock
 	wg      sync.WaitGroup
-	sem     chan struct{} // Semaphore to limit concurrency
+
+	closeTimeout time.Duration
+
+	concurrency    int
+	cmdConcurrency map[Cmd]int
+	sched          *scheduler // limits concurrency and orders waiting requests
+	adaptive       *aimd      // adjusts the limit of sched when set
+	serial         bool       // handle requests in order on the serve loop
+
+	logger         *slog.Logger
+	objectIDCompat bool
+	handshake      HandshakeFunc
+	inspect        func(r *Request)
+
+	maxBodySize    int64
+	oversizePolicy OversizePolicy
+	spillThreshold int64
+	spillDir       string
+	outputIDCheck  OutputIDCheck
+	outputIDHashes map[int]func() hash.Hash
+	idSizes        []int
+
+	probe       Pinger
+	probePolicy ProbePolicy
+	fallback    Handler // serves all requests when set, e.g. in fail-open mode
 }
 
 // serve starts handling GOCACHEPROG requests until a close request is received
 // or an error occurs.
 func (s *server) serve() error {
+	s.session = newSessionID()
+	s.logger = s.logger.With(slog.String("session", s.session))
+	stats.sessions.Add(1)
+	stats.lastSession.Store(s.session)
+
+	if err := s.runProbe(); err != nil {
+		return err
+	}
 	s.ack()
+	if d := time.Since(processStart); stats.handshake.CompareAndSwap(0, int64(d)) {
+		s.logger.Info("sent handshake", slog.Duration("since_start", d), slog.Any("environment", CurrentEnvironment()))
+	}
+
+	// base is canceled to abandon in-flight requests on close.
+	base, abandon := context.WithCancel(context.Background())
+	defer abandon()
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
-		var req *Request
-		if err := s.decoder.Decode(&req); err != nil {
+		req, err := s.decoder.Decode()
+		if req == nil {
+			if !errors.Is(err, io.EOF) {
+				stats.decodeErrors.Add(1)
+			}
 			s.wg.Wait()
+			return err
+		}
+		stats.requests.Add(1)
+		if s.inspect != nil {
+			s.inspect(req)
+		}
+		if err != nil {
+			stats.decodeErrors.Add(1)
+			WriteError(s.writer, req, err)
+			continue
+		}
+
+		// The timeout starts once the request is read, not while the go
+		// command is idle between requests.
+		ctx, cancel := clock.WithTimeout(base, s.clock, s.timeout)
+		cancel = chainCancel(cancel, req.closeBody)
+
+		if s.objectIDCompat {
+			mirrorObjectID(req)
+		}
+		if err := s.checkIDs(req); err != nil {
+			WriteError(s.writer, req, err)
+			cancel()
+			continue
+		}
+		ctx = newRequestContext(ctx, s.session, req, s.logger)
+		ctx, done, ok := s.limitBody(ctx, req)
+		if !ok {
 			cancel()
-			return fmt.Errorf("error: invalid request: %w", err)
+			continue
+		}
+		cancel = chainCancel(chainCancel(cancel, done), register(s.session, req, cancel))
+		// Spooled bodies are handed as they are, so that handlers can
+		// rename, link or sendfile the file; see WithBodySpillThreshold.
+		if req.Body != nil && req.bodyFile == nil {
+			req.Body = ContextReader(ctx, req.Body)
 		}
 
 		switch req.Command {
-		case CmdGet:
-			s.asyncHandleRequest(ctx, req, cancel)
-		case CmdPut:
-			if err := s.decodePutBody(req); err != nil {
-				s.writer.WriteResponse(Response{
-					ID:  req.ID,
-					Err: fmt.Errorf("error: failed to decode request body: %w", err).Error(),
-				})
-				cancel()
-				continue
-			}
-			s.asyncHandleRequest(ctx, req, cancel)
+		case CmdGet, CmdPut:
+			s.dispatch(ctx, req, cancel)
 		case CmdClose:
-			s.wg.Wait()
-			s.handleRequest(ctx, req)
+			// The close handler flushes state, so it gets a context of its
+			// own once the drain is over, rather than one that the drain
+			// may have outlived or abandoned.
+			cancel()
+			s.drain(abandon)
+			ctx, cancel := clock.WithTimeout(context.Background(), s.clock, s.timeout)
+			ctx = newRequestContext(ctx, s.session, req, s.logger)
+			s.handleRequest(ctx, s.writer, req)
 			cancel()
 			return nil
 		default:
-			s.writer.WriteResponse(Response{
-				ID:  req.ID,
-				Err: fmt.Sprintf("error: %s is unknown command", req.Command),
-			})
-			cancel()
+			if !mux.handles(req.Command) {
+				WriteError(s.writer, req, Errorf(CodeUnsupported, "%s is unknown command", req.Command))
+				cancel()
+				continue
+			}
+			s.dispatch(ctx, req, cancel)
+		}
+	}
+}
+
+// drain waits for in-flight requests before a close request is handled,
+// giving up after the close timeout by calling abandon.
+func (s *server) drain(abandon context.CancelFunc) {
+	if s.closeTimeout <= 0 {
+		s.wg.Wait()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	expired := make(chan struct{})
+	deadline := s.clock.AfterFunc(s.closeTimeout, func() { close(expired) })
+	defer deadline.Stop()
+	tick := make(chan struct{}, 1)
+	progress := func() clock.Timer {
+		return s.clock.AfterFunc(time.Second, func() { tick <- struct{}{} })
+	}
+	ticker := progress()
+	defer func() { ticker.Stop() }()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick:
+			s.logger.Info("waiting for in-flight requests before close", slog.Any("remaining", s.sched.pending()))
+			ticker = progress()
+		case <-expired:
+			s.logger.Warn("close timeout expired, abandoning in-flight requests", slog.Any("remaining", s.sched.pending()))
+			abandon()
+			return
 		}
 	}
 }
 
 // ack sends the initial KnownCommands response, indicating which commands this server supports.
 func (s *server) ack() {
-	s.writer.WriteResponse(Response{
+	res := Response{
 		ID:            0,
 		KnownCommands: mux.knownCommands(),
-	})
+	}
+	if s.handshake != nil {
+		res = s.handshake(res)
+		res.ID = 0
+	}
+	s.writer.WriteResponse(res)
 }
 
 // handleRequest processes a request by finding the appropriate handler and applying middlewares.
-func (s *server) handleRequest(ctx context.Context, r *Request) {
-	mux.mu.RLock()
-	h, ok := mux.m[r.Command]
-	mux.mu.RUnlock()
+func (s *server) handleRequest(ctx context.Context, w ResponseWriter, r *Request) {
+	t := mux.table.Load()
+	h, ok := t.handlers[r.Command]
+	if s.fallback != nil {
+		h, ok = mux.Apply(s.fallback, t.middleware...), true
+	}
 	if !ok {
-		s.writer.WriteResponse(Response{
-			ID:  r.ID,
-			Err: fmt.Sprintf("error: unknown command: %s", r.Command),
-		})
+		WriteError(w, r, Errorf(CodeUnsupported, "unknown command: %s", r.Command))
+		return
+	}
+	done, err := s.spillBody(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	defer done()
+	if err := s.checkOutputID(ctx, r); err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	h.Handle(ctx, w, r)
+}
+
+// dispatch handles a get, put or allowed command, asynchronously unless
+// serial handling is enabled.
+func (s *server) dispatch(ctx context.Context, req *Request, cancel context.CancelFunc) {
+	if !s.serial {
+		s.asyncHandleRequest(ctx, req, cancel)
+		return
+	}
+	defer cancel()
+	// With a limit of one and no other goroutine holding a slot, acquire
+	// returns at once; it keeps the stats consistent with async handling.
+	if err := s.sched.acquire(ctx, req.Command); err != nil {
+		WriteError(s.writer, req, Errorf(CodeTimeout, "context canceled: %w", err))
 		return
 	}
-	mux.Apply(h, mux.middleware...).Handle(ctx, s.writer, r)
+	defer s.sched.release(req.Command)
+	s.handleRequest(ctx, s.writer, req)
 }
 
 // asyncHandleRequest handles a request asynchronously, managing concurrency limits and timeouts.
@@ -139,62 +428,127 @@ func (s *server) asyncHandleRequest(ctx context.Context, req *Request, cancel co
 		defer s.wg.Done()
 		defer cancel()
 
-		select {
-		case s.sem <- struct{}{}:
-			defer func() { <-s.sem }()
-			s.handleRequest(ctx, req)
-		case <-ctx.Done():
-			s.writer.WriteResponse(Response{
-				ID:  req.ID,
-				Err: fmt.Sprintf("context canceled: %v", ctx.Err()),
-			})
+		if err := s.sched.acquire(ctx, req.Command); err != nil {
+			WriteError(s.writer, req, Errorf(CodeTimeout, "context canceled: %w", err))
+			return
+		}
+		defer s.sched.release(req.Command)
+
+		if s.adaptive == nil {
+			s.handleRequest(ctx, s.writer, req)
 			return
 		}
+		start := s.clock.Now()
+		ww := WrapResponseWriter(s.writer)
+		s.handleRequest(ctx, ww, req)
+		res, _ := ww.Response()
+		end := s.clock.Now()
+		limit := s.adaptive.observe(end, end.Sub(start), overloaded(res))
+		s.sched.setLimit(limit)
 	}()
 }
 
-// decodePutBody decodes the base64-encoded body that follows a put request.
-func (s *server) decodePutBody(req *Request) error {
-	if req.BodySize == 0 {
-		req.Body = bytes.NewReader(nil)
-		return nil
+// chainCancel returns a function calling cancel, then done.
+func chainCancel(cancel context.CancelFunc, done func()) context.CancelFunc {
+	return func() {
+		cancel()
+		done()
 	}
-	var base64Body string
-	if err := s.decoder.Decode(&base64Body); err != nil {
-		return fmt.Errorf("error: failed to decode body: %w", err)
+}
+
+// mirrorObjectID copies the OutputID to the deprecated ObjectID field, or
+// the other way around, whichever one the go command left empty.
+func mirrorObjectID(req *Request) {
+	switch {
+	case len(req.OutputID) == 0 && len(req.ObjectID) > 0:
+		req.OutputID = req.ObjectID
+	case len(req.ObjectID) == 0 && len(req.OutputID) > 0:
+		req.ObjectID = req.OutputID
 	}
-	req.Body = base64.NewDecoder(base64.StdEncoding, strings.NewReader(base64Body))
-	return nil
 }
 
 // serveMux is a request multiplexer.
 // It registers handlers for different commands and applies middleware.
+//
+// Handlers and middleware are registered before serving, but requests are
+// looked up concurrently on every request. Registrations therefore build a
+// new immutable table, which requests load without locking.
 type serveMux struct {
-	mu              sync.RWMutex
+	mu              sync.Mutex // serializes registrations
 	allowedCommands map[Cmd]struct{}
 	m               map[Cmd]Handler
 	middleware      []Middleware
+
+	table atomic.Pointer[muxTable]
+}
+
+// muxTable is a snapshot of the registrations of a serveMux.
+type muxTable struct {
+	handlers   map[Cmd]Handler // wrapped with the middleware
+	middleware []Middleware
+	known      []Cmd // sorted
 }
 
 // Global serveMux instance
-var mux = &serveMux{
-	allowedCommands: map[Cmd]struct{}{
-		CmdGet:   {},
-		CmdPut:   {},
-		CmdClose: {},
-	},
-	m: map[Cmd]Handler{},
+var mux = newServeMux()
+
+func newServeMux() *serveMux {
+	mux := &serveMux{
+		allowedCommands: map[Cmd]struct{}{
+			CmdGet:   {},
+			CmdPut:   {},
+			CmdClose: {},
+		},
+		m: map[Cmd]Handler{},
+	}
+	mux.publish()
+	return mux
+}
+
+// publish replaces the table with one built from the current
+// registrations. It must be called with mu held.
+func (mux *serveMux) publish() {
+	t := &muxTable{
+		handlers:   make(map[Cmd]Handler, len(mux.m)),
+		middleware: slices.Clone(mux.middleware),
+		known:      slices.Sorted(maps.Keys(mux.m)),
+	}
+	for cmd, h := range mux.m {
+		t.handlers[cmd] = mux.Apply(h, t.middleware...)
+	}
+	mux.table.Store(t)
 }
 
 // HandleFunc registers a handler function for a specific command.
+// It panics if cmd is neither a protocol command nor allowed by AllowCommand.
 func HandleFunc(cmd Cmd, handler func(ctx context.Context, w ResponseWriter, r *Request)) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
 	if _, ok := mux.allowedCommands[cmd]; !ok {
 		panic(fmt.Sprintf("error: unsupported command registered: %s", cmd))
 	}
+	mux.m[cmd] = HandlerFunc(handler)
+	mux.publish()
+}
 
+// AllowCommand allows handlers to be registered for cmd in addition to the
+// get, put and close commands. This lets a program handle experimental or
+// future commands (such as a "get2") without forking this package; the go
+// command only sends a command once it is listed in KnownCommands, which
+// happens when a handler is registered for it.
+//
+// Requests for allowed commands are handled concurrently like get and put.
+func AllowCommand(cmd Cmd) {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
-	mux.m[cmd] = HandlerFunc(handler)
+	mux.allowedCommands[cmd] = struct{}{}
+}
+
+// RegisterCommand allows cmd and registers a handler function for it.
+func RegisterCommand(cmd Cmd, handler func(ctx context.Context, w ResponseWriter, r *Request)) {
+	AllowCommand(cmd)
+	HandleFunc(cmd, handler)
 }
 
 // HandleGetFunc registers a handler for the get command.
@@ -217,6 +571,7 @@ func Use(middleware ...Middleware) {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
 	mux.middleware = append(mux.middleware, middleware...)
+	mux.publish()
 }
 
 // Apply wraps a handler with a chain of middleware in the order they
@@ -230,7 +585,13 @@ func (mux *serveMux) Apply(h Handler, middleware ...Middleware) Handler {
 
 // knownCommands returns a list of commands that have registered handlers.
 func (mux *serveMux) knownCommands() []Cmd {
-	return slices.Collect(maps.Keys(mux.m))
+	return slices.Clone(mux.table.Load().known)
+}
+
+// handles reports whether a handler is registered for cmd.
+func (mux *serveMux) handles(cmd Cmd) bool {
+	_, ok := mux.table.Load().handlers[cmd]
+	return ok
 }
 
 // Handler is the interface that handles GOCACHEPROG requests.
@@ -255,23 +616,21 @@ type ResponseWriter interface {
 }
 
 // defaultWriter is the default implementation of ResponseWriter that
-// writes JSON responses to stdout.
+// encodes responses to the output of the server.
 type defaultWriter struct {
 	mu      sync.Mutex
-	encoder *json.Encoder
+	encoder ResponseEncoder
 }
 
-// WriteResponse encodes and writes a Response as JSON to stdout.
+// WriteResponse encodes and writes a Response. If it cannot be encoded,
+// an error response is written in its place.
 func (w *defaultWriter) WriteResponse(res Response) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if err := w.encoder.Encode(res); err != nil {
-		err := w.encoder.Encode(Response{
-			ID:  res.ID,
-			Err: fmt.Sprintf("error: failed to encode response: %v", err),
-		})
-		if err != nil {
+	if err := w.encoder.Encode(&res); err != nil {
+		errRes := errorResponse(res.ID, Errorf(CodeInternal, "failed to encode response: %w", err))
+		if err := w.encoder.Encode(&errRes); err != nil {
 			log.Printf("error: failed to encode response: %v", err)
 		}
 	}
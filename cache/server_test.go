@@ -0,0 +1,93 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/cachetest"
+	"github.com/hirasawayuki/go-cache-prog/clock"
+)
+
+func TestResponseTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		advance time.Duration
+		wantErr bool
+	}{
+		{"before timeout", time.Minute, 59 * time.Second, false},
+		{"at timeout", time.Minute, time.Minute, true},
+		{"after timeout", time.Minute, time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			started := make(chan struct{})
+			release := make(chan struct{})
+			cache.HandleGetFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+				close(started)
+				select {
+				case <-ctx.Done():
+					cache.WriteError(w, r, ctx.Err())
+				case <-release:
+					w.WriteResponse(cache.Response{ID: r.ID, Miss: true})
+				}
+			})
+			cache.HandleCloseFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+				if err := ctx.Err(); err != nil {
+					cache.WriteError(w, r, err)
+					return
+				}
+				w.WriteResponse(cache.Response{ID: r.ID})
+			})
+
+			d, stdin, stdout := cachetest.Pipe()
+			served := make(chan error, 1)
+			go func() {
+				served <- cache.Serve(
+					cache.WithInput(stdin),
+					cache.WithOutput(stdout),
+					cache.WithClock(c),
+					cache.WithResponseTimeout(tt.timeout),
+				)
+			}()
+			if _, err := d.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+
+			type result struct {
+				res cache.Response
+				err error
+			}
+			got := make(chan result, 1)
+			go func() {
+				res, err := d.Get(make([]byte, 32))
+				got <- result{res, err}
+			}()
+			<-started
+			c.Advance(tt.advance)
+			if !tt.wantErr {
+				close(release)
+			}
+			r := <-got
+			if (r.err != nil) != tt.wantErr {
+				t.Fatalf("get: err = %v, want error %v", r.err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(r.res.Err, context.DeadlineExceeded.Error()) {
+				t.Fatalf("get: Err = %q, want a %q error", r.res.Err, context.DeadlineExceeded)
+			}
+
+			// The timeout of the get does not carry over to the close.
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-served; err != nil && !errors.Is(err, context.Canceled) {
+				t.Fatalf("Serve: %v", err)
+			}
+		})
+	}
+}
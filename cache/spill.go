@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hirasawayuki/go-cache-prog/spool"
+)
+
+// WithBodySpillThreshold copies the bodies of puts larger than n bytes to
+// temporary files before they are handled. Request.Body is then the
+// *os.File, positioned at its start, whose Name is its path: disk backends
+// can rename or link it into place instead of copying the body, and
+// network backends can send it with sendfile. Unlike other bodies, it is
+// not wrapped with ContextReader. The file is removed once the request is
+// handled, unless the handler moved it away.
+//
+// Renames only work within a volume; see WithBodySpillDir.
+func WithBodySpillThreshold(n int64) ServerOption {
+	return func(s *server) {
+		s.spillThreshold = n
+	}
+}
+
+// WithBodySpillDir creates the files of WithBodySpillThreshold in dir
+// instead of os.TempDir, typically on the volume of the cache directory.
+func WithBodySpillDir(dir string) ServerOption {
+	return func(s *server) {
+		s.spillDir = dir
+	}
+}
+
+// spillBody copies the body of r to a spool file if it is over the spill
+// threshold, and returns the function removing the file. Bodies read by a
+// Decoder are spilled as they are decoded instead, see bodyLimits.
+func (s *server) spillBody(r *Request) (func(), error) {
+	if s.spillThreshold <= 0 || r.Command != CmdPut || r.BodySize <= s.spillThreshold || r.Body == nil || r.bodyFile != nil {
+		return func() {}, nil
+	}
+	f, err := spool.Create(s.spillDir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.ReadFrom(r.Body); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to spill body: %w", err)
+	}
+	osf := f.OSFile()
+	if _, err := osf.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to rewind spilled body: %w", err)
+	}
+	r.Body = osf
+	r.bodyFile = osf
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,84 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/cachetest"
+)
+
+func TestBodySpillThreshold(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		wantFile bool
+	}{
+		{"below threshold", 10, false},
+		{"at threshold", 16, false},
+		{"above threshold", 17, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type seen struct {
+				file     bool
+				bodyFile bool
+				body     []byte
+				err      error
+			}
+			got := make(chan seen, 1)
+			cache.HandlePutFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+				var s seen
+				_, s.file = r.Body.(*os.File)
+				_, s.bodyFile = r.BodyFile()
+				s.body, s.err = io.ReadAll(r.Body)
+				got <- s
+				w.WriteResponse(cache.Response{ID: r.ID, DiskPath: "/dev/null"})
+			})
+			cache.HandleCloseFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+				w.WriteResponse(cache.Response{ID: r.ID})
+			})
+
+			d, stdin, stdout := cachetest.Pipe()
+			served := make(chan error, 1)
+			go func() {
+				served <- cache.Serve(
+					cache.WithInput(stdin),
+					cache.WithOutput(stdout),
+					cache.WithBodySpillThreshold(16),
+					cache.WithBodySpillDir(t.TempDir()),
+				)
+			}()
+			if _, err := d.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			body := make([]byte, tt.size)
+			for i := range body {
+				body[i] = byte(i)
+			}
+			if _, err := d.Put(cachetest.NewEntry(make([]byte, 32), body)); err != nil {
+				t.Fatal(err)
+			}
+			s := <-got
+			if s.err != nil {
+				t.Fatalf("reading body: %v", s.err)
+			}
+			if string(s.body) != string(body) {
+				t.Fatalf("body = %x, want %x", s.body, body)
+			}
+			if s.file != tt.wantFile || s.bodyFile != tt.wantFile {
+				t.Fatalf("Body is *os.File: %v, BodyFile: %v, want %v", s.file, s.bodyFile, tt.wantFile)
+			}
+
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-served; err != nil && !errors.Is(err, context.Canceled) {
+				t.Fatalf("Serve: %v", err)
+			}
+		})
+	}
+}
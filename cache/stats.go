@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// processStart approximates the start of the process, for measuring the
+// handshake latency. Package initialization runs before main.
+var processStart = time.Now()
+
+// ServerStats is a snapshot of the internal counters of the server, summed
+// over every session of the process.
+type ServerStats struct {
+	// Requests is the number of requests received, including invalid ones.
+	Requests int64
+
+	// DecodeErrors is the number of requests that could not be decoded.
+	DecodeErrors int64
+
+	// Inflight is the number of requests being handled.
+	Inflight int64
+
+	// Queued is the number of requests waiting for a worker slot.
+	Queued int64
+
+	// Waits is the number of requests that had to wait for a worker slot
+	// because the concurrency limit was reached.
+	Waits int64
+
+	// OutputIDMismatches is the number of puts whose body did not hash to
+	// their OutputID, see WithOutputIDCheck.
+	OutputIDMismatches int64
+
+	// Sessions is the number of sessions started, and Session the ID of
+	// the last one. A go command running the program on its standard
+	// input and output has a single session.
+	Sessions int64
+	Session  string
+
+	// Environment fingerprints the builder, to segment hit rates.
+	Environment Environment
+
+	// HandshakeLatency is the time from the start of the process to the
+	// first handshake, during which the go command waits. It adds directly
+	// to the duration of every go command run with GOCACHEPROG.
+	HandshakeLatency time.Duration
+}
+
+// stats holds the counters behind Stats.
+var stats struct {
+	requests           atomic.Int64
+	decodeErrors       atomic.Int64
+	inflight           atomic.Int64
+	queued             atomic.Int64
+	waits              atomic.Int64
+	handshake          atomic.Int64 // nanoseconds, 0 until the first handshake
+	sessions           atomic.Int64
+	outputIDMismatches atomic.Int64
+	lastSession        atomic.Value // string
+}
+
+func init() {
+	expvar.Publish("gocacheprog", expvar.Func(func() any { return Stats() }))
+}
+
+// Stats returns a snapshot of the server counters. They are also published
+// through expvar under the name "gocacheprog", so they can be scraped from
+// /debug/vars when the program serves net/http's default mux.
+func Stats() ServerStats {
+	session, _ := stats.lastSession.Load().(string)
+	return ServerStats{
+		Requests:           stats.requests.Load(),
+		DecodeErrors:       stats.decodeErrors.Load(),
+		Inflight:           stats.inflight.Load(),
+		Queued:             stats.queued.Load(),
+		Waits:              stats.waits.Load(),
+		Sessions:           stats.sessions.Load(),
+		OutputIDMismatches: stats.outputIDMismatches.Load(),
+
+		Session:          session,
+		Environment:      CurrentEnvironment(),
+		HandshakeLatency: time.Duration(stats.handshake.Load()),
+	}
+}
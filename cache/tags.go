@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"context"
+	"maps"
+)
+
+type tagsKey struct{}
+
+// ContextWithTags returns a copy of ctx carrying tags, merged over the
+// tags ctx carries already. Tags are key/value pairs, such as the branch
+// or CI job of a build, that backends persist with the entries stored by
+// puts, so that pruning and admin tools can select entries by them.
+func ContextWithTags(ctx context.Context, tags map[string]string) context.Context {
+	merged := maps.Clone(TagsFromContext(ctx))
+	if merged == nil {
+		merged = make(map[string]string, len(tags))
+	}
+	maps.Copy(merged, tags)
+	return context.WithValue(ctx, tagsKey{}, merged)
+}
+
+// TagsFromContext returns the tags of the request being handled, or nil.
+// The map must not be modified.
+func TagsFromContext(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	return tags
+}
+
+// TagMiddleware returns a middleware that attaches tags to every put.
+func TagMiddleware(tags map[string]string) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+			if r.Command == CmdPut && len(tags) > 0 {
+				ctx = ContextWithTags(ctx, tags)
+			}
+			next.Handle(ctx, w, r)
+		})
+	}
+}
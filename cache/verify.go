@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+)
+
+// OutputIDCheck is what the server does with puts whose body does not hash
+// to their OutputID.
+type OutputIDCheck int
+
+const (
+	// OutputIDCheckOff does not hash bodies.
+	OutputIDCheckOff OutputIDCheck = iota
+
+	// OutputIDCheckLog logs and counts mismatches, and stores the body.
+	OutputIDCheckLog
+
+	// OutputIDCheckReject also fails the put, so that a corrupted body is
+	// never stored.
+	OutputIDCheckReject
+)
+
+// WithOutputIDCheck hashes the body of every put and compares it with its
+// OutputID, which the go command computes as the SHA-256 of the content,
+// as a defense against bodies corrupted in transport. Puts with an OutputID
+// of a size without a hash registered by WithOutputIDHash are not checked.
+//
+// A spooled body (see Request.BodyFile) is hashed before the handler is
+// called. Other bodies are hashed as the handler reads them, and a mismatch
+// is reported when it reaches the end: with OutputIDCheckReject, the last
+// read returns an error instead of io.EOF, failing the put. Handlers that
+// do not read the whole body, for example because they have the object
+// already, leave it unchecked.
+func WithOutputIDCheck(check OutputIDCheck) ServerOption {
+	return func(s *server) {
+		s.outputIDCheck = check
+	}
+}
+
+// checkOutputID applies the OutputID check to r, hashing its body now if
+// it is spooled and otherwise as it is read.
+func (s *server) checkOutputID(ctx context.Context, r *Request) error {
+	if s.outputIDCheck == OutputIDCheckOff || r.Command != CmdPut || r.Body == nil {
+		return nil
+	}
+	newHash, ok := s.outputIDHashes[len(r.OutputID)]
+	if !ok {
+		return nil
+	}
+	if f, ok := r.BodyFile(); ok {
+		h := newHash()
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, r.BodySize)); err != nil {
+			return fmt.Errorf("failed to hash body: %w", err)
+		}
+		return s.compareOutputID(ctx, r, h.Sum(nil))
+	}
+	r.Body = &hashingReader{r: r.Body, hash: newHash(), check: func(sum []byte) error {
+		return s.compareOutputID(ctx, r, sum)
+	}}
+	return nil
+}
+
+// compareOutputID reports a mismatch between the OutputID of r and the hash
+// sum of its body, returning an error if the put must be rejected.
+func (s *server) compareOutputID(ctx context.Context, r *Request, sum []byte) error {
+	if bytes.Equal(sum, r.OutputID) {
+		return nil
+	}
+	stats.outputIDMismatches.Add(1)
+	LoggerFromContext(ctx).Warn("put body does not hash to its OutputID",
+		slog.String("action_id", hex.EncodeToString(r.ActionID)),
+		slog.String("output_id", hex.EncodeToString(r.OutputID)),
+		slog.String("body_hash", hex.EncodeToString(sum)))
+	if s.outputIDCheck == OutputIDCheckReject {
+		return Errorf(CodeInvalidRequest, "body hashes to %x, not to its OutputID %x", sum, r.OutputID)
+	}
+	return nil
+}
+
+// hashingReader hashes what is read through it and calls check with the
+// sum at the end of the stream, returning its error instead of io.EOF.
+type hashingReader struct {
+	r       io.Reader
+	hash    hash.Hash
+	check   func(sum []byte) error
+	checked bool
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && !h.checked {
+		h.checked = true
+		if cerr := h.check(h.hash.Sum(nil)); cerr != nil {
+			return n, cerr
+		}
+	}
+	return n, err
+}
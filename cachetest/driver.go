@@ -0,0 +1,279 @@
+// Package cachetest provides utilities for testing GOCACHEPROG programs.
+//
+// A Driver plays the role of the go command: it writes requests and their
+// base64-encoded bodies to the cache program's stdin, reads responses from
+// its stdout and checks that the program follows the protocol.
+//
+// A MockBackend plays the role of the backend behind a middleware, and
+// Golden compares the exchanges it recorded with a golden file.
+package cachetest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// ErrClosed is returned for requests issued after the connection to the
+// cache program is gone.
+var ErrClosed = errors.New("cachetest: connection closed")
+
+// Driver simulates the go command side of the GOCACHEPROG protocol.
+// It is safe for concurrent use once Handshake has returned.
+type Driver struct {
+	w io.Writer
+	r io.Reader
+
+	wmu sync.Mutex // serializes request writes
+	enc *json.Encoder
+	dec *json.Decoder
+
+	nextID atomic.Int64
+
+	mu      sync.Mutex
+	pending map[int64]chan cache.Response
+	err     error         // set when the read loop stops
+	done    chan struct{} // closed when the read loop stops
+
+	known []cache.Cmd
+	cmd   *exec.Cmd
+}
+
+// NewDriver returns a Driver that writes requests to w and reads responses
+// from r. Handshake must be called before issuing any request.
+func NewDriver(w io.Writer, r io.Reader) *Driver {
+	return &Driver{
+		w:       w,
+		r:       r,
+		enc:     json.NewEncoder(w),
+		dec:     json.NewDecoder(r),
+		pending: make(map[int64]chan cache.Response),
+		done:    make(chan struct{}),
+	}
+}
+
+// Pipe returns a Driver connected to an in-memory pipe, together with the
+// reader and writer the server under test should use as its stdin and stdout.
+//
+//	d, stdin, stdout := cachetest.Pipe()
+//	go cache.Serve(cache.WithInput(stdin), cache.WithOutput(stdout))
+//	known, err := d.Handshake()
+func Pipe() (*Driver, io.Reader, io.Writer) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	return NewDriver(inW, outR), inR, outW
+}
+
+// Start starts cmd as a cache program and returns a Driver connected to its
+// stdin and stdout. The caller must not set cmd.Stdin or cmd.Stdout.
+func Start(cmd *exec.Cmd) (*Driver, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start cache program: %w", err)
+	}
+	d := NewDriver(stdin, stdout)
+	d.cmd = cmd
+	return d, nil
+}
+
+// Handshake reads the initial ID==0 response and validates it. It returns
+// the commands the cache program declared as supported.
+func (d *Driver) Handshake() ([]cache.Cmd, error) {
+	var res cache.Response
+	if err := d.dec.Decode(&res); err != nil {
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
+	}
+	if res.ID != 0 {
+		return nil, fmt.Errorf("handshake has id %d, want 0", res.ID)
+	}
+	if len(res.KnownCommands) == 0 {
+		return nil, errors.New("handshake has no known commands")
+	}
+	d.known = res.KnownCommands
+	go d.readLoop()
+	return d.known, nil
+}
+
+// KnownCommands returns the commands declared in the handshake.
+func (d *Driver) KnownCommands() []cache.Cmd {
+	return d.known
+}
+
+// readLoop dispatches responses to the goroutines waiting for them.
+// Responses may arrive in any order, but each must match exactly one
+// outstanding request.
+func (d *Driver) readLoop() {
+	var err error
+	for {
+		var res cache.Response
+		if err = d.dec.Decode(&res); err != nil {
+			break
+		}
+		d.mu.Lock()
+		ch, ok := d.pending[res.ID]
+		delete(d.pending, res.ID)
+		d.mu.Unlock()
+		if !ok {
+			err = fmt.Errorf("response id %d does not match any outstanding request", res.ID)
+			break
+		}
+		ch <- res
+	}
+
+	d.mu.Lock()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+		err = ErrClosed
+	}
+	d.err = err
+	d.mu.Unlock()
+	close(d.done)
+}
+
+// Do sends req, followed by body when it is non-empty, and waits for the
+// matching response. The request ID and BodySize are assigned by Do.
+func (d *Driver) Do(req *cache.Request, body []byte) (cache.Response, error) {
+	if d.known == nil {
+		return cache.Response{}, errors.New("handshake has not been performed")
+	}
+	if !slices.Contains(d.known, req.Command) {
+		return cache.Response{}, fmt.Errorf("command %s was not declared in the handshake", req.Command)
+	}
+
+	req.ID = d.nextID.Add(1)
+	req.BodySize = int64(len(body))
+	ch := make(chan cache.Response, 1)
+
+	d.mu.Lock()
+	if d.err != nil {
+		err := d.err
+		d.mu.Unlock()
+		return cache.Response{}, err
+	}
+	d.pending[req.ID] = ch
+	d.mu.Unlock()
+
+	if err := d.write(req, body); err != nil {
+		d.mu.Lock()
+		delete(d.pending, req.ID)
+		d.mu.Unlock()
+		return cache.Response{}, err
+	}
+
+	select {
+	case res := <-ch:
+		return res, nil
+	case <-d.done:
+		// The response may have been delivered right before the loop stopped.
+		select {
+		case res := <-ch:
+			return res, nil
+		default:
+		}
+		return cache.Response{}, d.err
+	}
+}
+
+// write encodes a request and its body the way the go command does: the
+// body is sent as a separate base64-encoded JSON string following the
+// request object.
+func (d *Driver) write(req *cache.Request, body []byte) error {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+
+	if err := d.enc.Encode(req); err != nil {
+		return fmt.Errorf("failed to write request: %w", err)
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	if err := d.enc.Encode(base64.StdEncoding.EncodeToString(body)); err != nil {
+		return fmt.Errorf("failed to write request body: %w", err)
+	}
+	return nil
+}
+
+// Get sends a get request for actionID. A non-empty Response.Err and
+// malformed hits are reported as errors.
+func (d *Driver) Get(actionID []byte) (cache.Response, error) {
+	res, err := d.Do(&cache.Request{
+		Command:  cache.CmdGet,
+		ActionID: actionID,
+	}, nil)
+	if err != nil {
+		return res, err
+	}
+	if res.Err != "" {
+		return res, fmt.Errorf("get failed: %s", res.Err)
+	}
+	if !res.Miss {
+		if len(res.OutputID) == 0 {
+			return res, errors.New("get hit has no output id")
+		}
+		if res.DiskPath == "" {
+			return res, errors.New("get hit has no disk path")
+		}
+	}
+	return res, nil
+}
+
+// Put sends a put request storing e. A non-empty Response.Err and responses
+// without a DiskPath are reported as errors.
+func (d *Driver) Put(e Entry) (cache.Response, error) {
+	res, err := d.Do(&cache.Request{
+		Command:  cache.CmdPut,
+		ActionID: e.ActionID,
+		OutputID: e.OutputID,
+		ObjectID: e.OutputID,
+	}, e.Body)
+	if err != nil {
+		return res, err
+	}
+	if res.Err != "" {
+		return res, fmt.Errorf("put failed: %s", res.Err)
+	}
+	if res.DiskPath == "" {
+		return res, errors.New("put response has no disk path")
+	}
+	return res, nil
+}
+
+// Close sends a close request, waits for its response and releases the
+// connection. If the Driver was created by Start, Close also waits for the
+// cache program to exit.
+func (d *Driver) Close() error {
+	var errs []error
+	if slices.Contains(d.known, cache.CmdClose) {
+		res, err := d.Do(&cache.Request{Command: cache.CmdClose}, nil)
+		if err != nil {
+			errs = append(errs, err)
+		} else if res.Err != "" {
+			errs = append(errs, fmt.Errorf("close failed: %s", res.Err))
+		}
+	}
+	if c, ok := d.w.(io.Closer); ok {
+		c.Close()
+	}
+	if d.cmd != nil {
+		if err := d.cmd.Wait(); err != nil {
+			errs = append(errs, fmt.Errorf("cache program exited: %w", err))
+		}
+	} else if c, ok := d.r.(io.Closer); ok {
+		c.Close()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,135 @@
+package cachetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// UpdateGoldenEnv is the environment variable that makes Golden rewrite
+// golden files instead of comparing against them:
+//
+//	CACHETEST_UPDATE_GOLDEN=1 go test ./...
+const UpdateGoldenEnv = "CACHETEST_UPDATE_GOLDEN"
+
+// Exchange is the stable form of a Call stored in golden files. Fields that
+// change from run to run are left out: the entry time, and the directory of
+// DiskPath, of which only the file name is kept.
+type Exchange struct {
+	Request  ExchangeRequest
+	Response ExchangeResponse
+}
+
+// ExchangeRequest is the request half of an Exchange.
+type ExchangeRequest struct {
+	ID       int64
+	Command  cache.Cmd
+	ActionID []byte `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	BodySize int64  `json:",omitempty"`
+	Body     []byte `json:",omitempty"`
+}
+
+// ExchangeResponse is the response half of an Exchange.
+type ExchangeResponse struct {
+	Err      string `json:",omitempty"`
+	Miss     bool   `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	Size     int64  `json:",omitempty"`
+	DiskPath string `json:",omitempty"`
+}
+
+// Exchanges converts calls to their stable form.
+func Exchanges(calls []Call) []Exchange {
+	ex := make([]Exchange, len(calls))
+	for i, c := range calls {
+		res := c.Response
+		ex[i] = Exchange{
+			Request: ExchangeRequest{
+				ID:       c.Request.ID,
+				Command:  c.Request.Command,
+				ActionID: c.Request.ActionID,
+				OutputID: c.Request.OutputID,
+				BodySize: c.Request.BodySize,
+				Body:     c.Body,
+			},
+			Response: ExchangeResponse{
+				Err:      res.Err,
+				Miss:     res.Miss,
+				OutputID: res.OutputID,
+				Size:     res.Size,
+			},
+		}
+		if res.DiskPath != "" {
+			ex[i].Response.DiskPath = filepath.Base(res.DiskPath)
+		}
+	}
+	return ex
+}
+
+// WriteExchanges writes ex to w as JSON lines, one Exchange per line.
+func WriteExchanges(w io.Writer, ex []Exchange) error {
+	enc := json.NewEncoder(w)
+	for _, e := range ex {
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("failed to encode exchange: %w", err)
+		}
+	}
+	return nil
+}
+
+// Golden compares the exchanges of calls with the golden file at path and
+// fails t if they differ. When UpdateGoldenEnv is set, it writes the golden
+// file instead. Calls made concurrently complete in no fixed order, so tests
+// should issue requests one at a time, or sort calls first.
+func Golden(t testing.TB, path string, calls []Call) {
+	t.Helper()
+
+	var got bytes.Buffer
+	if err := WriteExchanges(&got, Exchanges(calls)); err != nil {
+		t.Fatal(err)
+	}
+
+	if os.Getenv(UpdateGoldenEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("golden file %s does not exist; run with %s=1 to create it", path, UpdateGoldenEnv)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got.Bytes(), want) {
+		return
+	}
+
+	gotLines := bytes.Split(got.Bytes(), []byte("\n"))
+	wantLines := bytes.Split(want, []byte("\n"))
+	for i := 0; i < max(len(gotLines), len(wantLines)); i++ {
+		var g, w []byte
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if !bytes.Equal(g, w) {
+			t.Fatalf("exchanges differ from %s at line %d:\ngot:  %s\nwant: %s\nrun with %s=1 to update it", path, i+1, g, w, UpdateGoldenEnv)
+		}
+	}
+}
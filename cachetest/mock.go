@@ -0,0 +1,169 @@
+package cachetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// Call is a request received by a MockBackend and the response it wrote.
+type Call struct {
+	Request  *cache.Request
+	Body     []byte // the body of a put, read from Request.Body
+	Response cache.Response
+}
+
+// ResponderFunc computes the response of a MockBackend to r, whose body has
+// already been read into body. A non-nil error is written with
+// cache.WriteError, so returning cache.ErrMiss reports a miss.
+type ResponderFunc func(ctx context.Context, r *cache.Request, body []byte) (cache.Response, error)
+
+// MockBackend is a cache.Handler for middleware tests. By default it behaves
+// like a working cache, storing put bodies in a directory and answering gets
+// from them; responses can be scripted per command with Respond and On, and
+// every call is recorded for inspection with Calls.
+type MockBackend struct {
+	dir string
+
+	mu      sync.Mutex
+	entries map[string]cache.Response // keyed by the raw ActionID
+	queued  map[cache.Cmd][]cache.Response
+	on      map[cache.Cmd]ResponderFunc
+	calls   []Call
+}
+
+// NewMockBackend returns a MockBackend storing objects in dir, typically
+// t.TempDir().
+func NewMockBackend(dir string) *MockBackend {
+	return &MockBackend{
+		dir:     dir,
+		entries: make(map[string]cache.Response),
+		queued:  make(map[cache.Cmd][]cache.Response),
+		on:      make(map[cache.Cmd]ResponderFunc),
+	}
+}
+
+// Respond queues responses to the next requests for cmd, in order. Queued
+// responses take precedence over On and the default behavior; their ID is
+// set to the request's.
+func (m *MockBackend) Respond(cmd cache.Cmd, res ...cache.Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued[cmd] = append(m.queued[cmd], res...)
+}
+
+// On makes f answer every request for cmd that has no queued response.
+// A nil f restores the default behavior.
+func (m *MockBackend) On(cmd cache.Cmd, f ResponderFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f == nil {
+		delete(m.on, cmd)
+		return
+	}
+	m.on[cmd] = f
+}
+
+// Calls returns the calls received so far, in the order they completed.
+func (m *MockBackend) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// Reset forgets the recorded calls, queued responses and stored entries.
+func (m *MockBackend) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.entries)
+	clear(m.queued)
+	clear(m.on)
+	m.calls = nil
+}
+
+// Handle implements cache.Handler.
+func (m *MockBackend) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			m.write(w, r, body, cache.Response{}, fmt.Errorf("failed to read body: %w", err))
+			return
+		}
+	}
+
+	m.mu.Lock()
+	if q := m.queued[r.Command]; len(q) > 0 {
+		res := q[0]
+		m.queued[r.Command] = q[1:]
+		m.mu.Unlock()
+		res.ID = r.ID
+		m.write(w, r, body, res, nil)
+		return
+	}
+	f := m.on[r.Command]
+	m.mu.Unlock()
+
+	if f == nil {
+		f = m.respond
+	}
+	res, err := f(ctx, r, body)
+	m.write(w, r, body, res, err)
+}
+
+// write sends res, or err if it is not nil, and records the call.
+func (m *MockBackend) write(w cache.ResponseWriter, r *cache.Request, body []byte, res cache.Response, err error) {
+	ww := cache.WrapResponseWriter(w)
+	if err != nil {
+		cache.WriteError(ww, r, err)
+	} else {
+		res.ID = r.ID
+		ww.WriteResponse(res)
+	}
+	res, _ = ww.Response()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, Call{Request: r, Body: body, Response: res})
+}
+
+// respond is the default behavior: a cache backed by m.dir.
+func (m *MockBackend) respond(ctx context.Context, r *cache.Request, body []byte) (cache.Response, error) {
+	switch r.Command {
+	case cache.CmdGet:
+		m.mu.Lock()
+		res, ok := m.entries[string(r.ActionID)]
+		m.mu.Unlock()
+		if !ok {
+			return cache.Response{}, cache.ErrMiss
+		}
+		return res, nil
+	case cache.CmdPut:
+		if int64(len(body)) != r.BodySize {
+			return cache.Response{}, cache.Errorf(cache.CodeInvalidRequest, "body is %d bytes, want %d", len(body), r.BodySize)
+		}
+		path := filepath.Join(m.dir, fmt.Sprintf("%x", r.OutputID))
+		if err := os.WriteFile(path, body, 0o644); err != nil {
+			return cache.Response{}, fmt.Errorf("failed to write object: %w", err)
+		}
+		now := time.Now()
+		m.mu.Lock()
+		m.entries[string(r.ActionID)] = cache.Response{
+			OutputID: bytes.Clone(r.OutputID),
+			Size:     r.BodySize,
+			Time:     &now,
+			DiskPath: path,
+		}
+		m.mu.Unlock()
+		return cache.Response{DiskPath: path}, nil
+	default:
+		return cache.Response{}, nil
+	}
+}
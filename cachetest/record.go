@@ -0,0 +1,69 @@
+package cachetest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// Op is one request of a recorded workload. Recorded workloads are stored
+// as JSON lines, one Op per line, in the order the requests were received.
+type Op struct {
+	Command  cache.Cmd
+	ActionID []byte `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	Size     int64  `json:",omitempty"`
+}
+
+// ReadOps reads a recorded workload from r.
+func ReadOps(r io.Reader) ([]Op, error) {
+	var ops []Op
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var op Op
+		if err := dec.Decode(&op); err == io.EOF {
+			return ops, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode op %d: %w", len(ops)+1, err)
+		}
+		ops = append(ops, op)
+	}
+}
+
+// WriteOps writes ops to w as a recorded workload.
+func WriteOps(w io.Writer, ops []Op) error {
+	enc := json.NewEncoder(w)
+	for _, op := range ops {
+		if err := enc.Encode(op); err != nil {
+			return fmt.Errorf("failed to encode op: %w", err)
+		}
+	}
+	return nil
+}
+
+// RecordMiddleware returns a middleware that appends every request it sees
+// to w as an Op, producing a workload that can be replayed later, for
+// example with cmd/cachebench.
+func RecordMiddleware(w io.Writer) cache.Middleware {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, rw cache.ResponseWriter, r *cache.Request) {
+			mu.Lock()
+			enc.Encode(Op{
+				Command:  r.Command,
+				ActionID: r.ActionID,
+				OutputID: r.OutputID,
+				Size:     r.BodySize,
+			})
+			mu.Unlock()
+
+			next.Handle(ctx, rw, r)
+		})
+	}
+}
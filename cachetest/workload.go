@@ -0,0 +1,112 @@
+package cachetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// Entry is a cache entry shaped like the ones the go command stores.
+type Entry struct {
+	ActionID []byte
+	OutputID []byte
+	Body     []byte
+}
+
+// NewEntry returns an Entry for body. Like the go command, the OutputID is
+// the SHA-256 of the body.
+func NewEntry(actionID, body []byte) Entry {
+	sum := sha256.Sum256(body)
+	return Entry{
+		ActionID: actionID,
+		OutputID: sum[:],
+		Body:     body,
+	}
+}
+
+// Check reports whether res is a valid hit for e: the OutputID and Size
+// must match and the file at DiskPath must hold the body.
+func (e Entry) Check(res cache.Response) error {
+	if res.Miss {
+		return errors.New("unexpected cache miss")
+	}
+	if !bytes.Equal(res.OutputID, e.OutputID) {
+		return fmt.Errorf("output id is %x, want %x", res.OutputID, e.OutputID)
+	}
+	if res.Size != int64(len(e.Body)) {
+		return fmt.Errorf("size is %d, want %d", res.Size, len(e.Body))
+	}
+	body, err := os.ReadFile(res.DiskPath)
+	if err != nil {
+		return fmt.Errorf("failed to read disk path: %w", err)
+	}
+	if !bytes.Equal(body, e.Body) {
+		return fmt.Errorf("content of %s does not match the stored body", res.DiskPath)
+	}
+	return nil
+}
+
+// Workload generates entries whose sizes roughly follow what a go build
+// produces: many small outputs, a long tail of large ones, and a share of
+// empty bodies.
+type Workload struct {
+	// MinSize and MaxSize bound the size of non-empty bodies. Sizes are
+	// drawn from a log-uniform distribution between them.
+	MinSize int
+	MaxSize int
+
+	// EmptyRatio is the fraction of entries with an empty body.
+	EmptyRatio float64
+
+	rand *rand.Rand
+}
+
+// NewWorkload returns a Workload with sensible defaults whose output is
+// fully determined by seed.
+func NewWorkload(seed uint64) *Workload {
+	return &Workload{
+		MinSize:    64,
+		MaxSize:    4 << 20,
+		EmptyRatio: 0.1,
+		rand:       rand.New(rand.NewPCG(seed, seed)),
+	}
+}
+
+// Entry returns a new random entry.
+func (w *Workload) Entry() Entry {
+	actionID := make([]byte, sha256.Size)
+	w.fill(actionID)
+	body := make([]byte, w.size())
+	w.fill(body)
+	return NewEntry(actionID, body)
+}
+
+// Entries returns n new random entries.
+func (w *Workload) Entries(n int) []Entry {
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i] = w.Entry()
+	}
+	return entries
+}
+
+func (w *Workload) size() int {
+	if w.rand.Float64() < w.EmptyRatio {
+		return 0
+	}
+	lo := math.Log(float64(max(w.MinSize, 1)))
+	hi := math.Log(float64(max(w.MaxSize, w.MinSize, 1)))
+	return int(math.Exp(lo + w.rand.Float64()*(hi-lo)))
+}
+
+func (w *Workload) fill(b []byte) {
+	for i := range b {
+		b[i] = byte(w.rand.Uint32())
+	}
+}
@@ -0,0 +1,333 @@
+// Package castore implements a local content-addressed object store keyed by
+// OutputID.
+//
+// Backends that fetch objects from a remote location need a local file to
+// return as Response.DiskPath. Storing those files in a Store deduplicates
+// objects shared by several ActionIDs, never rewrites an object once it is
+// complete, and lets objects be exposed elsewhere through reflinks or hard
+// links instead of copies.
+//
+// Objects are laid out as <dir>/<first two hex digits>/<hex OutputID>.
+package castore
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/fileclone"
+)
+
+// mtimeInterval is how stale an object's modification time may get before
+// Touch updates it. It mirrors the go command, which avoids rewriting
+// metadata on every access.
+const mtimeInterval = time.Hour
+
+// Store is a content-addressed object store rooted at a directory.
+// It is safe for concurrent use, including by several processes sharing the
+// directory, since objects are published with atomic renames.
+type Store struct {
+	dir string
+
+	mu    sync.Mutex
+	refs  map[string]int                 // hex OutputID -> number of active references
+	held  map[string]map[string]struct{} // session -> hex OutputIDs acquired with Hold
+	fills map[string]*filling            // hex OutputID -> fill in progress
+}
+
+// filling is a fill in progress; err is set before done is closed.
+type filling struct {
+	done chan struct{}
+	err  error
+}
+
+// New returns a Store rooted at dir, creating the directory if needed.
+// Shard subdirectories are created on first write.
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+	return &Store{
+		dir:   dir,
+		refs:  make(map[string]int),
+		held:  make(map[string]map[string]struct{}),
+		fills: make(map[string]*filling),
+	}, nil
+}
+
+// Dir returns the root directory of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Path returns the path of the object for outputID. The file exists only if
+// the object has been stored.
+func (s *Store) Path(outputID []byte) string {
+	hexID := hex.EncodeToString(outputID)
+	if len(hexID) < 2 {
+		return filepath.Join(s.dir, "_", hexID)
+	}
+	return filepath.Join(s.dir, hexID[:2], hexID)
+}
+
+// Stat returns the size of the object for outputID and reports whether it
+// is present.
+func (s *Store) Stat(outputID []byte) (int64, bool) {
+	fi, err := os.Stat(s.Path(outputID))
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// Put stores the content of r under outputID and returns the object's path
+// and size. Objects are write-once: if the object already exists, r is
+// drained and the existing object is kept.
+func (s *Store) Put(outputID []byte, r io.Reader) (string, int64, error) {
+	path := s.Path(outputID)
+	if size, ok := s.Stat(outputID); ok {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return "", 0, fmt.Errorf("failed to read object: %w", err)
+		}
+		s.Touch(outputID)
+		return path, size, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create shard directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create object file: %w", err)
+	}
+	size, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, fmt.Errorf("failed to write object file: %w", err)
+	}
+	return path, size, nil
+}
+
+// Fill makes sure the object for outputID is present with size bytes,
+// calling fetch to store it, typically by downloading it with Put, unless
+// it is. Concurrent fills of the same object in this process wait for the
+// fetch in progress instead of downloading it again, and return its error.
+// A fetch interrupted because its caller gave up is retried by a waiter
+// that has not.
+func (s *Store) Fill(ctx context.Context, outputID []byte, size int64, fetch func() error) error {
+	key := hex.EncodeToString(outputID)
+	for {
+		if got, ok := s.Stat(outputID); ok && got == size {
+			return nil
+		}
+		s.mu.Lock()
+		f, ok := s.fills[key]
+		if !ok {
+			f = &filling{done: make(chan struct{})}
+			s.fills[key] = f
+			s.mu.Unlock()
+			f.err = fetch()
+			s.mu.Lock()
+			delete(s.fills, key)
+			s.mu.Unlock()
+			close(f.done)
+			return f.err
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		canceled := errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)
+		if f.err != nil && !canceled {
+			return f.err
+		}
+	}
+}
+
+// PutFile stores the file at src under outputID without copying it when the
+// filesystem allows, and returns the object's path and size.
+func (s *Store) PutFile(outputID []byte, src string) (string, int64, error) {
+	path := s.Path(outputID)
+	if size, ok := s.Stat(outputID); ok {
+		s.Touch(outputID)
+		return path, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create shard directory: %w", err)
+	}
+	if _, err := fileclone.Clone(src, path); err != nil {
+		return "", 0, fmt.Errorf("failed to store object file: %w", err)
+	}
+	size, _ := s.Stat(outputID)
+	return path, size, nil
+}
+
+// Link materializes the object for outputID at dst using a reflink, hard
+// link or copy, in that order of preference. Linked files share storage
+// with the store and must be treated as read-only.
+func (s *Store) Link(outputID []byte, dst string) (fileclone.Method, error) {
+	m, err := fileclone.Clone(s.Path(outputID), dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, fmt.Errorf("object %x is not in the store: %w", outputID, err)
+	} else if err != nil {
+		return 0, err
+	}
+	s.Touch(outputID)
+	return m, nil
+}
+
+// Touch records that the object for outputID was used by updating its
+// modification time, at most once per hour.
+func (s *Store) Touch(outputID []byte) {
+	path := s.Path(outputID)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(fi.ModTime()) > mtimeInterval {
+		os.Chtimes(path, now, now)
+	}
+}
+
+// Acquire marks the object for outputID as in use, protecting it from Prune
+// until the matching Release. Backends acquire the objects whose DiskPath
+// they returned for the lifetime of the session.
+func (s *Store) Acquire(outputID []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs[hex.EncodeToString(outputID)]++
+}
+
+// Release drops a reference taken by Acquire.
+func (s *Store) Release(outputID []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(outputID)
+	if s.refs[key] <= 1 {
+		delete(s.refs, key)
+		return
+	}
+	s.refs[key]--
+}
+
+// Remove removes the object for outputID unless it is referenced through
+// Acquire or Hold, for stores that only stage objects on their way to
+// another backend.
+func (s *Store) Remove(outputID []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, inUse := s.refs[hex.EncodeToString(outputID)]; inUse {
+		return nil
+	}
+	if err := os.Remove(s.Path(outputID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove object: %w", err)
+	}
+	return nil
+}
+
+// Hold acquires the object for outputID on behalf of the session of ctx,
+// see cache.SessionIDFromContext, until ReleaseSession. Backends hold the
+// objects whose DiskPath they return, since the go command reads them
+// until it exits. Holding an object several times in a session takes a
+// single reference. Requests without a session, such as those a
+// go-cache-server handles over HTTP, hold nothing: they never send the
+// close request that would release their objects.
+func (s *Store) Hold(ctx context.Context, outputID []byte) {
+	session, ok := cache.SessionIDFromContext(ctx)
+	if !ok {
+		return
+	}
+	key := hex.EncodeToString(outputID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, ok := s.held[session]
+	if !ok {
+		ids = make(map[string]struct{})
+		s.held[session] = ids
+	}
+	if _, ok := ids[key]; ok {
+		return
+	}
+	ids[key] = struct{}{}
+	s.refs[key]++
+}
+
+// ReleaseSession releases the objects held for the session of ctx.
+// Backends call it when handling the close request.
+func (s *Store) ReleaseSession(ctx context.Context) {
+	session, _ := cache.SessionIDFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.held[session] {
+		if s.refs[key] <= 1 {
+			delete(s.refs, key)
+		} else {
+			s.refs[key]--
+		}
+	}
+	delete(s.held, session)
+}
+
+// PruneStats reports what Prune removed.
+type PruneStats struct {
+	Objects int
+	Bytes   int64
+}
+
+// Prune removes the objects that were last used before cutoff and are not
+// referenced through Acquire, along with temporary files left behind by
+// interrupted writes.
+func (s *Store) Prune(cutoff time.Time) (PruneStats, error) {
+	var st PruneStats
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !info.ModTime().Before(cutoff) {
+			return nil
+		}
+
+		// Remove under the lock, so that an object cannot be acquired
+		// between the check and its removal.
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, inUse := s.refs[d.Name()]; inUse {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove object: %w", err)
+		}
+		st.Objects++
+		st.Bytes += info.Size()
+		return nil
+	})
+	return st, err
+}
@@ -0,0 +1,143 @@
+// Package chaos injects faults into a cache program, to test that builds
+// survive a misbehaving cache layer. It is configured from environment
+// variables so that it can be enabled in a staging CI pipeline only,
+// without a different binary.
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// Config sets the probability of each fault, between 0 and 1. Faults are
+// drawn independently for every request.
+type Config struct {
+	// ErrorRate is the probability that a request fails with a retryable
+	// error instead of reaching the handler.
+	ErrorRate float64
+
+	// LatencyRate is the probability that a request is delayed by a random
+	// duration up to MaxLatency before reaching the handler.
+	LatencyRate float64
+	MaxLatency  time.Duration
+
+	// TruncateRate is the probability that the handler receives only half
+	// of the body of a put, while BodySize still announces all of it.
+	TruncateRate float64
+
+	// DropRate is the probability that the response to a get or put is not
+	// written at all. The go command waits for every response, so this is
+	// only meant to test timeouts in transports and wrappers in front of
+	// the program.
+	DropRate float64
+
+	// Seed makes the faults reproducible when non-zero.
+	Seed uint64
+}
+
+// FromEnv reads a Config from environment variables named after prefix:
+// <prefix>_CHAOS_ERROR_RATE, <prefix>_CHAOS_LATENCY_RATE,
+// <prefix>_CHAOS_MAX_LATENCY (a duration), <prefix>_CHAOS_TRUNCATE_RATE,
+// <prefix>_CHAOS_DROP_RATE and <prefix>_CHAOS_SEED.
+func FromEnv(prefix string) (Config, error) {
+	var c Config
+	var err error
+	parse := func(name string, fn func(s string) error) {
+		if s := os.Getenv(prefix + "_CHAOS_" + name); s != "" && err == nil {
+			if perr := fn(s); perr != nil {
+				err = fmt.Errorf("invalid %s_CHAOS_%s: %w", prefix, name, perr)
+			}
+		}
+	}
+	rate := func(p *float64) func(string) error {
+		return func(s string) (err error) {
+			*p, err = strconv.ParseFloat(s, 64)
+			if err == nil && (*p < 0 || *p > 1) {
+				err = fmt.Errorf("%v is not between 0 and 1", *p)
+			}
+			return err
+		}
+	}
+	parse("ERROR_RATE", rate(&c.ErrorRate))
+	parse("LATENCY_RATE", rate(&c.LatencyRate))
+	parse("MAX_LATENCY", func(s string) (err error) { c.MaxLatency, err = time.ParseDuration(s); return })
+	parse("TRUNCATE_RATE", rate(&c.TruncateRate))
+	parse("DROP_RATE", rate(&c.DropRate))
+	parse("SEED", func(s string) (err error) { c.Seed, err = strconv.ParseUint(s, 10, 64); return })
+	return c, err
+}
+
+// Enabled reports whether c injects any fault.
+func (c Config) Enabled() bool {
+	return c.ErrorRate > 0 || (c.LatencyRate > 0 && c.MaxLatency > 0) || c.TruncateRate > 0 || c.DropRate > 0
+}
+
+// Middleware returns a middleware injecting the faults of c into get and
+// put requests. Close requests are never affected.
+func Middleware(c Config) cache.Middleware {
+	seed := c.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	var mu sync.Mutex
+	rng := rand.New(rand.NewPCG(seed, seed))
+	roll := func(p float64) bool {
+		if p <= 0 {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return rng.Float64() < p
+	}
+	delay := func() time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Duration(rng.Int64N(int64(c.MaxLatency)))
+	}
+
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+			if r.Command != cache.CmdGet && r.Command != cache.CmdPut {
+				next.Handle(ctx, w, r)
+				return
+			}
+			log := cache.LoggerFromContext(ctx)
+
+			if c.MaxLatency > 0 && roll(c.LatencyRate) {
+				d := delay()
+				log.Info("chaos: delaying request", "delay", d)
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+				}
+			}
+			if roll(c.ErrorRate) {
+				log.Info("chaos: failing request")
+				cache.WriteError(w, r, cache.Errorf(cache.CodeUnavailable, "chaos: injected failure"))
+				return
+			}
+			if r.Command == cache.CmdPut && r.BodySize > 0 && roll(c.TruncateRate) {
+				log.Info("chaos: truncating body")
+				r.Body = io.LimitReader(r.Body, r.BodySize/2)
+			}
+			if roll(c.DropRate) {
+				log.Info("chaos: dropping response")
+				w = dropWriter{}
+			}
+			next.Handle(ctx, w, r)
+		})
+	}
+}
+
+// dropWriter is a ResponseWriter that drops responses.
+type dropWriter struct{}
+
+func (dropWriter) WriteResponse(cache.Response) {}
@@ -0,0 +1,160 @@
+// Package chunked transfers large objects as concurrent parts.
+//
+// Blob stores such as S3, GCS and Azure Blob Storage move multi-hundred-MB
+// objects much faster as parallel ranged reads and multipart uploads than as
+// a single stream. This package implements the splitting, scheduling and
+// error handling; a backend only supplies the calls that read a byte range
+// or upload one part.
+package chunked
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultPartSize is the part size used when Options.PartSize is zero.
+	// It is above the 5 MiB minimum part size of S3 multipart uploads.
+	DefaultPartSize = 8 << 20
+
+	// DefaultConcurrency is the number of parts transferred at once when
+	// Options.Concurrency is zero.
+	DefaultConcurrency = 4
+)
+
+// Options configures a transfer.
+type Options struct {
+	// PartSize is the size of each part in bytes. The last part may be
+	// smaller.
+	PartSize int64
+
+	// Concurrency is the maximum number of parts in flight.
+	Concurrency int
+}
+
+func (o Options) partSize() int64 {
+	if o.PartSize <= 0 {
+		return DefaultPartSize
+	}
+	return o.PartSize
+}
+
+func (o Options) concurrency() int {
+	if o.Concurrency <= 0 {
+		return DefaultConcurrency
+	}
+	return o.Concurrency
+}
+
+// Parts returns the number of parts an object of the given size is split
+// into. An empty object has one empty part.
+func (o Options) Parts(size int64) int {
+	ps := o.partSize()
+	return max(1, int((size+ps-1)/ps))
+}
+
+// RangeReader reads byte ranges of a remote object, for example with an
+// HTTP Range request.
+type RangeReader interface {
+	ReadRange(ctx context.Context, off, n int64) (io.ReadCloser, error)
+}
+
+// Download reads an object of the given size through concurrent ranged
+// reads and writes each part to w at its offset. w is typically the
+// *os.File that will become the DiskPath.
+func Download(ctx context.Context, w io.WriterAt, r RangeReader, size int64, opts Options) error {
+	ps := opts.partSize()
+	return run(ctx, opts.Parts(size), opts.concurrency(), func(ctx context.Context, part int) error {
+		off := int64(part) * ps
+		n := min(ps, size-off)
+		if n <= 0 {
+			return nil
+		}
+		body, err := r.ReadRange(ctx, off, n)
+		if err != nil {
+			return fmt.Errorf("failed to read part %d: %w", part+1, err)
+		}
+		defer body.Close()
+
+		written, err := io.Copy(io.NewOffsetWriter(w, off), io.LimitReader(body, n))
+		if err != nil {
+			return fmt.Errorf("failed to write part %d: %w", part+1, err)
+		}
+		if written != n {
+			return fmt.Errorf("part %d is %d bytes, want %d", part+1, written, n)
+		}
+		return nil
+	})
+}
+
+// PartUploader uploads the parts of a multipart upload. Part numbers start
+// at 1. The returned token identifies the uploaded part, such as an S3 ETag
+// or an Azure block ID, and is passed back to the backend to complete the
+// upload.
+type PartUploader interface {
+	UploadPart(ctx context.Context, number int, body *io.SectionReader) (token string, err error)
+}
+
+// Upload uploads an object of the given size from r in concurrent parts and
+// returns the part tokens in part order.
+func Upload(ctx context.Context, r io.ReaderAt, size int64, u PartUploader, opts Options) ([]string, error) {
+	ps := opts.partSize()
+	tokens := make([]string, opts.Parts(size))
+	err := run(ctx, len(tokens), opts.concurrency(), func(ctx context.Context, part int) error {
+		off := int64(part) * ps
+		n := max(0, min(ps, size-off))
+		token, err := u.UploadPart(ctx, part+1, io.NewSectionReader(r, off, n))
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d: %w", part+1, err)
+		}
+		tokens[part] = token
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// run calls fn for every part with at most concurrency calls in flight. The
+// first error cancels the remaining parts and is returned.
+func run(ctx context.Context, parts, concurrency int, fn func(ctx context.Context, part int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+	for part := range parts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(ctx, part); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,161 @@
+// Package clock abstracts the passage of time for the server and the
+// backends, so that timeouts, entry timestamps, TTLs and trimming can be
+// exercised deterministically with a Fake clock instead of with sleeps.
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and runs functions after a delay.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call scheduled with AfterFunc.
+type Timer interface {
+	// Stop cancels the call and reports whether it was still pending.
+	Stop() bool
+}
+
+// Real is the clock of the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// Since returns the time elapsed since t on c.
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// WithTimeout is context.WithTimeout on c: the returned context is done
+// when d has elapsed on c, with context.DeadlineExceeded as its error.
+func WithTimeout(parent context.Context, c Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if c == Real {
+		return context.WithTimeout(parent, d)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	tc := &timeoutCtx{Context: ctx, deadline: c.Now().Add(d)}
+	t := c.AfterFunc(d, func() {
+		tc.mu.Lock()
+		tc.expired = true
+		tc.mu.Unlock()
+		cancel()
+	})
+	return tc, func() {
+		t.Stop()
+		cancel()
+	}
+}
+
+// timeoutCtx is a context canceled by a timer of a Clock other than Real.
+type timeoutCtx struct {
+	context.Context
+	deadline time.Time
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func (c *timeoutCtx) Deadline() (time.Time, bool) {
+	if d, ok := c.Context.Deadline(); ok && d.Before(c.deadline) {
+		return d, true
+	}
+	return c.deadline, true
+}
+
+func (c *timeoutCtx) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired && c.Context.Err() != nil {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
+
+// Fake is a Clock whose time only moves with Advance. It is safe for
+// concurrent use.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake returns a Fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now implements Clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// AfterFunc implements Clock. The call runs in the goroutine of the
+// Advance that reaches its time.
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{clock: f, when: f.now.Add(d), f: fn}
+	f.timers = append(f.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, running the calls that come due in
+// the order of their times.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range f.timers {
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		f.remove(next)
+		if next.when.After(f.now) {
+			f.now = next.when
+		}
+		f.mu.Unlock()
+		next.f()
+		f.mu.Lock()
+	}
+	f.now = end
+	f.mu.Unlock()
+}
+
+// remove drops t from the pending timers and reports whether it was there.
+func (f *Fake) remove(t *fakeTimer) bool {
+	for i, p := range f.timers {
+		if p == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock *Fake
+	when  time.Time
+	f     func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.remove(t)
+}
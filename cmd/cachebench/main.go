@@ -0,0 +1,277 @@
+// Cachebench replays a synthetic or recorded workload against a GOCACHEPROG
+// program and reports throughput and latency percentiles.
+//
+// Usage:
+//
+//	cachebench [flags] program [args...]
+//
+// Without -workload, cachebench generates -n entries, stores -hit-ratio of
+// them in the cache beforehand, and then issues a get for every entry
+// followed by a put on each miss, the way the go command does. With
+// -workload, the requests of a recorded workload (see cachetest.ReadOps) are
+// replayed in order. Put bodies are always synthesized; only their sizes are
+// taken from the recording.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/cachetest"
+)
+
+var (
+	flagN           = flag.Int("n", 1000, "number of synthetic entries")
+	flagHitRatio    = flag.Float64("hit-ratio", 0.5, "fraction of synthetic entries stored before the run")
+	flagMinSize     = flag.Int("min-size", 64, "minimum synthetic body size in bytes")
+	flagMaxSize     = flag.Int("max-size", 1<<20, "maximum synthetic body size in bytes")
+	flagConcurrency = flag.Int("concurrency", 8, "number of concurrent requests")
+	flagSeed        = flag.Uint64("seed", 1, "seed for the synthetic workload")
+	flagWorkload    = flag.String("workload", "", "replay the recorded workload in `file`")
+	flagRecord      = flag.String("record", "", "write the synthetic workload to `file`")
+)
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix("[cachebench] ")
+	log.SetFlags(0)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: cachebench [flags] program [args...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	warmup, ops, err := loadOps()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cmd := exec.Command(flag.Arg(0), flag.Args()[1:]...)
+	cmd.Stderr = os.Stderr
+	d, err := cachetest.Start(cmd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := d.Handshake(); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, op := range warmup {
+		if _, err := d.Put(entry(op)); err != nil {
+			log.Fatalf("warm-up failed: %v", err)
+		}
+	}
+
+	st := run(d, ops, *flagConcurrency)
+
+	if err := d.Close(); err != nil {
+		log.Printf("close failed: %v", err)
+	}
+	st.report(os.Stdout)
+}
+
+// loadOps returns the requests to store before the run and the requests to
+// measure.
+func loadOps() (warmup, ops []cachetest.Op, err error) {
+	if *flagWorkload != "" {
+		f, err := os.Open(*flagWorkload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open workload: %w", err)
+		}
+		defer f.Close()
+		ops, err := cachetest.ReadOps(f)
+		return nil, ops, err
+	}
+
+	r := rand.New(rand.NewPCG(*flagSeed, *flagSeed))
+	lo := math.Log(float64(max(*flagMinSize, 1)))
+	hi := math.Log(float64(max(*flagMaxSize, *flagMinSize, 1)))
+	for range *flagN {
+		actionID := make([]byte, sha256.Size)
+		for i := range actionID {
+			actionID[i] = byte(r.Uint32())
+		}
+		size := int64(math.Exp(lo + r.Float64()*(hi-lo)))
+
+		get := cachetest.Op{Command: cache.CmdGet, ActionID: actionID}
+		put := cachetest.Op{Command: cache.CmdPut, ActionID: actionID, Size: size}
+		if r.Float64() < *flagHitRatio {
+			warmup = append(warmup, put)
+			ops = append(ops, get)
+		} else {
+			ops = append(ops, get, put)
+		}
+	}
+
+	if *flagRecord != "" {
+		f, err := os.Create(*flagRecord)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create record file: %w", err)
+		}
+		defer f.Close()
+		if err := cachetest.WriteOps(f, append(slices.Clip(warmup), ops...)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return warmup, ops, nil
+}
+
+// entry synthesizes the body of a put. The content is derived from the
+// ActionID so that repeated runs store identical objects.
+func entry(op cachetest.Op) cachetest.Entry {
+	var seed uint64
+	if len(op.ActionID) >= 8 {
+		seed = binary.LittleEndian.Uint64(op.ActionID)
+	}
+	r := rand.New(rand.NewPCG(seed, uint64(op.Size)))
+	body := make([]byte, op.Size)
+	for i := range body {
+		body[i] = byte(r.Uint32())
+	}
+	return cachetest.NewEntry(op.ActionID, body)
+}
+
+// run issues ops with the given concurrency and collects their latencies.
+// A get followed by a put of the same ActionID is issued by one worker,
+// which only puts on a miss, like the go command: a put running ahead of
+// its get would turn the miss into a hit.
+func run(d *cachetest.Driver, ops []cachetest.Op, concurrency int) *stats {
+	st := &stats{latencies: make(map[cache.Cmd][]time.Duration)}
+	ch := make(chan []cachetest.Op)
+	var wg sync.WaitGroup
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for unit := range ch {
+				for _, op := range unit {
+					res, elapsed, err := do(d, op)
+					st.add(op, res, err, elapsed)
+					if op.Command == cache.CmdGet && (err != nil || !res.Miss) {
+						break
+					}
+				}
+			}
+		}()
+	}
+
+	st.start = time.Now()
+	for i := 0; i < len(ops); i++ {
+		unit := ops[i : i+1]
+		if i+1 < len(ops) && ops[i].Command == cache.CmdGet && ops[i+1].Command == cache.CmdPut &&
+			bytes.Equal(ops[i].ActionID, ops[i+1].ActionID) {
+			unit = ops[i : i+2]
+			i++
+		}
+		ch <- unit
+	}
+	close(ch)
+	wg.Wait()
+	st.elapsed = time.Since(st.start)
+	return st
+}
+
+// do issues op and returns its latency, not counting the synthesis of put
+// bodies.
+func do(d *cachetest.Driver, op cachetest.Op) (cache.Response, time.Duration, error) {
+	var e cachetest.Entry
+	if op.Command == cache.CmdPut {
+		e = entry(op)
+	}
+
+	start := time.Now()
+	var res cache.Response
+	var err error
+	switch op.Command {
+	case cache.CmdGet:
+		res, err = d.Get(op.ActionID)
+	case cache.CmdPut:
+		res, err = d.Put(e)
+	default:
+		res, err = d.Do(&cache.Request{Command: op.Command, ActionID: op.ActionID}, nil)
+	}
+	return res, time.Since(start), err
+}
+
+// stats aggregates the results of a run.
+type stats struct {
+	mu        sync.Mutex
+	start     time.Time
+	elapsed   time.Duration
+	latencies map[cache.Cmd][]time.Duration
+	hits      int
+	misses    int
+	errors    int
+	bytes     int64
+}
+
+func (st *stats) add(op cachetest.Op, res cache.Response, err error, d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.latencies[op.Command] = append(st.latencies[op.Command], d)
+	switch {
+	case err != nil:
+		st.errors++
+		log.Printf("%s failed: %v", op.Command, err)
+	case op.Command == cache.CmdGet && res.Miss:
+		st.misses++
+	case op.Command == cache.CmdGet:
+		st.hits++
+		st.bytes += res.Size
+	case op.Command == cache.CmdPut:
+		st.bytes += op.Size
+	}
+}
+
+func (st *stats) report(w io.Writer) {
+	total := 0
+	for _, l := range st.latencies {
+		total += len(l)
+	}
+	secs := st.elapsed.Seconds()
+	fmt.Fprintf(w, "requests:   %d in %v (%.1f req/s, %.1f MB/s)\n",
+		total, st.elapsed.Round(time.Millisecond), float64(total)/secs, float64(st.bytes)/secs/(1<<20))
+	fmt.Fprintf(w, "gets:       %d hits, %d misses\n", st.hits, st.misses)
+	fmt.Fprintf(w, "errors:     %d\n", st.errors)
+	fmt.Fprintf(w, "\n%-8s %8s %12s %12s %12s %12s\n", "command", "count", "p50", "p90", "p99", "max")
+
+	cmds := make([]cache.Cmd, 0, len(st.latencies))
+	for cmd := range st.latencies {
+		cmds = append(cmds, cmd)
+	}
+	slices.Sort(cmds)
+	for _, cmd := range cmds {
+		l := st.latencies[cmd]
+		slices.Sort(l)
+		fmt.Fprintf(w, "%-8s %8d %12v %12v %12v %12v\n", cmd, len(l),
+			percentile(l, 0.50), percentile(l, 0.90), percentile(l, 0.99), l[len(l)-1])
+	}
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
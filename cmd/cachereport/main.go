@@ -0,0 +1,171 @@
+// Cachereport attributes the hits and misses of a build to the packages
+// it built, to find what keeps missing the cache.
+//
+// Usage:
+//
+//	cachereport -workload session.jsonl -actiongraph graph.json
+//
+// The workload is the session recorded by a cache program, for example with
+// the -record flag of the example program, and the action graph is written
+// by the go command of the same build:
+//
+//	GOCACHEPROG="go-cache-prog -record session.jsonl" go build -debug-actiongraph=graph.json ./...
+//
+// The go command puts the output of every action it misses, so a get
+// followed by a put of the same ActionID is counted as a miss, and any
+// other get as a hit. Requests are grouped by the package and mode of their
+// action; those of no action, such as the module index of the go command,
+// are grouped as "(no action)". The output of go build -x names no
+// ActionIDs, so it cannot be used instead of the action graph.
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/hirasawayuki/go-cache-prog/actiongraph"
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/cachetest"
+)
+
+var (
+	flagWorkload    = flag.String("workload", "", "read the recorded session in `file`")
+	flagActionGraph = flag.String("actiongraph", "", "read the action graph of the build in `file`")
+	flagJSON        = flag.Bool("json", false, "write the report as JSON")
+	flagTop         = flag.Int("top", 0, "report only the `n` groups with the most misses")
+)
+
+// group is the line of the report of a package and mode.
+type group struct {
+	Package  string `json:"package"`
+	Mode     string `json:"mode,omitempty"`
+	Gets     int    `json:"gets"`
+	Hits     int    `json:"hits"`
+	Misses   int    `json:"misses"`
+	PutBytes int64  `json:"put_bytes"`
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix("[cachereport] ")
+	log.SetFlags(0)
+	flag.Parse()
+	if *flagWorkload == "" || *flagActionGraph == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*flagWorkload)
+	if err != nil {
+		log.Fatalf("failed to open workload: %v", err)
+	}
+	ops, err := cachetest.ReadOps(f)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	g, err := actiongraph.Load(*flagActionGraph)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	groups := report(ops, g)
+	if *flagJSON {
+		if *flagTop > 0 && len(groups) > *flagTop {
+			groups = groups[:*flagTop]
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(groups)
+	} else {
+		err = writeTable(os.Stdout, groups, *flagTop)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// report groups ops by the action of their ActionID, most misses first.
+func report(ops []cachetest.Op, g *actiongraph.Graph) []group {
+	// Resolve every ActionID once before grouping, so that subkeys looked
+	// up before the ActionID they derive from resolve too.
+	for _, op := range ops {
+		g.Lookup(op.ActionID)
+	}
+
+	put := make(map[string]int64)
+	for _, op := range ops {
+		if op.Command == cache.CmdPut {
+			put[string(op.ActionID)] += op.Size
+		}
+	}
+
+	type key struct{ pkg, mode string }
+	byKey := make(map[key]*group)
+	lookup := func(actionID []byte) *group {
+		k := key{pkg: "(no action)"}
+		if a, ok := g.Lookup(actionID); ok {
+			k = key{pkg: cmp.Or(a.Package, "(no package)"), mode: a.Mode}
+		}
+		gr, ok := byKey[k]
+		if !ok {
+			gr = &group{Package: k.pkg, Mode: k.mode}
+			byKey[k] = gr
+		}
+		return gr
+	}
+	for _, op := range ops {
+		gr := lookup(op.ActionID)
+		switch op.Command {
+		case cache.CmdGet:
+			gr.Gets++
+			if _, ok := put[string(op.ActionID)]; ok {
+				gr.Misses++
+			} else {
+				gr.Hits++
+			}
+		case cache.CmdPut:
+			gr.PutBytes += op.Size
+		}
+	}
+
+	groups := make([]group, 0, len(byKey))
+	for _, gr := range byKey {
+		groups = append(groups, *gr)
+	}
+	slices.SortFunc(groups, func(a, b group) int {
+		return cmp.Or(
+			cmp.Compare(b.Misses, a.Misses),
+			cmp.Compare(b.PutBytes, a.PutBytes),
+			cmp.Compare(a.Package, b.Package),
+			cmp.Compare(a.Mode, b.Mode),
+		)
+	})
+	return groups
+}
+
+// writeTable writes the first top groups, or all of them if top is zero,
+// followed by the total of all groups.
+func writeTable(w io.Writer, groups []group, top int) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tMODE\tGETS\tHITS\tMISSES\tPUT BYTES\t")
+	var total group
+	for i, gr := range groups {
+		if top <= 0 || i < top {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t\n", gr.Package, gr.Mode, gr.Gets, gr.Hits, gr.Misses, gr.PutBytes)
+		}
+		total.Gets += gr.Gets
+		total.Hits += gr.Hits
+		total.Misses += gr.Misses
+		total.PutBytes += gr.PutBytes
+	}
+	fmt.Fprintf(tw, "%s\t\t%d\t%d\t%d\t%d\t\n", "total", total.Gets, total.Hits, total.Misses, total.PutBytes)
+	return tw.Flush()
+}
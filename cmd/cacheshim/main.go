@@ -0,0 +1,58 @@
+// Cacheshim connects the go command to a GOCACHEPROG server listening on a
+// Unix socket or TCP address, such as one started with cache.ServeListener.
+// It copies its stdin to the connection and the connection to its stdout,
+// so the go command sees an ordinary cache program:
+//
+//	GOCACHEPROG="cacheshim unix:/tmp/cacheprog.sock" go build ./...
+//
+// The address may also be given in the GOCACHEPROG_ADDR environment
+// variable.
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix("[cacheshim] ")
+
+	addr := os.Getenv("GOCACHEPROG_ADDR")
+	if len(os.Args) > 1 {
+		addr = os.Args[1]
+	}
+	if addr == "" {
+		log.Printf("usage: cacheshim unix:/path/to/socket | tcp:host:port")
+		os.Exit(2)
+	}
+
+	conn, err := cache.Dial(addr)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	// Forward requests until the go command closes our stdin, then
+	// half-close the connection so the server sees the end of the stream.
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+
+	// Forward responses until the server ends the session.
+	if _, err := io.Copy(os.Stdout, conn); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+}
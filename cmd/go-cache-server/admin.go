@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/acl"
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/httpcache"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+	"github.com/hirasawayuki/go-cache-prog/quota"
+	"github.com/hirasawayuki/go-cache-prog/retention"
+)
+
+// defaultNamespace accounts the requests that name no namespace.
+const defaultNamespace = "default"
+
+// tenants keeps per-namespace statistics of the requests served.
+type tenants struct {
+	usage *quota.Manager // bytes stored per namespace, never enforced
+
+	mu    sync.Mutex
+	stats map[string]*tenantStats
+}
+
+type tenantStats struct {
+	gets, hits, puts, putBytes atomic.Int64
+}
+
+func newTenants() *tenants {
+	return &tenants{
+		usage: quota.New(nil, 0, quota.Reject, nil),
+		stats: make(map[string]*tenantStats),
+	}
+}
+
+func (t *tenants) get(namespace string) *tenantStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.stats[namespace]
+	if !ok {
+		s = new(tenantStats)
+		t.stats[namespace] = s
+	}
+	return s
+}
+
+// namespace returns the namespace of a request, see httpcache.NamespaceHeader.
+func namespace(ctx context.Context) string {
+	if ns := httpcache.NamespaceFromContext(ctx); ns != "" {
+		return ns
+	}
+	return defaultNamespace
+}
+
+// identityNamespace sets the namespace header of every request to the
+// namespace of the identity authenticated by acl.HTTPMiddleware, so that
+// clients cannot name the namespace of another.
+func identityNamespace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := acl.IdentityFromContext(r.Context()); ok {
+			r.Header.Set(httpcache.NamespaceHeader, id.Namespace)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middleware counts the gets, hits and successful puts of every namespace,
+// and tags the entries put with their namespace for retention policies.
+func (t *tenants) middleware() cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+			if ns := httpcache.NamespaceFromContext(ctx); ns != "" && r.Command == cache.CmdPut {
+				ctx = cache.ContextWithTags(ctx, map[string]string{retention.NamespaceTag: ns})
+			}
+			ww := cache.WrapResponseWriter(w)
+			next.Handle(ctx, ww, r)
+			res, ok := ww.Response()
+			if !ok || res.Err != "" {
+				return
+			}
+			ns := namespace(ctx)
+			s := t.get(ns)
+			switch r.Command {
+			case cache.CmdGet:
+				s.gets.Add(1)
+				if !res.Miss {
+					s.hits.Add(1)
+				}
+			case cache.CmdPut:
+				s.puts.Add(1)
+				s.putBytes.Add(r.BodySize)
+				t.usage.Track(ns, hex.EncodeToString(r.ActionID), r.BodySize)
+			}
+		})
+	}
+}
+
+// tenantUsage is the JSON form of the statistics of a namespace.
+type tenantUsage struct {
+	Namespace string  `json:"namespace"`
+	Bytes     int64   `json:"bytes"` // size of the distinct entries put since startup
+	Gets      int64   `json:"gets"`
+	Hits      int64   `json:"hits"`
+	HitRate   float64 `json:"hit_rate"`
+	Puts      int64   `json:"puts"`
+	PutBytes  int64   `json:"put_bytes"`
+}
+
+// namespaces returns the namespaces served so far, sorted.
+func (t *tenants) namespaces() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.stats))
+	for ns := range t.stats {
+		names = append(names, ns)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (t *tenants) usageOf(ns string) tenantUsage {
+	s := t.get(ns)
+	u := tenantUsage{
+		Namespace: ns,
+		Gets:      s.gets.Load(),
+		Hits:      s.hits.Load(),
+		Puts:      s.puts.Load(),
+		PutBytes:  s.putBytes.Load(),
+	}
+	u.Bytes, _ = t.usage.Usage(ns)
+	if u.Gets > 0 {
+		u.HitRate = float64(u.Hits) / float64(u.Gets)
+	}
+	return u
+}
+
+// admin serves the admin API to platform teams operating the server:
+//
+//	GET  /admin/namespaces            the namespaces served since startup
+//	GET  /admin/usage                 the statistics of every namespace
+//	GET  /admin/usage/{namespace}     the statistics of one namespace
+//	GET  /admin/tags                  the entries and bytes stored per user tag
+//	GET  /admin/tags?tag=branch=main  the same, restricted to entries with that tag
+//	POST /admin/prune?max_age=72h     deletes the objects older than max_age
+//	POST /admin/prune?bytes=N         deletes the oldest objects until N bytes are freed
+//	POST /admin/prune?policy          deletes the entries expired by the retention policy
+//	POST /admin/gc?grace=1h           deletes the objects no entry refers to, modified over grace ago
+//
+// Requests must carry the admin token as a bearer token.
+type admin struct {
+	token   string
+	tenants *tenants
+	cache   *diskcache.LocalDiskCacheHandler
+	policy  *retention.Policy // nil without -retention-policy
+}
+
+// handler serves the admin API in front of next.
+func (a *admin) handler(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/namespaces", a.auth(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.tenants.namespaces())
+	}))
+	mux.HandleFunc("GET /admin/usage", a.auth(func(w http.ResponseWriter, r *http.Request) {
+		usage := []tenantUsage{}
+		for _, ns := range a.tenants.namespaces() {
+			usage = append(usage, a.tenants.usageOf(ns))
+		}
+		writeJSON(w, usage)
+	}))
+	mux.HandleFunc("GET /admin/usage/{namespace}", a.auth(func(w http.ResponseWriter, r *http.Request) {
+		ns := r.PathValue("namespace")
+		if !slices.Contains(a.tenants.namespaces(), ns) {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, a.tenants.usageOf(ns))
+	}))
+	mux.HandleFunc("GET /admin/tags", a.auth(a.handleTags))
+	mux.HandleFunc("POST /admin/prune", a.auth(a.handlePrune))
+	mux.HandleFunc("POST /admin/gc", a.auth(a.handleGC))
+	mux.Handle("/", next)
+	return mux
+}
+
+// auth rejects requests without the admin token.
+func (a *admin) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (a *admin) handlePrune(w http.ResponseWriter, r *http.Request) {
+	var (
+		n     int
+		freed int64
+		err   error
+	)
+	q := r.URL.Query()
+	switch {
+	case q.Has("max_age"):
+		maxAge, perr := time.ParseDuration(q.Get("max_age"))
+		if perr != nil || maxAge < 0 {
+			http.Error(w, "invalid max_age", http.StatusBadRequest)
+			return
+		}
+		n, freed, err = a.cache.Prune(maxAge)
+	case q.Has("bytes"):
+		need, perr := strconv.ParseInt(q.Get("bytes"), 10, 64)
+		if perr != nil || need <= 0 {
+			http.Error(w, "invalid bytes", http.StatusBadRequest)
+			return
+		}
+		n, freed, err = a.cache.Evict(need)
+	case q.Has("policy"):
+		if a.policy == nil {
+			http.Error(w, "no retention policy is configured", http.StatusBadRequest)
+			return
+		}
+		n, freed, err = applyRetention(a.cache, a.policy)
+	default:
+		http.Error(w, "max_age, bytes or policy is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("admin prune %s: deleted %d objects, %d bytes", r.URL.RawQuery, n, freed)
+	writeJSON(w, map[string]int64{"objects": int64(n), "bytes": freed})
+}
+
+func (a *admin) handleGC(w http.ResponseWriter, r *http.Request) {
+	grace := time.Hour
+	if v := r.URL.Query().Get("grace"); v != "" {
+		var err error
+		if grace, err = time.ParseDuration(v); err != nil || grace < 0 {
+			http.Error(w, "invalid grace", http.StatusBadRequest)
+			return
+		}
+	}
+	n, freed, err := a.cache.CollectGarbage(grace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("admin gc: deleted %d files, %d bytes", n, freed)
+	writeJSON(w, map[string]int64{"files": int64(n), "bytes": freed})
+}
+
+// tagUsage is the JSON form of the entries stored with a user tag.
+type tagUsage struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Entries int64  `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// handleTags summarizes the entries in the cache by user tag, see
+// cache.ContextWithTags. The tag parameters, as key=value, select the
+// entries carrying all of them.
+func (a *admin) handleTags(w http.ResponseWriter, r *http.Request) {
+	filter := make(map[string]string)
+	for _, kv := range r.URL.Query()["tag"] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			http.Error(w, "invalid tag, want key=value", http.StatusBadRequest)
+			return
+		}
+		filter[k] = v
+	}
+	type tag struct{ key, value string }
+	usage := make(map[tag]*tagUsage)
+	err := a.cache.Entries(func(e manifest.Entry) error {
+		for k, v := range filter {
+			if e.Tags[k] != v {
+				return nil
+			}
+		}
+		for k, v := range e.Tags {
+			u, ok := usage[tag{k, v}]
+			if !ok {
+				u = &tagUsage{Key: k, Value: v}
+				usage[tag{k, v}] = u
+			}
+			u.Entries++
+			u.Bytes += e.Size
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tags := []tagUsage{}
+	for _, u := range usage {
+		tags = append(tags, *u)
+	}
+	slices.SortFunc(tags, func(a, b tagUsage) int {
+		if c := strings.Compare(a.Key, b.Key); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Value, b.Value)
+	})
+	writeJSON(w, tags)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/s3"
+	"github.com/hirasawayuki/go-cache-prog/tiered"
+)
+
+// diskHandler serves the get and put commands with the disk cache.
+type diskHandler struct {
+	*diskcache.LocalDiskCacheHandler
+}
+
+func (h diskHandler) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	switch r.Command {
+	case cache.CmdGet:
+		h.HandleGet(ctx, w, r)
+	case cache.CmdPut:
+		h.HandlePut(ctx, w, r)
+	default:
+		cache.WriteError(w, r, cache.Errorf(cache.CodeUnsupported, "unknown command: %s", r.Command))
+	}
+}
+
+// newColdTier returns the disk cache h tiered over the S3 bucket, whose
+// objects are stored in class. The objects downloaded from the bucket and
+// the index of demoted entries are kept under dir.
+func newColdTier(h *diskcache.LocalDiskCacheHandler, bucket, class, dir string) (*tiered.Tiered, *castore.Store, error) {
+	store, err := castore.New(filepath.Join(dir, "cold-objects"))
+	if err != nil {
+		return nil, nil, err
+	}
+	cold, err := s3.New(bucket, store, s3.WithStorageClasses(s3.StorageClass{Class: class}))
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := tiered.New(diskHandler{h}, cold, tiered.WithIndexFile(filepath.Join(dir, "cold-index")))
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, store, nil
+}
+
+// runColdTier migrates the entries of t every interval until ctx is done.
+// Objects downloaded from the cold tier are promoted to the hot tier, so
+// their copies in store are pruned after every pass.
+func runColdTier(ctx context.Context, t *tiered.Tiered, store *castore.Store, interval time.Duration) {
+	go t.Run(ctx, interval)
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if _, err := store.Prune(time.Now().Add(-time.Hour)); err != nil {
+			log.Printf("failed to prune cold tier downloads: %v", err)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+// Go-cache-server is a standalone cache server that builders share over
+// HTTP, using the httpcache protocol. Entries are stored in a directory
+// with the example disk cache:
+//
+//	go-cache-server -addr :8080 -dir /var/cache/go
+//
+// Builders use it through an httpcache.Client backend, and can seed a local
+// cache from it with the warm subcommand of the example. With -peer, puts are
+// replicated to the servers of other regions and local misses are read from
+// them, nearest first:
+//
+//	go-cache-server -peer us=https://cache.us.example.com -peer ap=https://cache.ap.example.com
+//
+// Every flag can also be set with an environment variable, which suits a
+// Kubernetes Deployment: GO_CACHE_SERVER_ADDR, GO_CACHE_SERVER_DIR,
+// GO_CACHE_SERVER_TLS_CERT, GO_CACHE_SERVER_TLS_KEY, GO_CACHE_SERVER_PEERS
+// (comma-separated), GO_CACHE_SERVER_DRAIN_DELAY,
+// GO_CACHE_SERVER_DRAIN_TIMEOUT and GO_CACHE_SERVER_ADMIN_TOKEN. The server answers liveness probes on
+// /healthz and readiness probes on /readyz, and drains on SIGTERM: it fails
+// readiness for the drain delay, then stops accepting connections and waits
+// up to the drain timeout for requests in flight. The drain delay plus
+// timeout should fit in the pod's terminationGracePeriodSeconds.
+//
+// Requests are accounted to the namespace named in their X-Cache-Namespace
+// header, or "default". With -acl-policy, clients must present a bearer
+// token of the policy file, see package acl, which decides whether they may
+// read or write, and their requests are accounted to the namespace of the
+// identity holding the token instead. This flag can be set with
+// GO_CACHE_SERVER_ACL_POLICY. With -admin-token, the server serves an admin API
+// under /admin/ listing the namespaces with their usage and hit rates, and
+// forcing prunes:
+//
+//	curl -H "Authorization: Bearer $TOKEN" https://cache.example.com/admin/usage
+//	curl -X POST -H "Authorization: Bearer $TOKEN" https://cache.example.com/admin/prune?max_age=168h
+//
+// With -goproxy-addr, the server also serves a Go module proxy on a second
+// address, caching the module files of -goproxy-upstream in a separate
+// directory, so that one deployment caches both builds and modules:
+//
+//	go-cache-server -goproxy-addr :8081 -goproxy-upstream https://proxy.golang.org
+//
+// Builders then set GOPROXY=http://cache.example.com:8081. These flags can
+// be set with GO_CACHE_SERVER_GOPROXY_ADDR, GO_CACHE_SERVER_GOPROXY_DIR and
+// GO_CACHE_SERVER_GOPROXY_UPSTREAM.
+//
+// With -disk-budget, the caches sharing the volume are kept under a total
+// size: the module cache gets -goproxy-share of it and the build cache the
+// rest, and each is pruned in proportion to how far over its share it is
+// when the budget is exceeded. A GOMODCACHE on the same volume, named with
+// -gomodcache, is counted against the budget but never pruned. These flags
+// can be set with GO_CACHE_SERVER_DISK_BUDGET, GO_CACHE_SERVER_GOPROXY_SHARE
+// and GO_CACHE_SERVER_GOMODCACHE.
+//
+// With -retention-policy, the entries expired by the rules of a retention
+// policy file are deleted every -retention-interval, for example to keep
+// the entries of the main branch longer than those of pull requests; see
+// package retention. Entries put in a namespace carry it as their
+// "namespace" tag. These flags can be set with
+// GO_CACHE_SERVER_RETENTION_POLICY and GO_CACHE_SERVER_RETENTION_INTERVAL.
+//
+// With -cold-s3-bucket, the entries not got for -cold-after are moved to an
+// S3 bucket, in the -cold-storage-class of infrequent access, and moved
+// back on their next get; see package tiered. The bucket is accessed with
+// the AWS_* environment variables. These flags can be set with
+// GO_CACHE_SERVER_COLD_S3_BUCKET, GO_CACHE_SERVER_COLD_AFTER and
+// GO_CACHE_SERVER_COLD_STORAGE_CLASS.
+//
+// With -quota, every namespace is limited to a number of bytes, so that one
+// team's builds cannot evict the entries of the others. Under
+// -quota-policy reject, puts over the quota fail; under evict-oldest, they
+// delete the oldest entries of their namespace first. These flags can be
+// set with GO_CACHE_SERVER_QUOTA and GO_CACHE_SERVER_QUOTA_POLICY.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/acl"
+	"github.com/hirasawayuki/go-cache-prog/budget"
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/goproxy"
+	"github.com/hirasawayuki/go-cache-prog/httpcache"
+	"github.com/hirasawayuki/go-cache-prog/httpcompress"
+	"github.com/hirasawayuki/go-cache-prog/replicate"
+	"github.com/hirasawayuki/go-cache-prog/retention"
+)
+
+// peerFlags collects the -peer flags.
+type peerFlags []string
+
+func (p *peerFlags) String() string { return strings.Join(*p, ",") }
+
+func (p *peerFlags) Set(s string) error {
+	if !strings.Contains(s, "=") {
+		return fmt.Errorf("want region=URL, got %q", s)
+	}
+	*p = append(*p, s)
+	return nil
+}
+
+// envOr returns the value of GO_CACHE_SERVER_<name>, or def if it is unset.
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv("GO_CACHE_SERVER_" + name); ok {
+		return v
+	}
+	return def
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix("[go-cache-server] ")
+
+	defaultDir, err := diskcache.DefaultDir()
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	addr := flag.String("addr", envOr("ADDR", ":8080"), "listen `address`")
+	dir := flag.String("dir", envOr("DIR", defaultDir), "cache `directory`")
+	certFile := flag.String("tls-cert", envOr("TLS_CERT", ""), "serve HTTPS with the PEM certificate in `file`")
+	keyFile := flag.String("tls-key", envOr("TLS_KEY", ""), "PEM private key `file` of -tls-cert")
+	drainDelay := flag.Duration("drain-delay", 5*time.Second, "on SIGTERM, fail readiness for `duration` before closing the listener")
+	drainTimeout := flag.Duration("drain-timeout", 20*time.Second, "on SIGTERM, wait up to `duration` for requests in flight")
+	adminToken := flag.String("admin-token", envOr("ADMIN_TOKEN", ""), "serve the admin API to clients presenting `token`")
+	proxyAddr := flag.String("goproxy-addr", envOr("GOPROXY_ADDR", ""), "also serve a Go module proxy on `address`")
+	proxyDir := flag.String("goproxy-dir", envOr("GOPROXY_DIR", ""), "module cache `directory` of -goproxy-addr (default <dir>/goproxy)")
+	proxyUpstream := flag.String("goproxy-upstream", envOr("GOPROXY_UPSTREAM", goproxy.DefaultUpstream), "module proxy `URL` fetched from by -goproxy-addr")
+	diskBudget := flag.Int64("disk-budget", 0, "keep the caches under `bytes` in total")
+	proxyShare := flag.Float64("goproxy-share", 0.25, "`fraction` of -disk-budget given to the module cache")
+	modCache := flag.String("gomodcache", envOr("GOMODCACHE", ""), "count the module cache in `directory` against -disk-budget")
+	retentionFile := flag.String("retention-policy", envOr("RETENTION_POLICY", ""), "delete the entries expired by the retention policy in `file`")
+	retentionInterval := flag.Duration("retention-interval", time.Hour, "apply -retention-policy every `duration`")
+	aclFile := flag.String("acl-policy", envOr("ACL_POLICY", ""), "authorize clients with the access control policy in `file`")
+	coldBucket := flag.String("cold-s3-bucket", envOr("COLD_S3_BUCKET", ""), "move the entries not got for -cold-after to the S3 `bucket`")
+	coldAfter := flag.Duration("cold-after", 7*24*time.Hour, "move the entries of -cold-s3-bucket after `duration` without a get")
+	coldClass := flag.String("cold-storage-class", envOr("COLD_STORAGE_CLASS", "STANDARD_IA"), "S3 storage `class` of the objects of -cold-s3-bucket")
+	quotaBytes := flag.Int64("quota", 0, "limit the entries of every namespace to `bytes`")
+	quotaPolicy := flag.String("quota-policy", envOr("QUOTA_POLICY", "reject"), "what puts over -quota do: reject or evict-oldest")
+	var peers peerFlags
+	flag.Var(&peers, "peer", "replicate to the server of another region, as `region=URL`; repeatable")
+	for _, name := range []string{"DRAIN_DELAY", "DRAIN_TIMEOUT", "DISK_BUDGET", "GOPROXY_SHARE", "RETENTION_INTERVAL", "COLD_AFTER", "QUOTA"} {
+		if v := envOr(name, ""); v != "" {
+			if err := flag.Set(strings.ToLower(strings.ReplaceAll(name, "_", "-")), v); err != nil {
+				log.Printf("invalid GO_CACHE_SERVER_%s: %v", name, err)
+				os.Exit(2)
+			}
+		}
+	}
+	if v := envOr("PEERS", ""); v != "" {
+		for _, p := range strings.Split(v, ",") {
+			if err := peers.Set(strings.TrimSpace(p)); err != nil {
+				log.Printf("invalid GO_CACHE_SERVER_PEERS: %v", err)
+				os.Exit(2)
+			}
+		}
+	}
+	flag.Parse()
+	if *proxyShare <= 0 || *proxyShare >= 1 {
+		log.Printf("invalid -goproxy-share %v: want a fraction between 0 and 1", *proxyShare)
+		os.Exit(2)
+	}
+	var policy *retention.Policy
+	if *retentionFile != "" {
+		if policy, err = retention.LoadPolicy(*retentionFile); err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	h, err := diskcache.NewExampleCacheHandler(
+		diskcache.WithDir(*dir),
+		diskcache.WithDiskWatchdog(1<<30, 30*time.Second, diskcache.EvictOldest),
+		diskcache.WithIndex(filepath.Join(*dir, "index"), time.Minute),
+	)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	defer h.Close()
+
+	var backend cache.Handler = diskHandler{h}
+
+	// Move the entries nobody gets to cheaper storage
+	if *coldBucket != "" {
+		t, store, err := newColdTier(h, *coldBucket, *coldClass, *dir)
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		defer t.Close()
+		backend = t
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go runColdTier(ctx, t, store, *coldAfter)
+		defer func() { log.Printf("cold tier stats: %+v", t.Stats()) }()
+	}
+
+	var repl *replicate.Replicator
+	if len(peers) > 0 {
+		var rp []replicate.Peer
+		for _, p := range peers {
+			region, u, _ := strings.Cut(p, "=")
+			c, err := httpcache.NewClient(u, nil, filepath.Join(*dir, "peers", region))
+			if err != nil {
+				log.Printf("unexpected error: %v", err)
+				os.Exit(1)
+			}
+			rp = append(rp, replicate.Peer{Region: region, Handler: c})
+		}
+		repl = replicate.New(rp, 10000, 30*time.Second)
+		backend = repl.Middleware()(backend)
+	}
+
+	// Charge puts to the quota of their namespace before they are stored
+	// or replicated
+	if *quotaBytes > 0 {
+		q, err := newQuota(h, *quotaBytes, *quotaPolicy)
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		backend = q.Middleware(quotaNamespace)(backend)
+	}
+
+	// Count the requests of every namespace, hits from peers included
+	tn := newTenants()
+	backend = tn.middleware()(backend)
+
+	// Accept compressed puts and compress responses for the clients that
+	// ask for it, see httpcompress
+	var handler http.Handler = httpcompress.Handler(httpcache.NewServer(backend, httpcache.WithManifest(h.WriteManifest), httpcache.WithObjects(h.ObjectPath)))
+	if *aclFile != "" {
+		p, err := acl.LoadPolicy(*aclFile)
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		handler = acl.HTTPMiddleware(p)(identityNamespace(handler))
+	}
+	if *adminToken != "" {
+		handler = (&admin{token: *adminToken, tenants: tn, cache: h, policy: policy}).handler(handler)
+	}
+
+	lc := &lifecycle{ready: h}
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           lc.handler(handler),
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnState:         lc.connState,
+	}
+
+	// Drain on SIGINT/SIGTERM, letting requests in flight finish
+	drained := make(chan error, 1)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		drained <- lc.drain(srv, *drainDelay, *drainTimeout)
+	}()
+
+	var budgets *budget.Manager
+	if *diskBudget > 0 {
+		budgets = budget.New(*diskBudget)
+		budgets.Add("build", h, 1-*proxyShare)
+		if *modCache != "" {
+			budgets.Add("gomodcache", budget.Dir(*modCache), 0)
+		}
+	}
+
+	var proxySrv *http.Server
+	if *proxyAddr != "" {
+		if *proxyDir == "" {
+			*proxyDir = filepath.Join(*dir, "goproxy")
+		}
+		ph, err := diskcache.NewExampleCacheHandler(
+			diskcache.WithDir(*proxyDir),
+			diskcache.WithDiskWatchdog(1<<30, 30*time.Second, diskcache.EvictOldest),
+		)
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		defer ph.Close()
+		if budgets != nil {
+			budgets.Add("modules", ph, *proxyShare)
+		}
+		proxy := goproxy.New(cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+			if r.Command == cache.CmdPut {
+				ph.HandlePut(ctx, w, r)
+			} else {
+				ph.HandleGet(ctx, w, r)
+			}
+		}), goproxy.WithUpstream(*proxyUpstream))
+		defer func() { log.Printf("module proxy stats: %+v", proxy.Stats()) }()
+
+		proxySrv = &http.Server{
+			Addr:              *proxyAddr,
+			Handler:           proxy,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Printf("serving module proxy %s on %s", *proxyDir, *proxyAddr)
+			if err := proxySrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("unexpected error: %v", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if budgets != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go budgets.Run(ctx, 30*time.Second)
+	}
+
+	if policy != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go runRetention(ctx, h, policy, *retentionInterval)
+	}
+
+	log.Printf("serving %s on %s", *dir, *addr)
+	if *certFile != "" {
+		err = srv.ListenAndServeTLS(*certFile, *keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	if err := <-drained; err != nil {
+		log.Printf("unexpected error: %v", err)
+	}
+	if proxySrv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := proxySrv.Shutdown(ctx); err != nil {
+			log.Printf("unexpected error: %v", err)
+		}
+	}
+
+	if repl != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := repl.Close(ctx); err != nil {
+			log.Printf("replication queue not drained: %v", err)
+		}
+		log.Printf("replication stats: %+v", repl.Stats())
+	}
+}
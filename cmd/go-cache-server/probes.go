@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// lifecycle answers the Kubernetes probes and drains the server on
+// shutdown.
+type lifecycle struct {
+	ready    cache.Pinger // checked by /readyz
+	draining atomic.Bool
+	conns    sync.Map // net.Conn -> http.ConnState of open connections
+}
+
+// handler serves /healthz and /readyz in front of next.
+//
+// /healthz reports that the process is alive and serving HTTP. /readyz
+// reports whether the server should receive traffic: it fails while
+// draining and when the cache directory is not writable, so that the
+// Service routes builders to other replicas instead of turning their
+// requests into errors.
+func (l *lifecycle) handler(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if l.draining.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := l.ready.Ping(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.Handle("/", next)
+	return mux
+}
+
+// connState tracks connections; set it as http.Server.ConnState.
+func (l *lifecycle) connState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		l.conns.Delete(c)
+	default:
+		l.conns.Store(c, state)
+	}
+}
+
+// open returns the number of open connections and of those with a request
+// in progress.
+func (l *lifecycle) open() (conns, active int) {
+	l.conns.Range(func(_, state any) bool {
+		conns++
+		if state == http.StateActive {
+			active++
+		}
+		return true
+	})
+	return conns, active
+}
+
+// drain shuts srv down gracefully. It first fails /readyz for delay, so
+// that Kubernetes removes the pod from the Service endpoints before new
+// connections stop being accepted, then waits up to timeout for requests
+// in flight, logging the open connections every second.
+func (l *lifecycle) drain(srv *http.Server, delay, timeout time.Duration) error {
+	l.draining.Store(true)
+	log.Printf("draining: failing readiness for %v", delay)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(ctx) }()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				conns, active := l.open()
+				log.Printf("drain timeout expired with %d connections open (%d active)", conns, active)
+				srv.Close()
+			}
+			return err
+		case <-ticker.C:
+			conns, active := l.open()
+			log.Printf("draining: %d connections open (%d active)", conns, active)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+	"github.com/hirasawayuki/go-cache-prog/quota"
+	"github.com/hirasawayuki/go-cache-prog/retention"
+)
+
+// newQuota returns a quota manager limiting every namespace of h to limit
+// bytes under policy, "reject" or "evict-oldest", charged with the entries
+// already in h.
+func newQuota(h *diskcache.LocalDiskCacheHandler, limit int64, policy string) (*quota.Manager, error) {
+	var p quota.Policy
+	switch policy {
+	case "reject":
+		p = quota.Reject
+	case "evict-oldest":
+		p = quota.EvictOldest
+	default:
+		return nil, fmt.Errorf("invalid quota policy %q, want reject or evict-oldest", policy)
+	}
+	m := quota.New(nil, limit, p, func(_, key string) error {
+		actionID, err := hex.DecodeString(key)
+		if err != nil {
+			return err
+		}
+		return h.RemoveEntry(actionID)
+	})
+	err := h.Entries(func(e manifest.Entry) error {
+		ns := e.Tags[retention.NamespaceTag]
+		if ns == "" {
+			ns = defaultNamespace
+		}
+		m.Track(ns, hex.EncodeToString(e.ActionID), e.Size)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to charge existing entries: %w", err)
+	}
+	return m, nil
+}
+
+// quotaNamespace returns the namespace the quota of a put is charged to.
+func quotaNamespace(ctx context.Context, _ *cache.Request) string {
+	return namespace(ctx)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+	"github.com/hirasawayuki/go-cache-prog/retention"
+)
+
+// applyRetention deletes the entries of h that policy no longer keeps.
+func applyRetention(h *diskcache.LocalDiskCacheHandler, policy *retention.Policy) (int, int64, error) {
+	now := time.Now()
+	return h.PruneEntries(func(e manifest.Entry) bool {
+		return policy.Expired(e, now)
+	})
+}
+
+// runRetention applies policy to h every interval until ctx is done.
+func runRetention(ctx context.Context, h *diskcache.LocalDiskCacheHandler, policy *retention.Policy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, freed, err := applyRetention(h, policy)
+		if err != nil {
+			log.Printf("retention policy failed: %v", err)
+		} else if n > 0 {
+			log.Printf("retention policy deleted %d entries, %d bytes", n, freed)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package credentials provides short-lived credentials to remote backends
+// and refreshes them in the background.
+//
+// Tokens issued by OIDC providers, STS or SAS generators typically expire
+// after an hour or less, while long test runs can keep the go command busy
+// for much longer. A Refresher renews its token ahead of expiry so that
+// requests late in a build don't start failing.
+package credentials
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token is a credential with an optional expiry.
+type Token struct {
+	Value string
+
+	// Expiry is when the token stops being valid. The zero value means the
+	// token does not expire.
+	Expiry time.Time
+
+	// AWS holds the access keys of the tokens of STSWebIdentitySource.
+	AWS *AWSKeys
+}
+
+// validFor reports whether t is still valid d from now.
+func (t Token) validFor(d time.Duration) bool {
+	return t.Value != "" && (t.Expiry.IsZero() || time.Until(t.Expiry) > d)
+}
+
+// Source fetches a fresh token.
+type Source interface {
+	Token(ctx context.Context) (Token, error)
+}
+
+// SourceFunc is a function type that implements the Source interface.
+type SourceFunc func(ctx context.Context) (Token, error)
+
+// Token calls the source function.
+func (f SourceFunc) Token(ctx context.Context) (Token, error) {
+	return f(ctx)
+}
+
+// StaticSource returns a Source that always returns value, which never
+// expires.
+func StaticSource(value string) Source {
+	return SourceFunc(func(ctx context.Context) (Token, error) {
+		return Token{Value: value}, nil
+	})
+}
+
+// FileSource returns a Source that reads the token from path on every
+// refresh, as with Kubernetes projected service account tokens that are
+// rotated on disk. If the token is a JWT its exp claim is used as the
+// expiry; otherwise the token is considered valid for ttl.
+func FileSource(path string, ttl time.Duration) Source {
+	return SourceFunc(func(ctx context.Context) (Token, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return Token{}, fmt.Errorf("failed to read token file: %w", err)
+		}
+		value := strings.TrimSpace(string(b))
+		expiry, ok := jwtExpiry(value)
+		if !ok && ttl > 0 {
+			expiry = time.Now().Add(ttl)
+		}
+		return Token{Value: value, Expiry: expiry}, nil
+	})
+}
+
+// GitHubActionsOIDCSource returns a Source that requests an OIDC ID token
+// for audience from the GitHub Actions token service. The job must have the
+// id-token: write permission, which makes the runner set the
+// ACTIONS_ID_TOKEN_REQUEST_URL and ACTIONS_ID_TOKEN_REQUEST_TOKEN variables.
+func GitHubActionsOIDCSource(client *http.Client, audience string) Source {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return SourceFunc(func(ctx context.Context) (Token, error) {
+		reqURL := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL")
+		reqToken := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+		if reqURL == "" || reqToken == "" {
+			return Token{}, errors.New("GitHub Actions OIDC is not available: ACTIONS_ID_TOKEN_REQUEST_URL is not set")
+		}
+		if audience != "" {
+			u, err := url.Parse(reqURL)
+			if err != nil {
+				return Token{}, fmt.Errorf("invalid token request URL: %w", err)
+			}
+			q := u.Query()
+			q.Set("audience", audience)
+			u.RawQuery = q.Encode()
+			reqURL = u.String()
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+		if err != nil {
+			return Token{}, fmt.Errorf("failed to create token request: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+reqToken)
+		res, err := client.Do(req)
+		if err != nil {
+			return Token{}, fmt.Errorf("failed to request token: %w", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return Token{}, fmt.Errorf("failed to request token: %s", res.Status)
+		}
+
+		var body struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			return Token{}, fmt.Errorf("failed to decode token response: %w", err)
+		}
+		expiry, _ := jwtExpiry(body.Value)
+		return Token{Value: body.Value, Expiry: expiry}, nil
+	})
+}
+
+// jwtExpiry returns the exp claim of a JWT without verifying it; the
+// verification is up to the service the token is presented to.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+const (
+	// DefaultMargin is how long before expiry a token is refreshed.
+	DefaultMargin = 5 * time.Minute
+
+	// retryInterval is the delay between attempts after a failed refresh.
+	retryInterval = 10 * time.Second
+)
+
+// Refresher caches the token of a Source and refreshes it in the background
+// before it expires. It is safe for concurrent use.
+type Refresher struct {
+	src    Source
+	margin time.Duration
+
+	mu    sync.Mutex
+	token Token
+	err   error // error of the last refresh
+
+	refreshMu sync.Mutex // serializes refreshes
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{} // closed when the background loop exits; nil until Start
+}
+
+// NewRefresher returns a Refresher for src that renews tokens margin before
+// they expire. A non-positive margin means DefaultMargin. Call Start to
+// refresh in the background; without it, tokens are refreshed on demand.
+func NewRefresher(src Source, margin time.Duration) *Refresher {
+	if margin <= 0 {
+		margin = DefaultMargin
+	}
+	return &Refresher{
+		src:    src,
+		margin: margin,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Token returns a valid token, fetching one if the cached token is missing
+// or about to expire.
+func (r *Refresher) Token(ctx context.Context) (Token, error) {
+	r.mu.Lock()
+	t := r.token
+	r.mu.Unlock()
+	if t.validFor(r.margin) {
+		return t, nil
+	}
+	return r.refresh(ctx)
+}
+
+// refresh fetches a new token unless a concurrent refresh already did.
+func (r *Refresher) refresh(ctx context.Context) (Token, error) {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+
+	r.mu.Lock()
+	t := r.token
+	r.mu.Unlock()
+	if t.validFor(r.margin) {
+		return t, nil
+	}
+
+	nt, err := r.src.Token(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+	if err != nil {
+		// Keep serving the old token while it is still valid at all.
+		if t.validFor(0) {
+			return t, nil
+		}
+		return Token{}, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	r.token = nt
+	return nt, nil
+}
+
+// Start refreshes the token in the background until Stop is called or ctx
+// is done. It fetches the first token synchronously and returns its error,
+// so that invalid configuration is reported at startup.
+func (r *Refresher) Start(ctx context.Context) error {
+	if _, err := r.Token(ctx); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	r.mu.Lock()
+	r.done = done
+	r.mu.Unlock()
+	go r.loop(ctx, done)
+	return nil
+}
+
+func (r *Refresher) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for {
+		r.mu.Lock()
+		t, failed := r.token, r.err != nil
+		r.mu.Unlock()
+		if t.Expiry.IsZero() {
+			return
+		}
+
+		wait := time.Until(t.Expiry) - r.margin
+		if failed {
+			wait = retryInterval
+		}
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-timer.C:
+			r.refresh(ctx)
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Stop stops the background refresh started by Start.
+func (r *Refresher) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+	r.mu.Lock()
+	done := r.done
+	r.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
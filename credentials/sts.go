@@ -0,0 +1,88 @@
+package credentials
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// AWSKeys are the access keys of a token issued by STS. The Value of the
+// token is their session token.
+type AWSKeys struct {
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// defaultSTSEndpoint is the global endpoint of AWS STS.
+const defaultSTSEndpoint = "https://sts.amazonaws.com"
+
+// STSWebIdentitySource returns a Source of temporary AWS keys, obtained by
+// exchanging the token of idToken, such as one of GitHubActionsOIDCSource
+// or FileSource, for a session of the role roleARN with the
+// AssumeRoleWithWebIdentity call of STS. Tokens carry the keys in their AWS
+// field. Requests go to AWS_ENDPOINT_URL_STS if set, or to the global STS
+// endpoint.
+func STSWebIdentitySource(client *http.Client, roleARN, sessionName string, idToken Source) Source {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return SourceFunc(func(ctx context.Context) (Token, error) {
+		id, err := idToken.Token(ctx)
+		if err != nil {
+			return Token{}, fmt.Errorf("failed to get web identity token: %w", err)
+		}
+		endpoint := os.Getenv("AWS_ENDPOINT_URL_STS")
+		if endpoint == "" {
+			endpoint = defaultSTSEndpoint
+		}
+		form := url.Values{
+			"Action":           {"AssumeRoleWithWebIdentity"},
+			"Version":          {"2011-06-15"},
+			"RoleArn":          {roleARN},
+			"RoleSessionName":  {sessionName},
+			"WebIdentityToken": {id.Value},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return Token{}, fmt.Errorf("failed to create STS request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := client.Do(req)
+		if err != nil {
+			return Token{}, fmt.Errorf("failed to assume role: %w", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+			return Token{}, fmt.Errorf("failed to assume role: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+		}
+
+		var body struct {
+			Credentials struct {
+				AccessKeyID     string    `xml:"AccessKeyId"`
+				SecretAccessKey string    `xml:"SecretAccessKey"`
+				SessionToken    string    `xml:"SessionToken"`
+				Expiration      time.Time `xml:"Expiration"`
+			} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+		}
+		if err := xml.NewDecoder(res.Body).Decode(&body); err != nil {
+			return Token{}, fmt.Errorf("failed to decode STS response: %w", err)
+		}
+		c := body.Credentials
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return Token{}, errors.New("STS response has no credentials")
+		}
+		return Token{
+			Value:  c.SessionToken,
+			Expiry: c.Expiration,
+			AWS:    &AWSKeys{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey},
+		}, nil
+	})
+}
@@ -0,0 +1,231 @@
+// Package etcd keeps the action entries of a cache in etcd, for build farms
+// that need strongly consistent metadata shared by every builder while the
+// objects live in a blob store:
+//
+//	idx := etcd.New([]string{"https://etcd-0:2379", "https://etcd-1:2379"}, "/go-cache/")
+//	c, err := s3.New("go-cache", store, s3.WithIndex(idx))
+//
+// A get that follows a put on another builder sees its entry, which an
+// eventually consistent bucket listing or KV store does not guarantee.
+// Entries are small, but every one is a key in etcd, whose database is
+// limited to a few GiB: use it for small to medium caches, and set TTL so
+// that old entries expire.
+//
+// The package talks to the JSON gateway of the etcd v3 API, so it needs no
+// gRPC dependency.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/s3"
+)
+
+// Index is an s3.Index storing entries in etcd. It is safe for concurrent
+// use.
+type Index struct {
+	// HTTPClient sends the requests; nil means http.DefaultClient. Set its
+	// TLS configuration for clusters with client certificates.
+	HTTPClient *http.Client
+
+	// Username and Password authenticate to clusters with authentication
+	// enabled.
+	Username, Password string
+
+	// TTL, if at least a second, expires entries that long after their put,
+	// through a lease shared by the puts of one TTL period.
+	TTL time.Duration
+
+	endpoints []string
+	prefix    string
+
+	mu        sync.Mutex
+	next      int // endpoint that answered last
+	token     string
+	lease     int64
+	leaseTill time.Time
+}
+
+// New returns an Index storing entries under prefix in the cluster
+// reachable at endpoints. Requests go to the first endpoint that answers.
+func New(endpoints []string, prefix string) *Index {
+	return &Index{endpoints: endpoints, prefix: prefix}
+}
+
+func (idx *Index) client() *http.Client {
+	if idx.HTTPClient != nil {
+		return idx.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Get implements s3.Index with a linearizable read.
+func (idx *Index) Get(ctx context.Context, key string) ([]byte, error) {
+	var res struct {
+		KVs []struct {
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := idx.call(ctx, "/v3/kv/range", map[string]any{"key": []byte(idx.prefix + key)}, &res); err != nil {
+		return nil, err
+	}
+	if len(res.KVs) == 0 {
+		return nil, s3.ErrNotFound
+	}
+	return res.KVs[0].Value, nil
+}
+
+// Put implements s3.Index.
+func (idx *Index) Put(ctx context.Context, key string, value []byte) error {
+	req := map[string]any{"key": []byte(idx.prefix + key), "value": value}
+	if idx.TTL >= time.Second {
+		lease, err := idx.grant(ctx)
+		if err != nil {
+			return err
+		}
+		req["lease"] = strconv.FormatInt(lease, 10)
+	}
+	return idx.call(ctx, "/v3/kv/put", req, nil)
+}
+
+// grant returns a lease expiring TTL from now, give or take a tenth of it.
+// Sharing leases keeps their number, which etcd tracks individually, low.
+func (idx *Index) grant(ctx context.Context) (int64, error) {
+	idx.mu.Lock()
+	lease, till := idx.lease, idx.leaseTill
+	idx.mu.Unlock()
+	if lease != 0 && time.Now().Before(till) {
+		return lease, nil
+	}
+	var res struct {
+		ID string `json:"ID"`
+	}
+	ttl := idx.TTL + idx.TTL/10
+	if err := idx.call(ctx, "/v3/lease/grant", map[string]any{"TTL": strconv.Itoa(int(ttl.Seconds()))}, &res); err != nil {
+		return 0, fmt.Errorf("failed to grant lease: %w", err)
+	}
+	id, err := strconv.ParseInt(res.ID, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lease ID %q", res.ID)
+	}
+	idx.mu.Lock()
+	idx.lease, idx.leaseTill = id, time.Now().Add(idx.TTL/10)
+	idx.mu.Unlock()
+	return id, nil
+}
+
+// call posts req to path on the first endpoint that answers,
+// authenticating first if needed, and decodes the answer into res.
+func (idx *Index) call(ctx context.Context, path string, req, res any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	first, token := idx.next, idx.token
+	idx.mu.Unlock()
+
+	var lastErr error
+	for i := range idx.endpoints {
+		n := (first + i) % len(idx.endpoints)
+		ep := idx.endpoints[n]
+		status, b, err := idx.post(ctx, ep, path, body, token)
+		if err == nil && status == http.StatusUnauthorized && idx.Username != "" {
+			// The token expired or was never issued.
+			if token, err = idx.authenticate(ctx, ep); err == nil {
+				status, b, err = idx.post(ctx, ep, path, body, token)
+			}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		idx.mu.Lock()
+		idx.next = n
+		idx.mu.Unlock()
+		if status != http.StatusOK {
+			return errorFromStatus(status, b)
+		}
+		if res == nil {
+			return nil
+		}
+		return json.Unmarshal(b, res)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no endpoints")
+	}
+	return cache.Errorf(cache.CodeUnavailable, "failed to reach etcd: %w", lastErr)
+}
+
+func (idx *Index) authenticate(ctx context.Context, endpoint string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"name": idx.Username, "password": idx.Password})
+	status, b, err := idx.post(ctx, endpoint, "/v3/auth/authenticate", body, "")
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", errorFromStatus(status, b)
+	}
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil || res.Token == "" {
+		return "", cache.Errorf(cache.CodePermissionDenied, "etcd returned no token")
+	}
+	idx.mu.Lock()
+	idx.token = res.Token
+	idx.mu.Unlock()
+	return res.Token, nil
+}
+
+func (idx *Index) post(ctx context.Context, endpoint, path string, body []byte, token string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	res, err := idx.client().Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	return res.StatusCode, b, err
+}
+
+// errorFromStatus returns the cache error for an etcd gateway error, whose
+// body is a JSON-encoded gRPC status.
+func errorFromStatus(status int, body []byte) error {
+	var e struct {
+		Message string `json:"message"`
+	}
+	msg := string(body)
+	if json.Unmarshal(body, &e) == nil && e.Message != "" {
+		msg = e.Message
+	}
+	code := cache.CodeInternal
+	switch {
+	case status == http.StatusBadRequest:
+		code = cache.CodeInvalidRequest
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		code = cache.CodePermissionDenied
+	case status == http.StatusGatewayTimeout:
+		code = cache.CodeTimeout
+	case status == http.StatusTooManyRequests, status >= 500:
+		code = cache.CodeUnavailable
+	}
+	return cache.Errorf(code, "etcd: %d: %s", status, msg)
+}
@@ -0,0 +1,113 @@
+package diskcache
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// WithAdmission enables a TinyLFU-style admission policy for puts. While the
+// cache volume has less than pressureFree bytes free, a put is only admitted
+// if its ActionID was requested before, so that objects built once and never
+// asked for again do not push out entries that keep getting hits. Declined
+// puts still store the object, because the go command needs its DiskPath,
+// but write no action file and mark the object as the oldest for eviction.
+//
+// Free space is sampled by the disk watchdog; without WithDiskWatchdog it is
+// checked every 30 seconds.
+func WithAdmission(pressureFree uint64) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.pressureFree = pressureFree
+		h.sketch = newSketch(1 << 16)
+	}
+}
+
+// sketchDepth is the number of rows of the frequency sketch.
+const sketchDepth = 4
+
+// sketch is a count-min sketch with small saturating counters that are
+// halved periodically, so that frequencies reflect recent activity. It is
+// safe for concurrent use.
+type sketch struct {
+	seed maphash.Seed
+
+	mu        sync.Mutex
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// newSketch returns a sketch with width counters per row. width must be a
+// power of two.
+func newSketch(width int) *sketch {
+	s := &sketch{
+		seed:    maphash.MakeSeed(),
+		mask:    uint64(width - 1),
+		resetAt: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// indexes returns the counter index of key in each row, using double
+// hashing of one 64-bit hash.
+func (s *sketch) indexes(key []byte) [sketchDepth]uint64 {
+	h := maphash.Bytes(s.seed, key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+// add records one occurrence of key.
+func (s *sketch) add(key []byte) {
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, j := range idx {
+		if s.rows[i][j] < 15 {
+			s.rows[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.halve()
+	}
+}
+
+// estimate returns an upper bound of the recent frequency of key.
+func (s *sketch) estimate(key []byte) uint8 {
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := uint8(15)
+	for i, j := range idx {
+		n = min(n, s.rows[i][j])
+	}
+	return n
+}
+
+// halve ages every counter.
+func (s *sketch) halve() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+// admit records a put of actionID and reports whether it should be cached.
+// The go command looks an action up before building it, so an action that
+// was requested once before has an estimate of at least two here.
+func (h *LocalDiskCacheHandler) admit(actionID []byte) bool {
+	if h.sketch == nil {
+		return true
+	}
+	h.sketch.add(actionID)
+	return !h.underPressure.Load() || h.sketch.estimate(actionID) > 2
+}
@@ -0,0 +1,42 @@
+package diskcache
+
+import (
+	"os"
+	"time"
+)
+
+// mtimeInterval is how stale an object's modification time may get before
+// a get updates it. Eviction orders objects by modification time rather
+// than access time, which is not maintained on filesystems mounted with
+// noatime; like the go command, gets only rewrite it once in a while.
+const mtimeInterval = time.Hour
+
+// markUsed records a hit on the entry e, whose object is at path.
+func (h *LocalDiskCacheHandler) markUsed(path string, e indexEntry) {
+	if h.noWrite {
+		return
+	}
+	if h.usage != nil {
+		h.usage.record(e.outputID, e.size)
+		return
+	}
+	h.touch(path)
+}
+
+// touch marks the object or entry file at path as used. Files touched by
+// this process within mtimeInterval are skipped without a stat, so that
+// gets answered from the index stay off the disk.
+func (h *LocalDiskCacheHandler) touch(path string) {
+	now := h.clock.Now()
+	if t, ok := h.touched.Load(path); ok && now.Sub(t.(time.Time)) < mtimeInterval {
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if now.Sub(fi.ModTime()) > mtimeInterval {
+		os.Chtimes(path, now, now)
+	}
+	h.touched.Store(path, now)
+}
@@ -0,0 +1,223 @@
+package diskcache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// bloomMagic starts a persisted Bloom filter, followed by the number of bits
+// and of hash functions as little-endian uint64s, then the bit words.
+const bloomMagic = "gocacheprog-bloom-v1\n"
+
+// WithBloomFilter keeps a Bloom filter over the ActionIDs in the cache
+// directory, sized for expected entries with a 1% false positive rate, so
+// that gets for entries that were never put are answered as misses without
+// touching the disk. The filter is saved to path on Close, merged with the
+// filter other processes saved, and loaded on startup; it is rebuilt from
+// the action files when path is missing or the filter is more than half
+// full. An entry the filter does not know, for example because the process
+// that put it crashed, costs one miss: the go command puts it again. The
+// filter is disabled with a layout that does not name action files after
+// their ActionID, such as some Templates, since it could not be rebuilt.
+func WithBloomFilter(path string, expected int) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.bloomPath = path
+		h.bloomExpected = expected
+	}
+}
+
+// bloom is a Bloom filter safe for concurrent use.
+type bloom struct {
+	words []atomic.Uint64
+	k     uint64
+}
+
+// newBloom returns a filter with a false positive rate of fpRate at n
+// entries.
+func newBloom(n int, fpRate float64) *bloom {
+	n = max(n, 1)
+	m := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	return &bloom{
+		words: make([]atomic.Uint64, (uint64(m)+63)/64),
+		k:     uint64(k),
+	}
+}
+
+// positions calls fn with the bit position of key for each hash function,
+// using double hashing. ActionIDs are SHA-256 hashes already, so their
+// bytes are used directly; shorter keys are hashed first.
+func (b *bloom) positions(key []byte, fn func(pos uint64) bool) {
+	if len(key) < 16 {
+		sum := sha256.Sum256(key)
+		key = sum[:]
+	}
+	h1 := binary.LittleEndian.Uint64(key)
+	h2 := binary.LittleEndian.Uint64(key[8:]) | 1
+	m := uint64(len(b.words)) * 64
+	for i := range b.k {
+		if !fn((h1 + i*h2) % m) {
+			return
+		}
+	}
+}
+
+func (b *bloom) add(key []byte) {
+	b.positions(key, func(pos uint64) bool {
+		b.words[pos/64].Or(1 << (pos % 64))
+		return true
+	})
+}
+
+// mayContain reports false if key was definitely never added.
+func (b *bloom) mayContain(key []byte) bool {
+	found := true
+	b.positions(key, func(pos uint64) bool {
+		found = b.words[pos/64].Load()&(1<<(pos%64)) != 0
+		return found
+	})
+	return found
+}
+
+// fill returns the fraction of bits set.
+func (b *bloom) fill() float64 {
+	set := 0
+	for i := range b.words {
+		set += bits.OnesCount64(b.words[i].Load())
+	}
+	return float64(set) / float64(len(b.words)*64)
+}
+
+// merge sets the bits set in the filter persisted at path, if it has the
+// same size as b.
+func (b *bloom) merge(path string) (bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to open bloom filter: %w", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, len(bloomMagic)+16)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(bloomMagic)]) != bloomMagic {
+		return false, nil
+	}
+	words := binary.LittleEndian.Uint64(header[len(bloomMagic):])
+	k := binary.LittleEndian.Uint64(header[len(bloomMagic)+8:])
+	if words != uint64(len(b.words)) || k != b.k {
+		return false, nil
+	}
+	buf := make([]byte, 8*words)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false, nil
+	}
+	for i := range b.words {
+		b.words[i].Or(binary.LittleEndian.Uint64(buf[8*i:]))
+	}
+	return true, nil
+}
+
+// save writes b to path.
+func (b *bloom) save(path string) error {
+	buf := make([]byte, 0, len(bloomMagic)+16+8*len(b.words))
+	buf = append(buf, bloomMagic...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(b.words)))
+	buf = binary.LittleEndian.AppendUint64(buf, b.k)
+	for i := range b.words {
+		buf = binary.LittleEndian.AppendUint64(buf, b.words[i].Load())
+	}
+	err := writeFileAtomic(path, func(f *os.File) error {
+		_, err := f.Write(buf)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save bloom filter: %w", err)
+	}
+	return nil
+}
+
+// loadBloom loads the filter saved at h.bloomPath, or builds it from the
+// action and entry files in the cache directory. It returns nil, disabling
+// the filter, if the layout does not name action files by their ActionID,
+// since the filter could then not be rebuilt.
+func (h *LocalDiskCacheHandler) loadBloom() (*bloom, error) {
+	sample := make([]byte, 32)
+	if _, ok := h.actionIDOf(h.getActionPath(sample)); !ok {
+		log.Printf("Bloom filter disabled: layout %T does not name action files by their ActionID", h.layout)
+		return nil, nil
+	}
+	b := newBloom(h.bloomExpected, 0.01)
+	ok, err := b.merge(h.bloomPath)
+	if err != nil {
+		return nil, err
+	}
+	if ok && b.fill() <= 0.5 {
+		return b, nil
+	}
+
+	b = newBloom(h.bloomExpected, 0.01)
+	err = filepath.WalkDir(h.cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if actionID, ok := h.actionIDOf(path); ok {
+			b.add(actionID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build bloom filter: %w", err)
+	}
+	log.Printf("Built bloom filter from %s (%.1f%% full)", h.cacheDir, 100*b.fill())
+	return b, nil
+}
+
+// actionIDOf returns the ActionID of the action or entry file at path, if
+// path is where the layout puts the file of that ActionID.
+func (h *LocalDiskCacheHandler) actionIDOf(path string) ([]byte, bool) {
+	name := filepath.Base(path)
+	for _, suffix := range []string{actionFileSuffix, entryFileSuffix} {
+		hexID, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		actionID, err := hex.DecodeString(hexID)
+		if err != nil || len(actionID) == 0 {
+			continue
+		}
+		if path == h.getActionPath(actionID) || path == h.getEntryPath(actionID) {
+			return actionID, true
+		}
+	}
+	return nil, false
+}
+
+// saveBloom merges the filter saved by other processes into h.bloom and
+// saves the result, holding the cache directory lock exclusively so that
+// concurrent saves do not drop each other's entries.
+func (h *LocalDiskCacheHandler) saveBloom() error {
+	if err := h.lock.Lock(); err != nil {
+		return err
+	}
+	defer h.lock.Unlock()
+	if _, err := h.bloom.merge(h.bloomPath); err != nil {
+		return err
+	}
+	return h.bloom.save(h.bloomPath)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/httpcache"
+	"github.com/hirasawayuki/go-cache-prog/layout"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+	"github.com/hirasawayuki/go-cache-prog/retention"
+	"github.com/hirasawayuki/go-cache-prog/s3"
+	"github.com/hirasawayuki/go-cache-prog/warm"
+)
+
+// copyMain implements the copy subcommand, which copies the entries of a
+// backend into another, for example to fill a new backend before switching
+// to it. Entries are read from a cache directory, a snapshot directory, a
+// go-cache-server URL or an s3://bucket/prefix, and written to a cache
+// directory, a go-cache-server URL or an s3://bucket/prefix, through the
+// put handler of the destination.
+func copyMain(args []string) {
+	fs := flag.NewFlagSet("copy", flag.ExitOnError)
+	from := fs.String("from", "", "`backend` to copy from: a cache or snapshot directory, a go-cache-server URL or s3://bucket/prefix")
+	to := fs.String("to", "", "`backend` to copy to: a cache directory, a go-cache-server URL or s3://bucket/prefix")
+	maxAge := fs.Duration("max-age", 0, "copy only the entries put within `duration`")
+	namespace := fs.String("namespace", "", "copy only the entries put in the namespaces matching `pattern`")
+	concurrency := fs.Int("concurrency", 16, "number of parallel copies")
+	fs.Parse(args)
+	if *from == "" || *to == "" {
+		log.Printf("copy: -from and -to are required")
+		os.Exit(2)
+	}
+
+	f := &filteredSource{namespace: *namespace}
+	if *maxAge > 0 {
+		f.since = time.Now().Add(-*maxAge)
+	}
+	if err := copyEntries(*from, *to, f, *concurrency); err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+}
+
+// copyEntries copies the entries of the backend at from that f lets
+// through to the backend at to. It returns before copyMain exits, so that
+// the temporary directories of the backends are removed.
+func copyEntries(from, to string, f *filteredSource, concurrency int) error {
+	src, closeSrc, err := copySource(from)
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
+	dst, closeDst, err := copyDestination(to)
+	if err != nil {
+		return err
+	}
+	defer closeDst()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	f.Source = src
+	stats, err := warm.Run(ctx, f, dst, concurrency)
+	log.Printf("copied %d entries (%d bytes) from %s to %s, %d failed", stats.Entries, stats.Bytes, from, to, stats.Failed)
+	return err
+}
+
+// copySource returns the source of the entries of the backend at loc.
+// Cache directories are opened read-only.
+func copySource(loc string) (warm.Source, func(), error) {
+	if u, err := url.Parse(loc); err == nil && u.Scheme == "s3" {
+		c, err := s3.New(u.Host, nil, s3Layout(u))
+		if err != nil {
+			return nil, nil, err
+		}
+		return s3Source{c}, func() {}, nil
+	}
+	if isURL(loc) {
+		src, err := warm.ParseSource(loc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if src.(*warm.HTTPSource).Client, err = httpClient(); err != nil {
+			return nil, nil, err
+		}
+		return src, func() {}, nil
+	}
+	if _, err := os.Stat(filepath.Join(loc, manifest.FileName)); err == nil {
+		return warm.DirSource(loc), func() {}, nil
+	}
+	h, err := diskcache.NewExampleCacheHandler(diskcache.WithDir(loc), diskcache.WithReadOnly())
+	if err != nil {
+		return nil, nil, err
+	}
+	return diskSource{h}, func() { h.Close() }, nil
+}
+
+// copyDestination returns the handler storing entries in the backend at loc.
+func copyDestination(loc string) (cache.Handler, func(), error) {
+	u, err := url.Parse(loc)
+	switch {
+	case err == nil && u.Scheme == "s3":
+		// The client uploads objects from its store, which only stages
+		// them: each object is removed once its entry is copied.
+		dir, err := os.MkdirTemp("", "copy-s3-")
+		if err != nil {
+			return nil, nil, err
+		}
+		store, err := castore.New(dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, nil, err
+		}
+		c, err := s3.New(u.Host, store, s3Layout(u))
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, nil, err
+		}
+		return stagedHandler{c, store}, func() { os.RemoveAll(dir) }, nil
+	case isURL(loc):
+		client, err := httpClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		dir, err := os.MkdirTemp("", "copy-http-")
+		if err != nil {
+			return nil, nil, err
+		}
+		c, err := httpcache.NewClient(loc, client, dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, nil, err
+		}
+		return stagedHandler{c, c.Store()}, func() { os.RemoveAll(dir) }, nil
+	default:
+		h, err := diskcache.NewExampleCacheHandler(append(signingOptions(), diskcache.WithDir(loc))...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cache.HandlerFunc(h.HandlePut), func() { h.Close() }, nil
+	}
+}
+
+// s3Layout returns the layout of the entries under the prefix of an
+// s3://bucket/prefix URL.
+func s3Layout(u *url.URL) s3.Option {
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		return s3.WithLayout(layout.Default{})
+	}
+	return s3.WithLayout(layout.Prefixed{Prefix: prefix, Layout: layout.Default{}})
+}
+
+// stagedHandler removes the objects h stages in store once their put is
+// done, so that a copy does not keep a second copy of every object on
+// disk.
+type stagedHandler struct {
+	h     cache.Handler
+	store *castore.Store
+}
+
+func (s stagedHandler) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	s.store.Acquire(r.OutputID)
+	s.h.Handle(ctx, w, r)
+	s.store.Release(r.OutputID)
+	if err := s.store.Remove(r.OutputID); err != nil {
+		cache.LoggerFromContext(ctx).Warn("failed to remove staged object", "error", err)
+	}
+}
+
+// s3Source serves the entries of a bucket as a snapshot.
+type s3Source struct {
+	c *s3.Client
+}
+
+func (s s3Source) Open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	if name == manifest.FileName {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(s.c.WriteManifest(ctx, pw))
+		}()
+		return pr, -1, nil
+	}
+	outputID, err := objectName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.c.OpenObject(ctx, outputID)
+}
+
+func isURL(loc string) bool {
+	return strings.HasPrefix(loc, "http://") || strings.HasPrefix(loc, "https://")
+}
+
+// diskSource serves a cache directory as a snapshot.
+type diskSource struct {
+	h *diskcache.LocalDiskCacheHandler
+}
+
+func (s diskSource) Open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	if name == manifest.FileName {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(s.h.WriteManifest(pw))
+		}()
+		return pr, -1, nil
+	}
+	outputID, err := objectName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(s.h.ObjectPath(outputID))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// objectName returns the OutputID of the object file at name in a
+// snapshot.
+func objectName(name string) ([]byte, error) {
+	hexID, ok := strings.CutPrefix(name, "objects/")
+	if !ok {
+		return nil, fmt.Errorf("no file %s in snapshot", name)
+	}
+	outputID, err := hex.DecodeString(hexID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object name %s", name)
+	}
+	return outputID, nil
+}
+
+// filteredSource is a snapshot whose manifest lists only the entries put
+// since a time in the namespaces matching a pattern.
+type filteredSource struct {
+	warm.Source
+	since     time.Time
+	namespace string
+}
+
+func (s *filteredSource) Open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	rc, size, err := s.Source.Open(ctx, name)
+	if err != nil || name != manifest.FileName || (s.since.IsZero() && s.namespace == "") {
+		return rc, size, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer rc.Close()
+		pw.CloseWithError(s.filter(rc, pw))
+	}()
+	return pr, -1, nil
+}
+
+// filter copies the manifest in r to w, without the entries filtered out.
+func (s *filteredSource) filter(r io.Reader, w io.Writer) error {
+	mr, err := manifest.NewReader(r)
+	if err != nil {
+		return err
+	}
+	mw, err := manifest.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	for {
+		e, err := mr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !s.since.IsZero() && e.Time.Before(s.since) {
+			continue
+		}
+		if s.namespace != "" {
+			if ok, _ := path.Match(s.namespace, e.Tags[retention.NamespaceTag]); !ok {
+				continue
+			}
+		}
+		if err := mw.Write(e); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/gocache"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+// exportMain implements the export subcommand, which copies the entries of
+// the cache directory into the go command's native cache directory, so that
+// unsetting GOCACHEPROG keeps the cache warm.
+func exportMain(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	to := fs.String("to", "", "native cache `directory` to write (default: GOCACHE)")
+	concurrency := fs.Int("concurrency", 8, "number of parallel copies")
+	fs.Parse(args)
+
+	if *to == "" {
+		dir, err := gocache.Dir()
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		*to = dir
+	}
+
+	h, err := diskcache.NewExampleCacheHandler(signingOptions()...)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	defer h.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Stream the list of entries instead of holding it in memory
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(h.WriteManifest(pw))
+	}()
+	mr, err := manifest.NewReader(pr)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+
+	stats, err := gocache.Export(ctx, *to, cache.HandlerFunc(h.HandleGet), mr, *concurrency)
+	pr.Close()
+	log.Printf("exported %d entries (%d bytes) to %s, %d skipped, %d failed", stats.Entries, stats.Bytes, *to, stats.Skipped, stats.Failed)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+}
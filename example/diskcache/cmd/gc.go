@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+)
+
+// gcMain implements the gc subcommand, which deletes the objects no entry
+// refers to. Run it between builds: the objects of puts that were not
+// admitted have no entry, but the build that put them may still read them.
+func gcMain(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dir := fs.String("dir", "", "cache `directory` to collect (default: the directory the server uses)")
+	grace := fs.Duration("grace", time.Hour, "keep the files modified within `duration`")
+	xattr := fs.Bool("xattr", false, "the cache stores entries in extended attributes, see the -xattr flag of the server")
+	fs.Parse(args)
+
+	opts := []diskcache.Option{}
+	if *dir != "" {
+		opts = append(opts, diskcache.WithDir(*dir))
+	}
+	if *xattr {
+		opts = append(opts, diskcache.WithXattrMetadata())
+	}
+	h, err := diskcache.NewExampleCacheHandler(opts...)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	defer h.Close()
+
+	n, freed, err := h.CollectGarbage(*grace)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	log.Printf("deleted %d unreferenced files, %d bytes", n, freed)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/gocache"
+)
+
+// importMain implements the import subcommand, which copies the entries of
+// the go command's native cache directory into the cache directory, so that
+// switching to GOCACHEPROG doesn't start from a cold cache.
+func importMain(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	from := fs.String("from", "", "native cache `directory` to import (default: GOCACHE)")
+	concurrency := fs.Int("concurrency", 8, "number of parallel copies")
+	fs.Parse(args)
+
+	if *from == "" {
+		dir, err := gocache.Dir()
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		*from = dir
+	}
+
+	h, err := diskcache.NewExampleCacheHandler(signingOptions()...)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	defer h.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	stats, err := gocache.Import(ctx, *from, cache.HandlerFunc(h.HandlePut), *concurrency)
+	log.Printf("imported %d entries (%d bytes) from %s, %d skipped, %d failed", stats.Entries, stats.Bytes, *from, stats.Skipped, stats.Failed)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+}
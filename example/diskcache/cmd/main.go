@@ -1,39 +1,330 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/hirasawayuki/go-cache-prog/actiongraph"
 	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/cachetest"
+	"github.com/hirasawayuki/go-cache-prog/chaos"
 	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/httpcache"
+	"github.com/hirasawayuki/go-cache-prog/latency"
+	"github.com/hirasawayuki/go-cache-prog/mirror"
+	"github.com/hirasawayuki/go-cache-prog/signing"
+	"github.com/hirasawayuki/go-cache-prog/slo"
 )
 
+var (
+	listenAddr = flag.String("listen", "", "serve on a Unix socket or TCP `address` (unix:/path or tcp:host:port) instead of stdio; connect with cmd/cacheshim")
+	remoteURL  = flag.String("remote", "", "store entries on the go-cache-server at `URL` instead of the local cache directory")
+	spoolDir   = flag.String("spool", "", "receive put bodies in `dir`, e.g. on a tmpfs, before moving them into the cache directory")
+	xattrMeta  = flag.Bool("xattr", false, "store entries as single files with their metadata in extended attributes (Linux)")
+	minFree    = flag.Uint64("min-free", 0, "evict the least recently used objects while less than `bytes` are free on the cache volume")
+	admission  = flag.Uint64("admission", 0, "with -listen, cache only the objects of actions requested before while less than `bytes` are free")
+	logMisses  = flag.Bool("log-misses", false, "log every miss of an entry that was put, with its cause")
+	logSample  = flag.Float64("log-sample", 1, "log this `fraction` of the requests, plus those that fail or take over a second")
+	mirrorURL  = flag.String("mirror", "", "also store entries on the go-cache-server at `URL`, and copy the entries got into it, to migrate to it")
+	mirrorRead = flag.Bool("mirror-read", false, "get entries from -mirror first, and from the cache it migrates from on a miss")
+	recordFile = flag.String("record", "", "append every request of the session to `file`, for cmd/cachereport and cmd/cachebench")
+	tags       = make(map[string]string)
+)
+
+func init() {
+	flag.Func("tag", "attach the tag `key=value`, such as branch=main, to the entries put; may be repeated", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || k == "" {
+			return errors.New("want key=value")
+		}
+		tags[k] = v
+		return nil
+	})
+}
+
 func main() {
 	log.SetOutput(os.Stderr)
 	log.SetPrefix("[go-cache-prog] ")
 
+	// Subcommands run once and exit instead of serving
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "warm": // seed the cache from a snapshot: warm -from DIR|URL|s3://BUCKET/PREFIX
+			warmMain(os.Args[2:])
+			return
+		case "migrate": // upgrade the cache directory layout: migrate [-dir DIR]
+			migrateMain(os.Args[2:])
+			return
+		case "import": // copy entries from the native cache: import [-from GOCACHE]
+			importMain(os.Args[2:])
+			return
+		case "export": // copy entries to the native cache: export [-to GOCACHE]
+			exportMain(os.Args[2:])
+			return
+		case "gc": // delete unreferenced objects: gc [-dir DIR] [-grace 1h]
+			gcMain(os.Args[2:])
+			return
+		case "copy": // copy entries between backends: copy -from DIR|URL -to DIR|URL|s3://BUCKET
+			copyMain(os.Args[2:])
+			return
+		}
+	}
+	flag.Parse()
+
+	// Evict the least recently used objects when the cache volume runs low,
+	// sparing those handed to a build that is still running
+	var handlerOpts []diskcache.Option
+	if *minFree > 0 {
+		handlerOpts = append(handlerOpts, diskcache.WithDiskWatchdog(*minFree, 30*time.Second, diskcache.EvictOldest))
+	}
+
+	// In daemon mode, stop caching one-off objects when the volume runs
+	// low. The admission sketch lives in memory, so a process serving a
+	// single go command would never see an action requested twice.
+	if *admission > 0 {
+		if *listenAddr == "" {
+			log.Printf("-admission requires -listen")
+			os.Exit(2)
+		}
+		handlerOpts = append(handlerOpts, diskcache.WithAdmission(*admission))
+	}
+
+	// Answer gets for entries that were never put without touching the disk
+	cacheDir, err := diskcache.DefaultDir()
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	handlerOpts = append(handlerOpts, diskcache.WithBloomFilter(filepath.Join(cacheDir, "bloom"), 1<<20))
+
+	// Record object uses in a journal, so trimming works on noatime mounts
+	// without stat-ing every file
+	handlerOpts = append(handlerOpts, diskcache.WithUsageJournal(filepath.Join(cacheDir, "used")))
+
+	// Sign entries when a key is configured, so that unsigned entries are misses
+	handlerOpts = append(handlerOpts, signingOptions()...)
+
+	// Receive bodies on a faster volume than the cache directory
+	if *spoolDir != "" {
+		handlerOpts = append(handlerOpts, diskcache.WithSpoolDir(*spoolDir))
+	}
+
+	// Halve the files of the cache on filesystems with extended attributes
+	if *xattrMeta {
+		handlerOpts = append(handlerOpts, diskcache.WithXattrMetadata())
+	}
+
+	// Explain the misses of entries that were put, which waste build time
+	if *logMisses {
+		handlerOpts = append(handlerOpts, diskcache.WithMissLogging())
+	}
+
+	// In daemon mode, keep the ActionID index in memory across builds
+	if *listenAddr != "" {
+		indexPath := filepath.Join(cacheDir, "index")
+		handlerOpts = append(handlerOpts, diskcache.WithIndex(indexPath, time.Minute))
+	}
+
 	// Initialize the disk cache handler which implements the cache operations
-	h, err := diskcache.NewExampleCacheHandler()
+	h, err := diskcache.NewExampleCacheHandler(handlerOpts...)
 	if err != nil {
 		log.Printf("unexpected error: %v", err)
 		os.Exit(1)
 	}
 
-	// Register the logging middleware to record request/response details
-	cache.Use(diskcache.LoggingMiddleware())
+	// Name the package and action of every request in logs and in the
+	// gocacheprog_actions expvar, from the action graph written by
+	// go build -debug-actiongraph at the path in GOCACHEPROG_ACTIONGRAPH
+	if path := os.Getenv("GOCACHEPROG_ACTIONGRAPH"); path != "" {
+		annotator := actiongraph.NewAnnotator(path)
+		cache.Use(annotator.Middleware())
+		expvar.Publish("gocacheprog_actions", expvar.Func(func() any { return annotator.Stats() }))
+	}
+
+	// Register the logging middleware to record request/response details,
+	// of a sample of the requests on large builds
+	cache.Use(diskcache.LoggingMiddleware(diskcache.WithLogSampling(*logSample, time.Second)))
+
+	// Record the requests of the session, to attribute hits and misses to
+	// packages afterwards
+	if *recordFile != "" {
+		f, err := os.OpenFile(*recordFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		cache.Use(cachetest.RecordMiddleware(f))
+	}
+
+	// Tag the entries put, e.g. with the branch, for retention policies
+	if len(tags) > 0 {
+		cache.Use(cache.TagMiddleware(tags))
+	}
+
+	// Collect per-command latency histograms for the end-of-build report
+	latencies := latency.NewRecorder()
+	cache.Use(latencies.Middleware())
+
+	// Check hit rate and latency objectives set in GOCACHEPROG_SLO_* variables
+	objectives, err := slo.FromEnv("GOCACHEPROG")
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	cache.Use(slo.New(objectives).Middleware())
+
+	// Inject faults set in GOCACHEPROG_CHAOS_* variables, in staging CI only
+	faults, err := chaos.FromEnv("GOCACHEPROG")
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	if faults.Enabled() {
+		cache.Use(chaos.Middleware(faults))
+	}
 
 	// Register handlers for each of the GOCACHEPROG commands
+	var backend cache.Handler = cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+		if r.Command == cache.CmdGet {
+			h.HandleGet(ctx, w, r)
+		} else {
+			h.HandlePut(ctx, w, r)
+		}
+	})
 	cache.HandleGetFunc(h.HandleGet)
 	cache.HandlePutFunc(h.HandlePut)
 	cache.HandleCloseFunc(h.HandleClose)
 
+	// Or store entries on a shared cache server, keeping the downloaded
+	// objects next to the cache directory and accounting them to the team
+	// named in GOCACHEPROG_NAMESPACE
+	if *remoteURL != "" {
+		client, err := httpClient()
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		remote, err := httpcache.NewClient(*remoteURL, client, filepath.Join(cacheDir, "remote"),
+			httpcache.WithNamespace(os.Getenv("GOCACHEPROG_NAMESPACE")))
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		cache.HandleGetFunc(remote.Handle)
+		cache.HandlePutFunc(remote.Handle)
+		backend = remote
+	}
+
+	// While migrating to another cache server, store entries on both and
+	// copy those the builds get into the new one, until it can be switched to
+	var m *mirror.Mirror
+	if *mirrorURL != "" {
+		client, err := httpClient()
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		target, err := httpcache.NewClient(*mirrorURL, client, filepath.Join(cacheDir, "mirror"),
+			httpcache.WithNamespace(os.Getenv("GOCACHEPROG_NAMESPACE")))
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		mirrorOpts := []mirror.Option{mirror.WithBackfill(4)}
+		if *mirrorRead {
+			mirrorOpts = append(mirrorOpts, mirror.WithReadNew())
+		}
+		m = mirror.New(backend, target, mirrorOpts...)
+		cache.HandleGetFunc(m.Handle)
+		cache.HandlePutFunc(m.Handle)
+	}
+
+	// Server options shared by both transports
+	opts := []cache.ServerOption{
+		cache.WithConcurrency(4),                            // default: 6
+		cache.WithPutConcurrency(2),                         // leave room for gets
+		cache.WithResponseTimeout(10 * time.Second),         // default: 30 * time.Second
+		cache.WithMaxBodySize(256<<20, cache.OversizeSpool), // hold bodies over 256 MiB in temporary files
+		cache.WithObjectIDCompat(),                          // accept requests from Go 1.21-1.23
+		cache.WithStartupProbe(h, cache.ProbeFailOpen),      // serve uncached if the cache directory is unusable
+		cache.WithOutputIDCheck(cache.OutputIDCheckReject),  // never store a body corrupted in transport
+	}
+
+	// Serve many go commands from one long-lived process over a socket
+	if *listenAddr != "" {
+		l, err := cache.Listen(*listenAddr)
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+
+		// Stop accepting connections on SIGINT/SIGTERM, fail the requests in
+		// flight rather than wait for hung backends, and persist the index
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			l.Close()
+			if n := cache.CancelInflight(); n > 0 {
+				log.Printf("canceled %d in-flight requests", n)
+			}
+		}()
+
+		if err := cache.ServeListener(l, opts...); err != nil {
+			log.Printf("unexpected error: %v", err)
+		}
+		log.Printf("server stats: %+v", cache.Stats())
+		log.Printf("disk cache misses: %+v", h.Misses())
+		logMirror(m)
+		latencies.Report(os.Stderr)
+		if err := h.Close(); err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Start the cache server with server options
-	if err := cache.Serve(
-		cache.WithConcurrency(4),                  // default: 6
-		cache.WithResponseTimeout(10*time.Second), // default: 30 * time.Second
-	); err != nil {
+	err = cache.Serve(opts...)
+	log.Printf("server stats: %+v", cache.Stats())
+	log.Printf("disk cache misses: %+v", h.Misses())
+	logMirror(m)
+	latencies.Report(os.Stderr)
+	if cerr := h.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
 		log.Printf("unexpected error: %v", err)
 		os.Exit(1)
 	}
 }
+
+// logMirror waits for the backfills of m in flight and logs its stats, if
+// there is a mirror.
+func logMirror(m *mirror.Mirror) {
+	if m == nil {
+		return
+	}
+	m.Wait()
+	log.Printf("mirror stats: %+v", m.Stats())
+}
+
+// signingOptions returns the option enabling entry signing when
+// GOCACHEPROG_SIGNING_KEY is set.
+func signingOptions() []diskcache.Option {
+	key := os.Getenv("GOCACHEPROG_SIGNING_KEY")
+	if key == "" {
+		return nil
+	}
+	return []diskcache.Option{diskcache.WithSigner(signing.NewHMAC([]byte(key)))}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+)
+
+// migrateMain implements the migrate subcommand, which upgrades a cache
+// directory to the current layout ahead of time. The server also migrates
+// on startup; running it separately keeps the upgrade out of a build.
+func migrateMain(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dir := fs.String("dir", "", "cache `directory` to migrate (default: the directory the server uses)")
+	fs.Parse(args)
+
+	if *dir == "" {
+		d, err := diskcache.DefaultDir()
+		if err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+		*dir = d
+	}
+
+	from, err := diskcache.Migrate(*dir)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	log.Printf("cache directory %s migrated from layout version %d", *dir, from)
+}
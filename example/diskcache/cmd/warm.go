@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/httpcompress"
+	"github.com/hirasawayuki/go-cache-prog/httpconfig"
+	"github.com/hirasawayuki/go-cache-prog/s3"
+	"github.com/hirasawayuki/go-cache-prog/tlsconfig"
+	"github.com/hirasawayuki/go-cache-prog/warm"
+)
+
+// warmMain implements the warm subcommand, which downloads the entries of a
+// snapshot into the cache directory before a build starts.
+func warmMain(args []string) {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	from := fs.String("from", "", "snapshot `location`: a directory, an http(s) URL or s3://bucket/prefix")
+	concurrency := fs.Int("concurrency", 16, "number of parallel downloads")
+	fs.Parse(args)
+	if *from == "" {
+		log.Printf("warm: -from is required")
+		os.Exit(2)
+	}
+
+	src, err := warmSource(*from)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	if hs, ok := src.(*warm.HTTPSource); ok {
+		// Tune the transport and TLS with GOCACHEPROG_HTTP_* and
+		// GOCACHEPROG_TLS_* variables
+		if hs.Client, err = httpClient(); err != nil {
+			log.Printf("unexpected error: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	h, err := diskcache.NewExampleCacheHandler(signingOptions()...)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+	defer h.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	stats, err := warm.Run(ctx, src, cache.HandlerFunc(h.HandlePut), *concurrency)
+	log.Printf("warmed %d entries (%d bytes), %d failed", stats.Entries, stats.Bytes, stats.Failed)
+	if err != nil {
+		log.Printf("unexpected error: %v", err)
+		os.Exit(1)
+	}
+}
+
+// warmSource returns the snapshot at from. Snapshots in S3 are read with
+// the AWS_* environment variables, see s3.New.
+func warmSource(from string) (warm.Source, error) {
+	u, err := url.Parse(from)
+	if err != nil || u.Scheme != "s3" {
+		return warm.ParseSource(from)
+	}
+	c, err := s3.New(u.Host, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Snapshot(strings.TrimPrefix(u.Path, "/")), nil
+}
+
+// httpClient returns the client for network sources, configured from the
+// GOCACHEPROG_HTTP_* and GOCACHEPROG_TLS_* variables. With
+// GOCACHEPROG_TOKEN, requests present it as a bearer token, as a
+// go-cache-server with an access control policy requires. With
+// GOCACHEPROG_HTTP_COMPRESS=1, bodies are compressed on the wire, which
+// the server must support, as go-cache-server does; see httpcompress.
+func httpClient() (*http.Client, error) {
+	opts, err := httpconfig.FromEnv("GOCACHEPROG")
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsconfig.FromEnv("GOCACHEPROG").Config()
+	if err != nil {
+		return nil, err
+	}
+	client := opts.Client(tlsConfig)
+	if compress, _ := strconv.ParseBool(os.Getenv("GOCACHEPROG_HTTP_COMPRESS")); compress {
+		client.Transport = &httpcompress.Transport{Base: client.Transport}
+	}
+	if token := os.Getenv("GOCACHEPROG_TOKEN"); token != "" {
+		client.Transport = bearerTransport{token: token, next: client.Transport}
+	}
+	return client, nil
+}
+
+// bearerTransport authenticates requests with a bearer token.
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(req)
+}
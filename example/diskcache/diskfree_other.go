@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package diskcache
+
+import "errors"
+
+// freeSpace is not implemented on this platform, which disables the disk
+// space watchdog.
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,151 @@
+package diskcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/clock"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+// WithMaxEntryAge treats entries put more than maxAge ago as misses, like
+// the go command's own cache does with the Time of entries, and deletes
+// their action files so that the next build puts them again. Their
+// objects may be shared and are left to eviction.
+func WithMaxEntryAge(maxAge time.Duration) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.maxEntryAge = maxAge
+	}
+}
+
+// expired reports whether e is older than the maximum entry age.
+func (h *LocalDiskCacheHandler) expired(e indexEntry) bool {
+	return h.maxEntryAge > 0 && clock.Since(h.clock, e.time) > h.maxEntryAge
+}
+
+// expire answers r, whose entry e expired, with a miss and removes the
+// entry unless a concurrent put replaced it.
+func (h *LocalDiskCacheHandler) expire(ctx context.Context, w cache.ResponseWriter, r *cache.Request, e indexEntry) {
+	h.miss(w, r, missExpired, "put at "+e.time.Format(time.RFC3339))
+
+	mu := h.actionLock(r.ActionID)
+	mu.Lock()
+	defer mu.Unlock()
+	if h.index != nil {
+		h.index.remove(r.ActionID, e)
+	}
+	cur, err := h.readActionFile(r.ActionID)
+	if err != nil || !cur.time.Equal(e.time) {
+		return
+	}
+	if h.xattr {
+		// The entry file holds the object, which no other action shares.
+		removeFile(h.getEntryPath(r.ActionID))
+		return
+	}
+	removeFile(h.getActionPath(r.ActionID))
+}
+
+// RemoveEntry deletes the entry of actionID, for example when a quota
+// evicts it. Like those of expired entries, its object may be shared and
+// is left to eviction.
+func (h *LocalDiskCacheHandler) RemoveEntry(actionID []byte) error {
+	mu := h.actionLock(actionID)
+	mu.Lock()
+	defer mu.Unlock()
+	e, err := h.readActionFile(actionID)
+	if errors.Is(err, cache.ErrMiss) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, errCorruptEntry) {
+		return err
+	}
+	if h.index != nil && err == nil {
+		h.index.remove(actionID, e)
+	}
+	path := h.getActionPath(actionID)
+	if h.xattr {
+		path = h.getEntryPath(actionID)
+		h.touched.Delete(path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove entry: %w", err)
+	}
+	return nil
+}
+
+// PruneEntries deletes the entries for which expired returns true, such as
+// those a retention policy no longer keeps, together with the objects no
+// remaining entry refers to. It returns the number of entries deleted and
+// the bytes freed.
+func (h *LocalDiskCacheHandler) PruneEntries(expired func(manifest.Entry) bool) (int, int64, error) {
+	if err := h.lock.Lock(); err != nil {
+		return 0, 0, err
+	}
+	defer h.lock.Unlock()
+
+	type entry struct {
+		path     string
+		actionID []byte
+		e        indexEntry
+	}
+	var doomed []entry
+	kept := make(map[string]struct{})
+	err := h.walkEntries(func(path string, actionID []byte, e indexEntry) error {
+		if expired(manifest.Entry{ActionID: actionID, OutputID: e.outputID, Size: e.size, Time: e.time, Tags: e.tags}) {
+			doomed = append(doomed, entry{path, actionID, e})
+		} else {
+			kept[string(e.outputID)] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list entries: %w", err)
+	}
+
+	var (
+		n     int
+		freed int64
+	)
+	removed := make(map[string]struct{})
+	for _, d := range doomed {
+		if err := os.Remove(d.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		n++
+		if h.index != nil {
+			h.index.remove(d.actionID, d.e)
+		}
+		if h.xattr {
+			// The entry file held the object.
+			h.touched.Delete(d.path)
+			freed += d.e.size
+			if _, ok := kept[string(d.e.outputID)]; !ok {
+				removed[string(d.e.outputID)] = struct{}{}
+			}
+			continue
+		}
+		if _, ok := kept[string(d.e.outputID)]; ok {
+			continue
+		}
+		if _, ok := removed[string(d.e.outputID)]; ok {
+			continue
+		}
+		objectPath := h.getObjectPath(d.e.outputID)
+		if err := os.Remove(objectPath); err != nil {
+			continue
+		}
+		h.touched.Delete(objectPath)
+		removed[string(d.e.outputID)] = struct{}{}
+		freed += d.e.size
+	}
+	if h.usage != nil {
+		h.usage.remove(removed)
+	}
+	return n, freed, nil
+}
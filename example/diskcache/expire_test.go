@@ -0,0 +1,143 @@
+package diskcache_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/clock"
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+)
+
+func TestWithMaxEntryAge(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		age      time.Duration
+		wantMiss bool
+	}{
+		{"disabled", 0, 1000 * time.Hour, false},
+		{"fresh", time.Hour, 30 * time.Minute, false},
+		{"at limit", time.Hour, time.Hour, false},
+		{"expired", time.Hour, time.Hour + time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			h, err := diskcache.NewExampleCacheHandler(
+				diskcache.WithDir(t.TempDir()),
+				diskcache.WithClock(c),
+				diskcache.WithMaxEntryAge(tt.maxAge),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+
+			ctx := context.Background()
+			actionID := bytes.Repeat([]byte{1}, 32)
+			body := []byte("hello")
+			res := cache.Call(ctx, cache.HandlerFunc(h.HandlePut), &cache.Request{
+				ID:       1,
+				Command:  cache.CmdPut,
+				ActionID: actionID,
+				OutputID: bytes.Repeat([]byte{2}, 32),
+				Body:     bytes.NewReader(body),
+				BodySize: int64(len(body)),
+			})
+			if res.Err != "" {
+				t.Fatalf("put failed: %s", res.Err)
+			}
+
+			c.Advance(tt.age)
+			get := func() cache.Response {
+				return cache.Call(ctx, cache.HandlerFunc(h.HandleGet), &cache.Request{
+					ID:       2,
+					Command:  cache.CmdGet,
+					ActionID: actionID,
+				})
+			}
+			res = get()
+			if res.Err != "" {
+				t.Fatalf("get failed: %s", res.Err)
+			}
+			if res.Miss != tt.wantMiss {
+				t.Fatalf("get: Miss = %v, want %v", res.Miss, tt.wantMiss)
+			}
+			if !tt.wantMiss {
+				return
+			}
+			// The expired entry is removed, so it stays a miss until put
+			// again, whatever the clock says.
+			c.Advance(-tt.age)
+			if res := get(); !res.Miss {
+				t.Fatal("expired entry was not removed")
+			}
+		})
+	}
+}
+
+// TestWithMaxEntryAgeFollowsResponseTime checks that entries expire maxAge
+// after the Time reported to the go command, which a put refreshes.
+func TestWithMaxEntryAgeFollowsResponseTime(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewFake(start)
+	h, err := diskcache.NewExampleCacheHandler(
+		diskcache.WithDir(t.TempDir()),
+		diskcache.WithClock(c),
+		diskcache.WithMaxEntryAge(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ctx := context.Background()
+	actionID := bytes.Repeat([]byte{1}, 32)
+	body := []byte("hello")
+	put := func() {
+		t.Helper()
+		res := cache.Call(ctx, cache.HandlerFunc(h.HandlePut), &cache.Request{
+			ID:       1,
+			Command:  cache.CmdPut,
+			ActionID: actionID,
+			OutputID: bytes.Repeat([]byte{2}, 32),
+			Body:     bytes.NewReader(body),
+			BodySize: int64(len(body)),
+		})
+		if res.Err != "" {
+			t.Fatalf("put failed: %s", res.Err)
+		}
+	}
+	get := func() cache.Response {
+		t.Helper()
+		res := cache.Call(ctx, cache.HandlerFunc(h.HandleGet), &cache.Request{
+			ID:       2,
+			Command:  cache.CmdGet,
+			ActionID: actionID,
+		})
+		if res.Err != "" {
+			t.Fatalf("get failed: %s", res.Err)
+		}
+		return res
+	}
+
+	put()
+	c.Advance(45 * time.Minute)
+	put()
+	putAt := c.Now()
+	c.Advance(45 * time.Minute)
+	res := get()
+	if res.Miss {
+		t.Fatal("entry put again 45 minutes ago expired")
+	}
+	if res.Time == nil || !res.Time.Equal(putAt) {
+		t.Fatalf("Time = %v, want %v", res.Time, putAt)
+	}
+	c.Advance(15*time.Minute + time.Second)
+	if res := get(); !res.Miss {
+		t.Fatal("entry did not expire an hour after its Time")
+	}
+}
@@ -0,0 +1,34 @@
+package diskcache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes the file at path through a temporary file in the
+// same directory that is renamed into place. Readers, including other
+// processes sharing the cache directory, never observe a partially written
+// file, and an existing file is replaced on every platform.
+func writeFileAtomic(path string, write func(f *os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	// CreateTemp uses mode 0600; keep the permissions os.Create would give.
+	err = f.Chmod(0644)
+	if err == nil {
+		err = write(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = renameFile(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package diskcache
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CollectGarbage deletes the object files no entry refers to, left behind
+// by puts that failed between writing the object and its action file or by
+// prunes that removed action files only, and the temporary files of writes
+// interrupted by a crash. Only files last modified more than grace ago are
+// deleted. It returns the number of files deleted and the bytes freed.
+//
+// The objects of puts that WithAdmission did not admit have no entry
+// either, and are dated back so that they are evicted first; they are
+// collected whatever grace is. The go command reads them only during the
+// build that put them, so collect garbage between builds.
+func (h *LocalDiskCacheHandler) CollectGarbage(grace time.Duration) (int, int64, error) {
+	if err := h.lock.Lock(); err != nil {
+		return 0, 0, err
+	}
+	defer h.lock.Unlock()
+
+	referenced := make(map[string]struct{})
+	if !h.xattr {
+		err := h.walkEntries(func(_ string, _ []byte, e indexEntry) error {
+			referenced[string(e.outputID)] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to list entries: %w", err)
+		}
+	}
+
+	cutoff := h.clock.Now().Add(-grace)
+	var (
+		n     int
+		freed int64
+	)
+	collected := make(map[string]struct{})
+	err := filepath.WalkDir(h.cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		var outputID []byte
+		switch {
+		case isTempFile(name):
+		case strings.HasSuffix(name, objectFileSuffix):
+			id, err := hex.DecodeString(strings.TrimSuffix(name, objectFileSuffix))
+			if err != nil {
+				return nil
+			}
+			if _, ok := referenced[string(id)]; ok {
+				return nil
+			}
+			outputID = id
+		case strings.HasSuffix(name, entryFileSuffix):
+			// Entry files of WithXattrMetadata hold their own object,
+			// which is garbage until an entry is attached.
+			if _, err := readEntryXattr(path); err == nil {
+				return nil
+			}
+		default:
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(cutoff) || h.inUse.held(path) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		h.touched.Delete(path)
+		n++
+		freed += info.Size()
+		if outputID != nil {
+			collected[string(outputID)] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return n, freed, fmt.Errorf("failed to collect garbage: %w", err)
+	}
+	if h.usage != nil {
+		h.usage.remove(collected)
+	}
+	return n, freed, nil
+}
+
+// isTempFile reports whether name is the temporary file of an object,
+// action or entry file being written, see writeFileAtomic.
+func isTempFile(name string) bool {
+	base, _, ok := strings.Cut(name, ".tmp")
+	if !ok {
+		return false
+	}
+	for _, suffix := range []string{objectFileSuffix, actionFileSuffix, entryFileSuffix} {
+		if strings.HasSuffix(base, suffix) {
+			return true
+		}
+	}
+	return false
+}
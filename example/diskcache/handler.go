@@ -2,15 +2,21 @@ package diskcache
 
 import (
 	"context"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/clock"
+	"github.com/hirasawayuki/go-cache-prog/layout"
+	"github.com/hirasawayuki/go-cache-prog/signing"
 )
 
 const (
@@ -20,186 +26,649 @@ const (
 
 type LocalDiskCacheHandler struct {
 	cacheDir string
+	lock     *fileLock // cross-process lock on the cache directory
+
+	indexPath     string
+	indexInterval time.Duration
+	index         *index // nil unless WithIndex is used
+
+	minFree       uint64
+	checkInterval time.Duration
+	diskPolicy    DiskPolicy
+	readOnly      atomic.Bool // set by the disk watchdog with the ReadOnly policy
+	noWrite       bool        // set by WithReadOnly
+
+	usagePath string
+	usage     *usage // nil unless WithUsageJournal is used
+
+	bloomPath     string
+	bloomExpected int
+	bloom         *bloom // nil unless WithBloomFilter is used
+
+	pressureFree  uint64
+	sketch        *sketch     // nil unless WithAdmission is used
+	underPressure atomic.Bool // set by the disk watchdog below pressureFree
+
+	signer   signing.Signer // nil unless WithSigner is used
+	layout   layout.Layout
+	spoolDir string        // put bodies are received here when set
+	xattr    bool          // entries are single files with WithXattrMetadata
+	refetch  cache.Handler // nil unless WithRefetch is used
+
+	maxEntryAge time.Duration  // entries older than this are misses, if set
+	clock       clock.Clock    // dates entries and their use
+	dirs        sync.Map       // shard directories known to exist
+	actions     [64]sync.Mutex // serialize puts of an ActionID, see actionLock
+
+	misses    missCounters
+	logMisses bool
+	touched   sync.Map // path -> time of the last touch, see touch
+	verified  sync.Map // path -> verifiedObject, see verifyObject
+	inUse     *inUse   // objects returned to open sessions
+
+	stop      chan struct{} // closed by Close to stop background goroutines
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Option configures a LocalDiskCacheHandler.
+type Option func(*LocalDiskCacheHandler)
+
+// WithIndex keeps the ActionID index in memory, loading the snapshot at path
+// on startup and saving it every interval and on Close. Changes made between
+// saves are appended to a journal next to the snapshot. It is meant for
+// daemon mode, where one process serves many builds and the index stays warm
+// between them, so gets skip opening and parsing action files.
+func WithIndex(path string, interval time.Duration) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.indexPath = path
+		h.indexInterval = interval
+	}
+}
+
+// WithLayout sets how entries are named and sharded in the cache directory.
+// The default is layout.Default. Entries written with another layout are
+// not found after a change, so the layout of an existing directory should
+// be kept.
+func WithLayout(l layout.Layout) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.layout = l
+	}
+}
+
+// WithSharding shards entries into depth levels of subdirectories, from 0
+// to 2, named by width hex digits of the ID each, 1 or 2. The default, a
+// level of 256 directories, suits most caches; depth 0 avoids directory
+// lookups on small caches and depth 2 keeps directories small on large
+// ones. Like WithLayout, the sharding of an existing directory should be
+// kept.
+func WithSharding(depth, width int) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.layout = layout.Sharded{Depth: depth, Width: width}
+	}
+}
+
+// WithClock dates entries, expires them, records their use and prunes
+// them on c instead of the real clock, for tests of time-based behavior.
+func WithClock(c clock.Clock) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.clock = c
+	}
 }
 
-func NewExampleCacheHandler() (*LocalDiskCacheHandler, error) {
-	cacheDir := filepath.Join(os.TempDir(), "cacheprog")
+// WithDir sets the cache directory. The default is DefaultDir().
+func WithDir(dir string) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.cacheDir = dir
+	}
+}
+
+// WithReadOnly opens an existing cache directory for tools that list and
+// read its entries, such as the copy subcommand: the directory is not
+// created, migrated or locked, gets do not record their use, and puts
+// fail. Options that write files next to the entries, such as WithIndex,
+// must not be combined with it.
+func WithReadOnly() Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.noWrite = true
+	}
+}
+
+// DefaultDir returns the cache directory used by NewExampleCacheHandler.
+func DefaultDir() (string, error) {
+	// DiskPath must be absolute, and on Windows must use backslashes; Abs
+	// cleans the path, which converts any forward slashes.
+	dir, err := filepath.Abs(filepath.Join(os.TempDir(), "cacheprog"))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve cache directory: %w", err)
+	}
+	return dir, nil
+}
+
+func NewExampleCacheHandler(opts ...Option) (*LocalDiskCacheHandler, error) {
+	cacheDir, err := DefaultDir()
+	if err != nil {
+		return nil, err
+	}
 	handler := &LocalDiskCacheHandler{
 		cacheDir: cacheDir,
+		layout:   layout.Default{},
+		clock:    clock.Real,
+		inUse:    newInUse(),
+		stop:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(handler)
+	}
+	if l, ok := handler.layout.(layout.Sharded); ok && (l.Depth < 0 || l.Depth > 2 || l.Width < 1 || l.Width > 2) {
+		return nil, fmt.Errorf("invalid sharding: depth %d, width %d", l.Depth, l.Width)
+	}
+	// DiskPath must be absolute, whatever directory WithDir set.
+	if handler.cacheDir, err = filepath.Abs(handler.cacheDir); err != nil {
+		return nil, fmt.Errorf("failed to resolve cache directory: %w", err)
+	}
+	if err := checkLayout(handler.layout); err != nil {
+		return nil, err
 	}
 
 	if err := handler.initializeCache(); err != nil {
 		return nil, fmt.Errorf("failed to initialize cache: %w", err)
 	}
 
+	if handler.indexPath != "" {
+		ix, err := loadIndex(handler.indexPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load index: %w", err)
+		}
+		handler.index = ix
+		handler.wg.Add(1)
+		go handler.persistIndex()
+		log.Printf("Loaded index with %d entries from %s", len(ix.m), handler.indexPath)
+	}
+
+	if handler.usagePath != "" {
+		if handler.usage, err = loadUsage(handler.usagePath, handler.clock); err != nil {
+			return nil, fmt.Errorf("failed to load usage table: %w", err)
+		}
+	}
+
+	if handler.bloomPath != "" {
+		if handler.bloom, err = handler.loadBloom(); err != nil {
+			return nil, err
+		}
+	}
+
+	if handler.minFree > 0 || handler.pressureFree > 0 {
+		if handler.checkInterval <= 0 {
+			handler.checkInterval = 30 * time.Second
+		}
+		handler.wg.Add(1)
+		go handler.watchDisk()
+	}
+
 	return handler, nil
 }
 
-// initializeCache prepares the cache directory structure.
-// It creates the main cache directory and 256 subdirectories (16x16)
-// named with hexadecimal values from "00" to "ff". These subdirectories
-// are used to distribute cache files and avoid having too many files
-// in a single directory, which can lead to performance issues on some
-// filesystems. Returns an error if directory creation fails.
+// checkLayout checks that the files of an entry do not collide on
+// case-insensitive filesystems, the default on Windows and macOS. IDs are
+// lowercase hex, so only the action and object files of an ID can differ
+// in case alone, with a Template such as "{id}-A" and "{id}-a".
+func checkLayout(l layout.Layout) error {
+	id := make([]byte, 32)
+	if action, object := l.ActionKey(id), l.ObjectKey(id); strings.EqualFold(action, object) {
+		return fmt.Errorf("invalid layout: action file %s and object file %s collide on case-insensitive filesystems", action, object)
+	}
+	return nil
+}
+
+// persistIndex saves the index periodically until Close is called.
+func (h *LocalDiskCacheHandler) persistIndex() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(h.indexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.saveIndex(); err != nil {
+				log.Printf("failed to save index: %v", err)
+			}
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background goroutines started by the options, saves the
+// index and the Bloom filter, when used, a last time and folds the usage
+// journal into the usage table.
+func (h *LocalDiskCacheHandler) Close() error {
+	h.closeOnce.Do(func() { close(h.stop) })
+	h.wg.Wait()
+	var err error
+	if h.bloom != nil {
+		err = h.saveBloom()
+	}
+	if h.usage != nil {
+		if uerr := h.foldUsage(); err == nil {
+			err = uerr
+		}
+	}
+	if h.index == nil {
+		return err
+	}
+	if ierr := h.saveIndex(); err == nil {
+		err = ierr
+	}
+	if cerr := h.index.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// saveIndex saves the index while holding the cache directory lock
+// exclusively, so the snapshot is consistent with concurrent trims.
+func (h *LocalDiskCacheHandler) saveIndex() error {
+	if err := h.lock.Lock(); err != nil {
+		return err
+	}
+	defer h.lock.Unlock()
+	return h.index.save()
+}
+
+// foldUsage folds the usage journal while holding the cache directory lock
+// exclusively, so that two processes never fold it at once.
+func (h *LocalDiskCacheHandler) foldUsage() error {
+	err := h.lock.Lock()
+	if err == nil {
+		err = h.usage.fold()
+		h.lock.Unlock()
+	}
+	if cerr := h.usage.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// initializeCache prepares the cache directory: it creates the directory,
+// opens the lock file and upgrades the layout version. The shard
+// subdirectories are created by the first put into each, since creating
+// them all on every start is wasteful on network filesystems and for
+// mostly cold caches.
 func (h *LocalDiskCacheHandler) initializeCache() error {
+	start := time.Now()
+	if h.noWrite {
+		return h.checkCache()
+	}
 	if err := os.MkdirAll(h.cacheDir, 0755); err != nil {
 		return fmt.Errorf("failed to create cache directory: %w", err)
 	}
-
-	for i := range 16 {
-		for j := range 16 {
-			subdir := filepath.Join(h.cacheDir, fmt.Sprintf("%x%x", i, j))
-			if err := os.MkdirAll(subdir, 0755); err != nil {
-				return fmt.Errorf("failed to create subdirectory %s: %w", subdir, err)
-			}
+	if h.spoolDir != "" {
+		if err := os.MkdirAll(h.spoolDir, 0755); err != nil {
+			return fmt.Errorf("failed to create spool directory: %w", err)
+		}
+	}
+	if h.xattr {
+		if err := probeXattr(h.cacheDir); err != nil {
+			return err
 		}
 	}
 
-	log.Printf("Initialized cache directory at %s", h.cacheDir)
+	lock, err := openFileLock(filepath.Join(h.cacheDir, "lock"))
+	if err != nil {
+		return err
+	}
+	h.lock = lock
+
+	if err := h.lock.Lock(); err != nil {
+		return err
+	}
+	_, err = migrate(h.cacheDir)
+	h.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Initialized cache directory at %s in %v", h.cacheDir, time.Since(start).Round(time.Microsecond))
 	return nil
 }
 
+// checkCache checks that the cache directory of a handler opened with
+// WithReadOnly exists and needs no migration.
+func (h *LocalDiskCacheHandler) checkCache() error {
+	if _, err := os.Stat(h.cacheDir); err != nil {
+		return err
+	}
+	v, err := readLayoutVersion(h.cacheDir)
+	if err != nil {
+		return err
+	}
+	if v != layoutVersion {
+		return fmt.Errorf("cache directory has layout version %d, not %d: open it read-write once to migrate it", v, layoutVersion)
+	}
+	return nil
+}
+
+// Ping checks that the cache directory is writable by creating and removing
+// a temporary file in it.
+func (h *LocalDiskCacheHandler) Ping(ctx context.Context) error {
+	f, err := os.CreateTemp(h.cacheDir, "ping-*")
+	if err != nil {
+		return fmt.Errorf("cache directory is not writable: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 // HandleGet processes cache retrieval requests.
 // It checks if the requested cache entry exists by looking up the action file
 // using the provided ActionID. If found, it reads the metadata (OutputID, size,
 // and timestamp), verifies the corresponding object file exists with the expected
 // size, and returns its details. If any step fails or the cache entry is not found,
-// it returns a cache miss or appropriate error.
+// it returns a cache miss or appropriate error. Corrupt entries are removed, and
+// with WithRefetch fetched again.
+//
+// Hits update the modification time of the object, at most once an hour,
+// which eviction uses as the time of last use, or with WithUsageJournal
+// record the use in the usage table.
+//
+// With WithIndex, entries known to the index are answered without reading
+// their entry file, and with WithBloomFilter, entries that were never put
+// are misses without a lookup on disk.
 func (h *LocalDiskCacheHandler) HandleGet(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
-	actionPath := h.getActionPath(r.ActionID)
+	if h.sketch != nil {
+		h.sketch.add(r.ActionID)
+	}
+	if h.bloom != nil && !h.bloom.mayContain(r.ActionID) {
+		h.miss(w, r, missAbsent, "")
+		return
+	}
 
-	actionFile, err := os.Open(actionPath)
-	if os.IsNotExist(err) {
-		w.WriteResponse(cache.Response{
-			ID:   r.ID,
-			Miss: true,
-		})
+	if h.index != nil {
+		if e, ok := h.index.get(r.ActionID); ok && h.expired(e) {
+			h.expire(ctx, w, r, e)
+			return
+		} else if ok && h.verify(r.ActionID, e) {
+			objectPath := h.diskPath(r.ActionID, e)
+			// The object may have been deleted by another process sharing
+			// the directory, such as the gc subcommand.
+			if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+				h.index.remove(r.ActionID, e)
+				h.miss(w, r, missEvicted, "object file is missing")
+				return
+			}
+			if !h.verifyObject(objectPath, e) {
+				h.index.remove(r.ActionID, e)
+				h.heal(ctx, w, r, &e, "object file does not match its OutputID")
+				return
+			}
+			h.markUsed(objectPath, e)
+			h.inUse.acquire(ctx, objectPath)
+			w.WriteResponse(cache.Response{
+				ID:       r.ID,
+				OutputID: e.outputID,
+				Size:     e.size,
+				Time:     &e.time,
+				DiskPath: objectPath,
+			})
+			return
+		}
+	}
+
+	e, err := h.readActionFile(r.ActionID)
+	if errors.Is(err, cache.ErrMiss) {
+		h.miss(w, r, missAbsent, "")
+		return
+	} else if errors.Is(err, errCorruptEntry) {
+		h.heal(ctx, w, r, nil, err.Error())
 		return
 	} else if err != nil {
-		h.writeErrorResponse(w, r, fmt.Errorf("failed to open action file: %w", err))
+		cache.WriteError(w, r, err)
 		return
 	}
-	defer actionFile.Close()
-
-	var outputID []byte
-	var fileSize int64
-	var timestampUnix int64
-	var hexOutputID string
-	_, err = fmt.Fscanf(actionFile, "%s %d %d", &hexOutputID, &fileSize, &timestampUnix)
-	if err != nil {
-		h.writeErrorResponse(w, r, fmt.Errorf("failed to parse action file: %w", err))
+	if h.expired(e) {
+		h.expire(ctx, w, r, e)
 		return
 	}
-
-	timestamp := time.Unix(timestampUnix, 0)
-	outputID, err = hex.DecodeString(hexOutputID)
-	if err != nil {
-		h.writeErrorResponse(w, r, fmt.Errorf("failed to decode output ID: %w", err))
+	if !h.verify(r.ActionID, e) {
+		h.miss(w, r, missCorrupt, "invalid signature")
 		return
 	}
 
-	objectPath := h.getObjectPath(outputID)
+	objectPath := h.diskPath(r.ActionID, e)
 	fi, err := os.Stat(objectPath)
 	if os.IsNotExist(err) {
-		w.WriteResponse(cache.Response{
-			ID:   r.ID,
-			Miss: true,
-		})
+		h.miss(w, r, missEvicted, "object file is missing")
 		return
 	} else if err != nil {
-		h.writeErrorResponse(w, r, fmt.Errorf("failed to stat object file: %w", err))
+		cache.WriteError(w, r, fmt.Errorf("failed to stat object file: %w", err))
 		return
 	}
 
-	if fi.Size() != fileSize {
-		w.WriteResponse(cache.Response{
-			ID:   r.ID,
-			Miss: true,
-		})
+	if fi.Size() != e.size {
+		h.heal(ctx, w, r, &e, fmt.Sprintf("object file has %d bytes, want %d", fi.Size(), e.size))
+		return
+	}
+	if !h.verifyObject(objectPath, e) {
+		h.heal(ctx, w, r, &e, "object file does not match its OutputID")
 		return
 	}
 
+	if h.index != nil {
+		h.index.fill(r.ActionID, e)
+	}
+	h.markUsed(objectPath, e)
+
+	h.inUse.acquire(ctx, objectPath)
 	w.WriteResponse(cache.Response{
 		ID:       r.ID,
-		OutputID: outputID,
-		Size:     fileSize,
-		Time:     &timestamp,
+		OutputID: e.outputID,
+		Size:     e.size,
+		Time:     &e.time,
 		DiskPath: objectPath,
 	})
 }
 
+// readActionFile reads the metadata stored in the action file for actionID,
+// or attached to its entry file with WithXattrMetadata. It returns
+// cache.ErrMiss if there is no such file.
+func (h *LocalDiskCacheHandler) readActionFile(actionID []byte) (indexEntry, error) {
+	if h.xattr {
+		e, err := readEntryXattr(h.getEntryPath(actionID))
+		if err != nil {
+			// Missing files, files put without admission and files whose
+			// entry is not attached yet are all misses.
+			return indexEntry{}, cache.ErrMiss
+		}
+		return e, nil
+	}
+
+	data, err := os.ReadFile(h.getActionPath(actionID))
+	if os.IsNotExist(err) {
+		return indexEntry{}, cache.ErrMiss
+	} else if err != nil {
+		return indexEntry{}, fmt.Errorf("failed to open action file: %w", err)
+	}
+
+	e, err := parseEntry(strings.Fields(string(data)))
+	if err != nil {
+		return indexEntry{}, fmt.Errorf("%w: %v", errCorruptEntry, err)
+	}
+	return e, nil
+}
+
 // HandlePut processes cache storage requests.
 // It saves the cache data from the request body to a file named after the OutputID,
 // then creates a metadata file keyed by ActionID containing the OutputID, file size,
-// and timestamp. If any step in the process fails, it cleans up any partially created
-// files and returns an error. On success, it returns the path to the stored object.
+// and timestamp. Both files are written to a temporary name and renamed into place,
+// so a concurrent reader never sees a partial file. Objects are content-addressed
+// and may be shared by several actions, so they are kept if writing the action file
+// fails, and an object that already exists with the right size is not rewritten.
+// On success, it returns the path to the stored object.
 func (h *LocalDiskCacheHandler) HandlePut(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	if h.noWrite {
+		cache.WriteError(w, r, cache.Errorf(cache.CodeUnsupported, "cache directory is opened read-only"))
+		return
+	}
 	outputID := r.OutputID
 	objectPath := h.getObjectPath(outputID)
-	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
-		h.writeErrorResponse(w, r, fmt.Errorf("failed to create directory: %w", err))
+	actionPath := h.getActionPath(r.ActionID)
+	if h.xattr {
+		objectPath = h.getEntryPath(r.ActionID)
+	}
+	for _, dir := range []string{filepath.Dir(objectPath), filepath.Dir(actionPath)} {
+		if err := h.ensureDir(dir); err != nil {
+			cache.WriteError(w, r, fmt.Errorf("failed to create directory: %w", err))
+			return
+		}
+	}
+
+	if h.readOnly.Load() {
+		cache.WriteError(w, r, cache.Errorf(cache.CodeUnavailable, "cache volume is low on disk space"))
 		return
 	}
 
-	objectFile, err := os.Create(objectPath)
-	if err != nil {
-		h.writeErrorResponse(w, r, fmt.Errorf("failed to create object file: %w", err))
+	// Hold the directory lock shared so that a trim in another process
+	// cannot remove the object before its action file is written.
+	if err := h.lock.RLock(); err != nil {
+		cache.WriteError(w, r, err)
 		return
 	}
+	defer h.lock.RUnlock()
 
-	size, err := io.Copy(objectFile, r.Body)
-	objectFile.Close()
-	if err != nil {
-		os.Remove(objectPath)
-		h.writeErrorResponse(w, r, fmt.Errorf("failed to write object file: %w", err))
+	// Sign before writing anything, so that a verify-only signer fails the
+	// put without leaving an object behind.
+	e := indexEntry{outputID: outputID, size: r.BodySize, tags: cache.TagsFromContext(ctx)}
+	if err := h.sign(r.ActionID, &e); err != nil {
+		cache.WriteError(w, r, fmt.Errorf("failed to sign entry: %w", err))
 		return
 	}
 
-	actionPath := h.getActionPath(r.ActionID)
-	actionFile, err := os.Create(actionPath)
-	if err != nil {
-		os.Remove(objectPath)
-		h.writeErrorResponse(w, r, fmt.Errorf("failed to create action file: %w", err))
+	admitted := h.admit(r.ActionID)
+	fi, statErr := os.Stat(objectPath)
+	existed := statErr == nil
+
+	// Concurrent puts of the same ActionID, from parallel builds sharing
+	// the handler, store their entries one at a time, so the last one wins
+	// on disk and in the index alike. With WithXattrMetadata the entry file
+	// holds the object, which must be written under the lock too.
+	mu := h.actionLock(r.ActionID)
+	if h.xattr {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+
+	var err error
+	if existed && fi.Size() == e.size && !h.xattr {
+		// Identical outputs of different actions share their object:
+		// only the action file needs writing.
+		if admitted && h.usage == nil {
+			h.touch(objectPath)
+		}
+	} else if err = h.writeObject(objectPath, r.Body, e.size); err != nil {
+		cache.WriteError(w, r, fmt.Errorf("failed to write object file: %w", err))
 		return
 	}
 
-	_, err = fmt.Fprintf(actionFile, "%x %d %d", outputID, size, time.Now().Unix())
-	actionFile.Close()
+	if !admitted {
+		// Make a new object the first candidate for eviction; an object
+		// shared with other actions keeps its time.
+		if !existed {
+			os.Chtimes(objectPath, time.Time{}, time.Unix(0, 0))
+		}
+		h.inUse.acquire(ctx, objectPath)
+		w.WriteResponse(cache.Response{
+			ID:       r.ID,
+			DiskPath: objectPath,
+		})
+		return
+	}
+
+	if !h.xattr {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	e.time = time.Unix(h.clock.Now().Unix(), 0)
+	if h.xattr {
+		// Until the entry is attached, gets of the new file miss.
+		err = setxattr(objectPath, entryXattr, []byte(e.format()))
+	} else {
+		err = writeFileAtomic(actionPath, func(f *os.File) error {
+			_, err := io.WriteString(f, e.format())
+			return err
+		})
+	}
 	if err != nil {
-		os.Remove(objectPath)
-		os.Remove(actionPath)
-		h.writeErrorResponse(w, r, fmt.Errorf("failed to write action file: %w", err))
+		cache.WriteError(w, r, fmt.Errorf("failed to write action file: %w", err))
 		return
 	}
 
+	if h.index != nil {
+		h.index.put(r.ActionID, e)
+	}
+	if h.bloom != nil {
+		h.bloom.add(r.ActionID)
+	}
+	if h.usage != nil {
+		h.usage.record(e.outputID, e.size)
+	}
+
+	h.inUse.acquire(ctx, objectPath)
 	w.WriteResponse(cache.Response{
 		ID:       r.ID,
 		DiskPath: objectPath,
 	})
 }
 
+// actionLock returns the mutex serializing the puts of actionID. Unrelated
+// actions may share a mutex; puts only hold it briefly.
+func (h *LocalDiskCacheHandler) actionLock(actionID []byte) *sync.Mutex {
+	var n int
+	if len(actionID) > 0 {
+		n = int(actionID[len(actionID)-1])
+	}
+	return &h.actions[n%len(h.actions)]
+}
+
+// ensureDir creates the shard directory dir on the first put into it.
+// Directories are never removed while the cache is in use, so later puts
+// skip the syscalls.
+func (h *LocalDiskCacheHandler) ensureDir(dir string) error {
+	if _, ok := h.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	h.dirs.Store(dir, struct{}{})
+	return nil
+}
+
 // HandleClose processes the close command.
 // It responds with the request ID to acknowledge receipt of the close command,
 // allowing the Go command to terminate the cache program.
 func (h *LocalDiskCacheHandler) HandleClose(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	h.inUse.release(ctx)
 	w.WriteResponse(cache.Response{
 		ID: r.ID,
 	})
 }
 
-func (h *LocalDiskCacheHandler) writeErrorResponse(w cache.ResponseWriter, r *cache.Request, err error) {
-	w.WriteResponse(cache.Response{
-		ID:  r.ID,
-		Err: err.Error(),
-	})
+// ObjectPath returns the path of the object file of outputID, which may
+// not exist.
+func (h *LocalDiskCacheHandler) ObjectPath(outputID []byte) string {
+	return h.getObjectPath(outputID)
 }
 
+// getObjectPath and getActionPath use lowercase hex names only, so that
+// paths never differ just by case and cannot collide on case-insensitive
+// filesystems such as NTFS and APFS, as long as the layout passes
+// checkLayout. Paths longer than MAX_PATH on Windows
+// are handled by the os package, which adds the \\?\ prefix to absolute
+// paths as needed.
 func (h *LocalDiskCacheHandler) getObjectPath(objectID []byte) string {
-	hexID := hex.EncodeToString(objectID)
-	return filepath.Join(h.cacheDir, hexID[:2], hexID+objectFileSuffix)
+	return filepath.Join(h.cacheDir, filepath.FromSlash(h.layout.ObjectKey(objectID)))
 }
 
 func (h *LocalDiskCacheHandler) getActionPath(actionID []byte) string {
-	hexID := hex.EncodeToString(actionID)
-	return filepath.Join(h.cacheDir, hexID[:2], hexID+actionFileSuffix)
+	return filepath.Join(h.cacheDir, filepath.FromSlash(h.layout.ActionKey(actionID)))
 }
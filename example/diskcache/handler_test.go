@@ -0,0 +1,31 @@
+package diskcache_test
+
+import (
+	"testing"
+
+	"github.com/hirasawayuki/go-cache-prog/example/diskcache"
+	"github.com/hirasawayuki/go-cache-prog/layout"
+)
+
+func TestCaseInsensitiveLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  layout.Layout
+		wantErr bool
+	}{
+		{"default", layout.Default{}, false},
+		{"template", layout.Template{Action: "ac/{id}", Object: "cas/{id}"}, false},
+		{"suffixes differ in case", layout.Template{Action: "{id:0:2}/{id}-A", Object: "{id:0:2}/{id}-a"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := diskcache.NewExampleCacheHandler(diskcache.WithDir(t.TempDir()), diskcache.WithLayout(tt.layout))
+			if err == nil {
+				h.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewExampleCacheHandler: err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
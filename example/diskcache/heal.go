@@ -0,0 +1,96 @@
+package diskcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// errCorruptEntry is wrapped by the errors of action files that do not
+// parse.
+var errCorruptEntry = errors.New("unparsable action file")
+
+// WithRefetch answers gets of entries found corrupt from remote, typically
+// the shared tier the local cache is in front of, storing the entry again
+// on the way. Without it, corrupt entries are misses, and the go command
+// rebuilds and puts them again.
+func WithRefetch(remote cache.Handler) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.refetch = remote
+	}
+}
+
+// heal answers a get of a corrupt entry: its action file, unparsable or
+// pointing at an object of the wrong size, would fail the same way on every
+// build, so it is removed, along with the object if its size is still
+// wrong. e is nil for an unparsable action file.
+func (h *LocalDiskCacheHandler) heal(ctx context.Context, w cache.ResponseWriter, r *cache.Request, e *indexEntry, detail string) {
+	h.countMiss(r, missCorrupt, detail)
+
+	actionPath := h.getActionPath(r.ActionID)
+	if h.xattr {
+		// The entry file holds the object.
+		actionPath = h.getEntryPath(r.ActionID)
+	} else if e != nil {
+		objectPath := h.getObjectPath(e.outputID)
+		if fi, err := os.Stat(objectPath); err == nil && fi.Size() != e.size {
+			removeFile(objectPath)
+		}
+	}
+	removeFile(actionPath)
+
+	if h.refetch == nil {
+		cache.WriteError(w, r, cache.ErrMiss)
+		return
+	}
+	res, err := h.refetchEntry(ctx, r)
+	if err != nil {
+		log.Printf("failed to refetch corrupt entry: actionID=%x: %v", r.ActionID, err)
+		cache.WriteError(w, r, cache.ErrMiss)
+		return
+	}
+	res.ID = r.ID
+	w.WriteResponse(res)
+}
+
+// refetchEntry gets the entry of r from the refetch backend and puts it in
+// the cache. It returns cache.ErrMiss if the backend does not have it.
+func (h *LocalDiskCacheHandler) refetchEntry(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	res := cache.Call(ctx, h.refetch, &cache.Request{ID: r.ID, Command: cache.CmdGet, ActionID: r.ActionID})
+	if res.Err != "" {
+		return cache.Response{}, errors.New(res.Err)
+	}
+	if res.Miss {
+		return cache.Response{}, cache.ErrMiss
+	}
+	f, err := os.Open(res.DiskPath)
+	if err != nil {
+		return cache.Response{}, err
+	}
+	defer f.Close()
+	put := cache.Call(ctx, cache.HandlerFunc(h.HandlePut), &cache.Request{
+		ID:       r.ID,
+		Command:  cache.CmdPut,
+		ActionID: r.ActionID,
+		OutputID: res.OutputID,
+		Body:     f,
+		BodySize: res.Size,
+	})
+	if put.Err != "" {
+		return cache.Response{}, fmt.Errorf("failed to store entry: %s", put.Err)
+	}
+	return cache.Response{OutputID: res.OutputID, Size: res.Size, Time: res.Time, DiskPath: put.DiskPath}, nil
+}
+
+// removeFile removes the file at path of a corrupt or expired entry,
+// logging failures.
+func removeFile(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("failed to remove entry file: %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package diskcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexEntry is the metadata of a cache entry, as stored in its action file.
+type indexEntry struct {
+	outputID []byte
+	size     int64
+	time     time.Time
+	sig      []byte // set when entries are signed, see WithSigner
+	tags     map[string]string
+}
+
+// journalSuffix is appended to the index path to name its journal.
+const journalSuffix = ".journal"
+
+// index keeps the ActionID -> metadata mapping in memory so that gets don't
+// have to open and parse action files. It is a cache of the action files,
+// which remain the source of truth: entries missing from the index are
+// looked up on disk and added.
+//
+// The index is persisted as a flat-file snapshot plus a journal: every
+// change is appended to the journal as it happens, so a killed process loses
+// none of them, and save compacts the journal into a new snapshot.
+type index struct {
+	path string
+
+	mu      sync.RWMutex
+	m       map[string]indexEntry // keyed by the raw ActionID
+	journal *os.File              // opened for appending
+	dirty   bool
+}
+
+// loadIndex reads the index snapshot at path and replays its journal. A
+// missing snapshot yields an empty index; unparsable lines are skipped,
+// since they only cost a lookup on disk.
+func loadIndex(path string) (*index, error) {
+	ix := &index{
+		path: path,
+		m:    make(map[string]indexEntry),
+	}
+	if _, err := ix.replay(path); err != nil {
+		return nil, err
+	}
+	n, err := ix.replay(path + journalSuffix)
+	if err != nil {
+		return nil, err
+	}
+	ix.dirty = n > 0
+
+	ix.journal, err = os.OpenFile(path+journalSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index journal: %w", err)
+	}
+	return ix, nil
+}
+
+// replay applies the lines of the snapshot or journal at path to the index
+// and returns the number of lines read. A line holds an ActionID followed
+// by an entry, or by "-" for a removed entry.
+func (ix *index) replay(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer f.Close()
+
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n++
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		actionID, err := hex.DecodeString(fields[0])
+		if err != nil {
+			continue
+		}
+		if fields[1] == "-" {
+			delete(ix.m, string(actionID))
+			continue
+		}
+		e, err := parseEntry(fields[1:])
+		if err != nil {
+			continue
+		}
+		ix.m[string(actionID)] = e
+	}
+	if err := sc.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read index: %w", err)
+	}
+	return n, nil
+}
+
+// parseEntry parses the fields of an action file or index line: the hex
+// OutputID, the size, the Unix time, the hex signature if present, and the
+// tags as query-escaped key=value fields.
+func parseEntry(fields []string) (indexEntry, error) {
+	if len(fields) < 3 {
+		return indexEntry{}, fmt.Errorf("want at least 3 fields, got %d", len(fields))
+	}
+	outputID, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return indexEntry{}, fmt.Errorf("failed to decode output ID: %w", err)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return indexEntry{}, fmt.Errorf("failed to parse size: %w", err)
+	}
+	timestampUnix, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return indexEntry{}, fmt.Errorf("failed to parse time: %w", err)
+	}
+	e := indexEntry{
+		outputID: outputID,
+		size:     size,
+		time:     time.Unix(timestampUnix, 0),
+	}
+	fields = fields[3:]
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		if e.sig, err = hex.DecodeString(fields[0]); err != nil {
+			return indexEntry{}, fmt.Errorf("failed to decode signature: %w", err)
+		}
+		fields = fields[1:]
+	}
+	for _, f := range fields {
+		k, v, _ := strings.Cut(f, "=")
+		if k, err = url.QueryUnescape(k); err != nil {
+			return indexEntry{}, fmt.Errorf("failed to decode tag: %w", err)
+		}
+		if v, err = url.QueryUnescape(v); err != nil {
+			return indexEntry{}, fmt.Errorf("failed to decode tag %s: %w", k, err)
+		}
+		if e.tags == nil {
+			e.tags = make(map[string]string)
+		}
+		e.tags[k] = v
+	}
+	return e, nil
+}
+
+// format returns e in the format read by parseEntry.
+func (e indexEntry) format() string {
+	s := fmt.Sprintf("%x %d %d", e.outputID, e.size, e.time.Unix())
+	if len(e.sig) > 0 {
+		s += fmt.Sprintf(" %x", e.sig)
+	}
+	for _, k := range slices.Sorted(maps.Keys(e.tags)) {
+		s += " " + url.QueryEscape(k) + "=" + url.QueryEscape(e.tags[k])
+	}
+	return s
+}
+
+func (ix *index) get(actionID []byte) (indexEntry, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	e, ok := ix.m[string(actionID)]
+	return e, ok
+}
+
+func (ix *index) put(actionID []byte, e indexEntry) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.m[string(actionID)] = e
+	ix.dirty = true
+	ix.appendJournal("%x %s\n", actionID, e.format())
+}
+
+// fill adds e, read from the action file of actionID, unless the index
+// has an entry for it already. A put that raced with the read has stored
+// the newer entry, which must not be replaced by the one read before it.
+func (ix *index) fill(actionID []byte, e indexEntry) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if _, ok := ix.m[string(actionID)]; ok {
+		return
+	}
+	ix.m[string(actionID)] = e
+	ix.dirty = true
+	ix.appendJournal("%x %s\n", actionID, e.format())
+}
+
+// appendJournal appends a line to the journal. A failed write is only
+// logged: the change is still saved with the next snapshot.
+func (ix *index) appendJournal(format string, args ...any) {
+	if _, err := fmt.Fprintf(ix.journal, format, args...); err != nil {
+		log.Printf("failed to append to index journal: %v", err)
+	}
+}
+
+// remove drops the entry of actionID if it is still e.
+func (ix *index) remove(actionID []byte, e indexEntry) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if cur, ok := ix.m[string(actionID)]; !ok || !cur.time.Equal(e.time) || !bytes.Equal(cur.outputID, e.outputID) {
+		return
+	}
+	delete(ix.m, string(actionID))
+	ix.dirty = true
+	ix.appendJournal("%x -\n", actionID)
+}
+
+// removeOutputs drops the entries whose object is in outputIDs, keyed by
+// the raw OutputID, after those objects were deleted.
+func (ix *index) removeOutputs(outputIDs map[string]struct{}) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for actionID, e := range ix.m {
+		if _, ok := outputIDs[string(e.outputID)]; ok {
+			delete(ix.m, actionID)
+			ix.dirty = true
+			ix.appendJournal("%x -\n", actionID)
+		}
+	}
+}
+
+// save writes a snapshot of the index if it changed since the last save and
+// truncates the journal. A crash between the two replays the journal onto
+// the new snapshot on the next load, which yields the same entries.
+func (ix *index) save() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if !ix.dirty {
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(ix.path), filepath.Base(ix.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for actionID, e := range ix.m {
+		fmt.Fprintf(w, "%x %s\n", actionID, e.format())
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), ix.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := ix.journal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate index journal: %w", err)
+	}
+	ix.dirty = false
+	return nil
+}
+
+// close closes the journal.
+func (ix *index) close() error {
+	return ix.journal.Close()
+}
@@ -0,0 +1,71 @@
+package diskcache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// inUse tracks the object files whose DiskPath was returned to a session
+// that has not closed yet. The go command may read them until it sends the
+// close command, so eviction and garbage collection skip them.
+type inUse struct {
+	mu       sync.Mutex
+	refs     map[string]int                 // object path -> sessions holding it
+	sessions map[string]map[string]struct{} // session ID -> object paths held
+}
+
+func newInUse() *inUse {
+	return &inUse{
+		refs:     make(map[string]int),
+		sessions: make(map[string]map[string]struct{}),
+	}
+}
+
+// acquire records that path was returned to the session of ctx. Requests
+// of no session, such as those of other handlers wrapping this one, are
+// not tracked.
+func (u *inUse) acquire(ctx context.Context, path string) {
+	session, ok := cache.SessionIDFromContext(ctx)
+	if !ok {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	paths, ok := u.sessions[session]
+	if !ok {
+		paths = make(map[string]struct{})
+		u.sessions[session] = paths
+	}
+	if _, ok := paths[path]; ok {
+		return
+	}
+	paths[path] = struct{}{}
+	u.refs[path]++
+}
+
+// release drops the paths held by the session of ctx.
+func (u *inUse) release(ctx context.Context) {
+	session, ok := cache.SessionIDFromContext(ctx)
+	if !ok {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for path := range u.sessions[session] {
+		if u.refs[path] <= 1 {
+			delete(u.refs, path)
+		} else {
+			u.refs[path]--
+		}
+	}
+	delete(u.sessions, session)
+}
+
+// held reports whether a session holds path.
+func (u *inUse) held(path string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.refs[path] > 0
+}
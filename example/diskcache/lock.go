@@ -0,0 +1,74 @@
+package diskcache
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// fileLock is a readers-writer lock shared by every process using the same
+// cache directory. Puts hold it shared; operations that rewrite metadata or
+// delete files, such as saving the index or trimming, hold it exclusively,
+// so several go commands pointing at the same directory don't corrupt each
+// other.
+//
+// OS-level locks are held per open file, so goroutines of one process
+// share a single OS lock, counted in shared.
+type fileLock struct {
+	f *os.File
+
+	rw     sync.RWMutex // excludes in-process writers from readers
+	mu     sync.Mutex   // guards shared
+	shared int
+}
+
+// openFileLock opens, creating if needed, the lock file at path.
+func openFileLock(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	return &fileLock{f: f}, nil
+}
+
+// RLock acquires the lock shared.
+func (l *fileLock) RLock() error {
+	l.rw.RLock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shared == 0 {
+		if err := lockFile(l.f, false); err != nil {
+			l.rw.RUnlock()
+			return fmt.Errorf("failed to lock cache directory: %w", err)
+		}
+	}
+	l.shared++
+	return nil
+}
+
+// RUnlock releases a shared lock.
+func (l *fileLock) RUnlock() {
+	l.mu.Lock()
+	l.shared--
+	if l.shared == 0 {
+		unlockFile(l.f)
+	}
+	l.mu.Unlock()
+	l.rw.RUnlock()
+}
+
+// Lock acquires the lock exclusively.
+func (l *fileLock) Lock() error {
+	l.rw.Lock()
+	if err := lockFile(l.f, true); err != nil {
+		l.rw.Unlock()
+		return fmt.Errorf("failed to lock cache directory: %w", err)
+	}
+	return nil
+}
+
+// Unlock releases an exclusive lock.
+func (l *fileLock) Unlock() {
+	unlockFile(l.f)
+	l.rw.Unlock()
+}
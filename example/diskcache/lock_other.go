@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package diskcache
+
+import "os"
+
+// lockFile is a no-op on platforms without file locking; only goroutines of
+// the same process are synchronized there.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,74 @@
+package diskcache
+
+import (
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+// WriteManifest writes a manifest of every entry in the cache directory to
+// w. Action files that cannot be parsed, and entry files without an entry
+// attached, are left out.
+func (h *LocalDiskCacheHandler) WriteManifest(w io.Writer) error {
+	mw, err := manifest.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	return h.Entries(mw.Write)
+}
+
+// Entries calls fn for every entry in the cache directory, in no particular
+// order, and stops at the first error fn returns. Like WriteManifest, it
+// skips the entries that cannot be read.
+func (h *LocalDiskCacheHandler) Entries(fn func(manifest.Entry) error) error {
+	return h.walkEntries(func(_ string, actionID []byte, e indexEntry) error {
+		return fn(manifest.Entry{
+			ActionID: actionID,
+			OutputID: e.outputID,
+			Size:     e.size,
+			Time:     e.time,
+			Tags:     e.tags,
+		})
+	})
+}
+
+// walkEntries calls fn with the path, ActionID and entry of every action
+// file, or entry file with WithXattrMetadata, that can be read.
+func (h *LocalDiskCacheHandler) walkEntries(fn func(path string, actionID []byte, e indexEntry) error) error {
+	return filepath.WalkDir(h.cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		var e indexEntry
+		name := d.Name()
+		hexID, ok := strings.CutSuffix(name, actionFileSuffix)
+		if ok {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			if e, err = parseEntry(strings.Fields(string(data))); err != nil {
+				return nil
+			}
+		} else if hexID, ok = strings.CutSuffix(name, entryFileSuffix); ok {
+			if e, err = readEntryXattr(path); err != nil {
+				return nil
+			}
+		} else {
+			return nil
+		}
+		actionID, err := hex.DecodeString(hexID)
+		if err != nil {
+			return nil
+		}
+		return fn(path, actionID, e)
+	})
+}
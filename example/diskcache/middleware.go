@@ -2,61 +2,102 @@ package diskcache
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"math/rand/v2"
 	"time"
 
+	"github.com/hirasawayuki/go-cache-prog/actiongraph"
 	"github.com/hirasawayuki/go-cache-prog/cache"
 )
 
-type loggingResponseWriter struct {
-	cache.ResponseWriter
-	requestID int64
-	command   cache.Cmd
-}
-
-func (lw *loggingResponseWriter) WriteResponse(res cache.Response) {
+func logResponse(session string, r *cache.Request, res cache.Response) {
 	switch {
 	case res.Err != "":
-		log.Printf("response error for id=%d: %s", lw.requestID, res.Err)
+		log.Printf("response error for session=%s id=%d: %s", session, r.ID, res.Err)
 	case res.Miss:
-		log.Printf("cache miss for id=%d", lw.requestID)
-	case lw.command == cache.CmdGet:
-		log.Printf("cache hit for id=%d, size=%d bytes", lw.requestID, res.Size)
-	case lw.command == cache.CmdPut:
-		log.Printf("cache saved for id=%d, diskpath=%s", lw.requestID, res.DiskPath)
-	case lw.command == cache.CmdClose:
-		log.Printf("cache closed for id=%d", lw.requestID)
+		log.Printf("cache miss for session=%s id=%d", session, r.ID)
+	case r.Command == cache.CmdGet:
+		log.Printf("cache hit for session=%s id=%d, size=%d bytes", session, r.ID, res.Size)
+	case r.Command == cache.CmdPut:
+		log.Printf("cache saved for session=%s id=%d, diskpath=%s", session, r.ID, res.DiskPath)
+	case r.Command == cache.CmdClose:
+		log.Printf("cache closed for session=%s id=%d", session, r.ID)
+	}
+}
+
+// logReceived logs the receipt of r, with the package and mode of its
+// action when an actiongraph.Annotator resolved it.
+func logReceived(ctx context.Context, session string, r *cache.Request) {
+	var action string
+	if a, ok := actiongraph.ActionFromContext(ctx); ok {
+		action = fmt.Sprintf(", package=%s, mode=%s", a.Package, a.Mode)
+	}
+	switch r.Command {
+	case cache.CmdGet:
+		log.Printf("get request received: session=%s id=%d, actionID=%x%s", session, r.ID, r.ActionID, action)
+	case cache.CmdPut:
+		log.Printf("put request received: session=%s id=%d, actionID=%x, bodySize=%d%s", session, r.ID, r.ActionID, r.BodySize, action)
+	case cache.CmdClose:
+		log.Printf("close request received: session=%s id=%d", session, r.ID)
+	default:
+		log.Printf("unknown command received: session=%s id=%d, command=%s", session, r.ID, r.Command)
 	}
+}
+
+// LoggingOption configures LoggingMiddleware.
+type LoggingOption func(*loggingConfig)
 
-	lw.ResponseWriter.WriteResponse(res)
+type loggingConfig struct {
+	sampleRate float64
+	slow       time.Duration
 }
 
-func LoggingMiddleware() cache.Middleware {
+// WithLogSampling logs only a fraction rate of the requests, plus every
+// request that fails or takes at least slow, which bounds the cost of
+// logging on builds issuing 100k requests. Failed and slow requests that
+// were not sampled are logged once they complete. A zero slow logs no
+// request for being slow.
+func WithLogSampling(rate float64, slow time.Duration) LoggingOption {
+	return func(c *loggingConfig) {
+		c.sampleRate = rate
+		c.slow = slow
+	}
+}
+
+// LoggingMiddleware logs every request, its response and its duration.
+func LoggingMiddleware(opts ...LoggingOption) cache.Middleware {
+	cfg := loggingConfig{sampleRate: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	return func(next cache.Handler) cache.Handler {
 		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
 			start := time.Now()
+			session, _ := cache.SessionIDFromContext(ctx)
 
-			switch r.Command {
-			case cache.CmdGet:
-				log.Printf("get request received: id=%d, actionID=%x", r.ID, r.ActionID)
-			case cache.CmdPut:
-				log.Printf("put request received: id=%d, actionID=%x, bodySize=%d", r.ID, r.ActionID, r.BodySize)
-			case cache.CmdClose:
-				log.Printf("close request received: id=%d", r.ID)
-			default:
-				log.Printf("unknown command received: id=%d, command=%s", r.ID, r.Command)
+			sampled := cfg.sampleRate >= 1 || rand.Float64() < cfg.sampleRate
+			if sampled {
+				logReceived(ctx, session, r)
 			}
 
-			lw := &loggingResponseWriter{
-				ResponseWriter: w,
-				requestID:      r.ID,
-				command:        r.Command,
-			}
-
-			next.Handle(ctx, lw, r)
+			ww := cache.WrapResponseWriter(w)
+			next.Handle(ctx, ww, r)
+			res, ok := ww.Response()
 
 			duration := time.Since(start)
-			log.Printf("request id=%d completed in %v", r.ID, duration)
+			if !sampled {
+				failed := ok && res.Err != ""
+				slow := cfg.slow > 0 && duration >= cfg.slow
+				if !failed && !slow {
+					return
+				}
+				logReceived(ctx, session, r)
+			}
+			if ok {
+				logResponse(session, r, res)
+			}
+			log.Printf("request session=%s id=%d completed in %v", session, r.ID, duration)
 		})
 	}
 }
@@ -0,0 +1,132 @@
+package diskcache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// layoutVersion is the version of the on-disk layout written by this
+// package. It is stored in the VERSION file of the cache directory and
+// increases whenever the layout or metadata format changes in a way older
+// versions cannot read, with a migration added to migrations.
+const layoutVersion = 1
+
+const versionFileName = "VERSION"
+
+// migration upgrades a cache directory from one layout version to the next.
+type migration struct {
+	desc string
+	run  func(dir string) error
+}
+
+// migrations[v] upgrades layout version v to v+1. Directories without a
+// VERSION file are version 0.
+var migrations = []migration{
+	{"remove partial files left by non-atomic writes", sweepPartialFiles},
+}
+
+// Migrate upgrades the cache directory at dir to the current layout,
+// preserving its entries, and returns the version it started from. It
+// holds the directory lock exclusively, so it is safe to run while other
+// processes use the cache.
+func Migrate(dir string) (int, error) {
+	lock, err := openFileLock(filepath.Join(dir, "lock"))
+	if err != nil {
+		return 0, err
+	}
+	defer lock.f.Close()
+	if err := lock.Lock(); err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	return migrate(dir)
+}
+
+// migrate upgrades dir to the current layout. The caller holds the
+// directory lock exclusively.
+func migrate(dir string) (int, error) {
+	from, err := readLayoutVersion(dir)
+	if err != nil {
+		return 0, err
+	}
+	if from > layoutVersion {
+		return from, fmt.Errorf("cache directory has layout version %d, newer than the supported %d", from, layoutVersion)
+	}
+	for v := from; v < layoutVersion; v++ {
+		m := migrations[v]
+		log.Printf("Migrating cache directory from layout version %d to %d: %s", v, v+1, m.desc)
+		if err := m.run(dir); err != nil {
+			return from, fmt.Errorf("failed to migrate from layout version %d: %w", v, err)
+		}
+		// Record every step, so an interrupted upgrade resumes where it
+		// stopped.
+		if err := writeLayoutVersion(dir, v+1); err != nil {
+			return from, err
+		}
+	}
+	return from, nil
+}
+
+func readLayoutVersion(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, versionFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read layout version: %w", err)
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse layout version: %w", err)
+	}
+	return v, nil
+}
+
+func writeLayoutVersion(dir string, v int) error {
+	err := writeFileAtomic(filepath.Join(dir, versionFileName), func(f *os.File) error {
+		_, err := fmt.Fprintf(f, "%d\n", v)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write layout version: %w", err)
+	}
+	return nil
+}
+
+// sweepPartialFiles removes the temporary files of interrupted atomic
+// writes, and action files that cannot be parsed because an older version
+// wrote them in place and was interrupted. Their entries become misses
+// instead of errors.
+func sweepPartialFiles(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		switch {
+		case strings.Contains(name, ".tmp"):
+			return removeIfExists(path)
+		case strings.HasSuffix(name, actionFileSuffix):
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if _, err := parseEntry(strings.Fields(string(data))); err != nil {
+				return removeIfExists(path)
+			}
+		}
+		return nil
+	})
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package diskcache
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// MissStats counts the misses of a handler by cause. Misses other than
+// Absent are entries that were put but are no longer served; a growing
+// Corrupt count means the cache is quietly throwing data away.
+type MissStats struct {
+	Absent  int64 // never put, or removed with its action file
+	Evicted int64 // the object was evicted while the action file was kept
+	Corrupt int64 // the object has the wrong size or the signature does not verify
+	Expired int64 // older than the maximum age of WithMaxEntryAge
+}
+
+// missKind is a cause of miss, indexing the miss counters.
+type missKind int
+
+const (
+	missAbsent missKind = iota
+	missEvicted
+	missCorrupt
+	missExpired
+)
+
+var missKindNames = [...]string{"absent", "evicted", "corrupt", "expired"}
+
+// WithMissLogging logs every miss of an entry that was put, with its
+// cause. Misses of entries that were never put are only counted.
+func WithMissLogging() Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.logMisses = true
+	}
+}
+
+// Misses returns the misses of the handler since it was created.
+func (h *LocalDiskCacheHandler) Misses() MissStats {
+	return MissStats{
+		Absent:  h.misses[missAbsent].Load(),
+		Evicted: h.misses[missEvicted].Load(),
+		Corrupt: h.misses[missCorrupt].Load(),
+		Expired: h.misses[missExpired].Load(),
+	}
+}
+
+// miss answers r with a miss of the given cause.
+func (h *LocalDiskCacheHandler) miss(w cache.ResponseWriter, r *cache.Request, kind missKind, detail string) {
+	h.countMiss(r, kind, detail)
+	cache.WriteError(w, r, cache.ErrMiss)
+}
+
+// countMiss counts, and with WithMissLogging logs, a miss of r.
+func (h *LocalDiskCacheHandler) countMiss(r *cache.Request, kind missKind, detail string) {
+	h.misses[kind].Add(1)
+	if h.logMisses && kind != missAbsent {
+		log.Printf("%s entry: actionID=%x: %s", missKindNames[kind], r.ActionID, detail)
+	}
+}
+
+// missCounters are the counters of MissStats, indexed by missKind.
+type missCounters [len(missKindNames)]atomic.Int64
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package diskcache
+
+import "os"
+
+// renameFile renames oldpath to newpath, replacing newpath atomically.
+func renameFile(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
@@ -0,0 +1,27 @@
+package diskcache
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION from winerror.h.
+const errorSharingViolation = syscall.Errno(32)
+
+// renameFile renames oldpath to newpath, replacing newpath. os.Rename uses
+// MoveFileEx with MOVEFILE_REPLACE_EXISTING on Windows, which fails while
+// another process has newpath open, for example a go command reading the
+// DiskPath of a concurrent build. Such failures are retried briefly.
+func renameFile(oldpath, newpath string) error {
+	var err error
+	for i := range 5 {
+		err = os.Rename(oldpath, newpath)
+		if err == nil || !(errors.Is(err, syscall.ERROR_ACCESS_DENIED) || errors.Is(err, errorSharingViolation)) {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+	return err
+}
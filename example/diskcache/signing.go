@@ -0,0 +1,93 @@
+package diskcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"log"
+	"os"
+
+	"github.com/hirasawayuki/go-cache-prog/signing"
+)
+
+// WithSigner signs every entry on put and verifies the signature on get.
+// Entries that are unsigned, or whose signature does not verify, are
+// reported as misses, so writers without the key cannot poison a cache
+// directory shared between machines. With a verify-only signer, puts fail.
+//
+// The signature covers the OutputID, which the go command computes as the
+// SHA-256 of the output, so gets also check that the object file hashes to
+// it: replacing the object of a signed entry makes the entry corrupt. An
+// object is hashed on its first get by the process and again whenever its
+// size or modification time changes.
+func WithSigner(s signing.Signer) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.signer = s
+	}
+}
+
+// sign sets the signature of e for actionID.
+func (h *LocalDiskCacheHandler) sign(actionID []byte, e *indexEntry) error {
+	if h.signer == nil {
+		return nil
+	}
+	sig, err := h.signer.Sign(signing.Message(actionID, e.outputID, e.size))
+	if err != nil {
+		return err
+	}
+	e.sig = sig
+	return nil
+}
+
+// verify reports whether e may be served for actionID.
+func (h *LocalDiskCacheHandler) verify(actionID []byte, e indexEntry) bool {
+	if h.signer == nil {
+		return true
+	}
+	if h.signer.Verify(signing.Message(actionID, e.outputID, e.size), e.sig) {
+		return true
+	}
+	log.Printf("rejecting entry with invalid signature: actionID=%x", actionID)
+	return false
+}
+
+// verifiedObject is the state of an object file when it was last verified.
+type verifiedObject struct {
+	size    int64
+	modTime int64
+}
+
+// verifyObject reports whether the object file at path, for e, hashes to
+// the OutputID of e. It is true without a signer, since the OutputID is
+// then not trusted anyway. Files that do not match are removed.
+func (h *LocalDiskCacheHandler) verifyObject(path string, e indexEntry) bool {
+	if h.signer == nil {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		// Missing objects are reported by the caller.
+		return true
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	state := verifiedObject{size: fi.Size(), modTime: fi.ModTime().UnixNano()}
+	if v, ok := h.verified.Load(path); ok && v.(verifiedObject) == state {
+		return true
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return false
+	}
+	if !bytes.Equal(sum.Sum(nil), e.outputID) {
+		log.Printf("rejecting object not matching its OutputID: %s", path)
+		h.verified.Delete(path)
+		removeFile(path)
+		return false
+	}
+	h.verified.Store(path, state)
+	return true
+}
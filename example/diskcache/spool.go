@@ -0,0 +1,81 @@
+package diskcache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// WithSpoolDir receives put bodies into temporary files in dir before they
+// are moved into the cache directory. Placing dir on a fast local volume,
+// such as a tmpfs, frees the go command's stdin as fast as it can write when
+// the cache directory is on a network mount. The move is a rename when both
+// directories are on the same volume and a copy to a temporary file renamed
+// into place otherwise, so readers never observe a partial object either way.
+func WithSpoolDir(dir string) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.spoolDir = dir
+	}
+}
+
+// writeObject writes the size bytes of body to the object file at path,
+// through the spool directory if one is set. The size is checked before the
+// object is moved into place, so that a short body never leaves a truncated
+// object behind.
+func (h *LocalDiskCacheHandler) writeObject(path string, body io.Reader, size int64) error {
+	copyBody := func(f *os.File) error {
+		n, err := io.Copy(f, body)
+		if err == nil && n != size {
+			err = cache.Errorf(cache.CodeInvalidRequest, "body has %d bytes, want %d", n, size)
+		}
+		return err
+	}
+	// A body spilled by the server (see cache.WithBodySpillThreshold) is
+	// renamed into place when it is on the same volume.
+	if f, ok := body.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Size() == size && f.Chmod(0644) == nil && renameFile(f.Name(), path) == nil {
+			return nil
+		}
+	}
+	if h.spoolDir == "" {
+		return writeFileAtomic(path, copyBody)
+	}
+
+	f, err := os.CreateTemp(h.spoolDir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+	err = f.Chmod(0644)
+	if err == nil {
+		err = copyBody(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return moveFileAtomic(f.Name(), path)
+}
+
+// moveFileAtomic moves src to dst, replacing dst atomically. A rename fails
+// across volumes, in which case src is copied to a temporary file next to
+// dst that is renamed into place.
+func moveFileAtomic(src, dst string) error {
+	if err := renameFile(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open spool file: %w", err)
+	}
+	defer in.Close()
+	return writeFileAtomic(dst, func(f *os.File) error {
+		_, err := io.Copy(f, in)
+		return err
+	})
+}
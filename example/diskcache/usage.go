@@ -0,0 +1,195 @@
+package diskcache
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/clock"
+)
+
+// WithUsageJournal records when objects are used in a table persisted at
+// path, instead of in their modification times. Uses are appended to a
+// journal next to it as they happen and folded into the table on Close, so
+// a crashed build loses none of them, and trimming reads the sizes and
+// times of known objects from the table rather than stat-ing every file.
+//
+// Processes sharing the cache directory share the journal. Uses appended
+// by one of them while another folds the journal can be lost, which only
+// makes their objects look older.
+func WithUsageJournal(path string) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.usagePath = path
+	}
+}
+
+// usageEntry is the size and time of last use of an object.
+type usageEntry struct {
+	size int64
+	used time.Time
+}
+
+// usage is the table of object uses, keyed by the raw OutputID. It is
+// persisted like the index: a snapshot of "<outputID> <size> <time>" lines
+// plus a journal of the changes since, where "<outputID> -" removes an
+// object.
+type usage struct {
+	path  string
+	clock clock.Clock
+
+	mu      sync.Mutex
+	m       map[string]usageEntry
+	journal *os.File // opened for appending
+}
+
+// loadUsage reads the usage snapshot at path and replays its journal.
+func loadUsage(path string, c clock.Clock) (*usage, error) {
+	u := &usage{
+		path:  path,
+		clock: c,
+		m:     make(map[string]usageEntry),
+	}
+	if err := u.replay(path); err != nil {
+		return nil, err
+	}
+	if err := u.replay(path + journalSuffix); err != nil {
+		return nil, err
+	}
+	var err error
+	u.journal, err = os.OpenFile(path+journalSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open usage journal: %w", err)
+	}
+	return u, nil
+}
+
+// replay applies the lines of the snapshot or journal at path, keeping the
+// latest use of each object. Unparsable lines are skipped.
+func (u *usage) replay(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open usage table: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		outputID, err := hex.DecodeString(fields[0])
+		if err != nil {
+			continue
+		}
+		if fields[1] == "-" {
+			delete(u.m, string(outputID))
+			continue
+		}
+		if len(fields) < 3 {
+			continue
+		}
+		size, err1 := strconv.ParseInt(fields[1], 10, 64)
+		used, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		e := usageEntry{size: size, used: time.Unix(used, 0)}
+		if old, ok := u.m[string(outputID)]; !ok || e.used.After(old.used) {
+			u.m[string(outputID)] = e
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read usage table: %w", err)
+	}
+	return nil
+}
+
+// record marks the object of outputID as used now. Like mtime updates, a
+// use is only journaled if the last one is older than mtimeInterval.
+func (u *usage) record(outputID []byte, size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := u.clock.Now()
+	if e, ok := u.m[string(outputID)]; ok && e.size == size && now.Sub(e.used) < mtimeInterval {
+		return
+	}
+	u.m[string(outputID)] = usageEntry{size: size, used: now}
+	if _, err := fmt.Fprintf(u.journal, "%x %d %d\n", outputID, size, now.Unix()); err != nil {
+		log.Printf("failed to append to usage journal: %v", err)
+	}
+}
+
+// lookup returns the usage of the object of outputID.
+func (u *usage) lookup(outputID []byte) (usageEntry, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	e, ok := u.m[string(outputID)]
+	return e, ok
+}
+
+// remove drops the objects in outputIDs, keyed by the raw OutputID, after
+// they were deleted.
+func (u *usage) remove(outputIDs map[string]struct{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for id := range outputIDs {
+		if _, ok := u.m[id]; !ok {
+			continue
+		}
+		delete(u.m, id)
+		if _, err := fmt.Fprintf(u.journal, "%x -\n", id); err != nil {
+			log.Printf("failed to append to usage journal: %v", err)
+		}
+	}
+}
+
+// fold replays the journal, picking up the uses recorded by other
+// processes, writes the table to a new snapshot and truncates the journal.
+func (u *usage) fold() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.replay(u.path + journalSuffix); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(u.path), filepath.Base(u.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create usage table: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for outputID, e := range u.m {
+		fmt.Fprintf(w, "%x %d %d\n", outputID, e.size, e.used.Unix())
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), u.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write usage table: %w", err)
+	}
+	if err := u.journal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate usage journal: %w", err)
+	}
+	return nil
+}
+
+// close closes the journal.
+func (u *usage) close() error {
+	return u.journal.Close()
+}
@@ -0,0 +1,236 @@
+package diskcache
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DiskPolicy is what the disk watchdog does when free space runs low.
+type DiskPolicy int
+
+const (
+	// EvictOldest deletes the least recently used objects until free
+	// space is back above the threshold, plus 10% headroom.
+	EvictOldest DiskPolicy = iota
+
+	// ReadOnly rejects puts with a retryable error until free space
+	// recovers. Gets are still served.
+	ReadOnly
+)
+
+// WithDiskWatchdog checks the free space of the cache volume every interval
+// and applies policy when it drops below minFree bytes, instead of letting
+// puts fail with ENOSPC in the middle of a build.
+func WithDiskWatchdog(minFree uint64, interval time.Duration, policy DiskPolicy) Option {
+	return func(h *LocalDiskCacheHandler) {
+		h.minFree = minFree
+		h.checkInterval = interval
+		h.diskPolicy = policy
+	}
+}
+
+// watchDisk runs checkDisk every check interval until Close is called.
+func (h *LocalDiskCacheHandler) watchDisk() {
+	defer h.wg.Done()
+	h.checkDisk()
+	ticker := time.NewTicker(h.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.checkDisk()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// checkDisk compares the free space with the threshold and applies the
+// disk policy.
+func (h *LocalDiskCacheHandler) checkDisk() {
+	free, err := freeSpace(h.cacheDir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return
+	} else if err != nil {
+		log.Printf("failed to check free disk space: %v", err)
+		return
+	}
+
+	if h.pressureFree > 0 {
+		low := free < h.pressureFree
+		if h.underPressure.Swap(low) != low {
+			log.Printf("free disk space is %d bytes, admission policy active: %v", free, low)
+		}
+	}
+	if h.minFree == 0 {
+		return
+	}
+
+	if h.diskPolicy == ReadOnly {
+		low := free < h.minFree
+		if h.readOnly.Swap(low) != low {
+			log.Printf("free disk space is %d bytes, read-only mode: %v", free, low)
+		}
+		return
+	}
+
+	if free >= h.minFree {
+		return
+	}
+	target := h.minFree + h.minFree/10
+	n, freed, err := h.evictOldest(int64(target - free))
+	if err != nil {
+		log.Printf("emergency eviction failed: %v", err)
+	}
+	log.Printf("free disk space was %d bytes, evicted %d objects (%d bytes)", free, n, freed)
+}
+
+// object is an object file considered for eviction.
+type object struct {
+	path     string
+	outputID []byte
+	size     int64
+	modTime  time.Time // time of the last put or, within an hour, use
+}
+
+// evictOldest deletes object files, least recently used first, until at
+// least need bytes are freed. Action files pointing at deleted objects are
+// left in place; gets for them report a miss.
+func (h *LocalDiskCacheHandler) evictOldest(need int64) (int, int64, error) {
+	return h.evict(func(o object, freed int64) bool { return freed < need })
+}
+
+// Evict deletes object files, least recently used first, until at least
+// need bytes are freed, and returns the number of objects and bytes freed.
+func (h *LocalDiskCacheHandler) Evict(need int64) (int, int64, error) {
+	return h.evictOldest(need)
+}
+
+// Usage returns the bytes used by the object files in the cache directory.
+func (h *LocalDiskCacheHandler) Usage() (int64, error) {
+	objects, err := h.listObjects()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, o := range objects {
+		n += o.size
+	}
+	return n, nil
+}
+
+// Prune deletes the object files last used more than maxAge ago, and returns
+// the number of objects and bytes freed.
+func (h *LocalDiskCacheHandler) Prune(maxAge time.Duration) (int, int64, error) {
+	cutoff := h.clock.Now().Add(-maxAge)
+	return h.evict(func(o object, _ int64) bool { return o.modTime.Before(cutoff) })
+}
+
+// evict deletes object files, least recently used first, while more
+// returns true for the next one and the bytes freed so far.
+func (h *LocalDiskCacheHandler) evict(more func(o object, freed int64) bool) (int, int64, error) {
+	if err := h.lock.Lock(); err != nil {
+		return 0, 0, err
+	}
+	defer h.lock.Unlock()
+
+	objects, err := h.listObjects()
+	if err != nil {
+		return 0, 0, err
+	}
+	slices.SortFunc(objects, func(a, b object) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	var (
+		n     int
+		freed int64
+	)
+	evicted := make(map[string]struct{})
+	for _, o := range objects {
+		if !more(o, freed) {
+			break
+		}
+		if h.inUse.held(o.path) {
+			continue
+		}
+		if err := os.Remove(o.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		h.touched.Delete(o.path)
+		n++
+		freed += o.size
+		evicted[string(o.outputID)] = struct{}{}
+	}
+	if h.index != nil {
+		h.index.removeOutputs(evicted)
+	}
+	if h.usage != nil {
+		h.usage.remove(evicted)
+	}
+	return n, freed, nil
+}
+
+// listObjects returns every object file in the cache directory, including
+// the entry files of WithXattrMetadata. With WithUsageJournal, the size and
+// time of objects in the usage table are taken from it without a stat.
+func (h *LocalDiskCacheHandler) listObjects() ([]object, error) {
+	var objects []object
+	err := filepath.WalkDir(h.cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		var outputID []byte
+		name := d.Name()
+		if hexID, ok := strings.CutSuffix(name, objectFileSuffix); ok {
+			if outputID, err = hex.DecodeString(hexID); err != nil {
+				return nil
+			}
+		} else if strings.HasSuffix(name, entryFileSuffix) {
+			// Entry files of WithXattrMetadata hold their object; those
+			// without an entry attached were never admitted.
+			if e, err := readEntryXattr(path); err == nil {
+				outputID = e.outputID
+			}
+		} else {
+			return nil
+		}
+		if h.usage != nil && outputID != nil {
+			if u, ok := h.usage.lookup(outputID); ok {
+				objects = append(objects, object{
+					path:     path,
+					outputID: outputID,
+					size:     u.size,
+					modTime:  u.used,
+				})
+				return nil
+			}
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, object{
+			path:     path,
+			outputID: outputID,
+			size:     info.Size(),
+			modTime:  info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	return objects, nil
+}
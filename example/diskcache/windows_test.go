@@ -0,0 +1,65 @@
+//go:build windows
+
+package diskcache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+func TestRenameFileOverOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.WriteFile(src, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader holding dst open, like a go command reading a DiskPath,
+	// makes the rename fail until it closes the file.
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, func() { f.Close() })
+
+	if err := renameFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != "new" {
+		t.Fatalf("dst = %q, want %q", b, "new")
+	}
+}
+
+func TestDiskPathUsesBackslashes(t *testing.T) {
+	h, err := NewExampleCacheHandler(WithDir(filepath.ToSlash(t.TempDir())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	body := []byte("hello")
+	res := cache.Call(context.Background(), cache.HandlerFunc(h.HandlePut), &cache.Request{
+		ID:       1,
+		Command:  cache.CmdPut,
+		ActionID: bytes.Repeat([]byte{1}, 32),
+		OutputID: bytes.Repeat([]byte{2}, 32),
+		Body:     bytes.NewReader(body),
+		BodySize: int64(len(body)),
+	})
+	if res.Err != "" {
+		t.Fatalf("put failed: %s", res.Err)
+	}
+	if !filepath.IsAbs(res.DiskPath) || strings.Contains(res.DiskPath, "/") {
+		t.Fatalf("DiskPath = %q, want an absolute path with backslashes", res.DiskPath)
+	}
+}
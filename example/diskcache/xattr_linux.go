@@ -0,0 +1,24 @@
+package diskcache
+
+import "syscall"
+
+// getxattr returns the extended attribute name of the file at path.
+func getxattr(path, name string) ([]byte, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, 2*len(buf))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// setxattr sets the extended attribute name of the file at path.
+func setxattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package diskcache
+
+func getxattr(path, name string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+func setxattr(path, name string, value []byte) error {
+	return errXattrUnsupported
+}
@@ -0,0 +1,254 @@
+// Package failover spreads the requests of an HTTP cache backend over a
+// list of equivalent endpoints, such as a regional cache and its secondary,
+// so that an outage of one endpoint degrades to the next instead of turning
+// every lookup into a miss.
+//
+// A Transport sends each request to the most preferred healthy endpoint.
+// An endpoint is marked unhealthy when a request to it fails with a network
+// error or a 5xx status, and the request is retried on the next endpoint.
+// Unhealthy endpoints are tried again after a cooldown or, when health
+// checks are enabled with Run, once a check succeeds; requests then fail
+// back to the preferred endpoint.
+package failover
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCooldown is how long an endpoint is skipped after a failure when
+// no health check is running.
+const DefaultCooldown = 30 * time.Second
+
+// Transport is an http.RoundTripper that fails over between endpoints.
+// Requests are built against the first endpoint; their URL prefix is
+// rewritten for the endpoint that serves them.
+type Transport struct {
+	Base     http.RoundTripper // http.DefaultTransport if nil
+	Cooldown time.Duration     // DefaultCooldown if zero
+	Logger   *slog.Logger      // slog.Default() if nil
+
+	endpoints []*endpoint
+}
+
+type endpoint struct {
+	url *url.URL
+
+	mu        sync.Mutex
+	downUntil time.Time // zero while healthy
+	checked   bool      // health checks decide when the endpoint is back
+}
+
+// New returns a Transport over endpoints, which are base URLs in order of
+// preference.
+func New(base http.RoundTripper, endpoints ...string) (*Transport, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no endpoints")
+	}
+	t := &Transport{Base: base}
+	for _, s := range endpoints {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %w", s, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q: want an absolute URL", s)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		t.endpoints = append(t.endpoints, &endpoint{url: u})
+	}
+	return t, nil
+}
+
+// Active returns the base URL of the endpoint requests are currently sent
+// to, or the primary's if none is healthy.
+func (t *Transport) Active() string {
+	now := time.Now()
+	for _, e := range t.endpoints {
+		if e.healthy(now) {
+			return e.url.String()
+		}
+	}
+	return t.endpoints[0].url.String()
+}
+
+// RoundTrip implements http.RoundTripper. Healthy endpoints are tried in
+// order of preference, then unhealthy ones as a last resort. A request is
+// only retried on another endpoint if its body can be replayed, that is if
+// it has no body or GetBody is set.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	now := time.Now()
+	var order []*endpoint
+	for _, healthy := range []bool{true, false} {
+		for _, e := range t.endpoints {
+			if e.healthy(now) == healthy {
+				order = append(order, e)
+			}
+		}
+	}
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	for i, e := range order {
+		r, err := t.rewrite(req, e, i > 0)
+		if err != nil {
+			return nil, err
+		}
+		res, err := t.base().RoundTrip(r)
+		if err == nil && res.StatusCode < 500 {
+			t.markUp(e)
+			return res, nil
+		}
+		if req.Context().Err() != nil {
+			return res, err
+		}
+
+		if err == nil {
+			t.markDown(e, fmt.Errorf("%s", res.Status))
+		} else {
+			t.markDown(e, err)
+		}
+		if !replayable || i == len(order)-1 {
+			// The 5xx response, if any, is the answer of the last endpoint.
+			return res, err
+		}
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+			res.Body.Close()
+		}
+	}
+	panic("unreachable")
+}
+
+// rewrite returns a copy of req for e. A retry gets a fresh body.
+func (t *Transport) rewrite(req *http.Request, e *endpoint, retry bool) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	primary := t.endpoints[0].url
+	if r.URL.Scheme == primary.Scheme && r.URL.Host == primary.Host && strings.HasPrefix(r.URL.Path, primary.Path) {
+		r.URL.Scheme = e.url.Scheme
+		r.URL.Host = e.url.Host
+		r.URL.Path = e.url.Path + strings.TrimPrefix(r.URL.Path, primary.Path)
+		r.URL.RawPath = ""
+		r.Host = ""
+	}
+	if retry && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	return r, nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *Transport) logger() *slog.Logger {
+	if t.Logger != nil {
+		return t.Logger
+	}
+	return slog.Default()
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.checked {
+		return e.downUntil.IsZero()
+	}
+	return !now.Before(e.downUntil)
+}
+
+func (t *Transport) markDown(e *endpoint, err error) {
+	cooldown := t.Cooldown
+	if cooldown == 0 {
+		cooldown = DefaultCooldown
+	}
+	e.mu.Lock()
+	wasUp := e.downUntil.IsZero() || time.Now().After(e.downUntil)
+	e.downUntil = time.Now().Add(cooldown)
+	e.mu.Unlock()
+	if wasUp {
+		t.logger().Warn("cache endpoint is unhealthy, failing over", slog.String("endpoint", e.url.String()), slog.Any("error", err))
+	}
+}
+
+func (t *Transport) markUp(e *endpoint) {
+	e.mu.Lock()
+	wasDown := !e.downUntil.IsZero()
+	e.downUntil = time.Time{}
+	e.mu.Unlock()
+	if wasDown {
+		t.logger().Info("cache endpoint is healthy again", slog.String("endpoint", e.url.String()))
+	}
+}
+
+// Run checks the health of every endpoint every interval until ctx is done,
+// by sending a GET request for path relative to its base URL; a 2xx or 3xx
+// answer is healthy. While Run is active, unhealthy endpoints stay out of
+// rotation until a check succeeds instead of for a cooldown.
+func (t *Transport) Run(ctx context.Context, path string, interval time.Duration) {
+	for _, e := range t.endpoints {
+		e.mu.Lock()
+		e.checked = true
+		e.mu.Unlock()
+	}
+	defer func() {
+		for _, e := range t.endpoints {
+			e.mu.Lock()
+			e.checked = false
+			e.mu.Unlock()
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, e := range t.endpoints {
+			if err := t.check(ctx, e, path, interval); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				t.markDown(e, err)
+			} else {
+				t.markUp(e)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check sends one health check to e.
+func (t *Transport) check(ctx context.Context, e *endpoint, path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url.JoinPath(path).String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := t.base().RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("health check: %s", res.Status)
+	}
+	return nil
+}
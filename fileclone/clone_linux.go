@@ -0,0 +1,40 @@
+package fileclone
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request from linux/fs.h.
+const ficlone = 0x40049409
+
+// cloneFile makes dst share the data blocks of src using the FICLONE ioctl.
+// It fails with EOPNOTSUPP or EXDEV when the filesystem cannot reflink or
+// the files are on different filesystems.
+func cloneFile(dst, src *os.File) error {
+	dstConn, err := dst.SyscallConn()
+	if err != nil {
+		return err
+	}
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+	err = dstConn.Control(func(dstFd uintptr) {
+		err := srcConn.Control(func(srcFd uintptr) {
+			_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, dstFd, ficlone, srcFd)
+		})
+		if err != nil {
+			errno = syscall.EBADF
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package fileclone
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is not implemented on this platform; Clone falls back to hard
+// links and copies. On macOS, clonefile(2) is only reachable through
+// golang.org/x/sys, which this module does not depend on.
+func cloneFile(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
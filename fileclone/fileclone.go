@@ -0,0 +1,144 @@
+// Package fileclone materializes files without copying their content when
+// the filesystem allows it.
+//
+// Backends that keep objects in a local store can use Clone to expose an
+// object at the DiskPath the go command reads, instead of copying a possibly
+// large body. Clone tries, in order, a reflink (a copy-on-write clone that
+// shares the data blocks, supported by btrfs and xfs on Linux), a hard link,
+// and finally a regular copy.
+package fileclone
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Method is the way a file was materialized by Clone.
+type Method int
+
+const (
+	// Reflink means dst shares the data blocks of src copy-on-write.
+	Reflink Method = iota + 1
+
+	// HardLink means dst is another name for src. Writing to one of them
+	// changes the other, so the files must be treated as read-only.
+	HardLink
+
+	// Copy means the content of src was copied to dst.
+	Copy
+)
+
+// String returns the name of the method.
+func (m Method) String() string {
+	switch m {
+	case Reflink:
+		return "reflink"
+	case HardLink:
+		return "hardlink"
+	case Copy:
+		return "copy"
+	}
+	return fmt.Sprintf("Method(%d)", int(m))
+}
+
+// Clone makes the content of src available at dst using the cheapest method
+// the filesystem supports. dst is replaced atomically if it exists, so a
+// concurrent reader never observes a partially written file.
+func Clone(src, dst string) (Method, error) {
+	if err := reflink(src, dst); err == nil {
+		return Reflink, nil
+	}
+	if err := hardLink(src, dst); err == nil {
+		return HardLink, nil
+	}
+	if err := CopyFile(src, dst); err != nil {
+		return 0, err
+	}
+	return Copy, nil
+}
+
+// CopyFile copies the content of src to dst through a temporary file that
+// is renamed into place.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer in.Close()
+
+	return writeAtomic(dst, func(f *os.File) error {
+		if _, err := io.Copy(f, in); err != nil {
+			return fmt.Errorf("failed to copy file: %w", err)
+		}
+		return nil
+	})
+}
+
+// hardLink links src to a temporary name next to dst and renames it into
+// place, which, unlike os.Link alone, replaces an existing dst.
+func hardLink(src, dst string) error {
+	tmp, err := tempName(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// reflink clones src to dst with a copy-on-write clone.
+func reflink(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return writeAtomic(dst, func(f *os.File) error {
+		return cloneFile(f, in)
+	})
+}
+
+// writeAtomic creates a temporary file next to dst, lets fill write it and
+// renames it over dst. The temporary file is removed on failure.
+func writeAtomic(dst string, fill func(f *os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	err = fill(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// tempName returns an unused name for a temporary hard link next to dst.
+// The name is picked by os.CreateTemp, so that concurrent links to dst,
+// from this process or others, do not collide; the file it creates is
+// removed for os.Link to create the name again.
+func tempName(dst string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
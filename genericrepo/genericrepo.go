@@ -0,0 +1,393 @@
+// Package genericrepo stores cache entries in a generic repository of JFrog
+// Artifactory or Sonatype Nexus, for enterprises whose build artifacts must
+// live in their artifact manager.
+//
+// Each entry is two files under the repository URL, named by hex IDs:
+//
+//	ac/<action>        the entry, as JSON with the OutputID, size and time
+//	objects/<output>   the object
+//
+// Files can be named otherwise with WithLayout.
+//
+// Objects are content addressed, so entries sharing an output share one
+// file. With Artifactory, objects are deployed by checksum first: if the
+// repository already holds the content, the upload is skipped. Properties
+// set with WithProperty are attached to every file, so that Artifactory
+// cleanup policies and AQL queries can select cache files for retention.
+package genericrepo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+	"github.com/hirasawayuki/go-cache-prog/credentials"
+	"github.com/hirasawayuki/go-cache-prog/layout"
+)
+
+// DefaultLayout names the files of entries "ac/<action>" and
+// "objects/<output>".
+var DefaultLayout = layout.Template{Action: "ac/{id}", Object: "objects/{id}"}
+
+// Flavor is the artifact manager serving the repository.
+type Flavor int
+
+const (
+	// Artifactory is JFrog Artifactory. Base URLs look like
+	// https://example.jfrog.io/artifactory/go-cache.
+	Artifactory Flavor = iota
+
+	// Nexus is Sonatype Nexus Repository. Base URLs look like
+	// https://nexus.example.com/repository/go-cache; the repository must be
+	// a raw hosted repository.
+	Nexus
+)
+
+// Client is a cache backend stored in a generic repository. Objects are
+// downloaded to, and uploaded from, a local castore.Store, since the go
+// command reads them from the DiskPath of responses.
+type Client struct {
+	base       *url.URL
+	flavor     Flavor
+	store      *castore.Store
+	http       *http.Client
+	auth       func(ctx context.Context, req *http.Request) error
+	properties map[string]string
+	layout     layout.Layout
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with c instead of http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) {
+		cl.http = c
+	}
+}
+
+// WithAPIKey authenticates with an Artifactory API key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.auth = func(_ context.Context, req *http.Request) error {
+			req.Header.Set("X-JFrog-Art-Api", key)
+			return nil
+		}
+	}
+}
+
+// WithBasicAuth authenticates with a user name and password or user token,
+// as Nexus expects.
+func WithBasicAuth(user, password string) Option {
+	return func(c *Client) {
+		c.auth = func(_ context.Context, req *http.Request) error {
+			req.SetBasicAuth(user, password)
+			return nil
+		}
+	}
+}
+
+// WithToken authenticates with bearer tokens from src, such as Artifactory
+// access tokens; wrap src in a credentials.Refresher for expiring ones.
+func WithToken(src credentials.Source) Option {
+	return func(c *Client) {
+		c.auth = func(ctx context.Context, req *http.Request) error {
+			tok, err := src.Token(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get token: %w", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tok.Value)
+			return nil
+		}
+	}
+}
+
+// WithProperty attaches the property key=value to the files of every put,
+// for example retention.policy=ci-cache. Nexus has no properties; they are
+// ignored there.
+func WithProperty(key, value string) Option {
+	return func(c *Client) {
+		if c.properties == nil {
+			c.properties = make(map[string]string)
+		}
+		c.properties[key] = value
+	}
+}
+
+// WithLayout names files with l instead of DefaultLayout.
+func WithLayout(l layout.Layout) Option {
+	return func(c *Client) {
+		c.layout = l
+	}
+}
+
+// New returns a Client of the repository at base, keeping objects in a
+// castore.Store rooted at dir.
+func New(base string, flavor Flavor, dir string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid repository URL %q", base)
+	}
+	c := &Client{
+		base:   u,
+		flavor: flavor,
+		http:   http.DefaultClient,
+		auth:   func(context.Context, *http.Request) error { return nil },
+		layout: DefaultLayout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	// DiskPath must be absolute.
+	if dir, err = filepath.Abs(dir); err != nil {
+		return nil, fmt.Errorf("failed to resolve object directory: %w", err)
+	}
+	if c.store, err = castore.New(dir); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Store returns the store of the downloaded and uploaded objects, to be
+// pruned with castore.Store.Prune.
+func (c *Client) Store() *castore.Store {
+	return c.store
+}
+
+// entry is the JSON stored for an ActionID.
+type entry struct {
+	OutputID string    `json:"output"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// Handle implements cache.Handler for the get and put commands. The close
+// command releases the objects of the session, see castore.Store.Hold;
+// other commands succeed without effect.
+func (c *Client) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	var res cache.Response
+	var err error
+	switch r.Command {
+	case cache.CmdGet:
+		res, err = c.get(ctx, r)
+	case cache.CmdPut:
+		res, err = c.put(ctx, r)
+	case cache.CmdClose:
+		c.store.ReleaseSession(ctx)
+	}
+	if err != nil {
+		cache.WriteError(w, r, err)
+		return
+	}
+	res.ID = r.ID
+	w.WriteResponse(res)
+}
+
+func (c *Client) objectPath(outputID []byte) string {
+	return c.store.Path(outputID)
+}
+
+// fileURL returns the URL of the file at name in the repository. With
+// Artifactory, properties are set with matrix parameters on the path.
+func (c *Client) fileURL(name string, withProperties bool) string {
+	u := c.base.JoinPath(name).String()
+	if !withProperties || c.flavor != Artifactory || len(c.properties) == 0 {
+		return u
+	}
+	keys := make([]string, 0, len(c.properties))
+	for k := range c.properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(u)
+	for _, k := range keys {
+		fmt.Fprintf(&b, ";%s=%s", url.PathEscape(k), url.PathEscape(c.properties[k]))
+	}
+	return b.String()
+}
+
+// do sends an authenticated request.
+func (c *Client) do(ctx context.Context, method, u string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if err := c.auth(ctx, req); err != nil {
+		return nil, cache.Errorf(cache.CodePermissionDenied, "%w", err)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, cache.Errorf(cache.CodeUnavailable, "failed to reach repository: %w", err)
+	}
+	return res, nil
+}
+
+func (c *Client) get(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	res, err := c.do(ctx, http.MethodGet, c.fileURL(c.layout.ActionKey(r.ActionID), false), nil, nil)
+	if err != nil {
+		return cache.Response{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return cache.Response{}, cache.ErrMiss
+	}
+	if res.StatusCode != http.StatusOK {
+		return cache.Response{}, errorFromStatus(res)
+	}
+	var e entry
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<10)).Decode(&e); err != nil {
+		return cache.Response{}, cache.ErrMiss
+	}
+	outputID, err := hex.DecodeString(e.OutputID)
+	if err != nil || len(outputID) == 0 {
+		return cache.Response{}, cache.ErrMiss
+	}
+
+	c.store.Hold(ctx, outputID)
+	if err := c.store.Fill(ctx, outputID, e.Size, func() error {
+		return c.download(ctx, outputID, e.Size)
+	}); err != nil {
+		return cache.Response{}, err
+	}
+	t := e.Time
+	return cache.Response{OutputID: outputID, Size: e.Size, Time: &t, DiskPath: c.objectPath(outputID)}, nil
+}
+
+// download fetches the object outputID, of size bytes, into the store.
+func (c *Client) download(ctx context.Context, outputID []byte, size int64) error {
+	res, err := c.do(ctx, http.MethodGet, c.fileURL(c.layout.ObjectKey(outputID), false), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		// Removed by a cleanup policy after the entry was read.
+		return cache.ErrMiss
+	}
+	if res.StatusCode != http.StatusOK {
+		return errorFromStatus(res)
+	}
+	if res.ContentLength >= 0 && res.ContentLength != size {
+		return cache.Errorf(cache.CodeUnavailable, "object is %d bytes, want %d", res.ContentLength, size)
+	}
+	// Reads of a body cut short of its Content-Length fail, so the store
+	// never keeps a truncated object.
+	if _, _, err := c.store.Put(outputID, io.LimitReader(res.Body, size)); err != nil {
+		return cache.Errorf(cache.CodeUnavailable, "failed to download object: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) put(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	c.store.Hold(ctx, r.OutputID)
+	// An object already in the store is kept, and the body drained.
+	path, n, err := c.store.Put(r.OutputID, r.Body)
+	if err != nil {
+		return cache.Response{}, fmt.Errorf("failed to write object: %w", err)
+	}
+	if n != r.BodySize {
+		return cache.Response{}, cache.Errorf(cache.CodeInvalidRequest, "object is %d bytes, want %d", n, r.BodySize)
+	}
+	if err := c.upload(ctx, r.OutputID, path, n); err != nil {
+		return cache.Response{}, err
+	}
+
+	now := time.Now()
+	b, err := json.Marshal(entry{OutputID: hex.EncodeToString(r.OutputID), Size: n, Time: now})
+	if err != nil {
+		return cache.Response{}, err
+	}
+	res, err := c.do(ctx, http.MethodPut, c.fileURL(c.layout.ActionKey(r.ActionID), true), bytes.NewReader(b), http.Header{
+		"Content-Type": {"application/json"},
+	})
+	if err != nil {
+		return cache.Response{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return cache.Response{}, errorFromStatus(res)
+	}
+	return cache.Response{DiskPath: path}, nil
+}
+
+// upload deploys the object outputID from path. With Artifactory, it first
+// tries a checksum deploy, which succeeds without sending the content if
+// the repository already holds it.
+func (c *Client) upload(ctx context.Context, outputID []byte, path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	u := c.fileURL(c.layout.ObjectKey(outputID), true)
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if c.flavor == Artifactory {
+		s1, s256 := sha1.New(), sha256.New()
+		if _, err := io.Copy(io.MultiWriter(s1, s256), f); err != nil {
+			return fmt.Errorf("failed to hash object: %w", err)
+		}
+		header.Set("X-Checksum-Sha1", hex.EncodeToString(s1.Sum(nil)))
+		header.Set("X-Checksum-Sha256", hex.EncodeToString(s256.Sum(nil)))
+
+		deploy := header.Clone()
+		deploy.Set("X-Checksum-Deploy", "true")
+		res, err := c.do(ctx, http.MethodPut, u, http.NoBody, deploy)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode/100 == 2 {
+			return nil
+		}
+		// 404 means the checksum is unknown; upload the content.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	res, err := c.do(ctx, http.MethodPut, u, io.LimitReader(f, size), header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return errorFromStatus(res)
+	}
+	return nil
+}
+
+// errorFromStatus returns the cache error for an HTTP error response.
+func errorFromStatus(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+	code := cache.CodeInternal
+	switch {
+	case res.StatusCode == http.StatusBadRequest:
+		code = cache.CodeInvalidRequest
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		code = cache.CodePermissionDenied
+	case res.StatusCode == http.StatusGatewayTimeout:
+		code = cache.CodeTimeout
+	case res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+		code = cache.CodeUnavailable
+	}
+	return cache.Errorf(code, "repository: %s: %s", res.Status, msg)
+}
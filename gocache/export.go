@@ -0,0 +1,144 @@
+package gocache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/fileclone"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+// idSize is the length of the IDs the go command uses, SHA-256 hashes. The
+// native layout cannot hold entries with other IDs.
+const idSize = 32
+
+// Export writes the entries listed by mr into the native cache directory
+// dir, so that the go command can go back to its default cache without
+// losing warm state. Each entry is looked up through h, which must handle
+// get requests, and its object is cloned from the DiskPath of the response,
+// with up to concurrency entries at once. Entries that are now misses are
+// skipped.
+func Export(ctx context.Context, dir string, h cache.Handler, mr *manifest.Reader, concurrency int) (Stats, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return Stats{}, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	var (
+		stats Stats
+		id    atomic.Int64
+		wg    sync.WaitGroup
+		work  = make(chan manifest.Entry)
+	)
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				size, err := export(ctx, dir, h, id.Add(1), e)
+				switch {
+				case errors.Is(err, errSkipped):
+					atomic.AddInt64(&stats.Skipped, 1)
+				case err != nil:
+					cache.LoggerFromContext(ctx).Warn("failed to export entry", "actionID", fmt.Sprintf("%x", e.ActionID), "error", err)
+					atomic.AddInt64(&stats.Failed, 1)
+				default:
+					atomic.AddInt64(&stats.Entries, 1)
+					atomic.AddInt64(&stats.Bytes, size)
+				}
+			}
+		}()
+	}
+
+	var err error
+	for ctx.Err() == nil {
+		var e manifest.Entry
+		if e, err = mr.Next(); err != nil {
+			break
+		}
+		select {
+		case work <- e:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return stats, err
+}
+
+// export copies one entry into dir and returns its size.
+func export(ctx context.Context, dir string, h cache.Handler, id int64, e manifest.Entry) (int64, error) {
+	if len(e.ActionID) != idSize {
+		return 0, errSkipped
+	}
+	res := cache.Call(ctx, h, &cache.Request{
+		ID:       id,
+		Command:  cache.CmdGet,
+		ActionID: e.ActionID,
+	})
+	switch {
+	case res.Err != "":
+		return 0, errors.New(res.Err)
+	case res.Miss, len(res.OutputID) != idSize, res.DiskPath == "":
+		return 0, errSkipped
+	}
+
+	objectPath := ObjectPath(dir, res.OutputID)
+	actionPath := ActionPath(dir, e.ActionID)
+	for _, sub := range []string{filepath.Dir(objectPath), filepath.Dir(actionPath)} {
+		if err := os.MkdirAll(sub, 0777); err != nil {
+			return 0, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	if fi, err := os.Stat(objectPath); err != nil || fi.Size() != res.Size {
+		if _, err := fileclone.Clone(res.DiskPath, objectPath); err != nil {
+			return 0, fmt.Errorf("failed to copy object: %w", err)
+		}
+	}
+
+	nanos := e.Time.UnixNano()
+	if res.Time != nil {
+		nanos = res.Time.UnixNano()
+	}
+	// The go command requires action files of this exact format and
+	// length. They are written after the object, so that the go command
+	// never finds an action file without its object.
+	entry := fmt.Sprintf("v1 %x %x %20d %20d\n", e.ActionID, res.OutputID, res.Size, nanos)
+	if err := writeFileAtomic(actionPath, []byte(entry)); err != nil {
+		return 0, fmt.Errorf("failed to write action file: %w", err)
+	}
+	return res.Size, nil
+}
+
+// writeFileAtomic writes data to path through a temporary file renamed into
+// place, so that a go command running concurrently never reads a partial
+// action file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
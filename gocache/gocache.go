@@ -0,0 +1,182 @@
+// Package gocache reads and writes the native cache directory of the go
+// command, the one GOCACHE points to, so that its entries can be imported
+// into a GOCACHEPROG backend instead of starting from a cold cache, and
+// exported back when going back to the default cache.
+//
+// The native layout stores, under a two-hex-digit subdirectory, an action
+// file "<hex ActionID>-a" containing
+//
+//	v1 <hex ActionID> <hex OutputID> <size> <unix nanoseconds>
+//
+// and the object "<hex OutputID>-d" it refers to.
+package gocache
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+// Dir returns the native cache directory of the go command: $GOCACHE, or
+// the go-build directory of the user cache directory.
+func Dir() (string, error) {
+	if dir := os.Getenv("GOCACHE"); dir != "" && dir != "off" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate GOCACHE: %w", err)
+	}
+	return filepath.Join(dir, "go-build"), nil
+}
+
+// ObjectPath returns the path of the object file of outputID in dir.
+func ObjectPath(dir string, outputID []byte) string {
+	hexID := hex.EncodeToString(outputID)
+	return filepath.Join(dir, hexID[:2], hexID+"-d")
+}
+
+// ActionPath returns the path of the action file of actionID in dir.
+func ActionPath(dir string, actionID []byte) string {
+	hexID := hex.EncodeToString(actionID)
+	return filepath.Join(dir, hexID[:2], hexID+"-a")
+}
+
+// parseAction parses the contents of an action file.
+func parseAction(data []byte) (manifest.Entry, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) != 5 || fields[0] != "v1" {
+		return manifest.Entry{}, errors.New("malformed action file")
+	}
+	actionID, err1 := hex.DecodeString(fields[1])
+	outputID, err2 := hex.DecodeString(fields[2])
+	size, err3 := strconv.ParseInt(fields[3], 10, 64)
+	nanos, err4 := strconv.ParseInt(fields[4], 10, 64)
+	if err := errors.Join(err1, err2, err3, err4); err != nil || len(outputID) == 0 || size < 0 {
+		return manifest.Entry{}, fmt.Errorf("malformed action file: %v", err)
+	}
+	return manifest.Entry{
+		ActionID: actionID,
+		OutputID: outputID,
+		Size:     size,
+		Time:     time.Unix(0, nanos),
+	}, nil
+}
+
+// Walk calls fn for every entry of the cache directory dir. Malformed action
+// files are skipped. Entries whose object is missing are not filtered out,
+// since checking would double the number of file system operations.
+func Walk(dir string, fn func(e manifest.Entry) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && len(d.Name()) != 2 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), "-a") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		e, err := parseAction(data)
+		if err != nil {
+			return nil
+		}
+		return fn(e)
+	})
+}
+
+// Stats reports the outcome of an import or export.
+type Stats struct {
+	Entries int64
+	Bytes   int64
+	Skipped int64 // entries that are missing or cannot be represented
+	Failed  int64
+}
+
+// Import stores every entry of the cache directory dir through h, which
+// must handle put requests, with up to concurrency puts at once.
+func Import(ctx context.Context, dir string, h cache.Handler, concurrency int) (Stats, error) {
+	var (
+		stats Stats
+		id    atomic.Int64
+		wg    sync.WaitGroup
+		work  = make(chan manifest.Entry)
+	)
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				err := put(ctx, dir, h, id.Add(1), e)
+				switch {
+				case errors.Is(err, errSkipped):
+					atomic.AddInt64(&stats.Skipped, 1)
+				case err != nil:
+					cache.LoggerFromContext(ctx).Warn("failed to import entry", "actionID", fmt.Sprintf("%x", e.ActionID), "error", err)
+					atomic.AddInt64(&stats.Failed, 1)
+				default:
+					atomic.AddInt64(&stats.Entries, 1)
+					atomic.AddInt64(&stats.Bytes, e.Size)
+				}
+			}
+		}()
+	}
+	err := Walk(dir, func(e manifest.Entry) error {
+		select {
+		case work <- e:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(work)
+	wg.Wait()
+	return stats, err
+}
+
+// errSkipped reports an entry that is missing or cannot be copied.
+var errSkipped = errors.New("entry missing or unusable")
+
+func put(ctx context.Context, dir string, h cache.Handler, id int64, e manifest.Entry) error {
+	f, err := os.Open(ObjectPath(dir, e.OutputID))
+	if err != nil {
+		return errSkipped
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != e.Size {
+		return errSkipped
+	}
+
+	res := cache.Call(ctx, h, &cache.Request{
+		ID:       id,
+		Command:  cache.CmdPut,
+		ActionID: e.ActionID,
+		OutputID: e.OutputID,
+		Body:     f,
+		BodySize: e.Size,
+	})
+	if res.Err != "" {
+		return errors.New(res.Err)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Package goproxy serves a Go module proxy (GOPROXY) that caches the
+// module files it fetches from an upstream proxy in a cache backend, so
+// that a build cache server can cache modules too, on the storage it
+// already has:
+//
+//	p := goproxy.New(backend, goproxy.WithUpstream("https://proxy.golang.org"))
+//	http.ListenAndServe(":8081", p)
+//
+// and builders set GOPROXY=http://cache.example.com:8081.
+//
+// The .info, .mod and .zip files of a module version never change, so they
+// are stored as cache entries whose ActionID is the hash of their path and
+// whose OutputID is the hash of their content. Version lists, @latest
+// queries and checksum database requests change over time and are passed
+// through to the upstream proxy.
+package goproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// DefaultUpstream is the proxy fetched from by default.
+const DefaultUpstream = "https://proxy.golang.org"
+
+// contentTypes are the content types of the cached files, by extension.
+var contentTypes = map[string]string{
+	".info": "application/json",
+	".mod":  "text/plain; charset=utf-8",
+	".zip":  "application/zip",
+}
+
+// Proxy is an http.Handler serving the module proxy protocol.
+type Proxy struct {
+	backend  cache.Handler
+	upstream string
+	client   *http.Client
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// Option configures a Proxy.
+type Option func(*Proxy)
+
+// WithUpstream fetches the files missing from the cache from the proxy at
+// url instead of DefaultUpstream.
+func WithUpstream(url string) Option {
+	return func(p *Proxy) {
+		p.upstream = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithHTTPClient fetches from the upstream proxy with client instead of
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(p *Proxy) {
+		p.client = client
+	}
+}
+
+// New returns a Proxy caching module files in backend, which must handle
+// the get and put commands.
+func New(backend cache.Handler, opts ...Option) *Proxy {
+	p := &Proxy{
+		backend:  backend,
+		upstream: DefaultUpstream,
+		client:   http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Stats is a snapshot of the counters of a Proxy.
+type Stats struct {
+	// Hits is the number of files served from the cache.
+	Hits int64
+
+	// Misses is the number of files fetched from the upstream proxy.
+	Misses int64
+}
+
+// Stats returns a snapshot of the counters of p.
+func (p *Proxy) Stats() Stats {
+	return Stats{Hits: p.hits.Load(), Misses: p.misses.Load()}
+}
+
+// ServeHTTP implements http.Handler.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" || path.Clean("/"+name) != "/"+name {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if !immutable(name) {
+		p.passThrough(w, r, name)
+		return
+	}
+
+	actionID := sha256.Sum256([]byte("goproxy " + name))
+	res := cache.Call(r.Context(), p.backend, &cache.Request{
+		ID:       nextID(),
+		Command:  cache.CmdGet,
+		ActionID: actionID[:],
+	})
+	if res.Err == "" && !res.Miss {
+		if p.serveFile(w, r, name, res.DiskPath) {
+			p.hits.Add(1)
+			return
+		}
+	} else if res.Err != "" {
+		log.Printf("goproxy: failed to get %s: %s", name, res.Err)
+	}
+
+	p.misses.Add(1)
+	p.fetch(w, r, name, actionID[:])
+}
+
+// immutable reports whether the file at name, relative to the proxy root,
+// is a file of a module version, which never changes.
+func immutable(name string) bool {
+	_, file, ok := strings.Cut(name, "/@v/")
+	if !ok || strings.Contains(file, "/") {
+		return false
+	}
+	_, ok = contentTypes[path.Ext(file)]
+	return ok
+}
+
+// serveFile serves the cached file at diskPath and reports whether it
+// could be opened.
+func (p *Proxy) serveFile(w http.ResponseWriter, r *http.Request, name, diskPath string) bool {
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", contentTypes[path.Ext(name)])
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+	return true
+}
+
+// fetch gets the file at name from the upstream proxy, stores it in the
+// backend and serves it. Errors of the upstream proxy, including the 404s
+// and 410s of unknown versions, are passed on and not cached.
+func (p *Proxy) fetch(w http.ResponseWriter, r *http.Request, name string, actionID []byte) {
+	resp, err := p.get(r.Context(), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		copyResponse(w, resp)
+		return
+	}
+
+	// Spool the file to learn its hash and size, which the put needs
+	// before the body.
+	f, err := os.CreateTemp("", "goproxy-*")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create temporary file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), resp.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read %s from upstream: %v", name, err), http.StatusBadGateway)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, fmt.Sprintf("failed to rewind temporary file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	res := cache.Call(r.Context(), p.backend, &cache.Request{
+		ID:       nextID(),
+		Command:  cache.CmdPut,
+		ActionID: actionID,
+		OutputID: hash.Sum(nil),
+		BodySize: size,
+		Body:     f,
+	})
+	if res.Err != "" {
+		// The file is still served; only its caching failed.
+		log.Printf("goproxy: failed to put %s: %s", name, res.Err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, fmt.Sprintf("failed to rewind temporary file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypes[path.Ext(name)])
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+// passThrough serves the file at name from the upstream proxy without
+// caching it.
+func (p *Proxy) passThrough(w http.ResponseWriter, r *http.Request, name string) {
+	resp, err := p.get(r.Context(), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	copyResponse(w, resp)
+}
+
+// get requests the file at name from the upstream proxy.
+func (p *Proxy) get(ctx context.Context, name string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.upstream+"/"+name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s from upstream: %w", name, err)
+	}
+	return resp, nil
+}
+
+// copyResponse writes the status, content headers and body of resp to w.
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	for _, k := range []string{"Content-Type", "Content-Length", "Cache-Control"} {
+		if v := resp.Header.Get(k); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// lastID numbers the requests sent to the backend.
+var lastID atomic.Int64
+
+// nextID returns a unique request ID.
+func nextID() int64 {
+	return lastID.Add(1)
+}
@@ -0,0 +1,277 @@
+package httpcache
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+)
+
+// Client is a cache backend stored on a Server. Objects are downloaded to,
+// and uploaded from, a local castore.Store, since the go command reads them
+// from the DiskPath of responses.
+//
+// Its URLs are the protocol of the Server, not storage keys, so the Client
+// takes no layout: the backend of the Server, such as an s3.Client with
+// s3.WithLayout, decides where entries are stored.
+type Client struct {
+	base      *url.URL
+	http      *http.Client
+	store     *castore.Store
+	namespace string
+	noLink    atomic.Bool // set when the server does not support links
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithNamespace sends namespace with every request, so that the server
+// accounts the entries to it.
+func WithNamespace(namespace string) ClientOption {
+	return func(c *Client) {
+		c.namespace = namespace
+	}
+}
+
+// NewClient returns a Client of the server at base, keeping objects in a
+// castore.Store rooted at dir.
+// A nil httpClient means http.DefaultClient; use httpconfig, httpcompress
+// and failover to tune it.
+func NewClient(base string, httpClient *http.Client, dir string, opts ...ClientOption) (*Client, error) {
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid cache server URL %q", base)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	// DiskPath must be absolute.
+	if dir, err = filepath.Abs(dir); err != nil {
+		return nil, fmt.Errorf("failed to resolve object directory: %w", err)
+	}
+	store, err := castore.New(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{base: u, http: httpClient, store: store}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Store returns the store of the downloaded and uploaded objects, to be
+// pruned with castore.Store.Prune.
+func (c *Client) Store() *castore.Store {
+	return c.store
+}
+
+// do sends req, naming the namespace of the client and, for puts, the
+// tags of the request being handled.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.namespace != "" {
+		req.Header.Set(NamespaceHeader, c.namespace)
+	}
+	if req.Method == http.MethodPut || req.Method == http.MethodPost {
+		for k, v := range cache.TagsFromContext(req.Context()) {
+			req.Header.Add(TagHeader, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	return c.http.Do(req)
+}
+
+// Handle implements cache.Handler for the get and put commands. The close
+// command releases the objects of the session, see castore.Store.Hold;
+// other commands succeed without effect.
+func (c *Client) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	var res cache.Response
+	var err error
+	switch r.Command {
+	case cache.CmdGet:
+		res, err = c.get(ctx, r)
+	case cache.CmdPut:
+		res, err = c.put(ctx, r)
+	case cache.CmdClose:
+		c.store.ReleaseSession(ctx)
+	}
+	if err != nil {
+		cache.WriteError(w, r, err)
+		return
+	}
+	res.ID = r.ID
+	w.WriteResponse(res)
+}
+
+func (c *Client) entryURL(actionID []byte) *url.URL {
+	return c.base.JoinPath("ac", hex.EncodeToString(actionID))
+}
+
+func (c *Client) objectPath(outputID []byte) string {
+	return c.store.Path(outputID)
+}
+
+func (c *Client) get(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.entryURL(r.ActionID).String(), nil)
+	if err != nil {
+		return cache.Response{}, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return cache.Response{}, cache.Errorf(cache.CodeUnavailable, "failed to reach cache server: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return cache.Response{}, cache.ErrMiss
+	}
+	if res.StatusCode != http.StatusOK {
+		return cache.Response{}, errorFromStatus(res)
+	}
+
+	outputID, err := hex.DecodeString(res.Header.Get(OutputIDHeader))
+	if err != nil || len(outputID) == 0 {
+		return cache.Response{}, cache.Errorf(cache.CodeInternal, "invalid %s header", OutputIDHeader)
+	}
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		// A compressing transport drops Content-Length; read to the end.
+		size = -1
+	}
+
+	c.store.Hold(ctx, outputID)
+	// An object already in the store is served without reading the body.
+	// Otherwise concurrent gets of the object wait for one download; with
+	// an unknown size, the others drain their bodies once it is done.
+	n, ok := c.store.Stat(outputID)
+	if !ok || (size >= 0 && n != size) {
+		if err := c.store.Fill(ctx, outputID, size, func() error {
+			// Reads of a body cut short of its Content-Length, or of its
+			// last chunk when compressed, fail, so the store never keeps a
+			// truncated object.
+			if _, _, err := c.store.Put(outputID, res.Body); err != nil {
+				return cache.Errorf(cache.CodeUnavailable, "failed to download object: %w", err)
+			}
+			return nil
+		}); err != nil {
+			return cache.Response{}, err
+		}
+		n, _ = c.store.Stat(outputID)
+	}
+
+	out := cache.Response{OutputID: outputID, Size: n, DiskPath: c.objectPath(outputID)}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		out.Time = &t
+	}
+	return out, nil
+}
+
+func (c *Client) put(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	c.store.Hold(ctx, r.OutputID)
+	if size, ok := c.store.Stat(r.OutputID); ok && size == r.BodySize {
+		// The object was put or got before, so the server likely has it.
+		path := c.objectPath(r.OutputID)
+		if ok, err := c.link(ctx, r); ok || err != nil {
+			return cache.Response{DiskPath: path}, err
+		}
+		return c.upload(ctx, r, path, r.BodySize)
+	}
+	path, n, err := c.store.Put(r.OutputID, r.Body)
+	if err != nil {
+		return cache.Response{}, fmt.Errorf("failed to write object: %w", err)
+	}
+	if n != r.BodySize {
+		return cache.Response{}, cache.Errorf(cache.CodeInvalidRequest, "object is %d bytes, want %d", n, r.BodySize)
+	}
+	return c.upload(ctx, r, path, n)
+}
+
+// link asks the server to store the entry of r for the object it already
+// has, and reports whether it did. A server without the object, or
+// without support for links, is not an error; the object must be uploaded.
+func (c *Client) link(ctx context.Context, r *cache.Request) (bool, error) {
+	if c.noLink.Load() {
+		return false, nil
+	}
+	u := c.entryURL(r.ActionID)
+	u.RawQuery = url.Values{
+		"output": {hex.EncodeToString(r.OutputID)},
+		"size":   {strconv.FormatInt(r.BodySize, 10)},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return false, cache.Errorf(cache.CodeUnavailable, "failed to reach cache server: %w", err)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode/100 == 2:
+		return true, nil
+	case res.StatusCode == http.StatusMethodNotAllowed:
+		c.noLink.Store(true)
+		return false, nil
+	case res.StatusCode == http.StatusPreconditionFailed:
+		return false, nil
+	}
+	return false, errorFromStatus(res)
+}
+
+// upload stores the entry of r with the object at path, of n bytes.
+func (c *Client) upload(ctx context.Context, r *cache.Request, path string, n int64) (cache.Response, error) {
+	u := c.entryURL(r.ActionID)
+	u.RawQuery = url.Values{"output": {hex.EncodeToString(r.OutputID)}}.Encode()
+	open := func() (io.ReadCloser, error) { return os.Open(path) }
+	body, err := open()
+	if err != nil {
+		return cache.Response{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), body)
+	if err != nil {
+		body.Close()
+		return cache.Response{}, err
+	}
+	req.ContentLength = n
+	req.GetBody = open
+	if n == 0 {
+		// A body of length zero is sent chunked, as of unknown length,
+		// which the server rejects.
+		body.Close()
+		req.Body, req.GetBody = http.NoBody, nil
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return cache.Response{}, cache.Errorf(cache.CodeUnavailable, "failed to reach cache server: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return cache.Response{}, errorFromStatus(res)
+	}
+	return cache.Response{DiskPath: path}, nil
+}
+
+// errorFromStatus returns the cache error for an HTTP error response.
+func errorFromStatus(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+	code := cache.CodeInternal
+	switch {
+	case res.StatusCode == http.StatusBadRequest:
+		code = cache.CodeInvalidRequest
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		code = cache.CodePermissionDenied
+	case res.StatusCode == http.StatusGatewayTimeout:
+		code = cache.CodeTimeout
+	case res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+		code = cache.CodeUnavailable
+	}
+	return cache.Errorf(code, "cache server: %s: %s", res.Status, msg)
+}
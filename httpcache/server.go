@@ -0,0 +1,332 @@
+// Package httpcache serves a cache backend over HTTP and provides the
+// matching client backend, so that builders can share one cache server.
+//
+// The protocol has one resource per entry, named by the hex ActionID:
+//
+//	GET  /ac/<action>            the object, with the entry in headers; 404 on a miss
+//	HEAD /ac/<action>            the same headers without the object
+//	PUT  /ac/<action>?output=<output>
+//	                             stores the request body as the object
+//	POST /ac/<action>?output=<output>&size=<size>
+//	                             stores the object the server already has, with
+//	                             WithObjects; 412 if it has none of that size
+//	GET  /manifest.jsonl         a manifest of every entry, with WithManifest
+//	GET  /objects/<output>       an object by OutputID, with WithObjects
+//
+// The last two make a server a snapshot that warm can seed caches from.
+//
+// Requests may name the namespace, typically a team, they belong to in the
+// X-Cache-Namespace header; the backend finds it with NamespaceFromContext.
+// Puts may carry user tags in X-Cache-Tag headers, one query-escaped
+// key=value pair each, which the backend finds with cache.TagsFromContext.
+//
+// Identical outputs of different actions share their object, so clients
+// that know the server has an object, because they put or got it before,
+// link the entry to it with a POST instead of uploading it again. Servers
+// predating it answer 405, and clients fall back to a PUT.
+//
+// Responses carry the OutputID in the X-Output-ID header, the object size
+// in Content-Length and the entry time in Last-Modified. Gets take a single
+// round trip, which matters for builds issuing thousands of them.
+package httpcache
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+const (
+	// OutputIDHeader carries the hex OutputID of an entry.
+	OutputIDHeader = "X-Output-ID"
+
+	// NamespaceHeader carries the namespace of a request.
+	NamespaceHeader = "X-Cache-Namespace"
+
+	// TagHeader carries a user tag of a put, as a query-escaped key=value
+	// pair. It is repeated for every tag.
+	TagHeader = "X-Cache-Tag"
+)
+
+type namespaceKey struct{}
+
+// ContextWithNamespace returns a copy of ctx carrying namespace.
+func ContextWithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, namespace)
+}
+
+// NamespaceFromContext returns the namespace of the request being served,
+// or "" if it did not name one.
+func NamespaceFromContext(ctx context.Context) string {
+	ns, _ := ctx.Value(namespaceKey{}).(string)
+	return ns
+}
+
+// Server serves the entries of a backend.
+type Server struct {
+	backend    cache.Handler
+	manifest   func(w io.Writer) error
+	objectPath func(outputID []byte) string
+	mux        *http.ServeMux
+}
+
+// ServerOption configures a Server.
+type ServerOption func(*Server)
+
+// WithManifest serves the manifest written by fn.
+func WithManifest(fn func(w io.Writer) error) ServerOption {
+	return func(s *Server) {
+		s.manifest = fn
+	}
+}
+
+// WithObjects serves objects by OutputID from the files named by path.
+func WithObjects(path func(outputID []byte) string) ServerOption {
+	return func(s *Server) {
+		s.objectPath = path
+	}
+}
+
+// NewServer returns a Server storing entries through the get and put
+// commands of backend, whose responses must carry a DiskPath.
+func NewServer(backend cache.Handler, opts ...ServerOption) *Server {
+	s := &Server{
+		backend: backend,
+		mux:     http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.mux.HandleFunc("GET /ac/{action}", s.handleGet)
+	s.mux.HandleFunc("PUT /ac/{action}", s.handlePut)
+	if s.manifest != nil {
+		s.mux.HandleFunc("GET /"+manifest.FileName, s.handleManifest)
+	}
+	if s.objectPath != nil {
+		s.mux.HandleFunc("GET /objects/{output}", s.handleObject)
+		s.mux.HandleFunc("POST /ac/{action}", s.handleLink)
+	}
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// call sends a request to the backend on behalf of r, numbering requests
+// like a go command would.
+func (s *Server) call(r *http.Request, req *cache.Request) cache.Response {
+	req.ID = nextID()
+	ctx := ContextWithNamespace(r.Context(), r.Header.Get(NamespaceHeader))
+	if tags := parseTags(r.Header.Values(TagHeader)); len(tags) > 0 {
+		ctx = cache.ContextWithTags(ctx, tags)
+	}
+	return cache.Call(ctx, s.backend, req)
+}
+
+// parseTags parses the values of TagHeader, skipping malformed ones.
+func parseTags(values []string) map[string]string {
+	var tags map[string]string
+	for _, kv := range values {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		k, err := url.QueryUnescape(k)
+		if err != nil || k == "" {
+			continue
+		}
+		if v, err = url.QueryUnescape(v); err != nil {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	actionID, err := hex.DecodeString(r.PathValue("action"))
+	if err != nil || len(actionID) == 0 {
+		http.Error(w, "invalid action ID", http.StatusBadRequest)
+		return
+	}
+	res := s.call(r, &cache.Request{Command: cache.CmdGet, ActionID: actionID})
+	if res.Err != "" {
+		writeError(w, res)
+		return
+	}
+	if res.Miss {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(res.DiskPath)
+	if err != nil {
+		// Evicted between the lookup and now.
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	h := w.Header()
+	h.Set(OutputIDHeader, hex.EncodeToString(res.OutputID))
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(res.Size, 10))
+	if res.Time != nil {
+		h.Set("Last-Modified", res.Time.UTC().Format(http.TimeFormat))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, io.LimitReader(f, res.Size))
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	actionID, err := hex.DecodeString(r.PathValue("action"))
+	if err != nil || len(actionID) == 0 {
+		http.Error(w, "invalid action ID", http.StatusBadRequest)
+		return
+	}
+	outputID, err := hex.DecodeString(r.URL.Query().Get("output"))
+	if err != nil || len(outputID) == 0 {
+		http.Error(w, "invalid output ID", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+
+	res := s.call(r, &cache.Request{
+		Command:  cache.CmdPut,
+		ActionID: actionID,
+		OutputID: outputID,
+		Body:     r.Body,
+		BodySize: r.ContentLength,
+	})
+	if res.Err != "" {
+		writeError(w, res)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLink stores an entry for an object the server has, passing the
+// object file to the backend as the body of the put.
+func (s *Server) handleLink(w http.ResponseWriter, r *http.Request) {
+	actionID, err := hex.DecodeString(r.PathValue("action"))
+	if err != nil || len(actionID) == 0 {
+		http.Error(w, "invalid action ID", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	outputID, err := hex.DecodeString(q.Get("output"))
+	if err != nil || len(outputID) == 0 {
+		http.Error(w, "invalid output ID", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(q.Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(s.objectPath(outputID))
+	if err != nil {
+		http.Error(w, "object not found", http.StatusPreconditionFailed)
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.Size() != size {
+		http.Error(w, "object not found", http.StatusPreconditionFailed)
+		return
+	}
+
+	res := s.call(r, &cache.Request{
+		Command:  cache.CmdPut,
+		ActionID: actionID,
+		OutputID: outputID,
+		Body:     f,
+		BodySize: size,
+	})
+	if res.Err != "" {
+		writeError(w, res)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/jsonl")
+	if err := s.manifest(w); err != nil {
+		// The status is sent already; cut the stream short so that the
+		// client sees a truncated manifest rather than a complete one.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *Server) handleObject(w http.ResponseWriter, r *http.Request) {
+	outputID, err := hex.DecodeString(r.PathValue("output"))
+	if err != nil || len(outputID) == 0 {
+		http.Error(w, "invalid output ID", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(s.objectPath(outputID))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, f)
+}
+
+// writeError maps a backend error to an HTTP status.
+func writeError(w http.ResponseWriter, res cache.Response) {
+	code := http.StatusInternalServerError
+	if e := res.Error; e != nil {
+		switch e.Code {
+		case cache.CodeInvalidRequest:
+			code = http.StatusBadRequest
+		case cache.CodePermissionDenied:
+			code = http.StatusForbidden
+		case cache.CodeUnavailable:
+			code = http.StatusServiceUnavailable
+		case cache.CodeTimeout:
+			code = http.StatusGatewayTimeout
+		case cache.CodeUnsupported:
+			code = http.StatusNotImplemented
+		}
+	}
+	http.Error(w, res.Err, code)
+}
+
+// lastID numbers the requests sent to backends.
+var lastID atomic.Int64
+
+// nextID returns a unique request ID.
+func nextID() int64 {
+	return lastID.Add(1)
+}
@@ -0,0 +1,99 @@
+package httpcompress
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Handler decompresses request bodies sent with a registered
+// Content-Encoding and compresses response bodies with the most preferred
+// registered codec the client accepts. Requests with an unknown
+// Content-Encoding are answered with 415 Unsupported Media Type, which
+// makes a Transport retry them uncompressed. Decoded requests have the
+// ContentLength sent in DecodedLengthHeader, or -1.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		codecs := registered()
+
+		if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+			c, ok := lookup(codecs, enc)
+			if !ok {
+				w.Header().Set("Accept-Encoding", acceptEncoding(codecs))
+				http.Error(w, "unsupported content encoding "+enc, http.StatusUnsupportedMediaType)
+				return
+			}
+			zr, err := c.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "invalid "+enc+" body", http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			r = r.Clone(r.Context())
+			r.Body = zr
+			r.ContentLength = -1
+			if n, err := strconv.ParseInt(r.Header.Get(DecodedLengthHeader), 10, 64); err == nil && n >= 0 {
+				r.ContentLength = n
+			}
+			r.Header.Del(DecodedLengthHeader)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		c, ok := negotiate(codecs, r.Header.Get("Accept-Encoding"))
+		if !ok || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, codec: c}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter compresses the response body, unless the handler set its
+// own Content-Encoding or the status has no body.
+type compressWriter struct {
+	http.ResponseWriter
+	codec Codec
+
+	wroteHeader bool
+	zw          io.WriteCloser // nil if the body is written as is
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	bodiless := code == http.StatusNoContent || code == http.StatusNotModified || code < 200
+	if !bodiless && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", w.codec.Name())
+		h.Del("Content-Length")
+		w.zw = w.codec.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.zw == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.zw.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) close() {
+	if w.zw != nil {
+		w.zw.Close()
+	}
+}
@@ -0,0 +1,123 @@
+// Package httpcompress compresses request and response bodies exchanged
+// with HTTP cache backends, so that slow CI egress links move fewer bytes.
+// It is independent of how objects are stored: bodies are compressed on the
+// wire only.
+//
+// A Transport wraps the client side: it compresses request bodies, tells
+// the server which encodings it accepts and decompresses responses, all
+// transparently to the code using the http.Client. Handler does the same
+// on the server side. Both negotiate: a server that does not understand a
+// compressed request body answers 415 Unsupported Media Type, after which
+// the Transport sends plain bodies to that host.
+//
+// Only gzip is built in, since this module has no dependencies. Other
+// encodings, such as zstd, are added by registering a Codec backed by an
+// implementation of the encoding on both sides:
+//
+//	httpcompress.Register(zstdCodec{})
+package httpcompress
+
+import (
+	"compress/gzip"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DecodedLengthHeader is the request header in which a Transport sends the
+// length of a compressed request body before compression, since the
+// Content-Length of the request is unknown. Handler restores it as the
+// ContentLength of the decoded request, for servers requiring the length
+// of put bodies.
+const DecodedLengthHeader = "X-Decoded-Content-Length"
+
+// Codec implements one content encoding.
+type Codec interface {
+	// Name returns the Content-Encoding token, such as "gzip" or "zstd".
+	Name() string
+	NewWriter(w io.Writer) io.WriteCloser
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Gzip is the gzip Codec, registered by default.
+var Gzip Codec = gzipCodec{}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) NewWriter(w io.Writer) io.WriteCloser {
+	// Cache objects are mostly compiled code: the default level costs
+	// several times the CPU of BestSpeed for a few percent of size.
+	zw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	return zw
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+var registry = struct {
+	sync.RWMutex
+	codecs []Codec // in order of registration
+}{codecs: []Codec{Gzip}}
+
+// Register makes c available to Handler, and to Transports that do not
+// list their codecs. A codec registered under an existing name replaces it.
+// Later registrations are preferred when both sides support several
+// encodings.
+func Register(c Codec) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.codecs = slices.DeleteFunc(registry.codecs, func(r Codec) bool {
+		return r.Name() == c.Name()
+	})
+	registry.codecs = append(registry.codecs, c)
+}
+
+// registered returns the registered codecs, most preferred first.
+func registered() []Codec {
+	registry.RLock()
+	defer registry.RUnlock()
+	codecs := slices.Clone(registry.codecs)
+	slices.Reverse(codecs)
+	return codecs
+}
+
+// lookup returns the codec named name among codecs.
+func lookup(codecs []Codec, name string) (Codec, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// acceptEncoding returns the Accept-Encoding header listing codecs.
+func acceptEncoding(codecs []Codec) string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+// negotiate returns the first of codecs accepted by the Accept-Encoding
+// header accept. Encodings with q=0 are refused.
+func negotiate(codecs []Codec, accept string) (Codec, bool) {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		q := strings.ReplaceAll(params, " ", "")
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q != "q=0" && q != "q=0.0"
+	}
+	for _, c := range codecs {
+		if accepted[c.Name()] {
+			return c, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,145 @@
+package httpcompress
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// DefaultMinSize is the body size below which Transport sends bodies
+// uncompressed when MinSize is zero: small bodies do not shrink enough to
+// pay for the encoder.
+const DefaultMinSize = 1024
+
+// Transport is an http.RoundTripper that compresses request bodies and
+// decompresses response bodies.
+type Transport struct {
+	Base    http.RoundTripper // http.DefaultTransport if nil
+	Codecs  []Codec           // in order of preference; the registered codecs if empty
+	MinSize int64             // DefaultMinSize if zero
+
+	mu    sync.Mutex
+	plain map[string]bool // hosts that rejected compressed bodies
+}
+
+// RoundTrip implements http.RoundTripper.
+//
+// Request bodies of a known size of at least MinSize are compressed with
+// the first codec, unless the request sets Content-Encoding itself. If the
+// server answers such a request with 415 Unsupported Media Type, the
+// request is sent again uncompressed when its GetBody is set, and later
+// requests to the same host are not compressed.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	codecs := t.codecs()
+	req = req.Clone(req.Context())
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding(codecs))
+	}
+
+	if !t.compressible(req) {
+		return t.roundTrip(req, codecs)
+	}
+
+	plain := req.Clone(req.Context())
+	compressBody(req, codecs[0])
+	res, err := t.roundTrip(req, codecs)
+	if err != nil || res.StatusCode != http.StatusUnsupportedMediaType || plain.GetBody == nil {
+		return res, err
+	}
+
+	res.Body.Close()
+	t.mu.Lock()
+	if t.plain == nil {
+		t.plain = make(map[string]bool)
+	}
+	t.plain[req.URL.Host] = true
+	t.mu.Unlock()
+	if plain.Body, err = plain.GetBody(); err != nil {
+		return nil, err
+	}
+	return t.roundTrip(plain, codecs)
+}
+
+func (t *Transport) codecs() []Codec {
+	if len(t.Codecs) > 0 {
+		return t.Codecs
+	}
+	return registered()
+}
+
+// compressible reports whether the body of req should be compressed.
+func (t *Transport) compressible(req *http.Request) bool {
+	minSize := t.MinSize
+	if minSize == 0 {
+		minSize = DefaultMinSize
+	}
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength < minSize || req.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.plain[req.URL.Host]
+}
+
+// compressBody replaces the body of req with its compressed form, encoded
+// as it is sent.
+func compressBody(req *http.Request, c Codec) {
+	body := req.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		zw := c.NewWriter(pw)
+		_, err := io.Copy(zw, body)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	if req.ContentLength > 0 {
+		req.Header.Set(DecodedLengthHeader, strconv.FormatInt(req.ContentLength, 10))
+	}
+	req.Body = pr
+	req.ContentLength = -1
+	req.GetBody = nil
+	req.Header.Set("Content-Encoding", c.Name())
+	req.Header.Del("Content-Length")
+}
+
+// roundTrip sends req and decodes the body of the response.
+func (t *Transport) roundTrip(req *http.Request, codecs []Codec) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := lookup(codecs, res.Header.Get("Content-Encoding"))
+	if !ok || req.Method == http.MethodHead || res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified {
+		return res, nil
+	}
+	zr, err := c.NewReader(res.Body)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	res.Body = &decodedBody{ReadCloser: zr, raw: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return res, nil
+}
+
+// decodedBody closes both the decoder and the raw response body.
+type decodedBody struct {
+	io.ReadCloser
+	raw io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.raw.Close()
+}
@@ -0,0 +1,154 @@
+// Package httpconfig builds HTTP transports for network backends from a
+// small set of options, so that every backend pools connections the same
+// way. It complements tlsconfig, whose configuration the transport uses.
+//
+// The defaults are tuned for the traffic of go build: bursts of thousands
+// of small requests to one host, as many at once as the cache program's
+// concurrency allows, separated by silence. Go's own defaults keep only two
+// idle connections per host, so each burst would dial and close most of its
+// connections; here enough are kept idle to serve a whole burst, and long
+// enough to survive the pause between two builds of a CI job.
+package httpconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Defaults used for the zero fields of Options.
+const (
+	DefaultMaxIdleConns        = 256
+	DefaultMaxIdleConnsPerHost = 64
+	DefaultIdleConnTimeout     = 5 * time.Minute
+	DefaultDialTimeout         = 5 * time.Second
+	DefaultKeepAlive           = 30 * time.Second
+	DefaultTLSHandshakeTimeout = 5 * time.Second
+)
+
+// Options describes an HTTP transport. Zero fields take the defaults above.
+type Options struct {
+	// DisableHTTP2 keeps the transport on HTTP/1.1. HTTP/2 multiplexes a
+	// burst over few connections, but some proxies handle it poorly.
+	DisableHTTP2 bool
+
+	// MaxIdleConns limits idle connections across all hosts.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost limits idle connections to one host. It should
+	// be at least the concurrency of the cache program.
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost limits connections to one host, including active
+	// ones. Zero means no limit.
+	MaxConnsPerHost int
+
+	// IdleConnTimeout is how long an idle connection is kept.
+	IdleConnTimeout time.Duration
+
+	// DialTimeout bounds establishing a TCP connection. A short timeout
+	// turns an unreachable backend into misses quickly.
+	DialTimeout time.Duration
+
+	// KeepAlive is the interval of TCP keep-alive probes.
+	KeepAlive time.Duration
+
+	// TLSHandshakeTimeout bounds the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout bounds the wait for response headers once a
+	// request is written. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+}
+
+// FromEnv reads Options from environment variables named after prefix:
+// <prefix>_HTTP_DISABLE_HTTP2, <prefix>_HTTP_MAX_IDLE_CONNS,
+// <prefix>_HTTP_MAX_IDLE_CONNS_PER_HOST, <prefix>_HTTP_MAX_CONNS_PER_HOST,
+// <prefix>_HTTP_IDLE_CONN_TIMEOUT, <prefix>_HTTP_DIAL_TIMEOUT,
+// <prefix>_HTTP_KEEP_ALIVE, <prefix>_HTTP_TLS_HANDSHAKE_TIMEOUT and
+// <prefix>_HTTP_RESPONSE_HEADER_TIMEOUT.
+func FromEnv(prefix string) (Options, error) {
+	var o Options
+	var err error
+	parse := func(name string, fn func(s string) error) {
+		if s := os.Getenv(prefix + "_HTTP_" + name); s != "" && err == nil {
+			if perr := fn(s); perr != nil {
+				err = fmt.Errorf("invalid %s_HTTP_%s: %w", prefix, name, perr)
+			}
+		}
+	}
+	count := func(p *int) func(string) error {
+		return func(s string) (err error) {
+			*p, err = strconv.Atoi(s)
+			if err == nil && *p < 0 {
+				err = fmt.Errorf("%d is negative", *p)
+			}
+			return err
+		}
+	}
+	duration := func(p *time.Duration) func(string) error {
+		return func(s string) (err error) {
+			*p, err = time.ParseDuration(s)
+			return err
+		}
+	}
+	parse("DISABLE_HTTP2", func(s string) (err error) { o.DisableHTTP2, err = strconv.ParseBool(s); return })
+	parse("MAX_IDLE_CONNS", count(&o.MaxIdleConns))
+	parse("MAX_IDLE_CONNS_PER_HOST", count(&o.MaxIdleConnsPerHost))
+	parse("MAX_CONNS_PER_HOST", count(&o.MaxConnsPerHost))
+	parse("IDLE_CONN_TIMEOUT", duration(&o.IdleConnTimeout))
+	parse("DIAL_TIMEOUT", duration(&o.DialTimeout))
+	parse("KEEP_ALIVE", duration(&o.KeepAlive))
+	parse("TLS_HANDSHAKE_TIMEOUT", duration(&o.TLSHandshakeTimeout))
+	parse("RESPONSE_HEADER_TIMEOUT", duration(&o.ResponseHeaderTimeout))
+	return o, err
+}
+
+// Transport returns the transport described by o, using tlsConfig for
+// HTTPS connections; tlsConfig may be nil for the Go defaults.
+func (o Options) Transport(tlsConfig *tls.Config) *http.Transport {
+	or := func(v, def int) int {
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+	orDuration := func(v, def time.Duration) time.Duration {
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   orDuration(o.DialTimeout, DefaultDialTimeout),
+		KeepAlive: orDuration(o.KeepAlive, DefaultKeepAlive),
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     !o.DisableHTTP2,
+		MaxIdleConns:          or(o.MaxIdleConns, DefaultMaxIdleConns),
+		MaxIdleConnsPerHost:   or(o.MaxIdleConnsPerHost, DefaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:       o.MaxConnsPerHost,
+		IdleConnTimeout:       orDuration(o.IdleConnTimeout, DefaultIdleConnTimeout),
+		TLSHandshakeTimeout:   orDuration(o.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if o.DisableHTTP2 {
+		// A non-nil, empty map disables the bundled HTTP/2 support.
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+// Client returns an http.Client using the transport described by o.
+func (o Options) Client(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{Transport: o.Transport(tlsConfig)}
+}
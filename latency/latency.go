@@ -0,0 +1,177 @@
+// Package latency collects per-command latency histograms of a cache
+// program and reports their percentiles at the end of a build, to help
+// decide whether a remote tier is worth its round trips.
+package latency
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+const (
+	// minLatency is the upper bound of the first bucket.
+	minLatency = 10 * time.Microsecond
+
+	// bucketsPerDoubling sets the resolution: bucket bounds grow by a factor
+	// of 2^(1/4), so a reported percentile is within 19% of the true value.
+	bucketsPerDoubling = 4
+
+	// numBuckets covers latencies up to about 170 seconds; slower requests
+	// go into the last bucket.
+	numBuckets = 24 * bucketsPerDoubling
+)
+
+// Histogram is a latency histogram with logarithmic buckets. It is safe for
+// concurrent use.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets [numBuckets]int64
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+}
+
+// bucket returns the index of the bucket d falls into.
+func bucket(d time.Duration) int {
+	if d <= minLatency {
+		return 0
+	}
+	i := int(math.Ceil(math.Log2(float64(d)/float64(minLatency)) * bucketsPerDoubling))
+	return min(i, numBuckets-1)
+}
+
+// upperBound returns the largest latency of bucket i.
+func upperBound(i int) time.Duration {
+	return time.Duration(float64(minLatency) * math.Exp2(float64(i)/bucketsPerDoubling))
+}
+
+// Record adds one observation.
+func (h *Histogram) Record(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets[bucket(d)]++
+	h.count++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Mean returns the average latency.
+func (h *Histogram) Mean() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Max returns the largest latency observed.
+func (h *Histogram) Max() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.max
+}
+
+// Quantile returns the latency below which a fraction q of the observations
+// fall, rounded up to the bound of its bucket and capped at Max.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.count)))
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			return min(upperBound(i), h.max)
+		}
+	}
+	return h.max
+}
+
+// Recorder keeps one histogram per command.
+type Recorder struct {
+	mu         sync.Mutex
+	histograms map[cache.Cmd]*Histogram
+}
+
+// NewRecorder returns an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{histograms: make(map[cache.Cmd]*Histogram)}
+}
+
+// Histogram returns the histogram of cmd, creating it if needed.
+func (r *Recorder) Histogram(cmd cache.Cmd) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.histograms[cmd]
+	if !ok {
+		h = &Histogram{}
+		r.histograms[cmd] = h
+	}
+	return h
+}
+
+// Middleware returns a middleware that records the latency of every request
+// in the histogram of its command. The latency is measured from the time
+// the request was received, so it includes time spent waiting for a worker.
+func (r *Recorder) Middleware() cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, req *cache.Request) {
+			start, ok := cache.StartTimeFromContext(ctx)
+			if !ok {
+				start = time.Now()
+			}
+			next.Handle(ctx, w, req)
+			r.Histogram(req.Command).Record(time.Since(start))
+		})
+	}
+}
+
+// Report writes a table with the request count, mean, p50, p95, p99 and
+// maximum latency of every command.
+func (r *Recorder) Report(w io.Writer) error {
+	r.mu.Lock()
+	cmds := slices.Sorted(maps.Keys(r.histograms))
+	r.mu.Unlock()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "command\tcount\tmean\tp50\tp95\tp99\tmax\t")
+	for _, cmd := range cmds {
+		h := r.Histogram(cmd)
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%v\t%v\t%v\t%v\t\n", cmd, h.Count(),
+			round(h.Mean()), round(h.Quantile(0.50)), round(h.Quantile(0.95)),
+			round(h.Quantile(0.99)), round(h.Max()))
+	}
+	return tw.Flush()
+}
+
+// round drops digits below the histogram resolution.
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d.Round(time.Microsecond)
+	}
+}
@@ -0,0 +1,99 @@
+// Package layout maps cache entries to storage keys, so that backends
+// storing entries as files or bucket objects share a naming scheme.
+//
+// Keys are slash-separated, with lowercase hex IDs and an "-a" suffix for
+// action entries and "-d" for objects, like the go command's own cache.
+// Layouts differ in how they shard keys into directories or prefixes.
+//
+// A Layout is the key scheme of the backends storing entries under keys,
+// such as s3 and genericrepo, and can be replaced to match the keys of an
+// existing bucket or repository with a Template, or to add a prefix with
+// Prefixed.
+package layout
+
+import (
+	"encoding/hex"
+	"path"
+)
+
+const (
+	actionSuffix = "-a"
+	objectSuffix = "-d"
+)
+
+// Layout maps ActionIDs and OutputIDs to storage keys.
+type Layout interface {
+	ActionKey(actionID []byte) string
+	ObjectKey(outputID []byte) string
+}
+
+// Default shards keys by the first two hex digits of the ID, as in
+// "<prefix>/3f/3f2a…-d". It is the layout of the example disk cache.
+type Default struct {
+	Prefix string
+}
+
+// ActionKey returns the key of the action entry of actionID.
+func (l Default) ActionKey(actionID []byte) string {
+	hexID := hex.EncodeToString(actionID)
+	return path.Join(l.Prefix, hexID[:2], hexID+actionSuffix)
+}
+
+// ObjectKey returns the key of the object of outputID.
+func (l Default) ObjectKey(outputID []byte) string {
+	hexID := hex.EncodeToString(outputID)
+	return path.Join(l.Prefix, hexID[:2], hexID+objectSuffix)
+}
+
+// Sharded shards keys into Depth levels of directories named by successive
+// groups of Width hex digits of the ID: with Depth 2 and Width 1, as in
+// "<prefix>/3/f/3f2a…-d". Depth 0 puts every key directly under the
+// prefix, which suits small caches on filesystems with fast large
+// directories; deeper sharding keeps directories small for caches of
+// millions of entries. Default is Sharded with Depth 1 and Width 2.
+type Sharded struct {
+	Prefix string
+	Depth  int // 0 to 2
+	Width  int // 1 or 2
+}
+
+// ActionKey returns the key of the action entry of actionID.
+func (l Sharded) ActionKey(actionID []byte) string {
+	return l.key(hex.EncodeToString(actionID) + actionSuffix)
+}
+
+// ObjectKey returns the key of the object of outputID.
+func (l Sharded) ObjectKey(outputID []byte) string {
+	return l.key(hex.EncodeToString(outputID) + objectSuffix)
+}
+
+func (l Sharded) key(name string) string {
+	elems := []string{l.Prefix}
+	for i := range l.Depth {
+		elems = append(elems, name[i*l.Width:(i+1)*l.Width])
+	}
+	return path.Join(append(elems, name)...)
+}
+
+// Sccache shards keys like sccache does in S3 and GCS buckets: by each of
+// the first three hex digits, as in "<prefix>/3/f/2/3f2a…-d". Using it with
+// the key prefix configured for sccache lets a mixed Rust and Go pipeline
+// share one bucket and one lifecycle policy. The entries themselves are not
+// shared; the suffixes keep Go keys distinct from sccache's.
+type Sccache struct {
+	Prefix string
+}
+
+// ActionKey returns the key of the action entry of actionID.
+func (l Sccache) ActionKey(actionID []byte) string {
+	return sccacheKey(l.Prefix, hex.EncodeToString(actionID)+actionSuffix)
+}
+
+// ObjectKey returns the key of the object of outputID.
+func (l Sccache) ObjectKey(outputID []byte) string {
+	return sccacheKey(l.Prefix, hex.EncodeToString(outputID)+objectSuffix)
+}
+
+func sccacheKey(prefix, name string) string {
+	return path.Join(prefix, name[0:1], name[1:2], name[2:3], name)
+}
@@ -0,0 +1,121 @@
+package layout
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Template names keys by patterns, to match the layout of an existing
+// bucket or repository. In a pattern, "{id}" stands for the hex ID and
+// "{id:i:j}" for its hex digits i to j, so that the Default layout is:
+//
+//	layout.Template{Action: "{id:0:2}/{id}-a", Object: "{id:0:2}/{id}-d"}
+//
+// and the content-addressed store of bazel-remote is:
+//
+//	layout.Template{Action: "ac/{id:0:2}/{id}", Object: "cas/{id:0:2}/{id}"}
+type Template struct {
+	Action string
+	Object string
+}
+
+// ParseTemplate returns the Template of the action and object patterns.
+// Both must contain "{id}", and give different keys, so that no two entries
+// share a key.
+func ParseTemplate(action, object string) (Template, error) {
+	t := Template{Action: action, Object: object}
+	for _, p := range []string{action, object} {
+		if !strings.Contains(p, "{id}") {
+			return Template{}, fmt.Errorf("key pattern %q has no {id}", p)
+		}
+		if _, err := expand(p, ""); err != nil {
+			return Template{}, fmt.Errorf("invalid key pattern %q: %w", p, err)
+		}
+	}
+	// Compare expanded keys rather than patterns, which may differ only
+	// in ways expansion cleans up, such as "./{id}" and "{id}".
+	sample := make([]byte, 32)
+	for i := range sample {
+		sample[i] = byte(i)
+	}
+	if t.ActionKey(sample) == t.ObjectKey(sample) {
+		return Template{}, errors.New("action and object key patterns give the same keys")
+	}
+	return t, nil
+}
+
+// ActionKey returns the key of the action entry of actionID.
+func (t Template) ActionKey(actionID []byte) string {
+	key, _ := expand(t.Action, hex.EncodeToString(actionID))
+	return key
+}
+
+// ObjectKey returns the key of the object of outputID.
+func (t Template) ObjectKey(outputID []byte) string {
+	key, _ := expand(t.Object, hex.EncodeToString(outputID))
+	return key
+}
+
+// expand replaces the placeholders of pattern with hexID. Ranges beyond
+// the end of hexID are truncated.
+func expand(pattern, hexID string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(pattern, "{")
+		if i < 0 {
+			b.WriteString(pattern)
+			return path.Clean(b.String()), nil
+		}
+		j := strings.Index(pattern[i:], "}")
+		if j < 0 {
+			return "", errors.New("unterminated placeholder")
+		}
+		b.WriteString(pattern[:i])
+		s, err := placeholder(pattern[i+1:i+j], hexID)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s)
+		pattern = pattern[i+j+1:]
+	}
+}
+
+// placeholder returns the value of the placeholder named name, without its
+// braces.
+func placeholder(name, hexID string) (string, error) {
+	if name == "id" {
+		return hexID, nil
+	}
+	rest, ok := strings.CutPrefix(name, "id:")
+	if !ok {
+		return "", fmt.Errorf("unknown placeholder {%s}", name)
+	}
+	from, to, ok := strings.Cut(rest, ":")
+	i, err1 := strconv.Atoi(from)
+	j, err2 := strconv.Atoi(to)
+	if !ok || err1 != nil || err2 != nil || i < 0 || j <= i {
+		return "", fmt.Errorf("invalid placeholder {%s}: want {id:i:j} with i < j", name)
+	}
+	return hexID[min(i, len(hexID)):min(j, len(hexID))], nil
+}
+
+// Prefixed puts the keys of Layout under Prefix, for example a prefix per
+// team so that bucket lifecycle rules apply to the entries of each team.
+type Prefixed struct {
+	Prefix string
+	Layout Layout
+}
+
+// ActionKey returns the key of the action entry of actionID.
+func (l Prefixed) ActionKey(actionID []byte) string {
+	return path.Join(l.Prefix, l.Layout.ActionKey(actionID))
+}
+
+// ObjectKey returns the key of the object of outputID.
+func (l Prefixed) ObjectKey(outputID []byte) string {
+	return path.Join(l.Prefix, l.Layout.ObjectKey(outputID))
+}
@@ -0,0 +1,203 @@
+// Package manifest reads and writes manifests, the listing of cache entries
+// shared by snapshot export and import, warm-up and selective upload.
+//
+// # Format
+//
+// A manifest is a JSON Lines file. The first line is a header, and every
+// following line describes one entry:
+//
+//	{"version":1,"created":"2025-01-02T15:04:05Z"}
+//	{"action_id":"3f2a…","output_id":"9c41…","size":1234,"time":"2025-01-02T15:00:00Z"}
+//	{"action_id":"77b0…","output_id":"e5d8…","size":56,"time":"2025-01-02T15:00:01Z","tags":{"branch":"main"}}
+//
+// IDs are lowercase hex. Readers must ignore unknown fields, and reject a
+// header with a version they do not know. Entries are streamed, so a
+// manifest can list millions of entries without being held in memory.
+package manifest
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version is the format version written by this package.
+const Version = 1
+
+// FileName is the conventional name of the manifest in a snapshot.
+const FileName = "manifest.jsonl"
+
+// Header is the first line of a manifest.
+type Header struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// Entry maps an ActionID to the object stored for it.
+type Entry struct {
+	ActionID []byte
+	OutputID []byte
+	Size     int64
+	Time     time.Time
+
+	// Tags are the user tags attached to the entry, if any.
+	Tags map[string]string
+}
+
+// jsonEntry is the encoded form of an Entry.
+type jsonEntry struct {
+	ActionID string            `json:"action_id"`
+	OutputID string            `json:"output_id"`
+	Size     int64             `json:"size"`
+	Time     time.Time         `json:"time"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// MarshalJSON encodes e with hex IDs.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonEntry{
+		ActionID: hex.EncodeToString(e.ActionID),
+		OutputID: hex.EncodeToString(e.OutputID),
+		Size:     e.Size,
+		Time:     e.Time.UTC(),
+		Tags:     e.Tags,
+	})
+}
+
+// UnmarshalJSON decodes an entry with hex IDs.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var j jsonEntry
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	actionID, err := hex.DecodeString(j.ActionID)
+	if err != nil || len(actionID) == 0 {
+		return fmt.Errorf("invalid action ID %q", j.ActionID)
+	}
+	outputID, err := hex.DecodeString(j.OutputID)
+	if err != nil || len(outputID) == 0 {
+		return fmt.Errorf("invalid output ID %q", j.OutputID)
+	}
+	if j.Size < 0 {
+		return fmt.Errorf("invalid size %d", j.Size)
+	}
+	*e = Entry{ActionID: actionID, OutputID: outputID, Size: j.Size, Time: j.Time, Tags: j.Tags}
+	return nil
+}
+
+// Writer writes a manifest.
+type Writer struct {
+	enc *json.Encoder
+}
+
+// NewWriter writes the header to w and returns a Writer for the entries.
+func NewWriter(w io.Writer) (*Writer, error) {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(Header{Version: Version, Created: time.Now().UTC()}); err != nil {
+		return nil, fmt.Errorf("failed to write manifest header: %w", err)
+	}
+	return &Writer{enc: enc}, nil
+}
+
+// Write writes one entry.
+func (w *Writer) Write(e Entry) error {
+	if err := w.enc.Encode(e); err != nil {
+		return fmt.Errorf("failed to write manifest entry: %w", err)
+	}
+	return nil
+}
+
+// Reader reads a manifest.
+type Reader struct {
+	Header Header
+
+	dec  *json.Decoder
+	line int
+}
+
+// NewReader reads the header from r and returns a Reader for the entries.
+func NewReader(r io.Reader) (*Reader, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var h Header
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("failed to read manifest header: %w", err)
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("unsupported manifest version %d", h.Version)
+	}
+	return &Reader{Header: h, dec: dec, line: 1}, nil
+}
+
+// Next returns the next entry, or io.EOF at the end of the manifest.
+func (r *Reader) Next() (Entry, error) {
+	var e Entry
+	r.line++
+	if err := r.dec.Decode(&e); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Entry{}, io.EOF
+		}
+		return Entry{}, fmt.Errorf("manifest entry %d: %w", r.line-1, err)
+	}
+	return e, nil
+}
+
+// ReadAll reads every entry of a manifest.
+func ReadAll(r io.Reader) ([]Entry, error) {
+	mr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for {
+		e, err := mr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+// WriteFile writes a manifest of entries to the file at path, atomically.
+func WriteFile(path string, entries []Entry) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	bw := bufio.NewWriter(f)
+	w, err := NewWriter(bw)
+	for i := 0; err == nil && i < len(entries); i++ {
+		err = w.Write(entries[i])
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// ReadFile reads every entry of the manifest at path.
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer f.Close()
+	return ReadAll(f)
+}
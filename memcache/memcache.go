@@ -0,0 +1,297 @@
+// Package memcache keeps cache entries in memory, alone or as the front
+// tier of a slower backend, for cache servers and daemons that serve many
+// builds from one process.
+//
+// Objects of at most the inline size are held in memory with their entry,
+// and written to the scratch store only when a hit needs a file and the
+// one it was put or got with is gone. The go command reads every object
+// from the DiskPath of responses, so puts still need a file: in front of a
+// backend, it is the backend's own; alone, it is written to the scratch
+// store. Larger objects are only ever kept as files.
+//
+//	store, err := castore.New(scratchDir)
+//	c := memcache.New(store, memcache.WithNext(diskBackend), memcache.WithInlineSize(16<<10))
+//	cache.HandleGetFunc(c.Handle)
+//	cache.HandlePutFunc(c.Handle)
+package memcache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+)
+
+// entryOverhead is the memory charged for an entry besides its inline
+// object.
+const entryOverhead = 128
+
+// Cache is a cache backend in memory. It is safe for concurrent use.
+type Cache struct {
+	store      *castore.Store
+	next       cache.Handler
+	inlineSize int64
+	maxBytes   int64
+
+	mu      sync.Mutex
+	bytes   int64
+	order   *list.List               // of *entry, least recently used first
+	entries map[string]*list.Element // by raw ActionID
+}
+
+type entry struct {
+	actionID string
+	outputID []byte
+	size     int64
+	time     time.Time
+	data     []byte // the object, if at most the inline size
+	path     string // a file holding the object, which may have been removed
+}
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithNext puts the Cache in front of next: gets that miss in memory are
+// sent to next, and puts are stored by next as well.
+func WithNext(next cache.Handler) Option {
+	return func(c *Cache) {
+		c.next = next
+	}
+}
+
+// WithInlineSize keeps objects of at most n bytes in memory. The default is
+// 4 KiB; zero keeps no objects in memory.
+func WithInlineSize(n int64) Option {
+	return func(c *Cache) {
+		c.inlineSize = n
+	}
+}
+
+// WithMaxBytes bounds the memory used by entries and inline objects to n
+// bytes, evicting the least recently used entries beyond it. The default
+// is 256 MiB.
+func WithMaxBytes(n int64) Option {
+	return func(c *Cache) {
+		c.maxBytes = n
+	}
+}
+
+// New returns a Cache writing objects to store when they need a file.
+// Files of evicted entries stay in store until pruned with castore.Prune.
+func New(store *castore.Store, opts ...Option) *Cache {
+	c := &Cache{
+		store:      store,
+		inlineSize: 4 << 10,
+		maxBytes:   256 << 20,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Handle implements cache.Handler for the get and put commands. The close
+// command releases the files of the session in the scratch store, see
+// castore.Store.Hold; other commands succeed without effect.
+func (c *Cache) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	var res cache.Response
+	var err error
+	switch r.Command {
+	case cache.CmdGet:
+		res, err = c.get(ctx, r)
+	case cache.CmdPut:
+		res, err = c.put(ctx, r)
+	case cache.CmdClose:
+		c.store.ReleaseSession(ctx)
+	}
+	if err != nil {
+		cache.WriteError(w, r, err)
+		return
+	}
+	res.ID = r.ID
+	w.WriteResponse(res)
+}
+
+func (c *Cache) get(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	if e, ok := c.lookup(r.ActionID); ok {
+		c.store.Hold(ctx, e.outputID)
+		path, err := c.file(e)
+		if err != nil {
+			return cache.Response{}, err
+		}
+		if path != "" {
+			t := e.time
+			return cache.Response{OutputID: e.outputID, Size: e.size, Time: &t, DiskPath: path}, nil
+		}
+		// A large object whose file is gone.
+		c.remove(r.ActionID)
+	}
+	if c.next == nil {
+		return cache.Response{}, cache.ErrMiss
+	}
+
+	res := cache.Call(ctx, c.next, r)
+	if res.Err != "" || res.Miss {
+		return passThrough(res)
+	}
+	e := &entry{
+		actionID: string(r.ActionID),
+		outputID: res.OutputID,
+		size:     res.Size,
+		path:     res.DiskPath,
+	}
+	if res.Time != nil {
+		e.time = *res.Time
+	}
+	if res.Size <= c.inlineSize {
+		// A file that cannot be read is simply not kept inline.
+		if data, err := os.ReadFile(res.DiskPath); err == nil && int64(len(data)) == res.Size {
+			e.data = data
+		}
+	}
+	c.add(e)
+	return res, nil
+}
+
+func (c *Cache) put(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	e := &entry{
+		actionID: string(r.ActionID),
+		outputID: r.OutputID,
+		size:     r.BodySize,
+		time:     time.Now(),
+	}
+	body := r.Body
+	if r.BodySize <= c.inlineSize {
+		data, err := io.ReadAll(io.LimitReader(r.Body, r.BodySize+1))
+		if err != nil {
+			return cache.Response{}, fmt.Errorf("failed to read body: %w", err)
+		}
+		if int64(len(data)) != r.BodySize {
+			return cache.Response{}, cache.Errorf(cache.CodeInvalidRequest, "object is %d bytes, want %d", len(data), r.BodySize)
+		}
+		e.data = data
+		body = bytes.NewReader(data)
+	}
+
+	if c.next != nil {
+		req := *r
+		req.Body = body
+		res := cache.Call(ctx, c.next, &req)
+		if res.Err != "" {
+			return passThrough(res)
+		}
+		e.path = res.DiskPath
+	} else {
+		c.store.Hold(ctx, r.OutputID)
+		path, size, err := c.store.Put(r.OutputID, body)
+		if err != nil {
+			return cache.Response{}, err
+		}
+		if size != r.BodySize {
+			return cache.Response{}, cache.Errorf(cache.CodeInvalidRequest, "object is %d bytes, want %d", size, r.BodySize)
+		}
+		e.path = path
+	}
+	c.add(e)
+	return cache.Response{DiskPath: e.path}, nil
+}
+
+// file returns the path of a file holding the object of e, writing the
+// inline object to the scratch store if its file is gone, or "" if e has no
+// inline object to write.
+func (c *Cache) file(e entry) (string, error) {
+	if e.path != "" {
+		if fi, err := os.Stat(e.path); err == nil && fi.Size() == e.size {
+			return e.path, nil
+		}
+	}
+	if e.data == nil {
+		return "", nil
+	}
+	path, _, err := c.store.Put(e.outputID, bytes.NewReader(e.data))
+	if err != nil {
+		return "", err
+	}
+	c.setPath(e.actionID, path)
+	return path, nil
+}
+
+// lookup returns a copy of the entry of actionID, marking it as used.
+func (c *Cache) lookup(actionID []byte) (entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[string(actionID)]
+	if !ok {
+		return entry{}, false
+	}
+	c.order.MoveToBack(el)
+	return *el.Value.(*entry), true
+}
+
+// add stores e, replacing the entry of its ActionID, and evicts the least
+// recently used entries beyond the memory bound.
+func (c *Cache) add(e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.actionID]; ok {
+		c.removeElement(el)
+	}
+	c.entries[e.actionID] = c.order.PushBack(e)
+	c.bytes += cost(e)
+	for c.bytes > c.maxBytes && c.order.Len() > 1 {
+		c.removeElement(c.order.Front())
+	}
+}
+
+func (c *Cache) setPath(actionID, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[actionID]; ok {
+		el.Value.(*entry).path = path
+	}
+}
+
+func (c *Cache) remove(actionID []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[string(actionID)]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	e := c.order.Remove(el).(*entry)
+	delete(c.entries, e.actionID)
+	c.bytes -= cost(e)
+}
+
+// Len returns the number of entries and the bytes of memory they use.
+func (c *Cache) Len() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len(), c.bytes
+}
+
+func cost(e *entry) int64 {
+	return entryOverhead + int64(len(e.actionID)+len(e.outputID)+len(e.data)+len(e.path))
+}
+
+// passThrough returns the miss or error of the next tier's response res.
+func passThrough(res cache.Response) (cache.Response, error) {
+	if res.Error != nil {
+		return cache.Response{}, res.Error
+	}
+	if res.Err != "" {
+		return cache.Response{}, cache.Errorf(cache.CodeInternal, "%s", res.Err)
+	}
+	return cache.Response{}, cache.ErrMiss
+}
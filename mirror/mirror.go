@@ -0,0 +1,298 @@
+// Package mirror switches a cache between two backends without downtime,
+// such as from a go-cache-server to an S3 bucket.
+//
+// A Mirror serves gets from one backend, the old one at first, and writes
+// every put to both, so that the new backend receives all the entries put
+// during the migration. With WithBackfill, the entries got from the old
+// backend are copied into the new one too, so that it fills with the
+// entries builds actually use rather than with a bulk copy of the old
+// backend. Once the new backend hits as often as the old one, WithReadNew
+// serves gets from it, still falling back to the old backend on a miss,
+// and the old backend can then be removed:
+//
+//	m := mirror.New(oldBackend, newBackend, mirror.WithBackfill(4))
+//	cache.HandleGetFunc(m.Handle)
+//	cache.HandlePutFunc(m.Handle)
+//	cache.HandleCloseFunc(m.Handle)
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// maxCopied bounds the ActionIDs remembered as present in both backends.
+const maxCopied = 1 << 20
+
+// Stats counts the entries written to the secondary backend, the one gets
+// are not served from.
+type Stats struct {
+	// Mirrored and MirrorFailed count the puts written to the secondary.
+	Mirrored, MirrorFailed int64
+
+	// Backfilled and BackfillFailed count the hits of the old backend
+	// copied into the new one, and BackfillDropped those not copied
+	// because as many copies as allowed were in flight.
+	Backfilled, BackfillFailed, BackfillDropped int64
+
+	// Fallbacks counts the misses of the new backend answered by the old
+	// one, with WithReadNew.
+	Fallbacks int64
+}
+
+// Mirror is a cache.Handler writing to two backends.
+type Mirror struct {
+	from, to cache.Handler
+	readNew  bool
+	backfill chan struct{} // semaphore of backfills, nil if disabled
+	timeout  time.Duration
+	logger   *slog.Logger
+	wg       sync.WaitGroup
+	lastID   atomic.Int64
+
+	mu     sync.Mutex
+	copied map[string]struct{} // ActionIDs known to be in both backends
+
+	mirrored, mirrorFailed                      atomic.Int64
+	backfilled, backfillFailed, backfillDropped atomic.Int64
+	fallbacks                                   atomic.Int64
+}
+
+// Option configures a Mirror.
+type Option func(*Mirror)
+
+// WithBackfill copies the entries got from the old backend into the new
+// one in the background, at most concurrency at a time. Hits beyond the
+// limit are not copied rather than delaying the build.
+func WithBackfill(concurrency int) Option {
+	return func(m *Mirror) {
+		m.backfill = make(chan struct{}, concurrency)
+	}
+}
+
+// WithReadNew serves gets from the new backend, and its misses from the
+// old one. Puts are still written to both, so that the old backend can be
+// switched back to.
+func WithReadNew() Option {
+	return func(m *Mirror) {
+		m.readNew = true
+	}
+}
+
+// WithTimeout bounds every request to the secondary backend and every
+// backfill. The default is 30 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(m *Mirror) {
+		m.timeout = d
+	}
+}
+
+// WithLogger logs the failures of the secondary backend to l instead of
+// slog.Default().
+func WithLogger(l *slog.Logger) Option {
+	return func(m *Mirror) {
+		m.logger = l
+	}
+}
+
+// New returns a Mirror migrating from the backend from to the backend to.
+func New(from, to cache.Handler, opts ...Option) *Mirror {
+	m := &Mirror{
+		from:    from,
+		to:      to,
+		timeout: 30 * time.Second,
+		logger:  slog.Default(),
+		copied:  make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// primary returns the backend gets are served from, and the other one.
+func (m *Mirror) primary() (cache.Handler, cache.Handler) {
+	if m.readNew {
+		return m.to, m.from
+	}
+	return m.from, m.to
+}
+
+// Handle implements cache.Handler.
+func (m *Mirror) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	switch r.Command {
+	case cache.CmdGet:
+		m.get(ctx, w, r)
+	case cache.CmdPut:
+		m.put(ctx, w, r)
+	case cache.CmdClose:
+		m.wg.Wait()
+		primary, secondary := m.primary()
+		cr := *r
+		if res := m.call(ctx, secondary, &cr); res.Err != "" {
+			m.logger.Warn("failed to close secondary backend", "err", res.Err)
+		}
+		primary.Handle(ctx, w, r)
+	default:
+		primary, _ := m.primary()
+		primary.Handle(ctx, w, r)
+	}
+}
+
+func (m *Mirror) get(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	if !m.readNew {
+		res := cache.Call(ctx, m.from, r)
+		if res.Err == "" && !res.Miss {
+			m.startBackfill(ctx, r.ActionID, res)
+		}
+		w.WriteResponse(res)
+		return
+	}
+
+	res := cache.Call(ctx, m.to, r)
+	if res.Err != "" || !res.Miss || cache.LocalOnlyFromContext(ctx) {
+		w.WriteResponse(res)
+		return
+	}
+	res = cache.Call(ctx, m.from, r)
+	if res.Err == "" && !res.Miss {
+		m.fallbacks.Add(1)
+		m.startBackfill(ctx, r.ActionID, res)
+	}
+	w.WriteResponse(res)
+}
+
+// put writes the entry to the primary backend, then to the secondary from
+// the copy the primary returned, before responding so that no entry put
+// during the migration is missing from either backend. A failure of the
+// secondary is logged but not returned, since the go command only depends
+// on the primary.
+func (m *Mirror) put(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	primary, secondary := m.primary()
+	res := cache.Call(ctx, primary, r)
+	if res.Err == "" {
+		if err := m.copy(ctx, secondary, r.ActionID, r.OutputID, r.BodySize, res.DiskPath, r.Body); err != nil {
+			m.mirrorFailed.Add(1)
+			cache.LoggerFromContext(ctx).Warn("failed to mirror put", "err", err)
+		} else {
+			m.mirrored.Add(1)
+			m.remember(r.ActionID)
+		}
+	}
+	w.WriteResponse(res)
+}
+
+// startBackfill copies the hit res of the old backend into the new one in
+// the background, unless it is known to be there already.
+func (m *Mirror) startBackfill(ctx context.Context, actionID []byte, res cache.Response) {
+	if m.backfill == nil || m.known(actionID) {
+		return
+	}
+	select {
+	case m.backfill <- struct{}{}:
+	default:
+		m.backfillDropped.Add(1)
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() { <-m.backfill }()
+		if err := m.copy(ctx, m.to, actionID, res.OutputID, res.Size, res.DiskPath, nil); err != nil {
+			m.backfillFailed.Add(1)
+			cache.LoggerFromContext(ctx).Warn("failed to backfill entry", "err", err)
+			return
+		}
+		m.backfilled.Add(1)
+		m.remember(actionID)
+	}()
+}
+
+// copy puts the entry of actionID to dst, reading its object from the file
+// at path, or from body if path is empty and body can be rewound.
+func (m *Mirror) copy(ctx context.Context, dst cache.Handler, actionID, outputID []byte, size int64, path string, body io.Reader) error {
+	var src io.Reader
+	switch s, ok := body.(io.ReadSeeker); {
+	case path != "":
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open object: %w", err)
+		}
+		defer f.Close()
+		src = f
+	case ok:
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind body: %w", err)
+		}
+		src = s
+	case size == 0:
+	default:
+		return errors.New("the object is neither on disk nor rewindable")
+	}
+	if src != nil {
+		src = io.LimitReader(src, size)
+	}
+	res := m.call(ctx, dst, &cache.Request{
+		Command:  cache.CmdPut,
+		ActionID: actionID,
+		OutputID: outputID,
+		Body:     src,
+		BodySize: size,
+	})
+	if res.Err != "" {
+		return errors.New(res.Err)
+	}
+	return nil
+}
+
+// call sends r to h within the timeout, with an ID of its own.
+func (m *Mirror) call(ctx context.Context, h cache.Handler, r *cache.Request) cache.Response {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	r.ID = m.lastID.Add(1)
+	return cache.Call(ctx, h, r)
+}
+
+// remember records that the entry of actionID is in both backends.
+func (m *Mirror) remember(actionID []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.copied) >= maxCopied {
+		clear(m.copied)
+	}
+	m.copied[string(actionID)] = struct{}{}
+}
+
+func (m *Mirror) known(actionID []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.copied[string(actionID)]
+	return ok
+}
+
+// Stats returns the counters so far.
+func (m *Mirror) Stats() Stats {
+	return Stats{
+		Mirrored:        m.mirrored.Load(),
+		MirrorFailed:    m.mirrorFailed.Load(),
+		Backfilled:      m.backfilled.Load(),
+		BackfillFailed:  m.backfillFailed.Load(),
+		BackfillDropped: m.backfillDropped.Load(),
+		Fallbacks:       m.fallbacks.Load(),
+	}
+}
+
+// Wait waits for the backfills in flight.
+func (m *Mirror) Wait() {
+	m.wg.Wait()
+}
@@ -0,0 +1,650 @@
+// Package oci stores cache entries in an OCI container registry, such as
+// GHCR, ECR or ACR, so that teams can reuse the registry, its
+// authentication and its garbage collection for the build cache.
+//
+// Every entry is a manifest in one repository, tagged with the hex
+// ActionID or as set with WithLayout. Its single layer is the object,
+// stored as a blob addressed by the SHA-256 of its content, so entries
+// with the same output share a blob and deleting tags, for example with a
+// registry retention policy, lets the registry garbage collect the objects
+// no entry uses anymore:
+//
+//	{
+//	  "mediaType": "application/vnd.oci.image.manifest.v1+json",
+//	  "artifactType": "application/vnd.go-cache-prog.entry.v1",
+//	  "config": <the empty descriptor>,
+//	  "layers": [{"mediaType": "application/vnd.go-cache-prog.object.v1", ...}],
+//	  "annotations": {"dev.go-cache-prog.output-id": <hex OutputID>, ...}
+//	}
+//
+// The client authenticates with the token flow of the distribution
+// specification, using credentials from WithBasicAuth or, with
+// WithDockerConfig, the Docker configuration and credential helpers that
+// docker login and the cloud CLIs set up.
+package oci
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+	"github.com/hirasawayuki/go-cache-prog/layout"
+)
+
+const (
+	// ArtifactType is the artifact type of entry manifests.
+	ArtifactType = "application/vnd.go-cache-prog.entry.v1"
+
+	// ObjectMediaType is the media type of object layers.
+	ObjectMediaType = "application/vnd.go-cache-prog.object.v1"
+
+	// OutputIDAnnotation holds the hex OutputID of an entry.
+	OutputIDAnnotation = "dev.go-cache-prog.output-id"
+
+	manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	createdAnnotation = "org.opencontainers.image.created"
+)
+
+// emptyConfig is the empty descriptor of the image specification, used as
+// the config of artifacts that have none.
+var emptyConfig = descriptor{
+	MediaType: "application/vnd.oci.empty.v1+json",
+	Digest:    "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+	Size:      2,
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        descriptor        `json:"config"`
+	Layers        []descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Client is a cache backend stored in a registry repository. Objects are
+// downloaded to, and uploaded from, a local castore.Store, since the go
+// command reads them from the DiskPath of responses.
+type Client struct {
+	base   *url.URL // https://host/v2/name/
+	host   string
+	repo   string
+	store  *castore.Store
+	http   *http.Client
+	layout layout.Layout // names tags; nil for the hex ActionID
+
+	// credentials returns the user name and password for the registry, or
+	// empty strings for anonymous access.
+	credentials func(ctx context.Context) (user, password string, err error)
+
+	mu           sync.Mutex
+	token        string // bearer token of the last challenge
+	basic        bool   // the registry asked for basic authentication
+	pushedConfig bool   // the empty config blob is in the repository
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with c instead of http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) {
+		cl.http = c
+	}
+}
+
+// WithPlainHTTP talks to the registry over HTTP, for local registries.
+func WithPlainHTTP() Option {
+	return func(c *Client) {
+		c.base.Scheme = "http"
+	}
+}
+
+// WithBasicAuth authenticates as user with password, or with a personal
+// access token as the password as GHCR expects.
+func WithBasicAuth(user, password string) Option {
+	return func(c *Client) {
+		c.credentials = func(context.Context) (string, string, error) { return user, password, nil }
+	}
+}
+
+// WithDockerConfig authenticates with the credentials stored for the
+// registry in the Docker configuration, $DOCKER_CONFIG/config.json or
+// ~/.docker/config.json, running its credential helper if it names one, as
+// docker-credential-ecr-login for ECR.
+func WithDockerConfig() Option {
+	return func(c *Client) {
+		c.credentials = func(ctx context.Context) (string, string, error) { return dockerCredentials(ctx, c.host) }
+	}
+}
+
+// WithLayout tags entries with the action keys of l, with slashes replaced
+// by dashes, for example to put a prefix before the ActionID of every tag
+// that a registry retention policy matches:
+//
+//	oci.WithLayout(layout.Template{Action: "team-a-{id}", Object: "{id}"})
+//
+// Tags must be valid OCI tags, at most 128 letters, digits, underscores,
+// periods and dashes. Objects are blobs addressed by their digest, so the
+// object keys of l are not used.
+func WithLayout(l layout.Layout) Option {
+	return func(c *Client) {
+		c.layout = l
+	}
+}
+
+// New returns a Client of the repository ref, such as ghcr.io/org/go-cache,
+// keeping objects in a castore.Store rooted at dir.
+func New(ref, dir string, opts ...Option) (*Client, error) {
+	host, repo, ok := strings.Cut(ref, "/")
+	if !ok || host == "" || repo == "" || strings.Contains(ref, "://") {
+		return nil, fmt.Errorf("invalid repository %q, want host/name", ref)
+	}
+	c := &Client{
+		base:        &url.URL{Scheme: "https", Host: host, Path: "/v2/" + repo + "/"},
+		host:        host,
+		repo:        repo,
+		http:        http.DefaultClient,
+		credentials: func(context.Context) (string, string, error) { return "", "", nil },
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if tag := c.tag(make([]byte, 32)); !validTag(tag) {
+		return nil, fmt.Errorf("invalid layout: %q is not a valid tag", tag)
+	}
+	// DiskPath must be absolute.
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve object directory: %w", err)
+	}
+	if c.store, err = castore.New(dir); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Store returns the store of the downloaded and uploaded objects, to be
+// pruned with castore.Store.Prune.
+func (c *Client) Store() *castore.Store {
+	return c.store
+}
+
+// Handle implements cache.Handler for the get and put commands. The close
+// command releases the objects of the session, see castore.Store.Hold;
+// other commands succeed without effect.
+func (c *Client) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	var res cache.Response
+	var err error
+	switch r.Command {
+	case cache.CmdGet:
+		res, err = c.get(ctx, r)
+	case cache.CmdPut:
+		res, err = c.put(ctx, r)
+	case cache.CmdClose:
+		c.store.ReleaseSession(ctx)
+	}
+	if err != nil {
+		cache.WriteError(w, r, err)
+		return
+	}
+	res.ID = r.ID
+	w.WriteResponse(res)
+}
+
+// tag returns the tag of the entry of actionID.
+func (c *Client) tag(actionID []byte) string {
+	if c.layout == nil {
+		return hex.EncodeToString(actionID)
+	}
+	return strings.ReplaceAll(c.layout.ActionKey(actionID), "/", "-")
+}
+
+// validTag reports whether tag matches [a-zA-Z0-9_][a-zA-Z0-9._-]{0,127},
+// the tags of the distribution specification.
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > 128 || tag[0] == '.' || tag[0] == '-' {
+		return false
+	}
+	for _, r := range tag {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_' || r == '.' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) objectPath(outputID []byte) string {
+	return c.store.Path(outputID)
+}
+
+func (c *Client) get(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	res, err := c.do(ctx, http.MethodGet, c.base.JoinPath("manifests", c.tag(r.ActionID)).String(), nil, http.Header{
+		"Accept": {manifestMediaType},
+	})
+	if err != nil {
+		return cache.Response{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return cache.Response{}, cache.ErrMiss
+	}
+	if res.StatusCode != http.StatusOK {
+		return cache.Response{}, errorFromStatus(res)
+	}
+	var m manifest
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&m); err != nil || len(m.Layers) != 1 {
+		// Not an entry of ours.
+		return cache.Response{}, cache.ErrMiss
+	}
+	outputID, err := hex.DecodeString(m.Annotations[OutputIDAnnotation])
+	if err != nil || len(outputID) == 0 {
+		return cache.Response{}, cache.ErrMiss
+	}
+
+	layer := m.Layers[0]
+	c.store.Hold(ctx, outputID)
+	if err := c.store.Fill(ctx, outputID, layer.Size, func() error {
+		return c.download(ctx, outputID, layer)
+	}); err != nil {
+		return cache.Response{}, err
+	}
+	out := cache.Response{OutputID: outputID, Size: layer.Size, DiskPath: c.objectPath(outputID)}
+	if t, err := time.Parse(time.RFC3339, m.Annotations[createdAnnotation]); err == nil {
+		out.Time = &t
+	}
+	return out, nil
+}
+
+// download fetches the blob of layer into the store as the object of
+// outputID.
+func (c *Client) download(ctx context.Context, outputID []byte, layer descriptor) error {
+	res, err := c.do(ctx, http.MethodGet, c.base.JoinPath("blobs", layer.Digest).String(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		// Garbage collected after the manifest was read.
+		return cache.ErrMiss
+	}
+	if res.StatusCode != http.StatusOK {
+		return errorFromStatus(res)
+	}
+	if res.ContentLength >= 0 && res.ContentLength != layer.Size {
+		return cache.Errorf(cache.CodeUnavailable, "blob is %d bytes, want %d", res.ContentLength, layer.Size)
+	}
+	// Objects are never rewritten, so the digest is checked before the
+	// store keeps the blob.
+	blob := &digestReader{r: res.Body, hash: sha256.New(), want: layer.Digest}
+	if _, _, err := c.store.Put(outputID, blob); err != nil {
+		return cache.Errorf(cache.CodeUnavailable, "failed to download object: %w", err)
+	}
+	return nil
+}
+
+// digestReader hashes what is read through it and, at the end of the
+// stream, returns an error instead of io.EOF unless the digest is want.
+type digestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := "sha256:" + hex.EncodeToString(d.hash.Sum(nil)); got != d.want {
+			return n, fmt.Errorf("blob digest is %s, want %s", got, d.want)
+		}
+	}
+	return n, err
+}
+
+func (c *Client) put(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	c.store.Hold(ctx, r.OutputID)
+	// An object already in the store is kept, and the body only hashed.
+	h := sha256.New()
+	path, n, err := c.store.Put(r.OutputID, io.TeeReader(r.Body, h))
+	if err != nil {
+		return cache.Response{}, fmt.Errorf("failed to write object: %w", err)
+	}
+	if n != r.BodySize {
+		return cache.Response{}, cache.Errorf(cache.CodeInvalidRequest, "object is %d bytes, want %d", n, r.BodySize)
+	}
+	layer := descriptor{MediaType: ObjectMediaType, Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)), Size: n}
+
+	c.mu.Lock()
+	pushedConfig := c.pushedConfig
+	c.mu.Unlock()
+	if !pushedConfig {
+		if err := c.pushBlob(ctx, emptyConfig, bytesBody([]byte("{}")).open); err != nil {
+			return cache.Response{}, err
+		}
+		c.mu.Lock()
+		c.pushedConfig = true
+		c.mu.Unlock()
+	}
+	if err := c.pushBlob(ctx, layer, func() (io.ReadCloser, error) { return os.Open(path) }); err != nil {
+		return cache.Response{}, err
+	}
+
+	b, err := json.Marshal(manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+		ArtifactType:  ArtifactType,
+		Config:        emptyConfig,
+		Layers:        []descriptor{layer},
+		Annotations: map[string]string{
+			OutputIDAnnotation: hex.EncodeToString(r.OutputID),
+			createdAnnotation:  time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return cache.Response{}, err
+	}
+	res, err := c.do(ctx, http.MethodPut, c.base.JoinPath("manifests", c.tag(r.ActionID)).String(), bytesBody(b), http.Header{
+		"Content-Type": {manifestMediaType},
+	})
+	if err != nil {
+		return cache.Response{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return cache.Response{}, errorFromStatus(res)
+	}
+	return cache.Response{DiskPath: path}, nil
+}
+
+// pushBlob uploads the blob d, read from open, unless the repository has
+// it already.
+func (c *Client) pushBlob(ctx context.Context, d descriptor, open func() (io.ReadCloser, error)) error {
+	res, err := c.do(ctx, http.MethodHead, c.base.JoinPath("blobs", d.Digest).String(), nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	res, err = c.do(ctx, http.MethodPost, c.base.JoinPath("blobs", "uploads").String()+"/", nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		return errorFromStatus(res)
+	}
+	loc, err := res.Request.URL.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return cache.Errorf(cache.CodeInternal, "invalid upload location: %w", err)
+	}
+	q := loc.Query()
+	q.Set("digest", d.Digest)
+	loc.RawQuery = q.Encode()
+
+	res, err = c.do(ctx, http.MethodPut, loc.String(), &body{open: open, size: d.Size}, http.Header{
+		"Content-Type": {"application/octet-stream"},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return errorFromStatus(res)
+	}
+	return nil
+}
+
+// body is a replayable request body, which authentication retries need.
+type body struct {
+	open func() (io.ReadCloser, error)
+	size int64
+}
+
+func bytesBody(b []byte) *body {
+	return &body{
+		open: func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(b)), nil },
+		size: int64(len(b)),
+	}
+}
+
+// do sends a request, answering an authentication challenge once.
+func (c *Client) do(ctx context.Context, method, u string, b *body, header http.Header) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if b != nil {
+			if req.Body, err = b.open(); err != nil {
+				return nil, err
+			}
+			req.ContentLength = b.size
+			req.GetBody = b.open
+		}
+		if err := c.authorize(req); err != nil {
+			return nil, err
+		}
+		res, err := c.http.Do(req)
+		if err != nil {
+			return nil, cache.Errorf(cache.CodeUnavailable, "failed to reach registry: %w", err)
+		}
+		return res, nil
+	}
+
+	res, err := send()
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	challenge := res.Header.Get("WWW-Authenticate")
+	res.Body.Close()
+	if err := c.authenticate(ctx, challenge); err != nil {
+		return nil, cache.Errorf(cache.CodePermissionDenied, "failed to authenticate to %s: %w", c.host, err)
+	}
+	return send()
+}
+
+// authorize sets the credentials of the last challenge on req.
+func (c *Client) authorize(req *http.Request) error {
+	c.mu.Lock()
+	token, basic := c.token, c.basic
+	c.mu.Unlock()
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case basic:
+		user, password, err := c.credentials(req.Context())
+		if err != nil {
+			return cache.Errorf(cache.CodePermissionDenied, "failed to get registry credentials: %w", err)
+		}
+		req.SetBasicAuth(user, password)
+	}
+	return nil
+}
+
+// authenticate answers the WWW-Authenticate challenge of a registry. For
+// the Bearer scheme, it requests a token for pushing to and pulling from
+// the repository from the realm of the challenge.
+func (c *Client) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported challenge %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return fmt.Errorf("invalid realm in challenge %q", challenge)
+	}
+	q := realm.Query()
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	q.Set("scope", "repository:"+c.repo+":pull,push")
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	user, password, err := c.credentials(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials: %w", err)
+	}
+	if user != "" || password != "" {
+		req.SetBasicAuth(user, password)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint: %s", res.Status)
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return fmt.Errorf("failed to decode token: %w", err)
+	}
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+	if tok.Token == "" {
+		return errors.New("token endpoint returned no token")
+	}
+	c.mu.Lock()
+	c.token = tok.Token
+	c.mu.Unlock()
+	return nil
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and
+// parameters, as in: Bearer realm="https://ghcr.io/token",service="ghcr.io".
+func parseChallenge(h string) (scheme string, params map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	params = make(map[string]string)
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+	return scheme, params
+}
+
+// dockerCredentials returns the credentials stored for host in the Docker
+// configuration.
+func dockerCredentials(ctx context.Context, host string) (user, password string, err error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	var cfg struct {
+		Auths       map[string]struct{ Auth string } `json:"auths"`
+		CredsStore  string                           `json:"credsStore"`
+		CredHelpers map[string]string                `json:"credHelpers"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return "", "", fmt.Errorf("failed to parse Docker configuration: %w", err)
+	}
+
+	helper := cfg.CredHelpers[host]
+	if helper == "" {
+		if a, ok := cfg.Auths[host]; ok && a.Auth != "" {
+			dec, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid auth for %s in Docker configuration", host)
+			}
+			user, password, _ = strings.Cut(string(dec), ":")
+			return user, password, nil
+		}
+		helper = cfg.CredsStore
+	}
+	if helper == "" {
+		return "", "", nil
+	}
+
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("credential helper %s failed: %w", helper, err)
+	}
+	var cred struct{ Username, Secret string }
+	if err := json.Unmarshal(out, &cred); err != nil {
+		return "", "", fmt.Errorf("failed to parse output of credential helper %s: %w", helper, err)
+	}
+	return cred.Username, cred.Secret, nil
+}
+
+// errorFromStatus returns the cache error for an HTTP error response.
+func errorFromStatus(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+	code := cache.CodeInternal
+	switch {
+	case res.StatusCode == http.StatusBadRequest:
+		code = cache.CodeInvalidRequest
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		code = cache.CodePermissionDenied
+	case res.StatusCode == http.StatusGatewayTimeout:
+		code = cache.CodeTimeout
+	case res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+		code = cache.CodeUnavailable
+	}
+	return cache.Errorf(code, "registry: %s: %s", res.Status, msg)
+}
@@ -0,0 +1,200 @@
+// Package prefetch warms a local cache tier in the background at startup,
+// based on the entries the previous build requested.
+//
+// A Recorder middleware collects the ActionIDs of the get requests of a
+// session and writes them to a session file when the build ends. On the
+// next start, Start replays that file through a Fetcher supplied by the
+// backend, which typically downloads the entry from the remote tier into
+// the local one, so that network fetches overlap with early compilation.
+package prefetch
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// Recorder records the ActionIDs requested during a session.
+type Recorder struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+	ids  []string // hex ActionIDs in first-request order
+}
+
+// NewRecorder returns an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{seen: make(map[string]struct{})}
+}
+
+// Middleware returns a middleware that records the ActionID of every get
+// request.
+func (r *Recorder) Middleware() cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, req *cache.Request) {
+			if req.Command == cache.CmdGet && len(req.ActionID) > 0 {
+				r.add(hex.EncodeToString(req.ActionID))
+			}
+			next.Handle(ctx, w, req)
+		})
+	}
+}
+
+func (r *Recorder) add(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.seen[id]; ok {
+		return
+	}
+	r.seen[id] = struct{}{}
+	r.ids = append(r.ids, id)
+}
+
+// WriteFile writes the recorded ActionIDs to path, one hex ActionID per
+// line, replacing the file atomically.
+func (r *Recorder) WriteFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create session file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, id := range r.ids {
+		w.WriteString(id)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	return nil
+}
+
+// ReadFile reads the ActionIDs of a session file written by WriteFile.
+// A missing file yields no ActionIDs, since the first build has no
+// previous session.
+func ReadFile(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open session file: %w", err)
+	}
+	defer f.Close()
+
+	var ids [][]byte
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		id, err := hex.DecodeString(sc.Text())
+		if err != nil || len(id) == 0 {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read session file: %w", err)
+	}
+	return ids, nil
+}
+
+// Fetcher warms the local tier with the entry for an ActionID.
+type Fetcher interface {
+	Prefetch(ctx context.Context, actionID []byte) error
+}
+
+// FetcherFunc is a function type that implements the Fetcher interface.
+type FetcherFunc func(ctx context.Context, actionID []byte) error
+
+// Prefetch calls the fetcher function.
+func (f FetcherFunc) Prefetch(ctx context.Context, actionID []byte) error {
+	return f(ctx, actionID)
+}
+
+// Stats reports the outcome of a prefetch run.
+type Stats struct {
+	Fetched int64
+	Failed  int64
+}
+
+// Prefetcher is a prefetch run in progress.
+type Prefetcher struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	fetched atomic.Int64
+	failed  atomic.Int64
+}
+
+// Start prefetches ids in the background through f, with at most
+// concurrency fetches in flight. Failures are counted and otherwise
+// ignored: a failed prefetch only means the build's own get will go to the
+// remote tier.
+func Start(ctx context.Context, ids [][]byte, f Fetcher, concurrency int) *Prefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &Prefetcher{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	ch := make(chan []byte)
+	var wg sync.WaitGroup
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ch {
+				if err := f.Prefetch(ctx, id); err != nil {
+					p.failed.Add(1)
+				} else {
+					p.fetched.Add(1)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(p.done)
+		defer wg.Wait()
+		defer close(ch)
+		for _, id := range ids {
+			select {
+			case ch <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Stop cancels the prefetches that have not started yet, waits for the
+// ones in flight and returns the final statistics.
+func (p *Prefetcher) Stop() Stats {
+	p.cancel()
+	return p.Wait()
+}
+
+// Wait waits for all prefetches to complete and returns the statistics.
+func (p *Prefetcher) Wait() Stats {
+	<-p.done
+	return Stats{
+		Fetched: p.fetched.Load(),
+		Failed:  p.failed.Load(),
+	}
+}
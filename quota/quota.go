@@ -0,0 +1,223 @@
+// Package quota enforces per-namespace byte quotas on a shared cache.
+//
+// When several teams share one remote cache, a Manager keeps one team's
+// large builds from evicting everyone else's entries: every put is charged
+// to its namespace, and a namespace over its quota either has the put
+// rejected or makes room by evicting its own oldest entries.
+package quota
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// ErrExceeded is returned when a put does not fit in its namespace's quota.
+var ErrExceeded = errors.New("namespace quota exceeded")
+
+// Policy decides what happens to a put that exceeds its quota.
+type Policy int
+
+const (
+	// Reject refuses the put.
+	Reject Policy = iota
+
+	// EvictOldest evicts the oldest entries of the same namespace until the
+	// put fits.
+	EvictOldest
+)
+
+// EvictFunc deletes an entry from the backend on behalf of EvictOldest.
+type EvictFunc func(namespace, key string) error
+
+// Manager tracks the bytes stored per namespace. It is safe for concurrent
+// use.
+type Manager struct {
+	limits       map[string]int64
+	defaultLimit int64
+	policy       Policy
+	evict        EvictFunc
+
+	mu         sync.Mutex
+	namespaces map[string]*usage
+}
+
+// usage is the accounting of one namespace.
+type usage struct {
+	bytes   int64
+	order   *list.List               // of *entry, oldest first
+	entries map[string]*list.Element // by key
+}
+
+type entry struct {
+	key  string
+	size int64
+}
+
+// New returns a Manager enforcing limits, in bytes per namespace. Namespaces
+// missing from limits get defaultLimit; a limit of zero or less means
+// unlimited. evict is required with the EvictOldest policy.
+func New(limits map[string]int64, defaultLimit int64, policy Policy, evict EvictFunc) *Manager {
+	return &Manager{
+		limits:       limits,
+		defaultLimit: defaultLimit,
+		policy:       policy,
+		evict:        evict,
+		namespaces:   make(map[string]*usage),
+	}
+}
+
+func (m *Manager) limit(namespace string) int64 {
+	if l, ok := m.limits[namespace]; ok {
+		return l
+	}
+	return m.defaultLimit
+}
+
+func (m *Manager) usage(namespace string) *usage {
+	u, ok := m.namespaces[namespace]
+	if !ok {
+		u = &usage{order: list.New(), entries: make(map[string]*list.Element)}
+		m.namespaces[namespace] = u
+	}
+	return u
+}
+
+// Track records an entry that already exists, for example when loading an
+// existing cache at startup. It never rejects or evicts.
+func (m *Manager) Track(namespace, key string, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(m.usage(namespace), key, size)
+}
+
+func (m *Manager) add(u *usage, key string, size int64) {
+	if el, ok := u.entries[key]; ok {
+		u.bytes -= el.Value.(*entry).size
+		u.order.Remove(el)
+	}
+	u.entries[key] = u.order.PushBack(&entry{key: key, size: size})
+	u.bytes += size
+}
+
+// Reserve charges a put of size bytes for key to namespace. Under the
+// Reject policy it returns ErrExceeded if the put does not fit; under
+// EvictOldest it evicts older entries of the namespace first. Evictions
+// run without holding the lock of m, so that a slow backend does not block
+// the puts of other namespaces.
+func (m *Manager) Reserve(namespace, key string, size int64) error {
+	victims, err := m.reserve(namespace, key, size)
+	if err != nil {
+		return err
+	}
+	for i, e := range victims {
+		if err := m.evict(namespace, e.key); err != nil {
+			// The entries not evicted are still stored: account them
+			// again, oldest first, and give the reservation back.
+			m.mu.Lock()
+			u := m.usage(namespace)
+			m.remove(u, key)
+			for _, e := range slices.Backward(victims[i:]) {
+				if _, ok := u.entries[e.key]; !ok {
+					u.entries[e.key] = u.order.PushFront(e)
+					u.bytes += e.size
+				}
+			}
+			m.mu.Unlock()
+			return fmt.Errorf("failed to evict %s: %w", e.key, err)
+		}
+	}
+	return nil
+}
+
+// reserve charges the put to namespace and returns the entries it replaces
+// in the accounting, which the caller must evict.
+func (m *Manager) reserve(namespace, key string, size int64) ([]*entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.usage(namespace)
+	limit := m.limit(namespace)
+	if limit <= 0 {
+		m.add(u, key, size)
+		return nil, nil
+	}
+	if size > limit {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the %d byte quota of %q", ErrExceeded, size, limit, namespace)
+	}
+
+	current := u.bytes
+	if el, ok := u.entries[key]; ok {
+		current -= el.Value.(*entry).size
+	}
+	if current+size > limit && m.policy != EvictOldest {
+		return nil, fmt.Errorf("%w: %q uses %d of %d bytes", ErrExceeded, namespace, u.bytes, limit)
+	}
+	var victims []*entry
+	for el := u.order.Front(); el != nil && current+size > limit; {
+		next := el.Next()
+		if e := el.Value.(*entry); e.key != key {
+			victims = append(victims, e)
+			current -= e.size
+			u.bytes -= e.size
+			u.order.Remove(el)
+			delete(u.entries, e.key)
+		}
+		el = next
+	}
+	m.add(u, key, size)
+	return victims, nil
+}
+
+// Release removes key from the accounting of namespace, after the entry was
+// deleted by other means.
+func (m *Manager) Release(namespace, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(m.usage(namespace), key)
+}
+
+func (m *Manager) remove(u *usage, key string) {
+	if el, ok := u.entries[key]; ok {
+		u.bytes -= el.Value.(*entry).size
+		u.order.Remove(el)
+		delete(u.entries, key)
+	}
+}
+
+// Usage returns the bytes charged to namespace and its limit.
+func (m *Manager) Usage(namespace string) (used, limit int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage(namespace).bytes, m.limit(namespace)
+}
+
+// Middleware returns a middleware that reserves quota for every put before
+// passing it on. namespace maps a request to its namespace, and entries are
+// keyed by hex ActionID. Rejected puts get an error response and never
+// reach the handler; puts the handler fails give their quota back.
+func (m *Manager) Middleware(namespace func(ctx context.Context, r *cache.Request) string) cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+			if r.Command != cache.CmdPut {
+				next.Handle(ctx, w, r)
+				return
+			}
+			ns, key := namespace(ctx, r), fmt.Sprintf("%x", r.ActionID)
+			if err := m.Reserve(ns, key, r.BodySize); err != nil {
+				cache.WriteError(w, r, &cache.Error{Code: cache.CodeUnavailable, Msg: "put rejected", Err: err})
+				return
+			}
+			ww := cache.WrapResponseWriter(w)
+			next.Handle(ctx, ww, r)
+			if res, ok := ww.Response(); !ok || res.Err != "" {
+				m.Release(ns, key)
+			}
+		})
+	}
+}
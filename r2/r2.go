@@ -0,0 +1,171 @@
+// Package r2 stores cache entries in Cloudflare R2, whose egress is free,
+// so that a global CI fleet can share one cache without paying for every
+// download.
+//
+// R2 speaks the S3 API, and New returns an s3.Client configured for its
+// differences from AWS: requests are signed for the "auto" region and sent
+// to the account endpoint with path-style addressing, and multipart uploads
+// use the same size for every part but the last, which R2 requires.
+//
+// Action entries are small and read on every get, so they can be kept in
+// Workers KV, which serves reads from the edge nearest to the builder:
+//
+//	kv := r2.NewKV(account, namespace, apiToken)
+//	c, err := r2.New(account, "go-cache", store, s3.WithIndex(kv))
+//
+// KV is eventually consistent: a put can take up to a minute to be visible
+// to other regions, during which their gets miss.
+//
+// Keys follow the layout of s3.WithLayout, in the bucket and in KV alike,
+// for example to give every team a prefix:
+//
+//	c, err := r2.New(account, "go-cache", store,
+//		s3.WithLayout(layout.Prefixed{Prefix: "team-a", Layout: layout.Default{}}))
+package r2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+	"github.com/hirasawayuki/go-cache-prog/chunked"
+	"github.com/hirasawayuki/go-cache-prog/s3"
+)
+
+// Endpoint returns the S3 endpoint of accountID. jurisdiction is empty, or
+// "eu" or "fedramp" for buckets created in that jurisdiction.
+func Endpoint(accountID, jurisdiction string) string {
+	if jurisdiction != "" {
+		return fmt.Sprintf("https://%s.%s.r2.cloudflarestorage.com", accountID, jurisdiction)
+	}
+	return fmt.Sprintf("https://%s.r2.cloudflarestorage.com", accountID)
+}
+
+// New returns a Client of the R2 bucket of accountID, keeping objects in
+// store. opts are applied after the R2 defaults; credentials are R2 API
+// tokens' access keys, by default from the AWS_* environment variables.
+func New(accountID, bucket string, store *castore.Store, opts ...s3.Option) (*s3.Client, error) {
+	defaults := []s3.Option{
+		s3.WithEndpoint(Endpoint(accountID, "")),
+		s3.WithRegion("auto"),
+		s3.WithPathStyle(),
+		s3.WithChunking(chunked.Options{PartSize: chunked.DefaultPartSize}),
+	}
+	return s3.New(bucket, store, append(defaults, opts...)...)
+}
+
+// KV is an s3.Index storing action entries in a Workers KV namespace
+// through the Cloudflare API.
+type KV struct {
+	// HTTPClient sends the requests; nil means http.DefaultClient.
+	HTTPClient *http.Client
+
+	// TTL, if at least 60 seconds, expires entries that long after their
+	// put, keeping the namespace from growing without bounds.
+	TTL time.Duration
+
+	base  *url.URL
+	token string
+}
+
+// NewKV returns the KV namespace namespaceID of accountID, accessed with
+// an API token allowed to edit Workers KV storage.
+func NewKV(accountID, namespaceID, apiToken string) *KV {
+	return &KV{
+		base: &url.URL{
+			Scheme: "https",
+			Host:   "api.cloudflare.com",
+			Path:   fmt.Sprintf("/client/v4/accounts/%s/storage/kv/namespaces/%s/values/", accountID, namespaceID),
+		},
+		token: apiToken,
+	}
+}
+
+func (kv *KV) client() *http.Client {
+	if kv.HTTPClient != nil {
+		return kv.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// valueURL returns the URL of key, which is escaped whole since KV keys
+// may contain slashes.
+func (kv *KV) valueURL(key string) *url.URL {
+	u := *kv.base
+	u.Path += key
+	u.RawPath = kv.base.Path + url.PathEscape(key)
+	return &u
+}
+
+// Get implements s3.Index.
+func (kv *KV) Get(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kv.valueURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := kv.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, s3.ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errorFromStatus(res)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 64<<10))
+}
+
+// Put implements s3.Index.
+func (kv *KV) Put(ctx context.Context, key string, value []byte) error {
+	u := kv.valueURL(key)
+	if kv.TTL >= time.Minute {
+		u.RawQuery = url.Values{"expiration_ttl": {strconv.Itoa(int(kv.TTL.Seconds()))}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := kv.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errorFromStatus(res)
+	}
+	return nil
+}
+
+func (kv *KV) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+kv.token)
+	res, err := kv.client().Do(req)
+	if err != nil {
+		return nil, cache.Errorf(cache.CodeUnavailable, "failed to reach Workers KV: %w", err)
+	}
+	return res, nil
+}
+
+// errorFromStatus returns the cache error for a Cloudflare API error.
+func errorFromStatus(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+	code := cache.CodeInternal
+	switch {
+	case res.StatusCode == http.StatusBadRequest:
+		code = cache.CodeInvalidRequest
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		code = cache.CodePermissionDenied
+	case res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+		code = cache.CodeUnavailable
+	}
+	return cache.Errorf(code, "workers kv: %s: %s", res.Status, msg)
+}
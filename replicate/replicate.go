@@ -0,0 +1,259 @@
+// Package replicate connects the cache servers of several regions, so that
+// a global CI fleet gets local-latency hits wherever an entry was built.
+//
+// A Replicator wraps the local backend of one region's server. Successful
+// puts are queued and sent asynchronously to the backend of every peer
+// region, so the client never waits for the slow cross-region links. Gets
+// that miss locally are read from the peers, nearest first by measured
+// latency, which covers entries whose replication is still in flight or
+// was dropped. Peers are cache.Handlers; for a remote region, a handler
+// that speaks the server's network protocol.
+package replicate
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// Peer is the backend of another region.
+type Peer struct {
+	Region  string
+	Handler cache.Handler
+}
+
+// PeerStats counts the traffic to one peer.
+type PeerStats struct {
+	Region string
+
+	// Replicated and Failed count the puts sent to the peer, and Dropped
+	// those discarded because its queue was full.
+	Replicated, Failed, Dropped int64
+
+	// Reads and Hits count the local misses looked up on the peer.
+	Reads, Hits int64
+
+	// Latency is the moving average of the peer's get latency.
+	Latency time.Duration
+}
+
+// Replicator replicates puts to peer regions and reads local misses from
+// them.
+type Replicator struct {
+	peers   []*peer
+	timeout time.Duration
+	logger  *slog.Logger
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type peer struct {
+	Peer
+	queue chan *cache.Request
+
+	replicated, failed, dropped, reads, hits atomic.Int64
+	latency                                  atomic.Int64 // EWMA in nanoseconds, 0 until measured
+}
+
+// New returns a Replicator sending puts to peers with one worker per peer.
+// Up to queue puts per peer wait for replication; later ones are dropped
+// until the queue drains, bounding the memory held by their bodies. Each
+// call to a peer is bounded by timeout.
+func New(peers []Peer, queue int, timeout time.Duration) *Replicator {
+	r := &Replicator{
+		timeout: timeout,
+		logger:  slog.Default(),
+	}
+	for _, p := range peers {
+		pp := &peer{Peer: p, queue: make(chan *cache.Request, queue)}
+		r.peers = append(r.peers, pp)
+		r.wg.Add(1)
+		go r.replicate(pp)
+	}
+	return r
+}
+
+// Middleware returns a middleware that queues the puts the wrapped handler
+// stored for replication, and reads the gets it missed from the peers.
+// Puts marked local-only, see cache.OversizeLocalOnly, are not replicated.
+func (r *Replicator) Middleware() cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, req *cache.Request) {
+			switch req.Command {
+			case cache.CmdPut:
+				r.handlePut(ctx, next, w, req)
+			case cache.CmdGet:
+				r.handleGet(ctx, next, w, req)
+			default:
+				next.Handle(ctx, w, req)
+			}
+		})
+	}
+}
+
+func (r *Replicator) handlePut(ctx context.Context, next cache.Handler, w cache.ResponseWriter, req *cache.Request) {
+	if cache.LocalOnlyFromContext(ctx) || len(r.peers) == 0 {
+		next.Handle(ctx, w, req)
+		return
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			cache.WriteError(w, req, err)
+			return
+		}
+		req.Body = bytes.NewReader(body)
+	}
+
+	ww := cache.WrapResponseWriter(w)
+	next.Handle(ctx, ww, req)
+	if res, ok := ww.Response(); !ok || res.Err != "" {
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return
+	}
+	for _, p := range r.peers {
+		pr := *req
+		pr.Body = bytes.NewReader(body)
+		select {
+		case p.queue <- &pr:
+		default:
+			p.dropped.Add(1)
+		}
+	}
+}
+
+func (r *Replicator) handleGet(ctx context.Context, next cache.Handler, w cache.ResponseWriter, req *cache.Request) {
+	ww := cache.WrapResponseWriter(discard{})
+	next.Handle(ctx, ww, req)
+	res, ok := ww.Response()
+	if !ok || !res.Miss {
+		if ok {
+			w.WriteResponse(res)
+		}
+		return
+	}
+
+	for _, p := range r.nearest() {
+		p.reads.Add(1)
+		start := time.Now()
+		pctx, cancel := context.WithTimeout(ctx, r.timeout)
+		pres := cache.Call(pctx, p.Handler, req)
+		cancel()
+		p.observe(time.Since(start), pres.Err != "")
+		if pres.Err == "" && !pres.Miss {
+			p.hits.Add(1)
+			pres.ID = req.ID
+			w.WriteResponse(pres)
+			return
+		}
+	}
+	w.WriteResponse(res)
+}
+
+// nearest returns the peers by increasing latency. Peers not measured yet
+// come first, so that they get measured.
+func (r *Replicator) nearest() []*peer {
+	peers := slices.Clone(r.peers)
+	slices.SortStableFunc(peers, func(a, b *peer) int {
+		return int(a.latency.Load() - b.latency.Load())
+	})
+	return peers
+}
+
+// observe folds a call latency into the moving average. Failed calls count
+// as the timeout, pushing the peer back in the order.
+func (p *peer) observe(d time.Duration, failed bool) {
+	if failed {
+		d = max(d, time.Second)
+	}
+	for {
+		old := p.latency.Load()
+		next := int64(d)
+		if old != 0 {
+			next = int64(math.Round(0.8*float64(old) + 0.2*float64(d)))
+		}
+		if p.latency.CompareAndSwap(old, max(next, 1)) {
+			return
+		}
+	}
+}
+
+// replicate sends the queued puts of p until Close.
+func (r *Replicator) replicate(p *peer) {
+	defer r.wg.Done()
+	for req := range p.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		res := cache.Call(ctx, p.Handler, req)
+		cancel()
+		if res.Err != "" {
+			p.failed.Add(1)
+			r.logger.Warn("failed to replicate put", slog.String("region", p.Region), slog.String("error", res.Err))
+			continue
+		}
+		p.replicated.Add(1)
+	}
+}
+
+// Stats returns the counters of every peer.
+func (r *Replicator) Stats() []PeerStats {
+	stats := make([]PeerStats, len(r.peers))
+	for i, p := range r.peers {
+		stats[i] = PeerStats{
+			Region:     p.Region,
+			Replicated: p.replicated.Load(),
+			Failed:     p.failed.Load(),
+			Dropped:    p.dropped.Load(),
+			Reads:      p.reads.Load(),
+			Hits:       p.hits.Load(),
+			Latency:    time.Duration(p.latency.Load()),
+		}
+	}
+	return stats
+}
+
+// Close stops queueing puts and waits until the queued ones are sent or
+// ctx is done.
+func (r *Replicator) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		for _, p := range r.peers {
+			close(p.queue)
+		}
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// discard is a ResponseWriter that drops responses, used to look at the
+// local response before deciding what to send.
+type discard struct{}
+
+func (discard) WriteResponse(cache.Response) {}
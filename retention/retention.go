@@ -0,0 +1,229 @@
+// Package retention decides how long cache entries are kept, from rules
+// over their tags, namespace, size and age, so that operators can state
+// retention declaratively: entries of the main branch are kept 30 days,
+// those of pull requests 3 days, and outputs over 500MB a day.
+//
+// A policy is a JSON file:
+//
+//	{"rules": [
+//		{"name": "large", "min_size": "500MB", "max_age": "1d"},
+//		{"name": "main", "tags": {"branch": "main"}, "max_age": "30d"},
+//		{"name": "pr", "tags": {"branch": "pr/*"}, "max_age": "3d"},
+//		{"name": "default", "max_age": "7d"}
+//	]}
+//
+// Rules are checked in order and the first rule matching an entry decides
+// its maximum age, so specific rules come first. Entries matching no rule
+// are kept. The age of an entry is the time since it was put.
+package retention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+// NamespaceTag is the tag holding the namespace an entry was put in,
+// which servers attach to the entries of namespaced requests.
+const NamespaceTag = "namespace"
+
+// Duration is a time.Duration that also accepts a number of days, such as
+// "30d", in JSON.
+type Duration time.Duration
+
+// ParseDuration parses s as a number of days with a "d" suffix, or as a
+// time.Duration.
+func ParseDuration(s string) (Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return Duration(d), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// sizeUnits are the suffixes accepted by ParseSize, longest first.
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// Size is a number of bytes that also accepts a unit, such as "500MB" or
+// "1GiB", in JSON.
+type Size int64
+
+// ParseSize parses s as a number of bytes with an optional unit.
+func ParseSize(s string) (Size, error) {
+	n, mult := s, int64(1)
+	for _, u := range sizeUnits {
+		if v, ok := strings.CutSuffix(s, u.suffix); ok {
+			n, mult = strings.TrimSpace(v), u.n
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(n, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return Size(v * float64(mult)), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler for numbers and strings.
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		if n < 0 {
+			return fmt.Errorf("invalid size %d", n)
+		}
+		*s = Size(n)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return errors.New("size must be a number or a string")
+	}
+	v, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+// Rule sets the maximum age of the entries it matches. The conditions of a
+// rule must all hold; a rule without conditions matches every entry.
+type Rule struct {
+	Name string `json:"name"`
+
+	// Tags maps tag keys to path.Match patterns their values must match.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Namespace is a path.Match pattern the namespace of the entry, see
+	// NamespaceTag, must match.
+	Namespace string `json:"namespace,omitempty"`
+
+	// MinSize matches the entries of at least that many bytes.
+	MinSize Size `json:"min_size,omitempty"`
+
+	// MaxAge is how long the entries matched are kept.
+	MaxAge Duration `json:"max_age"`
+}
+
+// Matches reports whether the rule applies to e.
+func (r *Rule) Matches(e manifest.Entry) bool {
+	if r.MinSize > 0 && e.Size < int64(r.MinSize) {
+		return false
+	}
+	if r.Namespace != "" {
+		if ok, _ := path.Match(r.Namespace, e.Tags[NamespaceTag]); !ok {
+			return false
+		}
+	}
+	for k, pattern := range r.Tags {
+		v, ok := e.Tags[k]
+		if !ok {
+			return false
+		}
+		if ok, _ := path.Match(pattern, v); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy is an ordered list of rules.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// ParsePolicy reads a policy in JSON form.
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	var p Policy
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("failed to parse retention policy: %w", err)
+	}
+	for i, rule := range p.Rules {
+		name := rule.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i+1)
+		}
+		if rule.MaxAge <= 0 {
+			return nil, fmt.Errorf("retention rule %s has no max_age", name)
+		}
+		if _, err := path.Match(rule.Namespace, ""); err != nil {
+			return nil, fmt.Errorf("retention rule %s has an invalid namespace pattern %q", name, rule.Namespace)
+		}
+		for k, pattern := range rule.Tags {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("retention rule %s has an invalid pattern %q for tag %s", name, pattern, k)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// LoadPolicy reads the policy file at name.
+func LoadPolicy(name string) (*Policy, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open retention policy: %w", err)
+	}
+	defer f.Close()
+	return ParsePolicy(f)
+}
+
+// Match returns the first rule matching e.
+func (p *Policy) Match(e manifest.Entry) (*Rule, bool) {
+	for i := range p.Rules {
+		if p.Rules[i].Matches(e) {
+			return &p.Rules[i], true
+		}
+	}
+	return nil, false
+}
+
+// Expired reports whether e outlived the maximum age of the first rule
+// matching it at now.
+func (p *Policy) Expired(e manifest.Entry, now time.Time) bool {
+	rule, ok := p.Match(e)
+	return ok && now.Sub(e.Time) > time.Duration(rule.MaxAge)
+}
@@ -0,0 +1,145 @@
+package s3
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/hirasawayuki/go-cache-prog/layout"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+// WriteManifest writes a manifest of the entries in the bucket to w, see
+// Entries, so that the bucket can be read as a snapshot.
+func (c *Client) WriteManifest(ctx context.Context, w io.Writer) error {
+	mw, err := manifest.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	return c.Entries(ctx, mw.Write)
+}
+
+// Entries calls fn for every entry in the bucket, in key order, and stops
+// at the first error fn returns. Entries are found by listing their action
+// keys, which requires the entries to be stored in the bucket, not in an
+// Index set with WithIndex, and a layout whose action keys share a
+// prefix: layout.Default, or layout.Prefixed of it. Entries that cannot be
+// read are skipped.
+func (c *Client) Entries(ctx context.Context, fn func(manifest.Entry) error) error {
+	if _, ok := c.index.(bucketIndex); !ok {
+		return errors.New("entries stored in an index cannot be listed")
+	}
+	prefix, ok := listPrefix(c.layout)
+	if !ok {
+		return fmt.Errorf("entries stored with layout %T cannot be listed", c.layout)
+	}
+	return c.list(ctx, prefix, func(key string) error {
+		hexID, ok := strings.CutSuffix(path.Base(key), "-a")
+		if !ok {
+			return nil
+		}
+		actionID, err := hex.DecodeString(hexID)
+		if err != nil {
+			return nil
+		}
+		b, err := c.index.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var e entry
+		if json.Unmarshal(b, &e) != nil {
+			return nil
+		}
+		outputID, err := hex.DecodeString(e.OutputID)
+		if err != nil || len(outputID) == 0 {
+			return nil
+		}
+		return fn(manifest.Entry{ActionID: actionID, OutputID: outputID, Size: e.Size, Time: e.Time})
+	})
+}
+
+// listPrefix returns the prefix shared by the action keys of l.
+func listPrefix(l layout.Layout) (string, bool) {
+	switch l := l.(type) {
+	case layout.Default:
+		if l.Prefix == "" {
+			return "", true
+		}
+		return strings.TrimSuffix(l.Prefix, "/") + "/", true
+	case layout.Prefixed:
+		inner, ok := listPrefix(l.Layout)
+		if !ok {
+			return "", false
+		}
+		if p := path.Join(l.Prefix, inner); p != "" && p != "." {
+			return p + "/", true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// list calls fn with the keys in the bucket starting with prefix.
+func (c *Client) list(ctx context.Context, prefix string, fn func(key string) error) error {
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := c.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			defer res.Body.Close()
+			return fmt.Errorf("failed to list bucket: %w", errorFromStatus(res))
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to list bucket: %w", err)
+		}
+		for _, obj := range page.Contents {
+			if err := fn(obj.Key); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// OpenObject fetches the object of outputID and returns its size, without
+// storing it in the store of the Client.
+func (c *Client) OpenObject(ctx context.Context, outputID []byte) (io.ReadCloser, int64, error) {
+	res, err := c.do(ctx, http.MethodGet, c.layout.ObjectKey(outputID), nil, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, 0, fmt.Errorf("failed to fetch object: %w", errorFromStatus(res))
+	}
+	return res.Body, res.ContentLength, nil
+}
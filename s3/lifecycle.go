@@ -0,0 +1,123 @@
+package s3
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/retention"
+)
+
+// Limits of S3 object tagging.
+const (
+	maxTags        = 10
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+// StorageClass stores the objects matching a rule in a storage class.
+type StorageClass struct {
+	// Class is the storage class, such as "STANDARD_IA". Objects are read
+	// back without a restore, so archive classes other than
+	// "GLACIER_IR" are unsuitable.
+	Class string
+
+	// MinSize, if nonzero, matches the objects of at least MinSize bytes.
+	// Classes of infrequent access bill small objects as 128 KiB ones.
+	MinSize int64
+
+	// Namespace, if not empty, is a path.Match pattern the namespace the
+	// object was put in, its "namespace" tag, must match.
+	Namespace string
+}
+
+// WithStorageClasses stores the objects uploaded by puts in the class of
+// the first of rules they match, or in the default class of the bucket if
+// they match none. Action entries are small and always stored in the
+// default class.
+func WithStorageClasses(rules ...StorageClass) Option {
+	return func(c *Client) {
+		c.classes = rules
+	}
+}
+
+// WithTagging tags the objects and action entries uploaded by puts with
+// the tags of the request, see cache.ContextWithTags, so that the
+// lifecycle rules of the bucket expire them instead of a pruning job, for
+// example the entries of pull requests after a week:
+//
+//	<Rule>
+//	  <Filter><Tag><Key>namespace</Key><Value>pr</Value></Tag></Filter>
+//	  <Expiration><Days>7</Days></Expiration>
+//	  <Status>Enabled</Status>
+//	</Rule>
+//
+// An object is shared by the entries with the same output and keeps the
+// tags of the put that uploaded it. An object expired while an entry
+// still refers to it is a miss, and uploaded again by the next put. Only
+// the first 10 tags by key are kept, and tags longer than S3 allows are
+// dropped. Cloudflare R2 does not support object tagging.
+func WithTagging() Option {
+	return func(c *Client) {
+		c.tagging = true
+	}
+}
+
+// storageClass returns the storage class of an object of size bytes put
+// with ctx, or "" for the default class.
+func (c *Client) storageClass(ctx context.Context, size int64) string {
+	ns := cache.TagsFromContext(ctx)[retention.NamespaceTag]
+	for _, r := range c.classes {
+		if r.MinSize > 0 && size < r.MinSize {
+			continue
+		}
+		if r.Namespace != "" {
+			if ok, _ := path.Match(r.Namespace, ns); !ok {
+				continue
+			}
+		}
+		return r.Class
+	}
+	return ""
+}
+
+// tagHeader returns the X-Amz-Tagging header value of an upload with ctx,
+// or "" if there is none.
+func (c *Client) tagHeader(ctx context.Context) string {
+	if !c.tagging {
+		return ""
+	}
+	tags := cache.TagsFromContext(ctx)
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && len(k) <= maxTagKeyLen && len(v) <= maxTagValueLen {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	q := make(url.Values, maxTags)
+	for _, k := range keys[:min(len(keys), maxTags)] {
+		q.Set(k, tags[k])
+	}
+	// S3 decodes "+" as a plus sign, not a space.
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+// uploadHeader returns the headers of an upload of size bytes, or of an
+// action entry if object is false, put with ctx.
+func (c *Client) uploadHeader(ctx context.Context, contentType string, size int64, object bool) http.Header {
+	h := http.Header{"Content-Type": {contentType}}
+	if object {
+		if class := c.storageClass(ctx, size); class != "" {
+			h.Set("X-Amz-Storage-Class", class)
+		}
+	}
+	if t := c.tagHeader(ctx); t != "" {
+		h.Set("X-Amz-Tagging", t)
+	}
+	return h
+}
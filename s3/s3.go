@@ -0,0 +1,616 @@
+// Package s3 stores cache entries in an Amazon S3 bucket, or any storage
+// service speaking the S3 API, without depending on the AWS SDK.
+//
+// Entries are stored under the keys of a layout.Layout: the action entry,
+// a small JSON document naming the OutputID, size and time, and the object,
+// shared by every entry with the same output. Objects are kept in a local
+// castore.Store, since the go command reads them from the DiskPath of
+// responses, and objects larger than the part size are transferred as
+// concurrent parts with the chunked package.
+//
+// Action entries can be kept in another store than the bucket, such as a
+// low-latency key-value store, with WithIndex. Objects can be stored in
+// cheaper storage classes with WithStorageClasses, and expired by the
+// lifecycle rules of the bucket with WithTagging.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+	"github.com/hirasawayuki/go-cache-prog/chunked"
+	"github.com/hirasawayuki/go-cache-prog/credentials"
+	"github.com/hirasawayuki/go-cache-prog/layout"
+)
+
+// ErrNotFound is returned by an Index for a missing key.
+var ErrNotFound = errors.New("not found")
+
+// Index stores the action entries, small JSON documents keyed by the
+// action keys of the layout. By default they are stored in the bucket.
+type Index interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+}
+
+// Client is a cache backend stored in a bucket.
+type Client struct {
+	bucket    string
+	endpoint  *url.URL
+	region    string
+	creds     Credentials
+	credsSrc  credentials.Source // nil for static credentials
+	pathStyle bool
+	http      *http.Client
+	layout    layout.Layout
+	chunks    chunked.Options
+	index     Index
+	store     *castore.Store
+	classes   []StorageClass
+	tagging   bool
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithEndpoint sends requests to the S3-compatible service at endpoint,
+// such as https://minio.example.com, instead of AWS.
+func WithEndpoint(endpoint string) Option {
+	return func(c *Client) {
+		c.endpoint, _ = url.Parse(endpoint)
+	}
+}
+
+// WithRegion sets the region requests are signed for.
+func WithRegion(region string) Option {
+	return func(c *Client) {
+		c.region = region
+	}
+}
+
+// WithCredentials sets the access keys requests are signed with.
+func WithCredentials(creds Credentials) Option {
+	return func(c *Client) {
+		c.creds = creds
+	}
+}
+
+// WithCredentialsSource signs requests with the AWS keys of the tokens of
+// src, such as a credentials.Refresher of a
+// credentials.STSWebIdentitySource, instead of static keys, so that
+// temporary keys are renewed during long builds.
+func WithCredentialsSource(src credentials.Source) Option {
+	return func(c *Client) {
+		c.credsSrc = src
+	}
+}
+
+// WithPathStyle addresses the bucket in the path of URLs,
+// https://endpoint/bucket/key, rather than in the host name.
+func WithPathStyle() Option {
+	return func(c *Client) {
+		c.pathStyle = true
+	}
+}
+
+// WithHTTPClient sends requests with hc instead of http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithLayout names entries with l instead of layout.Default.
+func WithLayout(l layout.Layout) Option {
+	return func(c *Client) {
+		c.layout = l
+	}
+}
+
+// WithChunking sets the part size and concurrency of transfers. Objects
+// no larger than one part are transferred in a single request.
+func WithChunking(opts chunked.Options) Option {
+	return func(c *Client) {
+		c.chunks = opts
+	}
+}
+
+// WithIndex stores the action entries in idx instead of the bucket.
+func WithIndex(idx Index) Option {
+	return func(c *Client) {
+		c.index = idx
+	}
+}
+
+// New returns a Client of bucket keeping objects in store. The region,
+// credentials and endpoint default to the AWS_REGION (or
+// AWS_DEFAULT_REGION), AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN and AWS_ENDPOINT_URL_S3 environment variables.
+// Without access keys, requests are signed with the temporary keys of the
+// role AWS_ROLE_ARN, assumed with the web identity token in the file
+// AWS_WEB_IDENTITY_TOKEN_FILE, see credentials.STSWebIdentitySource.
+func New(bucket string, store *castore.Store, opts ...Option) (*Client, error) {
+	c := &Client{
+		bucket: bucket,
+		region: os.Getenv("AWS_REGION"),
+		creds: Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		http:   http.DefaultClient,
+		layout: layout.Default{},
+		store:  store,
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if e := os.Getenv("AWS_ENDPOINT_URL_S3"); e != "" {
+		WithEndpoint(e)(c)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.endpoint == nil {
+		c.endpoint = &url.URL{Scheme: "https", Host: "s3." + c.region + ".amazonaws.com"}
+	}
+	if c.endpoint.Scheme != "http" && c.endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", c.endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("bucket name is required")
+	}
+	if c.credsSrc == nil && c.creds.AccessKeyID == "" {
+		// Assume a role with a web identity token, as EKS and other
+		// OIDC-federated environments configure.
+		if role, file := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); role != "" && file != "" {
+			session := os.Getenv("AWS_ROLE_SESSION_NAME")
+			if session == "" {
+				session = "go-cache-prog"
+			}
+			c.credsSrc = credentials.NewRefresher(credentials.STSWebIdentitySource(c.http, role, session, credentials.FileSource(file, 0)), 0)
+		}
+	}
+	if c.credsSrc == nil && (c.creds.AccessKeyID == "" || c.creds.SecretAccessKey == "") {
+		return nil, errors.New("S3 credentials are required")
+	}
+	if c.index == nil {
+		c.index = bucketIndex{c}
+	}
+	return c, nil
+}
+
+// entry is the JSON stored for an ActionID.
+type entry struct {
+	OutputID string    `json:"output"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// Handle implements cache.Handler for the get and put commands. The close
+// command releases the objects of the session, see castore.Store.Hold;
+// other commands succeed without effect.
+func (c *Client) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	var res cache.Response
+	var err error
+	switch r.Command {
+	case cache.CmdGet:
+		res, err = c.get(ctx, r)
+	case cache.CmdPut:
+		res, err = c.put(ctx, r)
+	case cache.CmdClose:
+		c.store.ReleaseSession(ctx)
+	}
+	if err != nil {
+		cache.WriteError(w, r, err)
+		return
+	}
+	res.ID = r.ID
+	w.WriteResponse(res)
+}
+
+func (c *Client) get(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	b, err := c.index.Get(ctx, c.layout.ActionKey(r.ActionID))
+	if errors.Is(err, ErrNotFound) {
+		return cache.Response{}, cache.ErrMiss
+	}
+	if err != nil {
+		return cache.Response{}, err
+	}
+	var e entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return cache.Response{}, cache.ErrMiss
+	}
+	outputID, err := hex.DecodeString(e.OutputID)
+	if err != nil || len(outputID) == 0 {
+		return cache.Response{}, cache.ErrMiss
+	}
+
+	c.store.Hold(ctx, outputID)
+	if err := c.store.Fill(ctx, outputID, e.Size, func() error {
+		return c.download(ctx, outputID, e.Size)
+	}); err != nil {
+		return cache.Response{}, err
+	}
+	c.store.Touch(outputID)
+	t := e.Time
+	return cache.Response{OutputID: outputID, Size: e.Size, Time: &t, DiskPath: c.store.Path(outputID)}, nil
+}
+
+// download fetches the object of outputID into the store.
+func (c *Client) download(ctx context.Context, outputID []byte, size int64) error {
+	key := c.layout.ObjectKey(outputID)
+	if c.chunks.Parts(size) == 1 {
+		res, err := c.do(ctx, http.MethodGet, key, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			// Expired by a lifecycle rule after the entry was read.
+			return cache.ErrMiss
+		}
+		if res.StatusCode != http.StatusOK {
+			return errorFromStatus(res)
+		}
+		if _, _, err := c.store.Put(outputID, io.LimitReader(res.Body, size)); err != nil {
+			return cache.Errorf(cache.CodeUnavailable, "failed to download object: %w", err)
+		}
+		return nil
+	}
+
+	f, err := os.CreateTemp(c.store.Dir(), "download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = chunked.Download(ctx, f, rangeReader{c, key}, size, c.chunks)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return cache.Errorf(cache.CodeUnavailable, "failed to download object: %w", err)
+	}
+	if _, _, err := c.store.PutFile(outputID, f.Name()); err != nil {
+		return err
+	}
+	return nil
+}
+
+type rangeReader struct {
+	c   *Client
+	key string
+}
+
+func (rr rangeReader) ReadRange(ctx context.Context, off, n int64) (io.ReadCloser, error) {
+	res, err := rr.c.do(ctx, http.MethodGet, rr.key, nil, http.Header{
+		"Range": {fmt.Sprintf("bytes=%d-%d", off, off+n-1)},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		defer res.Body.Close()
+		return nil, errorFromStatus(res)
+	}
+	return res.Body, nil
+}
+
+func (c *Client) put(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	c.store.Hold(ctx, r.OutputID)
+	var (
+		path, hash string
+		size       int64
+		err        error
+	)
+	if f, ok := r.BodyFile(); ok {
+		// The server spooled the body: hash it first, so that the upload
+		// is signed and checked by S3, and store the file itself.
+		if hash, err = hashFile(f, r.BodySize); err != nil {
+			return cache.Response{}, fmt.Errorf("failed to hash object: %w", err)
+		}
+		path, size, err = c.store.PutFile(r.OutputID, f.Name())
+	} else {
+		path, size, err = c.store.Put(r.OutputID, r.Body)
+	}
+	if err != nil {
+		return cache.Response{}, fmt.Errorf("failed to write object: %w", err)
+	}
+	if size != r.BodySize {
+		return cache.Response{}, cache.Errorf(cache.CodeInvalidRequest, "object is %d bytes, want %d", size, r.BodySize)
+	}
+	if err := c.upload(ctx, r.OutputID, path, size, hash); err != nil {
+		return cache.Response{}, err
+	}
+
+	b, err := json.Marshal(entry{OutputID: hex.EncodeToString(r.OutputID), Size: size, Time: time.Now()})
+	if err != nil {
+		return cache.Response{}, err
+	}
+	if err := c.index.Put(ctx, c.layout.ActionKey(r.ActionID), b); err != nil {
+		return cache.Response{}, err
+	}
+	return cache.Response{DiskPath: path}, nil
+}
+
+// hashFile returns the hex SHA-256 of the first size bytes of f, without
+// moving its offset.
+func hashFile(f *os.File, size int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// upload uploads the object of outputID from path unless the bucket has it
+// already. hash is the hex SHA-256 of the object, signing single-part
+// uploads, or empty to send them unsigned.
+func (c *Client) upload(ctx context.Context, outputID []byte, path string, size int64, hash string) error {
+	key := c.layout.ObjectKey(outputID)
+	res, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK && res.ContentLength == size {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if c.chunks.Parts(size) > 1 {
+		return c.uploadParts(ctx, key, f, size)
+	}
+	res, err = c.do(ctx, http.MethodPut, key, nil, c.uploadHeader(ctx, "application/octet-stream", size, true), &body{
+		open: func() (io.ReadCloser, error) { return io.NopCloser(io.NewSectionReader(f, 0, size)), nil },
+		size: size,
+		hash: hash,
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errorFromStatus(res)
+	}
+	return nil
+}
+
+// uploadParts uploads an object from f with a multipart upload.
+func (c *Client) uploadParts(ctx context.Context, key string, f *os.File, size int64) error {
+	res, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, c.uploadHeader(ctx, "application/octet-stream", size, true), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errorFromStatus(res)
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&created); err != nil || created.UploadID == "" {
+		return cache.Errorf(cache.CodeInternal, "invalid CreateMultipartUpload response")
+	}
+	uploadID := url.Values{"uploadId": {created.UploadID}}
+
+	etags, err := chunked.Upload(ctx, f, size, partUploader{c, key, created.UploadID}, c.chunks)
+	if err != nil {
+		// Don't leave the parts behind, where they are billed until a
+		// lifecycle rule aborts the upload.
+		if res, aerr := c.do(context.WithoutCancel(ctx), http.MethodDelete, key, uploadID, nil, nil); aerr == nil {
+			res.Body.Close()
+		}
+		return cache.Errorf(cache.CodeUnavailable, "failed to upload object: %w", err)
+	}
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	b, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	res, err = c.do(ctx, http.MethodPost, key, uploadID, http.Header{"Content-Type": {"application/xml"}}, bytesBody(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// CompleteMultipartUpload can fail after a 200 status, with the error
+	// in the body.
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+	if res.StatusCode != http.StatusOK || bytes.Contains(msg, []byte("<Error>")) {
+		return cache.Errorf(cache.CodeUnavailable, "failed to complete upload: %s: %s", res.Status, msg)
+	}
+	return nil
+}
+
+type partUploader struct {
+	c        *Client
+	key      string
+	uploadID string
+}
+
+func (pu partUploader) UploadPart(ctx context.Context, number int, part *io.SectionReader) (string, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {pu.uploadID}}
+	res, err := pu.c.do(ctx, http.MethodPut, pu.key, q, nil, &body{
+		open: func() (io.ReadCloser, error) { return io.NopCloser(io.NewSectionReader(part, 0, part.Size())), nil },
+		size: part.Size(),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errorFromStatus(res)
+	}
+	return res.Header.Get("ETag"), nil
+}
+
+// bucketIndex stores action entries in the bucket.
+type bucketIndex struct {
+	c *Client
+}
+
+func (bi bucketIndex) Get(ctx context.Context, key string) ([]byte, error) {
+	res, err := bi.c.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errorFromStatus(res)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 64<<10))
+}
+
+func (bi bucketIndex) Put(ctx context.Context, key string, value []byte) error {
+	res, err := bi.c.do(ctx, http.MethodPut, key, nil, bi.c.uploadHeader(ctx, "application/json", int64(len(value)), false), bytesBody(value))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errorFromStatus(res)
+	}
+	return nil
+}
+
+// body is a replayable request body. Bodies of known content are signed;
+// others are sent as unsigned payloads.
+type body struct {
+	open func() (io.ReadCloser, error)
+	size int64
+	hash string // hex SHA-256, or empty if unsigned
+}
+
+func bytesBody(b []byte) *body {
+	sum := sha256.Sum256(b)
+	return &body{
+		open: func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(b)), nil },
+		size: int64(len(b)),
+		hash: hex.EncodeToString(sum[:]),
+	}
+}
+
+// emptyHash is the hex SHA-256 of an empty body.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// objectURL returns the URL of key in the bucket.
+func (c *Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = escape(u.Path, false)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do sends a signed request for key.
+func (c *Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, b *body) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(key, query).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := emptyHash
+	if b != nil {
+		if req.Body, err = b.open(); err != nil {
+			return nil, err
+		}
+		req.ContentLength = b.size
+		req.GetBody = b.open
+		payloadHash = b.hash
+		if payloadHash == "" {
+			payloadHash = unsignedPayload
+		}
+	}
+	creds, err := c.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sign(req, creds, c.region, payloadHash, time.Now())
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, cache.Errorf(cache.CodeUnavailable, "failed to reach S3: %w", err)
+	}
+	return res, nil
+}
+
+// credentials returns the keys to sign a request with.
+func (c *Client) credentials(ctx context.Context) (Credentials, error) {
+	if c.credsSrc == nil {
+		return c.creds, nil
+	}
+	t, err := c.credsSrc.Token(ctx)
+	if err != nil {
+		return Credentials{}, cache.Errorf(cache.CodePermissionDenied, "failed to get S3 credentials: %w", err)
+	}
+	if t.AWS == nil {
+		return Credentials{}, cache.Errorf(cache.CodePermissionDenied, "credentials source returned no AWS keys")
+	}
+	return Credentials{AccessKeyID: t.AWS.AccessKeyID, SecretAccessKey: t.AWS.SecretAccessKey, SessionToken: t.Value}, nil
+}
+
+// errorFromStatus returns the cache error for an S3 error response.
+func errorFromStatus(res *http.Response) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+	if xml.Unmarshal(msg, &e) == nil && e.Code != "" {
+		msg = []byte(e.Code + ": " + e.Message)
+	}
+	code := cache.CodeInternal
+	switch {
+	case res.StatusCode == http.StatusBadRequest:
+		code = cache.CodeInvalidRequest
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		code = cache.CodePermissionDenied
+	case res.StatusCode == http.StatusGatewayTimeout:
+		code = cache.CodeTimeout
+	case res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+		code = cache.CodeUnavailable
+	}
+	return cache.Errorf(code, "s3: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+}
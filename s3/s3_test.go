@@ -0,0 +1,110 @@
+package s3_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/cachetest"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+	"github.com/hirasawayuki/go-cache-prog/s3"
+)
+
+// TestPutSignsSpooledBody checks that a put whose body the server spooled
+// uploads the object with its SHA-256 as the signed payload hash, and
+// other puts upload it unsigned.
+func TestPutSignsSpooledBody(t *testing.T) {
+	body := make([]byte, 64)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	sum := sha256.Sum256(body)
+	tests := []struct {
+		name      string
+		threshold int64
+		wantHash  string
+	}{
+		{"spooled", 16, hex.EncodeToString(sum[:])},
+		{"streamed", 0, "UNSIGNED-PAYLOAD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				hashes []string
+				got    []byte
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodHead:
+					w.WriteHeader(http.StatusNotFound)
+				case r.Method == http.MethodPut && r.Header.Get("Content-Type") == "application/octet-stream":
+					b, _ := io.ReadAll(r.Body)
+					mu.Lock()
+					hashes = append(hashes, r.Header.Get("X-Amz-Content-Sha256"))
+					got = b
+					mu.Unlock()
+				case r.Method == http.MethodPut:
+					io.Copy(io.Discard, r.Body)
+				default:
+					w.WriteHeader(http.StatusNotImplemented)
+				}
+			}))
+			defer srv.Close()
+
+			store, err := castore.New(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := s3.New("bucket", store,
+				s3.WithEndpoint(srv.URL),
+				s3.WithPathStyle(),
+				s3.WithCredentials(s3.Credentials{AccessKeyID: "id", SecretAccessKey: "secret"}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache.HandlePutFunc(c.Handle)
+			cache.HandleCloseFunc(c.Handle)
+
+			d, stdin, stdout := cachetest.Pipe()
+			served := make(chan error, 1)
+			go func() {
+				served <- cache.Serve(
+					cache.WithInput(stdin),
+					cache.WithOutput(stdout),
+					cache.WithBodySpillThreshold(tt.threshold),
+					cache.WithBodySpillDir(t.TempDir()),
+				)
+			}()
+			if _, err := d.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.Put(cachetest.NewEntry(make([]byte, 32), body)); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-served; err != nil && !errors.Is(err, context.Canceled) {
+				t.Fatalf("Serve: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(hashes) != 1 || hashes[0] != tt.wantHash {
+				t.Fatalf("uploads signed with %q, want one with %q", hashes, tt.wantHash)
+			}
+			if string(got) != string(body) {
+				t.Fatalf("uploaded %x, want %x", got, body)
+			}
+		})
+	}
+}
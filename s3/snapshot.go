@@ -0,0 +1,43 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+// Snapshot is a snapshot of a cache stored in a bucket, as read by package
+// warm: a manifest and the objects it lists, under a prefix. It implements
+// warm.Source.
+type Snapshot struct {
+	c      *Client
+	prefix string
+}
+
+// Snapshot returns the snapshot stored in the bucket under prefix, for
+// example one uploaded with "aws s3 sync" after a build. A Client used
+// only to read snapshots may have a nil store.
+func (c *Client) Snapshot(prefix string) *Snapshot {
+	return &Snapshot{c: c, prefix: prefix}
+}
+
+// Open fetches the file at name, relative to the prefix of the snapshot.
+func (s *Snapshot) Open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	res, err := s.c.do(ctx, http.MethodGet, path.Join(s.prefix, name), nil, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, res.ContentLength, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("failed to fetch %s: %w", name, fs.ErrNotExist)
+	default:
+		defer res.Body.Close()
+		return nil, 0, fmt.Errorf("failed to fetch %s: %w", name, errorFromStatus(res))
+	}
+}
@@ -0,0 +1,180 @@
+// Package shadow evaluates a new backend on production traffic before
+// switching over: every request is also sent to a secondary backend, whose
+// responses are compared with the primary's and then discarded.
+package shadow
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/latency"
+)
+
+// Stats counts the outcome of shadowed requests.
+type Stats struct {
+	// Agreed is the number of requests for which both backends returned
+	// the same result: the same hit, both a miss, or both a success.
+	Agreed int64
+
+	// Disagreed is the number of requests with different results, not
+	// counting errors of the secondary backend.
+	Disagreed int64
+
+	// Errors is the number of requests that failed on the secondary.
+	Errors int64
+
+	// Dropped is the number of requests not shadowed because the secondary
+	// was already handling as many requests as allowed.
+	Dropped int64
+}
+
+// Shadow sends requests to a secondary backend in the background.
+type Shadow struct {
+	secondary cache.Handler
+	timeout   time.Duration
+	sem       chan struct{}
+	wg        sync.WaitGroup
+
+	agreed, disagreed, errors, dropped atomic.Int64
+
+	primaryLatency, secondaryLatency *latency.Recorder
+}
+
+// New returns a Shadow that sends requests to secondary, at most
+// concurrency at a time, each bounded by timeout. Requests beyond the
+// concurrency limit are dropped rather than slowing down the primary.
+func New(secondary cache.Handler, concurrency int, timeout time.Duration) *Shadow {
+	return &Shadow{
+		secondary:        secondary,
+		timeout:          timeout,
+		sem:              make(chan struct{}, concurrency),
+		primaryLatency:   latency.NewRecorder(),
+		secondaryLatency: latency.NewRecorder(),
+	}
+}
+
+// Middleware returns a middleware that passes every request to the primary
+// handler it wraps and, in parallel, to the secondary. The go command only
+// ever sees the primary's response. Close requests are passed to the
+// secondary after the shadowed requests in flight have finished.
+func (s *Shadow) Middleware() cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+			if r.Command == cache.CmdClose {
+				s.wg.Wait()
+				s.handle(ctx, r)
+				next.Handle(ctx, w, r)
+				return
+			}
+
+			select {
+			case s.sem <- struct{}{}:
+			default:
+				s.dropped.Add(1)
+				next.Handle(ctx, w, r)
+				return
+			}
+
+			sr, err := s.clone(r)
+			if err != nil {
+				<-s.sem
+				cache.WriteError(w, r, err)
+				return
+			}
+			// A single goroutine, counted before the primary runs, handles
+			// the request on the secondary and then compares the responses,
+			// so that the primary's latency does not include the
+			// secondary's and Wait covers the comparison.
+			primaryc := make(chan cache.Response, 1)
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				secondary := s.handle(ctx, sr)
+				<-s.sem
+				if primary, ok := <-primaryc; ok {
+					s.compare(r.Command, primary, secondary)
+				}
+			}()
+
+			start := time.Now()
+			ww := cache.WrapResponseWriter(w)
+			next.Handle(ctx, ww, r)
+			s.primaryLatency.Histogram(r.Command).Record(time.Since(start))
+			if primary, ok := ww.Response(); ok {
+				primaryc <- primary
+			}
+			close(primaryc)
+		})
+	}
+}
+
+// clone returns a copy of r whose body can be read independently.
+func (s *Shadow) clone(r *cache.Request) (*cache.Request, error) {
+	sr := *r
+	if r.Body == nil {
+		return &sr, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = bytes.NewReader(body)
+	sr.Body = bytes.NewReader(body)
+	return &sr, nil
+}
+
+// handle sends r to the secondary and returns its response.
+func (s *Shadow) handle(ctx context.Context, r *cache.Request) cache.Response {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.timeout)
+	defer cancel()
+
+	start := time.Now()
+	res := cache.Call(ctx, s.secondary, r)
+	s.secondaryLatency.Histogram(r.Command).Record(time.Since(start))
+	return res
+}
+
+// compare records whether both backends agreed on a request.
+func (s *Shadow) compare(cmd cache.Cmd, primary, secondary cache.Response) {
+	switch {
+	case secondary.Err != "":
+		s.errors.Add(1)
+	case primary.Err != "":
+		s.disagreed.Add(1)
+	case cmd == cache.CmdGet && (primary.Miss != secondary.Miss ||
+		!bytes.Equal(primary.OutputID, secondary.OutputID) || primary.Size != secondary.Size):
+		s.disagreed.Add(1)
+	default:
+		s.agreed.Add(1)
+	}
+}
+
+// Stats returns the counters so far.
+func (s *Shadow) Stats() Stats {
+	return Stats{
+		Agreed:    s.agreed.Load(),
+		Disagreed: s.disagreed.Load(),
+		Errors:    s.errors.Load(),
+		Dropped:   s.dropped.Load(),
+	}
+}
+
+// Report writes the latency percentiles of the primary and the secondary.
+func (s *Shadow) Report(w io.Writer) error {
+	io.WriteString(w, "primary:\n")
+	if err := s.primaryLatency.Report(w); err != nil {
+		return err
+	}
+	io.WriteString(w, "secondary:\n")
+	return s.secondaryLatency.Report(w)
+}
+
+// Wait waits for the shadowed requests in flight.
+func (s *Shadow) Wait() {
+	s.wg.Wait()
+}
@@ -0,0 +1,85 @@
+// Package signing signs cache entries so that a shared cache cannot be
+// poisoned by writers that do not hold the key: an entry mapping an
+// ActionID to an OutputID is only trusted if its signature verifies.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrNoPrivateKey is returned by Sign when the Signer can only verify.
+var ErrNoPrivateKey = errors.New("signer has no private key")
+
+// Signer signs and verifies entry messages built by Message.
+type Signer interface {
+	Sign(msg []byte) ([]byte, error)
+	Verify(msg, sig []byte) bool
+}
+
+// Message returns the canonical message signed for an entry. It covers
+// everything a get response is built from except the time.
+func Message(actionID, outputID []byte, size int64) []byte {
+	msg := make([]byte, 0, 16+len(actionID)+len(outputID))
+	msg = append(msg, "gocacheprog-entry-v1"...)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(actionID)))
+	msg = append(msg, actionID...)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(outputID)))
+	msg = append(msg, outputID...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(size))
+	return msg
+}
+
+// hmacSigner signs with HMAC-SHA256 and a shared secret.
+type hmacSigner struct {
+	key []byte
+}
+
+// NewHMAC returns a Signer using HMAC-SHA256 with a secret shared by every
+// reader and writer.
+func NewHMAC(key []byte) Signer {
+	return &hmacSigner{key: key}
+}
+
+func (s *hmacSigner) Sign(msg []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+func (s *hmacSigner) Verify(msg, sig []byte) bool {
+	want, _ := s.Sign(msg)
+	return hmac.Equal(sig, want)
+}
+
+// ed25519Signer signs with an Ed25519 key pair.
+type ed25519Signer struct {
+	priv ed25519.PrivateKey // nil for verify-only signers
+	pub  ed25519.PublicKey
+}
+
+// NewEd25519 returns a Signer that signs with priv. Unlike an HMAC secret,
+// the private key only needs to be given to trusted writers.
+func NewEd25519(priv ed25519.PrivateKey) Signer {
+	return &ed25519Signer{priv: priv, pub: priv.Public().(ed25519.PublicKey)}
+}
+
+// NewEd25519Verifier returns a Signer that only verifies signatures made
+// with the private key of pub, for readers that must not write.
+func NewEd25519Verifier(pub ed25519.PublicKey) Signer {
+	return &ed25519Signer{pub: pub}
+}
+
+func (s *ed25519Signer) Sign(msg []byte) ([]byte, error) {
+	if s.priv == nil {
+		return nil, ErrNoPrivateKey
+	}
+	return ed25519.Sign(s.priv, msg), nil
+}
+
+func (s *ed25519Signer) Verify(msg, sig []byte) bool {
+	return ed25519.Verify(s.pub, msg, sig)
+}
@@ -0,0 +1,182 @@
+// Package slo checks during a build that the cache meets service level
+// objectives, such as a minimum hit rate and a maximum get latency, and
+// records the verdict in a status file when the build closes the cache.
+//
+// The go command ignores how its cache program exits, so CI jobs gate on
+// the status file instead, to notice when a remote cache silently
+// degrades:
+//
+//	jq -e .ok "$GOCACHEPROG_SLO_STATUS_FILE"
+package slo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/latency"
+)
+
+// Objectives are the thresholds a build must meet. Zero values disable the
+// corresponding check.
+type Objectives struct {
+	MinHitRate   float64       // fraction of gets that hit
+	MaxGetP95    time.Duration // 95th percentile latency of gets
+	MaxErrorRate float64       // fraction of requests that failed
+
+	// MinGets is the number of gets below which no verdict is given,
+	// since hit rates of tiny builds are meaningless.
+	MinGets int64
+
+	// StatusFile is where the verdict is written when the cache is closed.
+	StatusFile string
+}
+
+// FromEnv reads Objectives from environment variables named after prefix:
+// <prefix>_SLO_MIN_HIT_RATE, <prefix>_SLO_MAX_GET_P95 (a duration),
+// <prefix>_SLO_MAX_ERROR_RATE, <prefix>_SLO_MIN_GETS and
+// <prefix>_SLO_STATUS_FILE.
+func FromEnv(prefix string) (Objectives, error) {
+	env := func(name string) string {
+		return os.Getenv(prefix + "_SLO_" + name)
+	}
+	var o Objectives
+	var err error
+	parse := func(name string, fn func(s string) error) {
+		if s := env(name); s != "" && err == nil {
+			if perr := fn(s); perr != nil {
+				err = fmt.Errorf("invalid %s_SLO_%s: %w", prefix, name, perr)
+			}
+		}
+	}
+	parse("MIN_HIT_RATE", func(s string) (err error) { o.MinHitRate, err = strconv.ParseFloat(s, 64); return })
+	parse("MAX_GET_P95", func(s string) (err error) { o.MaxGetP95, err = time.ParseDuration(s); return })
+	parse("MAX_ERROR_RATE", func(s string) (err error) { o.MaxErrorRate, err = strconv.ParseFloat(s, 64); return })
+	parse("MIN_GETS", func(s string) (err error) { o.MinGets, err = strconv.ParseInt(s, 10, 64); return })
+	o.StatusFile = env("STATUS_FILE")
+	return o, err
+}
+
+// Verdict is the outcome of the checks.
+type Verdict struct {
+	OK         bool     `json:"ok"`
+	Violations []string `json:"violations,omitempty"`
+
+	Requests  int64   `json:"requests"`
+	Gets      int64   `json:"gets"`
+	HitRate   float64 `json:"hit_rate"`
+	ErrorRate float64 `json:"error_rate"`
+	GetP95    string  `json:"get_p95"`
+}
+
+// Tracker measures a build against Objectives.
+type Tracker struct {
+	obj Objectives
+
+	requests, errors, gets, hits atomic.Int64
+	getLatency                   latency.Histogram
+}
+
+// New returns a Tracker for obj.
+func New(obj Objectives) *Tracker {
+	return &Tracker{obj: obj}
+}
+
+// Middleware returns a middleware that measures every request and, after a
+// close request was handled, writes the verdict to the status file if one
+// is configured.
+func (t *Tracker) Middleware() cache.Middleware {
+	return func(next cache.Handler) cache.Handler {
+		return cache.HandlerFunc(func(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+			start, ok := cache.StartTimeFromContext(ctx)
+			if !ok {
+				start = time.Now()
+			}
+			ww := cache.WrapResponseWriter(w)
+			next.Handle(ctx, ww, r)
+			res, _ := ww.Response()
+
+			switch r.Command {
+			case cache.CmdClose:
+				if t.obj.StatusFile != "" {
+					if err := t.WriteStatusFile(t.obj.StatusFile); err != nil {
+						cache.LoggerFromContext(ctx).Warn("failed to write SLO status file", "error", err)
+					}
+				}
+				return
+			case cache.CmdGet:
+				t.gets.Add(1)
+				if res.Err == "" && !res.Miss {
+					t.hits.Add(1)
+				}
+				t.getLatency.Record(time.Since(start))
+			}
+			t.requests.Add(1)
+			if res.Err != "" {
+				t.errors.Add(1)
+			}
+		})
+	}
+}
+
+// Verdict checks the measurements so far against the objectives.
+func (t *Tracker) Verdict() Verdict {
+	v := Verdict{
+		Requests: t.requests.Load(),
+		Gets:     t.gets.Load(),
+		GetP95:   t.getLatency.Quantile(0.95).String(),
+	}
+	if v.Gets > 0 {
+		v.HitRate = float64(t.hits.Load()) / float64(v.Gets)
+	}
+	if v.Requests > 0 {
+		v.ErrorRate = float64(t.errors.Load()) / float64(v.Requests)
+	}
+	if v.Gets < t.obj.MinGets {
+		v.OK = true
+		return v
+	}
+
+	if t.obj.MinHitRate > 0 && v.HitRate < t.obj.MinHitRate {
+		v.Violations = append(v.Violations, fmt.Sprintf("hit rate %.3f is below %.3f", v.HitRate, t.obj.MinHitRate))
+	}
+	if p95 := t.getLatency.Quantile(0.95); t.obj.MaxGetP95 > 0 && p95 > t.obj.MaxGetP95 {
+		v.Violations = append(v.Violations, fmt.Sprintf("get p95 latency %v is above %v", p95, t.obj.MaxGetP95))
+	}
+	if t.obj.MaxErrorRate > 0 && v.ErrorRate > t.obj.MaxErrorRate {
+		v.Violations = append(v.Violations, fmt.Sprintf("error rate %.3f is above %.3f", v.ErrorRate, t.obj.MaxErrorRate))
+	}
+	v.OK = len(v.Violations) == 0
+	return v
+}
+
+// WriteStatusFile writes the verdict as JSON to the file at path,
+// atomically.
+func (t *Tracker) WriteStatusFile(path string) error {
+	data, err := json.MarshalIndent(t.Verdict(), "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create status file: %w", err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write status file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Package spool holds object bodies in temporary files while they move
+// between the go command, a local cache directory and the network.
+//
+// A File never wraps its *os.File in buffers or generic readers, so copies
+// take the zero-copy fast paths of the io and net packages on Linux:
+// sendfile(2) when a File is written to a TCP or Unix connection, splice(2)
+// when it is filled from one, and copy_file_range(2) between files. Network
+// backends should copy through File.ReadFrom and File.WriteTo, or hand
+// File.OSFile to net/http as a request body, rather than reading bodies
+// into memory.
+package spool
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// File is a temporary file holding one body.
+type File struct {
+	f    *os.File
+	size int64
+}
+
+// Create creates an empty spool file in dir, or in the default directory
+// for temporary files if dir is empty.
+func Create(dir string) (*File, error) {
+	f, err := os.CreateTemp(dir, "spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	return &File{f: f}, nil
+}
+
+// ReadFrom appends the content of r to the file.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	n, err := f.f.ReadFrom(r)
+	f.size += n
+	return n, err
+}
+
+// Write appends p to the file.
+func (f *File) Write(p []byte) (int, error) {
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// WriteTo writes the whole content of the file to w. It reads from the
+// start of the file and can be called repeatedly, for example to retry an
+// upload. It must not be called concurrently with other methods.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	if _, err := f.f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+	// The net and os packages recognize an *io.LimitedReader around an
+	// *os.File and use sendfile or copy_file_range for it.
+	return io.Copy(w, &io.LimitedReader{R: f.f, N: f.size})
+}
+
+// Reader returns a reader of the whole content that implements io.ReaderAt
+// and io.Seeker, independent of other readers of the file. Copies from it
+// go through a buffer; prefer WriteTo for plain transfers.
+func (f *File) Reader() *io.SectionReader {
+	return io.NewSectionReader(f.f, 0, f.size)
+}
+
+// OSFile returns the underlying file, positioned at its end after writes.
+// Seek to the start before using it as an io.Reader.
+func (f *File) OSFile() *os.File {
+	return f.f
+}
+
+// Name returns the path of the file.
+func (f *File) Name() string {
+	return f.f.Name()
+}
+
+// Size returns the number of bytes written to the file.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Close closes and removes the file.
+func (f *File) Close() error {
+	err := f.f.Close()
+	if rerr := os.Remove(f.f.Name()); err == nil && !os.IsNotExist(rerr) {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,300 @@
+// Package sqlcache stores cache entries in PostgreSQL or MySQL, for
+// enterprises whose only blessed shared datastore is a relational database.
+//
+// The package uses database/sql and no driver: open the *sql.DB with the
+// driver of your choice, such as github.com/jackc/pgx/v5/stdlib or
+// github.com/go-sql-driver/mysql, and pass the matching Dialect.
+//
+// A Backend keeps the entries in one table and the objects in another, as
+// bytea or LONGBLOB values that are read whole into memory: it suits
+// caches whose objects are at most tens of MiB, and MySQL needs a
+// max_allowed_packet above the largest object. For larger objects, keep
+// them in a blob store and only the action entries in the database, with
+// an Index:
+//
+//	c, err := s3.New("go-cache", store, s3.WithIndex(sqlcache.NewIndex(db, sqlcache.Postgres, "go_cache_index")))
+package sqlcache
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/castore"
+	"github.com/hirasawayuki/go-cache-prog/s3"
+)
+
+// Dialect is the SQL dialect of a database.
+type Dialect int
+
+const (
+	// Postgres is PostgreSQL, and compatible databases such as CockroachDB.
+	Postgres Dialect = iota
+
+	// MySQL is MySQL or MariaDB.
+	MySQL
+)
+
+// blobType returns the column type of objects.
+func (d Dialect) blobType() string {
+	if d == MySQL {
+		return "LONGBLOB"
+	}
+	return "BYTEA"
+}
+
+// keyType returns the column type of binary keys.
+func (d Dialect) keyType() string {
+	if d == MySQL {
+		return "VARBINARY(255)"
+	}
+	return "BYTEA"
+}
+
+// query rewrites the ? placeholders of q for d.
+func (d Dialect) query(q string) string {
+	if d != Postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// upsert returns an insert of columns into table that replaces the row
+// with the same first column.
+func (d Dialect) upsert(table string, columns ...string) string {
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), marks)
+	var set []string
+	for _, c := range columns[1:] {
+		if d == MySQL {
+			set = append(set, fmt.Sprintf("%s = VALUES(%s)", c, c))
+		} else {
+			set = append(set, fmt.Sprintf("%s = EXCLUDED.%s", c, c))
+		}
+	}
+	if d == MySQL {
+		q += " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+	} else {
+		q += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", columns[0], strings.Join(set, ", "))
+	}
+	return d.query(q)
+}
+
+// Backend is a cache backend stored in a database. Objects read from the
+// database are kept in a local castore.Store, since the go command reads
+// them from the DiskPath of responses.
+type Backend struct {
+	db      *sql.DB
+	dialect Dialect
+	prefix  string
+	store   *castore.Store
+}
+
+// New returns a Backend on db keeping its tables, <prefix>entries and
+// <prefix>objects, in the default schema. Create them with CreateTables.
+func New(db *sql.DB, dialect Dialect, prefix string, store *castore.Store) *Backend {
+	return &Backend{db: db, dialect: dialect, prefix: prefix, store: store}
+}
+
+// CreateTables creates the tables of b unless they exist.
+func (b *Backend) CreateTables(ctx context.Context) error {
+	d := b.dialect
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %sentries (
+	action_id %s PRIMARY KEY,
+	output_id %s NOT NULL,
+	size BIGINT NOT NULL,
+	created BIGINT NOT NULL
+)`, b.prefix, d.keyType(), d.keyType()),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %sobjects (
+	output_id %s PRIMARY KEY,
+	data %s NOT NULL
+)`, b.prefix, d.keyType(), d.blobType()),
+	}
+	for _, stmt := range stmts {
+		if _, err := b.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+	}
+	return nil
+}
+
+// Handle implements cache.Handler for the get and put commands. The close
+// command releases the objects of the session, see castore.Store.Hold;
+// other commands succeed without effect.
+func (b *Backend) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	var res cache.Response
+	var err error
+	switch r.Command {
+	case cache.CmdGet:
+		res, err = b.get(ctx, r)
+	case cache.CmdPut:
+		res, err = b.put(ctx, r)
+	case cache.CmdClose:
+		b.store.ReleaseSession(ctx)
+	}
+	if err != nil {
+		cache.WriteError(w, r, err)
+		return
+	}
+	res.ID = r.ID
+	w.WriteResponse(res)
+}
+
+func (b *Backend) get(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	var (
+		outputID []byte
+		size     int64
+		created  int64
+	)
+	err := b.db.QueryRowContext(ctx,
+		b.dialect.query(fmt.Sprintf("SELECT output_id, size, created FROM %sentries WHERE action_id = ?", b.prefix)),
+		r.ActionID,
+	).Scan(&outputID, &size, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cache.Response{}, cache.ErrMiss
+	}
+	if err != nil {
+		return cache.Response{}, unavailable("failed to query entry", err)
+	}
+
+	b.store.Hold(ctx, outputID)
+	if err := b.store.Fill(ctx, outputID, size, func() error {
+		var data []byte
+		err := b.db.QueryRowContext(ctx,
+			b.dialect.query(fmt.Sprintf("SELECT data FROM %sobjects WHERE output_id = ?", b.prefix)),
+			outputID,
+		).Scan(&data)
+		if errors.Is(err, sql.ErrNoRows) {
+			return cache.ErrMiss
+		}
+		if err != nil {
+			return unavailable("failed to query object", err)
+		}
+		if int64(len(data)) != size {
+			return cache.ErrMiss
+		}
+		_, _, err = b.store.Put(outputID, bytes.NewReader(data))
+		return err
+	}); err != nil {
+		return cache.Response{}, err
+	}
+	b.store.Touch(outputID)
+	t := time.Unix(0, created)
+	return cache.Response{OutputID: outputID, Size: size, Time: &t, DiskPath: b.store.Path(outputID)}, nil
+}
+
+func (b *Backend) put(ctx context.Context, r *cache.Request) (cache.Response, error) {
+	var data []byte
+	if r.Body != nil {
+		var err error
+		if data, err = io.ReadAll(r.Body); err != nil {
+			return cache.Response{}, fmt.Errorf("failed to read body: %w", err)
+		}
+	}
+	if int64(len(data)) != r.BodySize {
+		return cache.Response{}, cache.Errorf(cache.CodeInvalidRequest, "object is %d bytes, want %d", len(data), r.BodySize)
+	}
+	b.store.Hold(ctx, r.OutputID)
+	path, _, err := b.store.Put(r.OutputID, bytes.NewReader(data))
+	if err != nil {
+		return cache.Response{}, err
+	}
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return cache.Response{}, unavailable("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+	var exists int
+	err = tx.QueryRowContext(ctx,
+		b.dialect.query(fmt.Sprintf("SELECT 1 FROM %sobjects WHERE output_id = ?", b.prefix)),
+		r.OutputID,
+	).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = tx.ExecContext(ctx, b.dialect.upsert(b.prefix+"objects", "output_id", "data"), r.OutputID, data)
+	}
+	if err != nil {
+		return cache.Response{}, unavailable("failed to store object", err)
+	}
+	if _, err := tx.ExecContext(ctx, b.dialect.upsert(b.prefix+"entries", "action_id", "output_id", "size", "created"),
+		r.ActionID, r.OutputID, r.BodySize, time.Now().UnixNano()); err != nil {
+		return cache.Response{}, unavailable("failed to store entry", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return cache.Response{}, unavailable("failed to commit entry", err)
+	}
+	return cache.Response{DiskPath: path}, nil
+}
+
+// Index is an s3.Index storing action entries in a table of a database,
+// for objects kept in a blob store.
+type Index struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+}
+
+// NewIndex returns an Index storing entries in table of db. Create it with
+// CreateTable.
+func NewIndex(db *sql.DB, dialect Dialect, table string) *Index {
+	return &Index{db: db, dialect: dialect, table: table}
+}
+
+// CreateTable creates the table of idx unless it exists.
+func (idx *Index) CreateTable(ctx context.Context) error {
+	_, err := idx.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	k VARCHAR(255) PRIMARY KEY,
+	v %s NOT NULL
+)`, idx.table, idx.dialect.blobType()))
+	if err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+	return nil
+}
+
+// Get implements s3.Index.
+func (idx *Index) Get(ctx context.Context, key string) ([]byte, error) {
+	var v []byte
+	err := idx.db.QueryRowContext(ctx, idx.dialect.query(fmt.Sprintf("SELECT v FROM %s WHERE k = ?", idx.table)), key).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, s3.ErrNotFound
+	}
+	if err != nil {
+		return nil, unavailable("failed to query entry", err)
+	}
+	return v, nil
+}
+
+// Put implements s3.Index.
+func (idx *Index) Put(ctx context.Context, key string, value []byte) error {
+	if _, err := idx.db.ExecContext(ctx, idx.dialect.upsert(idx.table, "k", "v"), key, value); err != nil {
+		return unavailable("failed to store entry", err)
+	}
+	return nil
+}
+
+// unavailable wraps a database error as retryable; a failover or a full
+// connection pool resolve themselves.
+func unavailable(msg string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return cache.Errorf(cache.CodeTimeout, "%s: %w", msg, err)
+	}
+	return cache.Errorf(cache.CodeUnavailable, "%s: %w", msg, err)
+}
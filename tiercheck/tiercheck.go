@@ -0,0 +1,166 @@
+// Package tiercheck verifies that two tiers of a cache, typically a local
+// disk cache and a shared remote one, agree on the entries they both hold.
+//
+// A Checker samples ActionIDs, looks each one up in both tiers through
+// their handlers, and reports entries whose OutputID or size differ. With
+// Repair set, the local tier is overwritten with the remote entry, since
+// the remote tier is the one shared by every builder.
+package tiercheck
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+)
+
+// Result counts the outcome of a check.
+type Result struct {
+	Checked int
+
+	// Divergent is the number of entries present in both tiers with a
+	// different OutputID or size.
+	Divergent int
+
+	// MissingLocal and MissingRemote count entries present in one tier
+	// only. They are expected while uploads are in flight or after
+	// evictions, and are not repaired.
+	MissingLocal  int
+	MissingRemote int
+
+	Repaired int
+	Errors   int
+}
+
+// Checker compares the entries of two tiers.
+type Checker struct {
+	Local  cache.Handler
+	Remote cache.Handler
+
+	// Repair overwrites divergent local entries with the remote ones.
+	Repair bool
+
+	// Logger receives a line for every divergent entry. The default is
+	// slog.Default().
+	Logger *slog.Logger
+
+	id atomic.Int64
+}
+
+func (c *Checker) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+func (c *Checker) get(ctx context.Context, h cache.Handler, actionID []byte) (cache.Response, error) {
+	res := cache.Call(ctx, h, &cache.Request{
+		ID:       c.id.Add(1),
+		Command:  cache.CmdGet,
+		ActionID: actionID,
+	})
+	if res.Error != nil {
+		return res, res.Error
+	} else if res.Err != "" {
+		return res, errors.New(res.Err)
+	}
+	return res, nil
+}
+
+// Check compares the entries of actionIDs in both tiers.
+func (c *Checker) Check(ctx context.Context, actionIDs [][]byte) (Result, error) {
+	var result Result
+	for _, actionID := range actionIDs {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		result.Checked++
+
+		local, lerr := c.get(ctx, c.Local, actionID)
+		remote, rerr := c.get(ctx, c.Remote, actionID)
+		switch {
+		case lerr != nil || rerr != nil:
+			result.Errors++
+			c.logger().Warn("failed to look up entry", "actionID", fmt.Sprintf("%x", actionID), "local", lerr, "remote", rerr)
+			continue
+		case local.Miss && remote.Miss:
+			continue
+		case local.Miss:
+			result.MissingLocal++
+			continue
+		case remote.Miss:
+			result.MissingRemote++
+			continue
+		case bytes.Equal(local.OutputID, remote.OutputID) && local.Size == remote.Size:
+			continue
+		}
+
+		result.Divergent++
+		c.logger().Warn("tiers diverge",
+			"actionID", fmt.Sprintf("%x", actionID),
+			"localOutputID", fmt.Sprintf("%x", local.OutputID), "localSize", local.Size,
+			"remoteOutputID", fmt.Sprintf("%x", remote.OutputID), "remoteSize", remote.Size)
+		if !c.Repair {
+			continue
+		}
+		if err := c.repair(ctx, actionID, remote); err != nil {
+			result.Errors++
+			c.logger().Warn("failed to repair entry", "actionID", fmt.Sprintf("%x", actionID), "error", err)
+			continue
+		}
+		result.Repaired++
+	}
+	return result, nil
+}
+
+// repair puts the remote entry, whose object is at remote.DiskPath, into
+// the local tier.
+func (c *Checker) repair(ctx context.Context, actionID []byte, remote cache.Response) error {
+	f, err := os.Open(remote.DiskPath)
+	if err != nil {
+		return fmt.Errorf("failed to open remote object: %w", err)
+	}
+	defer f.Close()
+
+	res := cache.Call(ctx, c.Local, &cache.Request{
+		ID:       c.id.Add(1),
+		Command:  cache.CmdPut,
+		ActionID: actionID,
+		OutputID: remote.OutputID,
+		Body:     f,
+		BodySize: remote.Size,
+	})
+	if res.Err != "" {
+		return errors.New(res.Err)
+	}
+	return nil
+}
+
+// Run checks the entries returned by sample every interval until ctx is
+// done, logging a summary of each round.
+func (c *Checker) Run(ctx context.Context, sample func() [][]byte, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			result, err := c.Check(ctx, sample())
+			if err != nil {
+				return
+			}
+			c.logger().Info("tier check finished",
+				"checked", result.Checked, "divergent", result.Divergent,
+				"missingLocal", result.MissingLocal, "missingRemote", result.MissingRemote,
+				"repaired", result.Repaired, "errors", result.Errors)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// Package tiered keeps the entries of a large shared cache on two tiers:
+// a hot tier on fast storage, such as a local SSD, and a cold tier on cheap
+// storage, such as an S3 bucket in an infrequent access storage class.
+//
+// Entries are put in the hot tier. Every pass, entries accessed fewer than
+// a minimum number of times since the previous pass are copied to the cold
+// tier and deleted from the hot one. Demoted entries are remembered in an
+// index, so that gets missing the hot tier are answered from the cold tier
+// only for them, and a true miss costs no round trip to the cold tier. An
+// entry got from the cold tier is promoted back to the hot tier.
+//
+//	t, err := tiered.New(disk, bucket, tiered.WithIndexFile(path))
+//	go t.Run(ctx, 24*time.Hour)
+//	cache.HandleGetFunc(t.Handle)
+//	cache.HandlePutFunc(t.Handle)
+package tiered
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+// Hot is the hot tier. It must list and delete its entries, like the
+// example disk cache does.
+type Hot interface {
+	cache.Handler
+
+	// Entries calls fn for every entry of the tier.
+	Entries(fn func(manifest.Entry) error) error
+
+	// PruneEntries deletes the entries for which expired returns true.
+	PruneEntries(expired func(manifest.Entry) bool) (int, int64, error)
+}
+
+// Tiered is a cache.Handler over a hot and a cold tier.
+type Tiered struct {
+	hot         Hot
+	cold        cache.Handler
+	minAccesses int
+	indexPath   string
+
+	mu       sync.Mutex
+	accesses map[string]int      // gets of hot entries since the last pass, by ActionID
+	demoted  map[string]struct{} // ActionIDs of the entries moved to the cold tier
+	since    time.Time           // start of the current pass window
+	journal  *os.File
+
+	promoted atomic.Int64
+	demotedN atomic.Int64
+	lastID   atomic.Int64
+}
+
+// Option configures a Tiered.
+type Option func(*Tiered)
+
+// WithMinAccesses demotes the entries got fewer than n times since the
+// previous pass. The default is 1: entries not got at all are demoted.
+func WithMinAccesses(n int) Option {
+	return func(t *Tiered) {
+		t.minAccesses = n
+	}
+}
+
+// WithIndexFile persists the index of demoted entries in the file at path,
+// so that they are still found after a restart.
+func WithIndexFile(path string) Option {
+	return func(t *Tiered) {
+		t.indexPath = path
+	}
+}
+
+// New returns a Tiered over the hot and cold tiers.
+func New(hot Hot, cold cache.Handler, opts ...Option) (*Tiered, error) {
+	t := &Tiered{
+		hot:         hot,
+		cold:        cold,
+		minAccesses: 1,
+		accesses:    make(map[string]int),
+		demoted:     make(map[string]struct{}),
+		since:       time.Now(),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.indexPath != "" {
+		if err := t.loadIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// loadIndex replays the index file, made of "+<hex ActionID>" lines for
+// demotions and "-<hex ActionID>" lines for promotions, compacts it to the
+// demotions left and opens it for appending.
+func (t *Tiered) loadIndex() error {
+	f, err := os.Open(t.indexPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to open tier index: %w", err)
+	}
+	if err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Text()
+			if len(line) < 2 {
+				continue
+			}
+			id, err := hex.DecodeString(line[1:])
+			if err != nil {
+				continue
+			}
+			switch line[0] {
+			case '+':
+				t.demoted[string(id)] = struct{}{}
+			case '-':
+				delete(t.demoted, string(id))
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read tier index: %w", err)
+		}
+	}
+	if err := t.compactIndex(); err != nil {
+		return fmt.Errorf("failed to compact tier index: %w", err)
+	}
+	t.journal, err = os.OpenFile(t.indexPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open tier index: %w", err)
+	}
+	return nil
+}
+
+// compactIndex replaces the index file with the demotions in t.demoted,
+// so that it does not grow with every promotion and demotion.
+func (t *Tiered) compactIndex() error {
+	f, err := os.CreateTemp(filepath.Dir(t.indexPath), filepath.Base(t.indexPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	for id := range t.demoted {
+		fmt.Fprintf(w, "+%x\n", id)
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), t.indexPath)
+}
+
+// record appends a change of the index to its file. t.mu must be held.
+func (t *Tiered) record(op byte, actionID []byte) {
+	if t.journal == nil {
+		return
+	}
+	if _, err := fmt.Fprintf(t.journal, "%c%x\n", op, actionID); err != nil {
+		log.Printf("failed to append to tier index: %v", err)
+	}
+}
+
+// Close closes the index file.
+func (t *Tiered) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.journal == nil {
+		return nil
+	}
+	err := t.journal.Close()
+	t.journal = nil
+	return err
+}
+
+// Handle implements cache.Handler. Puts and commands other than get go to
+// the hot tier; a put of a demoted entry makes it a hot entry again.
+func (t *Tiered) Handle(ctx context.Context, w cache.ResponseWriter, r *cache.Request) {
+	if r.Command == cache.CmdPut {
+		res := cache.Call(ctx, t.hot, r)
+		if res.Err == "" {
+			t.undemote(r.ActionID)
+		}
+		w.WriteResponse(res)
+		return
+	}
+	if r.Command != cache.CmdGet {
+		t.hot.Handle(ctx, w, r)
+		return
+	}
+	res := cache.Call(ctx, t.hot, r)
+	if res.Err == "" && !res.Miss {
+		t.mu.Lock()
+		t.accesses[string(r.ActionID)]++
+		t.mu.Unlock()
+		w.WriteResponse(res)
+		return
+	}
+
+	t.mu.Lock()
+	_, demoted := t.demoted[string(r.ActionID)]
+	t.mu.Unlock()
+	if !demoted || cache.LocalOnlyFromContext(ctx) {
+		w.WriteResponse(res)
+		return
+	}
+	res = cache.Call(ctx, t.cold, r)
+	if res.Err == "" && !res.Miss {
+		if err := t.promote(ctx, r.ActionID, res); err != nil {
+			log.Printf("failed to promote entry %x to the hot tier: %v", r.ActionID, err)
+		}
+	}
+	w.WriteResponse(res)
+}
+
+// promote stores the entry got from the cold tier in the hot tier.
+func (t *Tiered) promote(ctx context.Context, actionID []byte, res cache.Response) error {
+	f, err := os.Open(res.DiskPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	put := cache.Call(ctx, t.hot, &cache.Request{
+		ID:       t.lastID.Add(1),
+		Command:  cache.CmdPut,
+		ActionID: actionID,
+		OutputID: res.OutputID,
+		Body:     f,
+		BodySize: res.Size,
+	})
+	if put.Err != "" {
+		return errors.New(put.Err)
+	}
+	t.mu.Lock()
+	t.accesses[string(actionID)]++
+	t.mu.Unlock()
+	t.undemote(actionID)
+	t.promoted.Add(1)
+	return nil
+}
+
+// undemote forgets that the entry of actionID is in the cold tier, once it
+// is back in the hot tier, so that a later hot miss is a true miss.
+func (t *Tiered) undemote(actionID []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.demoted[string(actionID)]; !ok {
+		return
+	}
+	delete(t.demoted, string(actionID))
+	t.record('-', actionID)
+}
+
+// Stats counts the migrations between the tiers.
+type Stats struct {
+	Demoted  int64 // entries moved to the cold tier
+	Promoted int64 // entries moved back to the hot tier
+	Cold     int   // entries in the cold tier only
+}
+
+// Stats returns the migrations since t was created.
+func (t *Tiered) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Stats{Demoted: t.demotedN.Load(), Promoted: t.promoted.Load(), Cold: len(t.demoted)}
+}
+
+// Migrate runs a pass: the hot entries put before the previous pass, and
+// got fewer than the minimum number of times since, are copied to the cold
+// tier and deleted from the hot tier. It returns the number of entries and
+// bytes demoted. Entries whose copy fails stay in the hot tier.
+func (t *Tiered) Migrate(ctx context.Context) (int, int64, error) {
+	t.mu.Lock()
+	accesses, since := t.accesses, t.since
+	t.accesses, t.since = make(map[string]int), time.Now()
+	t.mu.Unlock()
+
+	var candidates []manifest.Entry
+	err := t.hot.Entries(func(e manifest.Entry) error {
+		if e.Time.Before(since) && accesses[string(e.ActionID)] < t.minAccesses {
+			candidates = append(candidates, e)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list hot entries: %w", err)
+	}
+
+	copied := make(map[string]manifest.Entry)
+	for _, e := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := t.demote(ctx, e); err != nil {
+			log.Printf("failed to demote entry %x: %v", e.ActionID, err)
+			continue
+		}
+		copied[string(e.ActionID)] = e
+	}
+
+	n, freed, err := t.hot.PruneEntries(func(e manifest.Entry) bool {
+		c, ok := copied[string(e.ActionID)]
+		// An entry put again since it was copied stays hot.
+		return ok && c.Time.Equal(e.Time) && string(c.OutputID) == string(e.OutputID)
+	})
+	t.demotedN.Add(int64(n))
+	if err != nil {
+		return n, freed, fmt.Errorf("failed to delete demoted entries: %w", err)
+	}
+	return n, freed, ctx.Err()
+}
+
+// demote copies the hot entry e to the cold tier and indexes it.
+func (t *Tiered) demote(ctx context.Context, e manifest.Entry) error {
+	res := cache.Call(ctx, t.hot, &cache.Request{
+		ID:       t.lastID.Add(1),
+		Command:  cache.CmdGet,
+		ActionID: e.ActionID,
+	})
+	if res.Err != "" {
+		return errors.New(res.Err)
+	}
+	if res.Miss {
+		return cache.ErrMiss
+	}
+	f, err := os.Open(res.DiskPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if len(e.Tags) > 0 {
+		ctx = cache.ContextWithTags(ctx, e.Tags)
+	}
+	put := cache.Call(ctx, t.cold, &cache.Request{
+		ID:       t.lastID.Add(1),
+		Command:  cache.CmdPut,
+		ActionID: e.ActionID,
+		OutputID: res.OutputID,
+		Body:     io.LimitReader(f, res.Size),
+		BodySize: res.Size,
+	})
+	if put.Err != "" {
+		return errors.New(put.Err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.demoted[string(e.ActionID)] = struct{}{}
+	t.record('+', e.ActionID)
+	return nil
+}
+
+// Run migrates every interval until ctx is done, logging the migrations.
+// The first pass runs after one interval, so that the accesses of a whole
+// interval are counted.
+func (t *Tiered) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		n, freed, err := t.Migrate(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("tier migration failed: %v", err)
+		}
+		if n > 0 {
+			log.Printf("moved %d entries, %d bytes, to the cold tier", n, freed)
+		}
+	}
+}
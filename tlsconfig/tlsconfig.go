@@ -0,0 +1,121 @@
+// Package tlsconfig builds TLS client configurations for network backends
+// from a small set of options, so that every backend supports custom CAs,
+// client certificates (mTLS) and minimum versions in the same way.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Options describes a TLS client configuration. The zero value yields the
+// Go defaults: system roots and TLS 1.2 or later.
+type Options struct {
+	// CAFile is a PEM bundle of certificate authorities to trust in
+	// addition to the system roots.
+	CAFile string
+
+	// NoSystemRoots trusts only the authorities in CAFile.
+	NoSystemRoots bool
+
+	// CertFile and KeyFile are the PEM client certificate and private key
+	// presented for mutual TLS. Both or neither must be set.
+	CertFile string
+	KeyFile  string
+
+	// MinVersion is the minimum TLS version, "1.2" or "1.3".
+	MinVersion string
+
+	// ServerName overrides the name used to verify the server certificate.
+	ServerName string
+
+	// InsecureSkipVerify disables server certificate verification. It is
+	// meant for local testing only.
+	InsecureSkipVerify bool
+}
+
+// FromEnv reads Options from environment variables named after prefix:
+// <prefix>_TLS_CA_FILE, <prefix>_TLS_NO_SYSTEM_ROOTS, <prefix>_TLS_CERT_FILE,
+// <prefix>_TLS_KEY_FILE, <prefix>_TLS_MIN_VERSION, <prefix>_TLS_SERVER_NAME
+// and <prefix>_TLS_INSECURE_SKIP_VERIFY.
+func FromEnv(prefix string) Options {
+	env := func(name string) string {
+		return os.Getenv(prefix + "_TLS_" + name)
+	}
+	flag := func(name string) bool {
+		b, _ := strconv.ParseBool(env(name))
+		return b
+	}
+	return Options{
+		CAFile:             env("CA_FILE"),
+		NoSystemRoots:      flag("NO_SYSTEM_ROOTS"),
+		CertFile:           env("CERT_FILE"),
+		KeyFile:            env("KEY_FILE"),
+		MinVersion:         env("MIN_VERSION"),
+		ServerName:         env("SERVER_NAME"),
+		InsecureSkipVerify: flag("INSECURE_SKIP_VERIFY"),
+	}
+}
+
+// Config returns the tls.Config described by o.
+func (o Options) Config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	switch o.MinVersion {
+	case "", "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version: %q", o.MinVersion)
+	}
+
+	if o.CAFile != "" || o.NoSystemRoots {
+		pool, err := o.rootCAs()
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (o Options) rootCAs() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !o.NoSystemRoots {
+		sys, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load system roots: %w", err)
+		}
+		pool = sys
+	}
+	if o.CAFile == "" {
+		return pool, nil
+	}
+	pem, err := os.ReadFile(o.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+	}
+	return pool, nil
+}
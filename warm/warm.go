@@ -0,0 +1,183 @@
+// Package warm seeds a cache from a snapshot of a previous build before the
+// next build starts, for runners without persistent disks.
+//
+// A snapshot is a directory, on disk or served over HTTP, with a manifest
+// named manifest.FileName and the objects it lists under
+// "objects/<hex OutputID>". Entries are stored through the put handler of the backend, so any backend
+// can be warmed.
+package warm
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hirasawayuki/go-cache-prog/cache"
+	"github.com/hirasawayuki/go-cache-prog/manifest"
+)
+
+// Source gives access to the files of a snapshot.
+type Source interface {
+	// Open opens the file at the slash-separated name, relative to the
+	// root of the snapshot, and returns its size.
+	Open(ctx context.Context, name string) (io.ReadCloser, int64, error)
+}
+
+// DirSource is a snapshot in a local directory.
+type DirSource string
+
+// Open opens a file of the snapshot.
+func (d DirSource) Open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// HTTPSource is a snapshot served under a base URL, for example a bucket
+// behind a CDN or a presigned prefix.
+type HTTPSource struct {
+	Base   *url.URL
+	Client *http.Client // http.DefaultClient if nil
+}
+
+// Open fetches a file of the snapshot.
+func (s *HTTPSource) Open(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Base.JoinPath(name).String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("failed to fetch %s: %s", name, res.Status)
+	}
+	return res.Body, res.ContentLength, nil
+}
+
+// ParseSource returns the Source for a local path or an http(s) URL.
+func ParseSource(from string) (Source, error) {
+	u, err := url.Parse(from)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return &HTTPSource{Base: u}, nil
+	}
+	if err == nil && len(u.Scheme) > 1 {
+		return nil, fmt.Errorf("unsupported snapshot location %q: use a local path or an http(s) URL", from)
+	}
+	return DirSource(from), nil
+}
+
+// Stats reports the outcome of a warm-up.
+type Stats struct {
+	Entries int64
+	Bytes   int64
+	Failed  int64
+}
+
+// Run downloads the entries of the snapshot at src and stores them through
+// h, which must handle put requests, with up to concurrency downloads at
+// once. Entries that fail are counted and skipped; Run only returns an error
+// if the manifest cannot be read or ctx is done. The manifest is streamed,
+// so downloads start before it has been read in full.
+func Run(ctx context.Context, src Source, h cache.Handler, concurrency int) (Stats, error) {
+	rc, _, err := src.Open(ctx, manifest.FileName)
+	if err != nil {
+		return Stats{}, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer rc.Close()
+	mr, err := manifest.NewReader(rc)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var (
+		stats Stats
+		id    atomic.Int64
+		wg    sync.WaitGroup
+		work  = make(chan manifest.Entry)
+	)
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				if err := put(ctx, src, h, id.Add(1), e); err != nil {
+					cache.LoggerFromContext(ctx).Warn("failed to warm entry", "actionID", fmt.Sprintf("%x", e.ActionID), "error", err)
+					atomic.AddInt64(&stats.Failed, 1)
+					continue
+				}
+				atomic.AddInt64(&stats.Entries, 1)
+				atomic.AddInt64(&stats.Bytes, e.Size)
+			}
+		}()
+	}
+	var readErr error
+	for ctx.Err() == nil {
+		e, err := mr.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				readErr = err
+			}
+			break
+		}
+		select {
+		case work <- e:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+	if readErr != nil {
+		return stats, readErr
+	}
+	return stats, ctx.Err()
+}
+
+// put downloads the object of e and stores the entry through h.
+func put(ctx context.Context, src Source, h cache.Handler, id int64, e manifest.Entry) error {
+	rc, size, err := src.Open(ctx, "objects/"+hex.EncodeToString(e.OutputID))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if size >= 0 && size != e.Size {
+		return fmt.Errorf("object has %d bytes, manifest says %d", size, e.Size)
+	}
+	if len(e.Tags) > 0 {
+		ctx = cache.ContextWithTags(ctx, e.Tags)
+	}
+
+	res := cache.Call(ctx, h, &cache.Request{
+		ID:       id,
+		Command:  cache.CmdPut,
+		ActionID: e.ActionID,
+		OutputID: e.OutputID,
+		Body:     io.LimitReader(rc, e.Size),
+		BodySize: e.Size,
+	})
+	if res.Err != "" {
+		return errors.New(res.Err)
+	}
+	return nil
+}